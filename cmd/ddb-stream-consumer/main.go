@@ -0,0 +1,69 @@
+// Long-running consumer indexing the orders table stream into Elasticsearch, an alternative
+// to the lambda in cmd/ddb-stream-indexer. Replicas share the stream through shard leases kept
+// in the lease table and continue from its checkpoints after restarts.
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"go-grpc-kubernetes/pkg/config"
+	"go-grpc-kubernetes/pkg/ddbstore"
+	"go-grpc-kubernetes/pkg/order"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams"
+)
+
+func main() {
+	if err := runConsumer(); err != nil {
+		panic(err)
+	}
+}
+
+func runConsumer() error {
+	cfg, err := config.FromEnv()
+	if err != nil {
+		return err
+	}
+	sess := order.NewSession(cfg)
+	server := &order.Server{
+		DdbSession: sess,
+		Ddb:        dynamodb.New(sess),
+		Config:     cfg,
+	}
+	indexer, err := server.StreamIndexer()
+	if err != nil {
+		return err
+	}
+	drifts, err := ddbstore.EnsureTable(ddbstore.LeaseTableSpec(server.LeaseTableName()), server.Ddb, ddbstore.ReconcileOptions{
+		AllowCreate: cfg.CanCreateTables(),
+	})
+	if err != nil {
+		return err
+	}
+	for _, drift := range drifts {
+		fmt.Printf("dynamodb table %s: %v\n", server.LeaseTableName(), drift)
+	}
+	// pod name is unique among replicas
+	owner, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	consumer := ddbstore.NewStreamConsumer(dynamodbstreams.New(sess), server.Ddb, server.TableName(), indexer.HandleEvent, ddbstore.StreamConsumerOptions{
+		LeaseTable: server.LeaseTableName(),
+		Owner:      owner,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		cancel()
+	}()
+	return consumer.Run(ctx)
+}
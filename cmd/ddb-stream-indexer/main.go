@@ -0,0 +1,36 @@
+// Lambda indexing dynamodb stream records of the orders table into Elasticsearch.
+// The event source mapping must enable ReportBatchItemFailures so a failed record and the ones
+// after it are delivered again instead of the whole batch.
+package main
+
+import (
+	"go-grpc-kubernetes/pkg/config"
+	"go-grpc-kubernetes/pkg/ddbstore"
+	"go-grpc-kubernetes/pkg/order"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func main() {
+	indexer, err := newIndexer()
+	if err != nil {
+		panic(err)
+	}
+	lambda.Start(indexer.HandleEvent)
+}
+
+// newIndexer return stream indexer sharing storage configuration with the orders server
+func newIndexer() (*ddbstore.StreamIndexer, error) {
+	cfg, err := config.FromEnv()
+	if err != nil {
+		return nil, err
+	}
+	sess := order.NewSession(cfg)
+	server := &order.Server{
+		DdbSession: sess,
+		Ddb:        dynamodb.New(sess),
+		Config:     cfg,
+	}
+	return server.StreamIndexer()
+}
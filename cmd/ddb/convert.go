@@ -0,0 +1,32 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"go-grpc-kubernetes/pkg/config"
+	"go-grpc-kubernetes/pkg/ddbstore"
+	pb "go-grpc-kubernetes/proto/orderservice"
+)
+
+// convertOrders rewrite orders still stored in json format into binary format once the servers
+// run with STORAGE_FORMAT=binary. It can run next to live traffic and be run again after
+// it stopped since orders already converted are skipped, e.g.
+// STAGE=prod STORAGE_FORMAT=binary go run ./cmd/ddb convert -workers 4
+func convertOrders(args []string) error {
+	fs := flag.NewFlagSet("convert", flag.ContinueOnError)
+	workers := fs.Int("workers", 4, "parallel scan segments")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	server, err := ordersStore()
+	if err != nil {
+		return err
+	}
+	if server.Config.StorageFormat != config.StorageBinary {
+		return fmt.Errorf("STORAGE_FORMAT=%s required to convert orders", config.StorageBinary)
+	}
+	count, err := ddbstore.ConvertToBinary(&pb.Order{}, *workers, server.Ddb, server.TableName())
+	fmt.Printf("converted %d orders to binary format\n", count)
+	return err
+}
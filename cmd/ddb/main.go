@@ -4,42 +4,59 @@ import (
 	"fmt"
 	"os"
 
-	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
-	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
 	"github.com/aws/aws-sdk-go/service/dynamodb/expression"
+
+	"go-grpc-kubernetes/pkg/ddbstore"
+	"go-grpc-kubernetes/pkg/order"
+	pb "go-grpc-kubernetes/proto/orderservice"
 )
 
 func main() {
-	// AWS_PROFILE=perkbox-development go run cmd/ddb/main.go
-	// sess := session.Must(session.NewSessionWithOptions(session.Options{
-	// 	SharedConfigState: session.SharedConfigEnable,
-	// }))
-
-	// Use your ~/.aws/credentials file to get profile
-	// sess := session.Must(session.NewSession(&aws.Config{
-	// 	Region:      aws.String("eu-west-1"),
-	// 	Credentials: credentials.NewSharedCredentials("~/.aws/credentials", "perkbox-dev"),
-	// }))
-
-	sess := session.Must(session.NewSession())
+	if len(os.Args) > 1 {
+		var err error
+		switch os.Args[1] {
+		case "export":
+			err = exportOrders(os.Args[2:])
+		case "import":
+			err = importOrders(os.Args[2:])
+		case "replay":
+			err = replayDeadLetters(os.Args[2:])
+		case "mappings":
+			err = checkMappings(os.Args[2:])
+		case "reindex":
+			err = reindexOrders(os.Args[2:])
+		case "reconcile":
+			err = reconcileOrders(os.Args[2:])
+		case "convert":
+			err = convertOrders(os.Args[2:])
+		default:
+			err = fmt.Errorf("unknown command %q, expected export, import, replay, mappings, reindex, reconcile or convert", os.Args[1])
+		}
+		if err != nil {
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+		return
+	}
 
-	// Create DynamoDB client
-	svc := dynamodb.New(sess, &aws.Config{
-		Endpoint:    aws.String("http://dynamodb:8000"),
-		Region:      aws.String("eu-west-1"),
-		Credentials: credentials.NewStaticCredentials("blah", "blah", ""), // AKID, SECRET_KEY, TOKEN
-	})
+	// AWS_PROFILE=perkbox-development go run cmd/ddb/main.go
+	// the orders table of the stage is read with the server's configuration,
+	// e.g. DYNAMODB_ENDPOINT=http://dynamodb:8000 STAGE=dev go run cmd/ddb/main.go
+	server, err := ordersStore()
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
 
-	//listTables(svc)
-	getItems(svc)
+	//listTables(server.Ddb)
+	getItems(server)
 
 }
 
-func listTables(svc *dynamodb.DynamoDB) error {
+func listTables(svc dynamodbiface.DynamoDBAPI) error {
 	input := &dynamodb.ListTablesInput{}
 	fmt.Printf("Tables:\n")
 
@@ -79,70 +96,38 @@ func listTables(svc *dynamodb.DynamoDB) error {
 	return nil
 }
 
-// Item dynamoDB
-type Item struct {
-	UUID   string
-	Status string
-	Owner  string
-}
-
-func getItems(svc *dynamodb.DynamoDB) error {
-	tableName := "dev__Perks_Saga"
+// getItems print orders which are still started
+func getItems(server *order.Server) error {
+	tableName := server.TableName()
 
-	// Create the Expression to fill the input struct with.
-	// Get all movies in that year; we'll pull out those with a higher rating later
-	// filt := expression.Name("Year").Equal(expression.Value(year))
+	// status is stored as the name of the enum value, zero valued Started included
+	filt := expression.Name("status").Equal(expression.Value(pb.Status_Started.String()))
 
-	// Or we could get by ratings and pull out those with the right year later
-	filt := expression.Name("status").Equal(expression.Value("STARTED"))
-
-	// Get back the title, year, and rating
-	proj := expression.NamesList(expression.Name("uuid"), expression.Name("status"), expression.Name("owner"))
-
-	expr, err := expression.NewBuilder().WithFilter(filt).WithProjection(proj).Build() // .WithFilter(filt)
+	// orders stored in binary format are decoded from their binary attribute so whole items are read
+	it, err := ddbstore.ScanProtoFromDdb(&pb.Order{}, ddbstore.QueryInput{Filter: &filt}, server.Ddb, tableName)
 	if err != nil {
 		fmt.Println("Got error building expression:")
 		fmt.Println(err.Error())
 		os.Exit(1)
 	}
 
-	// Build the query input parameters
-	params := &dynamodb.ScanInput{
-		ExpressionAttributeNames:  expr.Names(),
-		ExpressionAttributeValues: expr.Values(),
-		FilterExpression:          expr.Filter(),
-		ProjectionExpression:      expr.Projection(),
-		TableName:                 aws.String(tableName),
-	}
-
-	// Make the DynamoDB Query API call
-	result, err := svc.Scan(params)
-	if err != nil {
-		fmt.Println("Query API call failed:")
-		fmt.Println((err.Error()))
-		os.Exit(1)
-	}
-
 	numItems := 0
 
-	for _, i := range result.Items {
-		item := Item{}
-
-		err = dynamodbattribute.UnmarshalMap(i, &item)
-
-		if err != nil {
-			fmt.Println("Got error unmarshalling:")
-			fmt.Println(err.Error())
-			os.Exit(1)
-		}
+	for it.Next() {
+		item := it.Message().(*pb.Order)
 
 		numItems++
 
-		fmt.Println("UUID: ", item.UUID)
-		fmt.Println("Status:", item.Status)
-		fmt.Println("Owner:", item.Owner)
+		fmt.Println("UUID: ", item.GetUuid())
+		fmt.Println("Status:", item.GetStatus())
+		fmt.Println("Product:", item.GetProductUuid())
 		fmt.Println()
 	}
+	if err := it.Err(); err != nil {
+		fmt.Println("Scan API call failed:")
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
 
 	fmt.Println("Found", numItems, " in the table")
 
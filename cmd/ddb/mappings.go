@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// checkMappings report drift of the orders index mapping from the one generated from the proto
+// and exit with an error when a difference is left, -apply creates the index and adds missing fields e.g.
+// STAGE=prod go run ./cmd/ddb mappings
+func checkMappings(args []string) error {
+	fs := flag.NewFlagSet("mappings", flag.ContinueOnError)
+	apply := fs.Bool("apply", false, "create the index and add missing fields instead of only reporting them")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if !*apply {
+		os.Setenv("SCHEMA_DRY_RUN", "true")
+	}
+	server, err := ordersStore()
+	if err != nil {
+		return err
+	}
+	es, err := server.Elasticsearch()
+	if err != nil {
+		return err
+	}
+	drifts, err := server.EnsureSearchIndex(context.Background(), es)
+	if err != nil {
+		return err
+	}
+	left := 0
+	for _, drift := range drifts {
+		if !drift.Applied {
+			left++
+		}
+	}
+	if left > 0 {
+		return fmt.Errorf("index %s: %d mapping differences left, changing field types requires reindexing", server.SearchIndex(), left)
+	}
+	fmt.Printf("index %s matches the order mapping\n", server.SearchIndex())
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"go-grpc-kubernetes/pkg/ddbstore"
+)
+
+// reconcileOrders compare the orders table with its search index and report documents missing,
+// extra or divergent in the index and exit with an error when any is left, -repair indexes or
+// deletes them like the stream indexer would, e.g.
+// STAGE=prod go run ./cmd/ddb reconcile -repair -rate 50
+func reconcileOrders(args []string) error {
+	fs := flag.NewFlagSet("reconcile", flag.ContinueOnError)
+	repair := fs.Bool("repair", false, "index missing and divergent orders and delete extra documents")
+	rate := fs.Float64("rate", 10, "max documents repaired per second, 0 is unlimited")
+	workers := fs.Int("workers", 4, "parallel scan segments")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	server, err := ordersStore()
+	if err != nil {
+		return err
+	}
+	es, err := server.Elasticsearch()
+	if err != nil {
+		return err
+	}
+	bulk, err := ddbstore.NewBulkIndexer(es, ddbstore.BulkOptions{Refresh: server.Config.IndexRefresh})
+	if err != nil {
+		return err
+	}
+	report, err := ddbstore.ReconcileIndex(context.Background(), es, ddbstore.ReconcileIndexOptions{
+		Repair:  *repair,
+		Indexer: bulk,
+		Rate:    *rate,
+		Workers: *workers,
+	}, server.Ddb, server.TableName())
+	if closeErr := bulk.Close(); err == nil {
+		err = closeErr
+	}
+	if report != nil {
+		for _, drift := range report.Drifts {
+			fmt.Println(drift)
+		}
+		fmt.Printf("compared %d orders with %d documents of %s\n", report.Items, report.Documents, server.SearchIndex())
+	}
+	if err != nil {
+		return err
+	}
+	if !*repair && len(report.Drifts) > 0 {
+		return fmt.Errorf("index %s: %d documents drifted from the table", server.SearchIndex(), len(report.Drifts))
+	}
+	return nil
+}
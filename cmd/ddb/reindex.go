@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"go-grpc-kubernetes/pkg/ddbstore"
+	"go-grpc-kubernetes/pkg/order"
+)
+
+// reindexOrders backfill a new version of the orders index from the table and move the index
+// alias to it once done, stream indexers keep writing to both meanwhile, e.g.
+// STAGE=prod go run ./cmd/ddb reindex -workers 8 -rate 500
+func reindexOrders(args []string) error {
+	fs := flag.NewFlagSet("reindex", flag.ContinueOnError)
+	workers := fs.Int("workers", 4, "parallel scan segments")
+	rate := fs.Float64("rate", 0, "max items per second read from the table, 0 is unlimited")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	server, err := ordersStore()
+	if err != nil {
+		return err
+	}
+	es, err := server.Elasticsearch()
+	if err != nil {
+		return err
+	}
+	index, err := ddbstore.Reindex(context.Background(), es, ddbstore.ReindexOptions{
+		Mapping: order.SearchMapping(),
+		Workers: *workers,
+		Rate:    *rate,
+	}, server.Ddb, server.TableName())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("alias %s now points to %s\n", server.SearchIndex(), index)
+	return nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"time"
+)
+
+// replayDeadLetters index again orders stream records of the configured dead letter sink
+// once the cluster is healthy, e.g.
+// STAGE=prod DEAD_LETTER=table go run ./cmd/ddb replay -wait 1m
+func replayDeadLetters(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	wait := fs.Duration("wait", 30*time.Second, "how long to wait for the cluster to be healthy")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	server, err := ordersStore()
+	if err != nil {
+		return err
+	}
+	sink, err := server.DeadLetterSink()
+	if err != nil {
+		return err
+	}
+	if sink == nil {
+		return errors.New("replay: DEAD_LETTER must be file or table")
+	}
+	es, err := server.Elasticsearch()
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	if err := es.WaitHealthy(ctx, *wait); err != nil {
+		return err
+	}
+	indexer, err := server.StreamIndexer()
+	if err != nil {
+		return err
+	}
+	replayed, err := indexer.Replay(ctx, sink)
+	fmt.Printf("replayed %d dead letters\n", replayed)
+	return err
+}
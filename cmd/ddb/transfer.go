@@ -0,0 +1,133 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"go-grpc-kubernetes/pkg/config"
+	"go-grpc-kubernetes/pkg/ddbstore"
+	"go-grpc-kubernetes/pkg/order"
+	pb "go-grpc-kubernetes/proto/orderservice"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// transferFlags are the flags shared by export and import subcommands
+type transferFlags struct {
+	file       string
+	format     string
+	checkpoint string
+	workers    int
+	rate       float64
+	sensitive  bool
+}
+
+func parseTransferFlags(name string, args []string) (*transferFlags, error) {
+	f := &transferFlags{}
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.StringVar(&f.file, "file", "", "file to "+name+", required")
+	fs.StringVar(&f.format, "format", string(ddbstore.ExportNDJSON), "ndjson or pb (length-delimited protobuf)")
+	fs.StringVar(&f.checkpoint, "checkpoint", "", "checkpoint file to resume an interrupted "+name+" from")
+	fs.IntVar(&f.workers, "workers", 4, "parallel scan segments, must not change when resuming")
+	fs.Float64Var(&f.rate, "rate", 0, "max items per second, 0 is unlimited")
+	if name == "export" {
+		fs.BoolVar(&f.sensitive, "sensitive", false, "export sensitive fields in plaintext, needed to restore them on import")
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if f.file == "" {
+		return nil, fmt.Errorf("%s: -file is required", name)
+	}
+	return f, nil
+}
+
+func (f *transferFlags) options() ddbstore.TransferOptions {
+	return ddbstore.TransferOptions{
+		Format:           ddbstore.ExportFormat(f.format),
+		Workers:          f.workers,
+		Rate:             f.rate,
+		IncludeSensitive: f.sensitive,
+	}
+}
+
+// ordersStore return orders server configured for the stage from environment,
+// without touching the table schema
+func ordersStore() (*order.Server, error) {
+	cfg, err := config.FromEnv()
+	if err != nil {
+		return nil, err
+	}
+	sess := order.NewSession(cfg)
+	server := &order.Server{
+		DdbSession: sess,
+		Ddb:        dynamodb.New(sess),
+		Config:     cfg,
+	}
+	if err := server.ConfigureStorage(); err != nil {
+		return nil, err
+	}
+	return server, nil
+}
+
+// exportOrders write all orders to a file, e.g.
+// STAGE=dev go run ./cmd/ddb export -file orders.ndjson -checkpoint orders.checkpoint
+func exportOrders(args []string) error {
+	f, err := parseTransferFlags("export", args)
+	if err != nil {
+		return err
+	}
+	server, err := ordersStore()
+	if err != nil {
+		return err
+	}
+	cp, err := ddbstore.LoadCheckpoint(f.checkpoint)
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(f.file, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	// drop whatever was written after the last checkpoint, those pages are exported again
+	if err := out.Truncate(cp.Offset); err != nil {
+		return err
+	}
+	if _, err := out.Seek(cp.Offset, io.SeekStart); err != nil {
+		return err
+	}
+	err = ddbstore.ExportTable(&pb.Order{}, out, cp, f.options(), server.Ddb, server.TableName())
+	fmt.Printf("exported %d orders from %s\n", cp.Items, server.TableName())
+	return err
+}
+
+// importOrders put all orders from a file, e.g.
+// STAGE=dev go run ./cmd/ddb import -file orders.ndjson -rate 100
+func importOrders(args []string) error {
+	f, err := parseTransferFlags("import", args)
+	if err != nil {
+		return err
+	}
+	server, err := ordersStore()
+	if err != nil {
+		return err
+	}
+	cp, err := ddbstore.LoadCheckpoint(f.checkpoint)
+	if err != nil {
+		return err
+	}
+	in, err := os.Open(f.file)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if _, err := in.Seek(cp.Offset, io.SeekStart); err != nil {
+		return err
+	}
+	err = ddbstore.ImportTable(&pb.Order{}, in, cp, f.options(), server.Ddb, server.TableName())
+	fmt.Printf("imported %d orders to %s\n", cp.Items, server.TableName())
+	return err
+}
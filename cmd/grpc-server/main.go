@@ -1,9 +1,13 @@
 package main
 
 import (
+	_ "expvar"
+	"fmt"
+	"go-grpc-kubernetes/pkg/config"
 	"go-grpc-kubernetes/pkg/order"
 	pb "go-grpc-kubernetes/proto/orderservice"
 	"net"
+	"net/http"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/reflection"
@@ -16,7 +20,12 @@ func main() {
 }
 
 func runServer() error {
-	lis, err := net.Listen("tcp", ":9092")
+	cfg, err := config.FromEnv()
+	if err != nil {
+		return err
+	}
+
+	lis, err := net.Listen("tcp", ":"+cfg.Port)
 	if err != nil {
 		return err
 	}
@@ -24,7 +33,19 @@ func runServer() error {
 	grpcServer := grpc.NewServer()
 	reflection.Register(grpcServer)
 
-	server := order.MakeServer()
+	server, err := order.MakeServer(cfg)
+	if err != nil {
+		return err
+	}
+
+	if cfg.MetricsPort != "" {
+		// expvar registers /debug/vars on the default mux
+		go func() {
+			if err := http.ListenAndServe(":"+cfg.MetricsPort, nil); err != nil {
+				fmt.Printf("metrics server stopped: %v\n", err)
+			}
+		}()
+	}
 	pb.RegisterOrderServiceServer(grpcServer, server)
 
 	if err := grpcServer.Serve(lis); err != nil {
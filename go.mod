@@ -8,5 +8,6 @@ require (
 	github.com/elastic/go-elasticsearch/v7 v7.4.1
 	github.com/golang/protobuf v1.3.2
 	github.com/sha1sum/aws_signing_client v0.0.0-20170514202702-9088e4c7b34b
+	google.golang.org/genproto v0.0.0-20180817151627-c66870c02cf8
 	google.golang.org/grpc v1.24.0
 )
@@ -52,3 +52,20 @@ func (*OrderServiceServer) GetOrder(ctx context.Context, in *orderservice.Reques
 		Timestamp:   1218731821,
 	}, nil
 }
+
+// BatchGetOrders service
+func (*OrderServiceServer) BatchGetOrders(ctx context.Context, in *orderservice.BatchGetOrdersRequest) (*orderservice.BatchGetOrdersResponse, error) {
+	resp := &orderservice.BatchGetOrdersResponse{}
+	for _, uuid := range in.GetUuids() {
+		resp.Orders = append(resp.Orders, &orderservice.Order{
+			Uuid:        uuid,
+			ProductUuid: "1231231",
+			Quantity:    10,
+			Amount:      2.50,
+			Currency:    "PLN",
+			Status:      0,
+			Timestamp:   1218731821,
+		})
+	}
+	return resp, nil
+}
@@ -0,0 +1,181 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"go-grpc-kubernetes/pkg/env"
+)
+
+const (
+	StageDev     = "dev"
+	StageStaging = "staging"
+	StageProd    = "prod"
+
+	StorageJSON   = "json"
+	StorageBinary = "binary"
+
+	ThrottleQueue = "queue"
+	ThrottleFail  = "fail"
+	ThrottleOff   = "off"
+
+	IndexRefreshFalse   = "false"
+	IndexRefreshTrue    = "true"
+	IndexRefreshWaitFor = "wait_for"
+
+	DeadLetterOff   = "off"
+	DeadLetterFile  = "file"
+	DeadLetterTable = "table"
+)
+
+var (
+	ErrUnknownStage         = errors.New("unknown stage")
+	ErrUnknownStorageFormat = errors.New("unknown storage format")
+	ErrUnknownThrottleMode  = errors.New("unknown throttle mode")
+	ErrUnknownDeadLetter    = errors.New("unknown dead letter sink")
+	ErrUnknownIndexRefresh  = errors.New("unknown index refresh policy")
+)
+
+// Config is the central configuration of the service resolved from environment
+type Config struct {
+	// Stage is one of dev, staging or prod, read from STAGE
+	Stage string
+	// Prefix is prepended to all table and index names, read from TABLE_PREFIX
+	Prefix string
+	// Port the grpc server listens on, read from PORT
+	Port string
+	// DdbEndpoint overrides dynamodb endpoint e.g. http://dynamodb:8000 for local dynamodb,
+	// read from DYNAMODB_ENDPOINT
+	DdbEndpoint string
+	// CacheSize is the number of orders kept in GetOrder cache, 0 disables it, read from CACHE_SIZE
+	CacheSize int
+	// CacheTTL bounds how long an order is cached, read from CACHE_TTL
+	CacheTTL time.Duration
+	// MetricsPort serves expvar metrics on /debug/vars when set, read from METRICS_PORT
+	MetricsPort string
+	// KMSKeyID wraps data keys of sensitive attributes with AWS KMS, read from KMS_KEY_ID
+	KMSKeyID string
+	// EncryptionKeyFile wraps data keys with a local master key for dev, read from ENCRYPTION_KEY_FILE
+	EncryptionKeyFile string
+	// BlobBucket is S3 bucket keeping attributes too large for dynamodb, read from BLOB_BUCKET
+	BlobBucket string
+	// BlobDir is local directory alternative to BlobBucket for dev, read from BLOB_DIR
+	BlobDir string
+	// StorageFormat is json or binary protobuf format of stored items, read from STORAGE_FORMAT
+	StorageFormat string
+	// ThrottleMode is queue, fail or off, deciding whether requests over table capacity wait,
+	// fail fast with ResourceExhausted or go straight to dynamodb, read from THROTTLE_MODE
+	ThrottleMode string
+	// ThrottleMaxWait bounds how long a queued request waits for capacity, read from THROTTLE_MAX_WAIT
+	ThrottleMaxWait time.Duration
+	// IndexRefresh is false, true or wait_for refresh policy of documents indexed to Elasticsearch,
+	// read from INDEX_REFRESH
+	IndexRefresh string
+	// IndexMaxAttempts is the number of times a stream record is indexed before it is dead lettered,
+	// read from INDEX_MAX_ATTEMPTS
+	IndexMaxAttempts int
+	// DeadLetter is off, file or table sink of stream records failed IndexMaxAttempts times,
+	// read from DEAD_LETTER
+	DeadLetter string
+	// DeadLetterFile is the NDJSON file of the file sink, read from DEAD_LETTER_FILE
+	DeadLetterFile string
+	// ElasticsearchURLs are addresses of Elasticsearch nodes, read from comma separated ELASTICSEARCH_URL
+	ElasticsearchURLs []string
+	// ElasticsearchAuth is sigv4, basic, apikey or none authentication of Elasticsearch requests,
+	// checked when the client is built and sigv4 when empty, read from ELASTICSEARCH_AUTH
+	ElasticsearchAuth string
+	// ElasticsearchUsername and ElasticsearchPassword of basic auth, read from ELASTICSEARCH_USERNAME
+	// and ELASTICSEARCH_PASSWORD
+	ElasticsearchUsername, ElasticsearchPassword string
+	// ElasticsearchAPIKey of apikey auth, read from ELASTICSEARCH_API_KEY
+	ElasticsearchAPIKey string
+	// ElasticsearchCACert is PEM file of trusted certificate authorities, read from ELASTICSEARCH_CA_CERT
+	ElasticsearchCACert string
+	// ElasticsearchClientCert and ElasticsearchClientKey are PEM files of the TLS client certificate,
+	// read from ELASTICSEARCH_CLIENT_CERT and ELASTICSEARCH_CLIENT_KEY
+	ElasticsearchClientCert, ElasticsearchClientKey string
+}
+
+// FromEnv return configuration read from environment variables
+func FromEnv() (*Config, error) {
+	cfg := &Config{
+		Stage:                   env.Get("STAGE", StageDev),
+		Prefix:                  env.Get("TABLE_PREFIX", ""),
+		Port:                    env.Get("PORT", "9092"),
+		DdbEndpoint:             env.Get("DYNAMODB_ENDPOINT", ""),
+		MetricsPort:             env.Get("METRICS_PORT", ""),
+		KMSKeyID:                env.Get("KMS_KEY_ID", ""),
+		EncryptionKeyFile:       env.Get("ENCRYPTION_KEY_FILE", ""),
+		BlobBucket:              env.Get("BLOB_BUCKET", ""),
+		BlobDir:                 env.Get("BLOB_DIR", ""),
+		StorageFormat:           env.Get("STORAGE_FORMAT", StorageJSON),
+		ThrottleMode:            env.Get("THROTTLE_MODE", ThrottleQueue),
+		IndexRefresh:            env.Get("INDEX_REFRESH", IndexRefreshFalse),
+		DeadLetter:              env.Get("DEAD_LETTER", DeadLetterOff),
+		DeadLetterFile:          env.Get("DEAD_LETTER_FILE", "dead-letters.ndjson"),
+		ElasticsearchURLs:       env.List("ELASTICSEARCH_URL"),
+		ElasticsearchAuth:       env.Get("ELASTICSEARCH_AUTH", ""),
+		ElasticsearchUsername:   env.Get("ELASTICSEARCH_USERNAME", ""),
+		ElasticsearchPassword:   env.Get("ELASTICSEARCH_PASSWORD", ""),
+		ElasticsearchAPIKey:     env.Get("ELASTICSEARCH_API_KEY", ""),
+		ElasticsearchCACert:     env.Get("ELASTICSEARCH_CA_CERT", ""),
+		ElasticsearchClientCert: env.Get("ELASTICSEARCH_CLIENT_CERT", ""),
+		ElasticsearchClientKey:  env.Get("ELASTICSEARCH_CLIENT_KEY", ""),
+	}
+	var err error
+	if cfg.CacheSize, err = strconv.Atoi(env.Get("CACHE_SIZE", "0")); err != nil {
+		return nil, err
+	}
+	if cfg.CacheTTL, err = time.ParseDuration(env.Get("CACHE_TTL", "1m")); err != nil {
+		return nil, err
+	}
+	if cfg.ThrottleMaxWait, err = time.ParseDuration(env.Get("THROTTLE_MAX_WAIT", "1s")); err != nil {
+		return nil, err
+	}
+	if cfg.IndexMaxAttempts, err = strconv.Atoi(env.Get("INDEX_MAX_ATTEMPTS", "5")); err != nil {
+		return nil, err
+	}
+	switch cfg.Stage {
+	case StageDev, StageStaging, StageProd:
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownStage, cfg.Stage)
+	}
+	switch cfg.StorageFormat {
+	case StorageJSON, StorageBinary:
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownStorageFormat, cfg.StorageFormat)
+	}
+	switch cfg.ThrottleMode {
+	case ThrottleQueue, ThrottleFail, ThrottleOff:
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownThrottleMode, cfg.ThrottleMode)
+	}
+	switch cfg.IndexRefresh {
+	case IndexRefreshFalse, IndexRefreshTrue, IndexRefreshWaitFor:
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownIndexRefresh, cfg.IndexRefresh)
+	}
+	switch cfg.DeadLetter {
+	case DeadLetterOff, DeadLetterFile, DeadLetterTable:
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownDeadLetter, cfg.DeadLetter)
+	}
+	return cfg, nil
+}
+
+// TableName return stage aware name of the table e.g. orders-api-dev
+func (c *Config) TableName(name string) string {
+	return fmt.Sprintf("%s%s-%s", c.Prefix, name, c.Stage)
+}
+
+// RequiresEncryption report whether sensitive attributes must be encrypted, which is all stages but dev
+func (c *Config) RequiresEncryption() bool {
+	return c.Stage != StageDev
+}
+
+// CanCreateTables report whether missing tables may be created, which is allowed in dev only
+func (c *Config) CanCreateTables() bool {
+	return c.Stage == StageDev
+}
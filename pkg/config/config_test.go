@@ -0,0 +1,91 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestFromEnvElasticsearch(t *testing.T) {
+	os.Setenv("ELASTICSEARCH_URL", "https://es-1:9200, https://es-2:9200,")
+	os.Setenv("ELASTICSEARCH_AUTH", "basic")
+	defer os.Unsetenv("ELASTICSEARCH_URL")
+	defer os.Unsetenv("ELASTICSEARCH_AUTH")
+	cfg, err := FromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"https://es-1:9200", "https://es-2:9200"}; !reflect.DeepEqual(cfg.ElasticsearchURLs, want) {
+		t.Errorf("ElasticsearchURLs = %v, want %v", cfg.ElasticsearchURLs, want)
+	}
+	if cfg.ElasticsearchAuth != "basic" {
+		t.Errorf("ElasticsearchAuth = %q, want basic", cfg.ElasticsearchAuth)
+	}
+	if cfg.IndexRefresh != IndexRefreshFalse {
+		t.Errorf("IndexRefresh = %q, want %q", cfg.IndexRefresh, IndexRefreshFalse)
+	}
+
+	os.Setenv("INDEX_REFRESH", "sometimes")
+	defer os.Unsetenv("INDEX_REFRESH")
+	if _, err := FromEnv(); !errors.Is(err, ErrUnknownIndexRefresh) {
+		t.Errorf("FromEnv with unknown refresh = %v, want %v", err, ErrUnknownIndexRefresh)
+	}
+}
+
+func TestFromEnvStage(t *testing.T) {
+	cfg, err := FromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Stage != StageDev {
+		t.Errorf("Stage = %q, want %q by default", cfg.Stage, StageDev)
+	}
+	os.Setenv("STAGE", "qa")
+	defer os.Unsetenv("STAGE")
+	if _, err := FromEnv(); !errors.Is(err, ErrUnknownStage) {
+		t.Errorf("FromEnv with unknown stage = %v, want %v", err, ErrUnknownStage)
+	}
+}
+
+func TestTableName(t *testing.T) {
+	for _, tc := range []struct {
+		stage, prefix, want string
+	}{
+		{StageDev, "", "orders-api-dev"},
+		{StageStaging, "", "orders-api-staging"},
+		{StageProd, "", "orders-api-prod"},
+		{StageProd, "team-a-", "team-a-orders-api-prod"},
+	} {
+		os.Setenv("STAGE", tc.stage)
+		os.Setenv("TABLE_PREFIX", tc.prefix)
+		cfg, err := FromEnv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name := cfg.TableName("orders-api"); name != tc.want {
+			t.Errorf("TableName in %s with prefix %q = %q, want %q", tc.stage, tc.prefix, name, tc.want)
+		}
+	}
+	os.Unsetenv("STAGE")
+	os.Unsetenv("TABLE_PREFIX")
+}
+
+func TestStagePermissions(t *testing.T) {
+	for _, tc := range []struct {
+		stage                  string
+		createTables, encrypts bool
+	}{
+		{StageDev, true, false},
+		{StageStaging, false, true},
+		{StageProd, false, true},
+	} {
+		cfg := &Config{Stage: tc.stage}
+		if got := cfg.CanCreateTables(); got != tc.createTables {
+			t.Errorf("CanCreateTables in %s = %v, want %v", tc.stage, got, tc.createTables)
+		}
+		if got := cfg.RequiresEncryption(); got != tc.encrypts {
+			t.Errorf("RequiresEncryption in %s = %v, want %v", tc.stage, got, tc.encrypts)
+		}
+	}
+}
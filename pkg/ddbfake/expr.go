@@ -0,0 +1,934 @@
+package ddbfake
+
+import (
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// token kinds produced by lexer
+const (
+	tokEOF = iota
+	tokIdent
+	tokName  // #name placeholder
+	tokValue // :value placeholder
+	tokNumber
+	tokPunct
+)
+
+type token struct {
+	kind int
+	text string
+}
+
+// lex split expression into tokens
+func lex(expr string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(expr); {
+		c := rune(expr[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '#' || c == ':' || c == '_' || unicode.IsLetter(c):
+			j := i + 1
+			for j < len(expr) && (expr[j] == '_' || unicode.IsLetter(rune(expr[j])) || unicode.IsDigit(rune(expr[j]))) {
+				j++
+			}
+			kind := tokIdent
+			if c == '#' {
+				kind = tokName
+			} else if c == ':' {
+				kind = tokValue
+			}
+			if j == i+1 && kind != tokIdent {
+				return nil, fmt.Errorf("invalid token %q at %d", expr[i:j], i)
+			}
+			tokens = append(tokens, token{kind, expr[i:j]})
+			i = j
+		case unicode.IsDigit(c):
+			j := i + 1
+			for j < len(expr) && unicode.IsDigit(rune(expr[j])) {
+				j++
+			}
+			tokens = append(tokens, token{tokNumber, expr[i:j]})
+			i = j
+		case strings.HasPrefix(expr[i:], "<>") || strings.HasPrefix(expr[i:], "<=") || strings.HasPrefix(expr[i:], ">="):
+			tokens = append(tokens, token{tokPunct, expr[i : i+2]})
+			i += 2
+		case strings.ContainsRune("()[],.=<>+-", c):
+			tokens = append(tokens, token{tokPunct, string(c)})
+			i++
+		default:
+			return nil, fmt.Errorf("invalid character %q at %d", c, i)
+		}
+	}
+	return append(tokens, token{kind: tokEOF}), nil
+}
+
+// pathElem is a single step of document path, a map key or a list index
+type pathElem struct {
+	name    string
+	index   int
+	isIndex bool
+}
+
+type path []pathElem
+
+func (p path) String() string {
+	var b strings.Builder
+	for i, e := range p {
+		if e.isIndex {
+			fmt.Fprintf(&b, "[%d]", e.index)
+			continue
+		}
+		if i > 0 {
+			b.WriteByte('.')
+		}
+		b.WriteString(e.name)
+	}
+	return b.String()
+}
+
+// operand of conditions and update actions
+type operand interface{}
+
+type (
+	pathOperand  struct{ path path }
+	valueOperand struct{ name string }
+	funcOperand  struct {
+		name string
+		args []operand
+	}
+	arithOperand struct {
+		op   string
+		l, r operand
+	}
+)
+
+// condition node of condition, filter and key condition expressions
+type condition interface{}
+
+type (
+	compareCond struct {
+		op   string
+		l, r operand
+	}
+	betweenCond struct{ v, lo, hi operand }
+	inCond      struct {
+		v    operand
+		list []operand
+	}
+	andCond  struct{ l, r condition }
+	orCond   struct{ l, r condition }
+	notCond  struct{ c condition }
+	funcCond struct {
+		name string
+		args []operand
+	}
+)
+
+var comparators = map[string]bool{"=": true, "<>": true, "<": true, "<=": true, ">": true, ">=": true}
+
+// parser of dynamodb expressions, it resolves #name placeholders while parsing
+// and records which placeholders were used
+type parser struct {
+	tokens []token
+	pos    int
+	names  map[string]*string
+	values map[string]*dynamodb.AttributeValue
+
+	usedNames  map[string]bool
+	usedValues map[string]bool
+}
+
+func newParser(names map[string]*string, values map[string]*dynamodb.AttributeValue) *parser {
+	return &parser{
+		names:      names,
+		values:     values,
+		usedNames:  map[string]bool{},
+		usedValues: map[string]bool{},
+	}
+}
+
+func (p *parser) reset(expr string) error {
+	tokens, err := lex(expr)
+	if err != nil {
+		return err
+	}
+	p.tokens, p.pos = tokens, 0
+	return nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+// keyword report whether the next token is given case insensitive keyword
+func (p *parser) keyword(word string) bool {
+	t := p.peek()
+	return t.kind == tokIdent && strings.EqualFold(t.text, word)
+}
+
+func (p *parser) punct(text string) bool {
+	t := p.peek()
+	return t.kind == tokPunct && t.text == text
+}
+
+func (p *parser) expect(text string) error {
+	if !p.punct(text) {
+		return fmt.Errorf("expected %q, got %q", text, p.peek().text)
+	}
+	p.next()
+	return nil
+}
+
+// checkUnused return error when some expression attribute name or value was never referenced
+func (p *parser) checkUnused() error {
+	for name := range p.names {
+		if !p.usedNames[name] {
+			return fmt.Errorf("Value provided in ExpressionAttributeNames unused in expressions: keys: {%s}", name)
+		}
+	}
+	for name := range p.values {
+		if !p.usedValues[name] {
+			return fmt.Errorf("Value provided in ExpressionAttributeValues unused in expressions: keys: {%s}", name)
+		}
+	}
+	return nil
+}
+
+func (p *parser) parsePath() (path, error) {
+	var out path
+	for {
+		t := p.next()
+		switch t.kind {
+		case tokIdent:
+			out = append(out, pathElem{name: t.text})
+		case tokName:
+			name, ok := p.names[t.text]
+			if !ok {
+				return nil, fmt.Errorf("An expression attribute name used in the document path is not defined; attribute name: %s", t.text)
+			}
+			p.usedNames[t.text] = true
+			out = append(out, pathElem{name: aws.StringValue(name)})
+		default:
+			return nil, fmt.Errorf("expected attribute name, got %q", t.text)
+		}
+		for p.punct("[") {
+			p.next()
+			n := p.next()
+			if n.kind != tokNumber {
+				return nil, fmt.Errorf("expected list index, got %q", n.text)
+			}
+			index, _ := strconv.Atoi(n.text)
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			out = append(out, pathElem{index: index, isIndex: true})
+		}
+		if !p.punct(".") {
+			return out, nil
+		}
+		p.next()
+	}
+}
+
+func (p *parser) parseOperand() (operand, error) {
+	t := p.peek()
+	switch {
+	case t.kind == tokValue:
+		p.next()
+		if _, ok := p.values[t.text]; !ok {
+			return nil, fmt.Errorf("An expression attribute value used in expression is not defined; attribute value: %s", t.text)
+		}
+		p.usedValues[t.text] = true
+		return &valueOperand{name: t.text}, nil
+	case t.kind == tokIdent && p.tokens[p.pos+1].kind == tokPunct && p.tokens[p.pos+1].text == "(":
+		p.next()
+		p.next()
+		args, err := p.parseArgs()
+		if err != nil {
+			return nil, err
+		}
+		return &funcOperand{name: t.text, args: args}, nil
+	case t.kind == tokIdent || t.kind == tokName:
+		pth, err := p.parsePath()
+		if err != nil {
+			return nil, err
+		}
+		return &pathOperand{path: pth}, nil
+	}
+	return nil, fmt.Errorf("expected operand, got %q", t.text)
+}
+
+// parseArgs parse comma separated operands up to closing parenthesis
+func (p *parser) parseArgs() ([]operand, error) {
+	var args []operand
+	for !p.punct(")") {
+		if len(args) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		arg, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	p.next()
+	return args, nil
+}
+
+// parseCondition parse whole condition expression
+func (p *parser) parseCondition(expr string) (condition, error) {
+	if err := p.reset(expr); err != nil {
+		return nil, err
+	}
+	c, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %q", t.text)
+	}
+	return c, nil
+}
+
+func (p *parser) parseOr() (condition, error) {
+	l, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("OR") {
+		p.next()
+		r, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l = &orCond{l, r}
+	}
+	return l, nil
+}
+
+func (p *parser) parseAnd() (condition, error) {
+	l, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("AND") {
+		p.next()
+		r, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		l = &andCond{l, r}
+	}
+	return l, nil
+}
+
+func (p *parser) parseNot() (condition, error) {
+	if p.keyword("NOT") {
+		p.next()
+		c, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &notCond{c}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (condition, error) {
+	if p.punct("(") {
+		p.next()
+		c, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return c, p.expect(")")
+	}
+	l, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	t := p.peek()
+	switch {
+	case t.kind == tokPunct && comparators[t.text]:
+		p.next()
+		r, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		return &compareCond{op: t.text, l: l, r: r}, nil
+	case p.keyword("BETWEEN"):
+		p.next()
+		lo, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		if !p.keyword("AND") {
+			return nil, fmt.Errorf("expected AND in BETWEEN")
+		}
+		p.next()
+		hi, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		return &betweenCond{v: l, lo: lo, hi: hi}, nil
+	case p.keyword("IN"):
+		p.next()
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		list, err := p.parseArgs()
+		if err != nil {
+			return nil, err
+		}
+		return &inCond{v: l, list: list}, nil
+	}
+	// a function call is a condition on its own, e.g. attribute_exists(#a)
+	if f, ok := l.(*funcOperand); ok && f.name != "size" {
+		return &funcCond{name: f.name, args: f.args}, nil
+	}
+	return nil, fmt.Errorf("expected comparison, got %q", t.text)
+}
+
+// evaluator resolves operands against an item
+type evaluator struct {
+	item   map[string]*dynamodb.AttributeValue
+	values map[string]*dynamodb.AttributeValue
+}
+
+// resolvePath return value at document path, nil when it doesn't exist
+func resolvePath(item map[string]*dynamodb.AttributeValue, pth path) *dynamodb.AttributeValue {
+	if len(pth) == 0 || pth[0].isIndex {
+		return nil
+	}
+	av := item[pth[0].name]
+	for _, e := range pth[1:] {
+		if av == nil {
+			return nil
+		}
+		if e.isIndex {
+			if av.L == nil || e.index >= len(av.L) {
+				return nil
+			}
+			av = av.L[e.index]
+		} else {
+			if av.M == nil {
+				return nil
+			}
+			av = av.M[e.name]
+		}
+	}
+	return av
+}
+
+func (ev *evaluator) operand(op operand) (*dynamodb.AttributeValue, error) {
+	switch o := op.(type) {
+	case *pathOperand:
+		return resolvePath(ev.item, o.path), nil
+	case *valueOperand:
+		return ev.values[o.name], nil
+	case *funcOperand:
+		return ev.function(o)
+	case *arithOperand:
+		l, err := ev.operand(o.l)
+		if err != nil {
+			return nil, err
+		}
+		r, err := ev.operand(o.r)
+		if err != nil {
+			return nil, err
+		}
+		if typeOf(l) != typeN || typeOf(r) != typeN {
+			return nil, fmt.Errorf("An operand in the update expression has an incorrect data type")
+		}
+		x, _ := parseNumber(*l.N)
+		y, _ := parseNumber(*r.N)
+		if o.op == "+" {
+			x = new(big.Rat).Add(x, y)
+		} else {
+			x = new(big.Rat).Sub(x, y)
+		}
+		return &dynamodb.AttributeValue{N: aws.String(formatNumber(x))}, nil
+	}
+	return nil, fmt.Errorf("invalid operand")
+}
+
+func (ev *evaluator) function(f *funcOperand) (*dynamodb.AttributeValue, error) {
+	switch f.name {
+	case "size":
+		if len(f.args) != 1 {
+			return nil, fmt.Errorf("Incorrect number of operands for operator or function; operator or function: size")
+		}
+		v, err := ev.operand(f.args[0])
+		if err != nil {
+			return nil, err
+		}
+		n, ok := size(v)
+		if !ok {
+			return nil, nil
+		}
+		return &dynamodb.AttributeValue{N: aws.String(strconv.Itoa(n))}, nil
+	case "if_not_exists":
+		if len(f.args) != 2 {
+			return nil, fmt.Errorf("Incorrect number of operands for operator or function; operator or function: if_not_exists")
+		}
+		if _, ok := f.args[0].(*pathOperand); !ok {
+			return nil, fmt.Errorf("Operator or function requires a document path; operator or function: if_not_exists")
+		}
+		v, err := ev.operand(f.args[0])
+		if err != nil || v != nil {
+			return v, err
+		}
+		return ev.operand(f.args[1])
+	case "list_append":
+		if len(f.args) != 2 {
+			return nil, fmt.Errorf("Incorrect number of operands for operator or function; operator or function: list_append")
+		}
+		l, err := ev.operand(f.args[0])
+		if err != nil {
+			return nil, err
+		}
+		r, err := ev.operand(f.args[1])
+		if err != nil {
+			return nil, err
+		}
+		if typeOf(l) != typeL || typeOf(r) != typeL {
+			return nil, fmt.Errorf("An operand in the update expression has an incorrect data type")
+		}
+		out := &dynamodb.AttributeValue{L: []*dynamodb.AttributeValue{}}
+		out.L = append(append(out.L, l.L...), r.L...)
+		return out, nil
+	}
+	return nil, fmt.Errorf("Invalid function name; function: %s", f.name)
+}
+
+// eval return whether the item satisfies the condition
+func (ev *evaluator) eval(c condition) (bool, error) {
+	switch c := c.(type) {
+	case *andCond:
+		l, err := ev.eval(c.l)
+		if err != nil || !l {
+			return false, err
+		}
+		return ev.eval(c.r)
+	case *orCond:
+		l, err := ev.eval(c.l)
+		if err != nil || l {
+			return l, err
+		}
+		return ev.eval(c.r)
+	case *notCond:
+		v, err := ev.eval(c.c)
+		return !v, err
+	case *compareCond:
+		l, err := ev.operand(c.l)
+		if err != nil {
+			return false, err
+		}
+		r, err := ev.operand(c.r)
+		if err != nil {
+			return false, err
+		}
+		if l == nil || r == nil {
+			return false, nil
+		}
+		switch c.op {
+		case "=":
+			return equal(l, r), nil
+		case "<>":
+			return !equal(l, r), nil
+		}
+		cmp, ok := compare(l, r)
+		if !ok {
+			return false, nil
+		}
+		switch c.op {
+		case "<":
+			return cmp < 0, nil
+		case "<=":
+			return cmp <= 0, nil
+		case ">":
+			return cmp > 0, nil
+		case ">=":
+			return cmp >= 0, nil
+		}
+	case *betweenCond:
+		v, err := ev.operand(c.v)
+		if err != nil {
+			return false, err
+		}
+		lo, err := ev.operand(c.lo)
+		if err != nil {
+			return false, err
+		}
+		hi, err := ev.operand(c.hi)
+		if err != nil {
+			return false, err
+		}
+		if bound, ok := compare(lo, hi); ok && bound > 0 {
+			return false, fmt.Errorf("Invalid KeyConditionExpression: The BETWEEN operator requires upper bound to be greater than or equal to lower bound")
+		}
+		a, okA := compare(v, lo)
+		b, okB := compare(v, hi)
+		return okA && okB && a >= 0 && b <= 0, nil
+	case *inCond:
+		v, err := ev.operand(c.v)
+		if err != nil || v == nil {
+			return false, err
+		}
+		for _, op := range c.list {
+			candidate, err := ev.operand(op)
+			if err != nil {
+				return false, err
+			}
+			if equal(v, candidate) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case *funcCond:
+		return ev.condFunction(c)
+	}
+	return false, fmt.Errorf("invalid condition")
+}
+
+func (ev *evaluator) condFunction(c *funcCond) (bool, error) {
+	arity := map[string]int{
+		"attribute_exists":     1,
+		"attribute_not_exists": 1,
+		"attribute_type":       2,
+		"begins_with":          2,
+		"contains":             2,
+	}
+	n, ok := arity[c.name]
+	if !ok {
+		return false, fmt.Errorf("Invalid function name; function: %s", c.name)
+	}
+	if len(c.args) != n {
+		return false, fmt.Errorf("Incorrect number of operands for operator or function; operator or function: %s", c.name)
+	}
+	if _, ok := c.args[0].(*pathOperand); !ok {
+		return false, fmt.Errorf("Operator or function requires a document path; operator or function: %s", c.name)
+	}
+	v, err := ev.operand(c.args[0])
+	if err != nil {
+		return false, err
+	}
+	switch c.name {
+	case "attribute_exists":
+		return v != nil, nil
+	case "attribute_not_exists":
+		return v == nil, nil
+	}
+	arg, err := ev.operand(c.args[1])
+	if err != nil || v == nil || arg == nil {
+		return false, err
+	}
+	switch c.name {
+	case "attribute_type":
+		return typeOf(arg) == typeS && *arg.S == typeOf(v), nil
+	case "begins_with":
+		switch {
+		case typeOf(v) == typeS && typeOf(arg) == typeS:
+			return strings.HasPrefix(*v.S, *arg.S), nil
+		case typeOf(v) == typeB && typeOf(arg) == typeB:
+			return len(v.B) >= len(arg.B) && string(v.B[:len(arg.B)]) == string(arg.B), nil
+		}
+		return false, nil
+	}
+	// contains
+	switch typeOf(v) {
+	case typeS:
+		return typeOf(arg) == typeS && strings.Contains(*v.S, *arg.S), nil
+	case typeB:
+		return typeOf(arg) == typeB && strings.Contains(string(v.B), string(arg.B)), nil
+	case typeSS, typeNS, typeBS:
+		for _, e := range setElements(v) {
+			if equal(e, arg) {
+				return true, nil
+			}
+		}
+	case typeL:
+		for _, e := range v.L {
+			if equal(e, arg) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// updateAction is a single action of update expression
+type updateAction struct {
+	clause string // SET, REMOVE, ADD or DELETE
+	path   path
+	value  operand
+}
+
+// parseUpdate parse update expression into actions in order of clauses
+func (p *parser) parseUpdate(expr string) ([]updateAction, error) {
+	if err := p.reset(expr); err != nil {
+		return nil, err
+	}
+	var actions []updateAction
+	seen := map[string]bool{}
+	for p.peek().kind != tokEOF {
+		t := p.next()
+		clause := strings.ToUpper(t.text)
+		if t.kind != tokIdent || (clause != "SET" && clause != "REMOVE" && clause != "ADD" && clause != "DELETE") {
+			return nil, fmt.Errorf("Invalid UpdateExpression: Syntax error; token: %q", t.text)
+		}
+		if seen[clause] {
+			return nil, fmt.Errorf("Invalid UpdateExpression: The %q section can only be used once in an update expression", clause)
+		}
+		seen[clause] = true
+		for {
+			pth, err := p.parsePath()
+			if err != nil {
+				return nil, err
+			}
+			action := updateAction{clause: clause, path: pth}
+			switch clause {
+			case "SET":
+				if err := p.expect("="); err != nil {
+					return nil, err
+				}
+				if action.value, err = p.parseOperand(); err != nil {
+					return nil, err
+				}
+				if p.punct("+") || p.punct("-") {
+					op := p.next().text
+					r, err := p.parseOperand()
+					if err != nil {
+						return nil, err
+					}
+					action.value = &arithOperand{op: op, l: action.value, r: r}
+				}
+			case "ADD", "DELETE":
+				if action.value, err = p.parseOperand(); err != nil {
+					return nil, err
+				}
+				if _, ok := action.value.(*valueOperand); !ok {
+					return nil, fmt.Errorf("Invalid UpdateExpression: %s action requires an expression attribute value", clause)
+				}
+			}
+			actions = append(actions, action)
+			if !p.punct(",") {
+				break
+			}
+			p.next()
+		}
+	}
+	// two actions on overlapping paths are rejected by dynamodb
+	for i := range actions {
+		for j := i + 1; j < len(actions); j++ {
+			a, b := actions[i].path.String(), actions[j].path.String()
+			if a == b || strings.HasPrefix(a, b+".") || strings.HasPrefix(b, a+".") || strings.HasPrefix(a, b+"[") || strings.HasPrefix(b, a+"[") {
+				return nil, fmt.Errorf("Invalid UpdateExpression: Two document paths overlap with each other; path one: [%s], path two: [%s]", a, b)
+			}
+		}
+	}
+	return actions, nil
+}
+
+// parseProjection parse comma separated document paths
+func (p *parser) parseProjection(expr string) ([]path, error) {
+	if err := p.reset(expr); err != nil {
+		return nil, err
+	}
+	var paths []path
+	for {
+		pth, err := p.parsePath()
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, pth)
+		if p.peek().kind == tokEOF {
+			return paths, nil
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// setPath set value at document path, the parent of the last element must exist
+func setPath(item map[string]*dynamodb.AttributeValue, pth path, v *dynamodb.AttributeValue) error {
+	if len(pth) == 1 {
+		item[pth[0].name] = v
+		return nil
+	}
+	parent := resolvePath(item, pth[:len(pth)-1])
+	last := pth[len(pth)-1]
+	switch {
+	case parent == nil:
+	case last.isIndex && parent.L != nil:
+		if last.index >= len(parent.L) {
+			parent.L = append(parent.L, v)
+		} else {
+			parent.L[last.index] = v
+		}
+		return nil
+	case !last.isIndex && parent.M != nil:
+		parent.M[last.name] = v
+		return nil
+	}
+	return fmt.Errorf("The document path provided in the update expression is invalid for update")
+}
+
+// removePath remove value at document path, missing paths are ignored
+func removePath(item map[string]*dynamodb.AttributeValue, pth path) {
+	if len(pth) == 1 {
+		delete(item, pth[0].name)
+		return
+	}
+	parent := resolvePath(item, pth[:len(pth)-1])
+	last := pth[len(pth)-1]
+	switch {
+	case parent == nil:
+	case last.isIndex && parent.L != nil && last.index < len(parent.L):
+		parent.L = append(parent.L[:last.index], parent.L[last.index+1:]...)
+	case !last.isIndex && parent.M != nil:
+		delete(parent.M, last.name)
+	}
+}
+
+// applyUpdate apply actions to the item in place, operands are evaluated against the item
+// as it was before the update
+func applyUpdate(item map[string]*dynamodb.AttributeValue, actions []updateAction, values map[string]*dynamodb.AttributeValue) error {
+	ev := &evaluator{item: cloneItem(item), values: values}
+	for _, action := range actions {
+		switch action.clause {
+		case "SET":
+			v, err := ev.operand(action.value)
+			if err != nil {
+				return err
+			}
+			if v == nil {
+				return fmt.Errorf("The provided expression refers to an attribute that does not exist in the item")
+			}
+			if err := setPath(item, action.path, clone(v)); err != nil {
+				return err
+			}
+		case "REMOVE":
+			removePath(item, action.path)
+		case "ADD":
+			v, _ := ev.operand(action.value)
+			current := resolvePath(item, action.path)
+			switch {
+			case typeOf(v) == typeN && current == nil:
+				current = clone(v)
+			case typeOf(v) == typeN && typeOf(current) == typeN:
+				x, _ := parseNumber(*current.N)
+				y, _ := parseNumber(*v.N)
+				current = &dynamodb.AttributeValue{N: aws.String(formatNumber(new(big.Rat).Add(x, y)))}
+			case (typeOf(v) == typeSS || typeOf(v) == typeNS || typeOf(v) == typeBS) && (current == nil || typeOf(current) == typeOf(v)):
+				elements := setElements(v)
+				if current != nil {
+					elements = append(setElements(current), elements...)
+				}
+				current = setFromElements(typeOf(v), unique(elements))
+			default:
+				return fmt.Errorf("An operand in the update expression has an incorrect data type")
+			}
+			if err := setPath(item, action.path, current); err != nil {
+				return err
+			}
+		case "DELETE":
+			v, _ := ev.operand(action.value)
+			current := resolvePath(item, action.path)
+			if current == nil {
+				continue
+			}
+			if typeOf(current) != typeOf(v) || (typeOf(v) != typeSS && typeOf(v) != typeNS && typeOf(v) != typeBS) {
+				return fmt.Errorf("An operand in the update expression has an incorrect data type")
+			}
+			var kept []*dynamodb.AttributeValue
+			for _, e := range setElements(current) {
+				remove := false
+				for _, d := range setElements(v) {
+					remove = remove || equal(e, d)
+				}
+				if !remove {
+					kept = append(kept, e)
+				}
+			}
+			if set := setFromElements(typeOf(v), kept); set != nil {
+				if err := setPath(item, action.path, set); err != nil {
+					return err
+				}
+			} else {
+				removePath(item, action.path)
+			}
+		}
+	}
+	return nil
+}
+
+// unique drop repeated elements of a sorted or unsorted element list
+func unique(elements []*dynamodb.AttributeValue) []*dynamodb.AttributeValue {
+	var out []*dynamodb.AttributeValue
+	for _, e := range elements {
+		dup := false
+		for _, o := range out {
+			dup = dup || equal(e, o)
+		}
+		if !dup {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// project return copy of the item with only given document paths
+func project(item map[string]*dynamodb.AttributeValue, paths []path) map[string]*dynamodb.AttributeValue {
+	out := map[string]*dynamodb.AttributeValue{}
+	for _, pth := range paths {
+		v := resolvePath(item, pth)
+		if v == nil {
+			continue
+		}
+		// rebuild intermediate maps and lists, list elements are compacted as dynamodb does
+		dst := out
+		for i, e := range pth[:len(pth)-1] {
+			if e.isIndex {
+				break
+			}
+			next := pth[i+1]
+			if dst[e.name] == nil {
+				if next.isIndex {
+					dst[e.name] = &dynamodb.AttributeValue{L: []*dynamodb.AttributeValue{}}
+				} else {
+					dst[e.name] = &dynamodb.AttributeValue{M: map[string]*dynamodb.AttributeValue{}}
+				}
+			}
+			if next.isIndex {
+				dst[e.name].L = append(dst[e.name].L, clone(v))
+				dst = nil
+				break
+			}
+			dst = dst[e.name].M
+		}
+		if dst != nil {
+			dst[pth[len(pth)-1].name] = clone(v)
+		}
+	}
+	return out
+}
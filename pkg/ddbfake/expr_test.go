@@ -0,0 +1,226 @@
+package ddbfake
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func exprItem() map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"id":     {S: aws.String("order-1")},
+		"count":  {N: aws.String("5")},
+		"status": {S: aws.String("InProgress")},
+		"tags":   {SS: []*string{aws.String("a"), aws.String("b")}},
+		"list":   {L: []*dynamodb.AttributeValue{{S: aws.String("x")}, {N: aws.String("1")}}},
+		"nested": {M: map[string]*dynamodb.AttributeValue{
+			"inner": {M: map[string]*dynamodb.AttributeValue{"deep": {S: aws.String("value")}}},
+		}},
+		"raw":   {B: []byte("prefix-data")},
+		"empty": {NULL: aws.Bool(true)},
+	}
+}
+
+func TestConditionExpressions(t *testing.T) {
+	names := map[string]*string{"#s": aws.String("status"), "#n": aws.String("nested")}
+	values := map[string]*dynamodb.AttributeValue{
+		":five":   {N: aws.String("5")},
+		":four":   {N: aws.String("4.0")},
+		":ten":    {N: aws.String("10")},
+		":ip":     {S: aws.String("InProgress")},
+		":done":   {S: aws.String("Completed")},
+		":a":      {S: aws.String("a")},
+		":x":      {S: aws.String("x")},
+		":ord":    {S: aws.String("ord")},
+		":prefix": {B: []byte("prefix")},
+		":typeSS": {S: aws.String("SS")},
+		":two":    {N: aws.String("2")},
+		":value":  {S: aws.String("value")},
+	}
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{"#s = :ip", true},
+		{"#s <> :ip", false},
+		{"#s = :ip AND count = :five", true},
+		{"#s = :done OR count = :five", true},
+		{"NOT #s = :ip", false},
+		{"NOT (#s = :done OR count > :ten)", true},
+		{"count > :four", true},
+		{"count >= :five AND count <= :five", true},
+		{"count < :four", false},
+		{"count BETWEEN :four AND :ten", true},
+		{"count BETWEEN :ten AND :ten", false},
+		{"#s IN (:done, :ip)", true},
+		{"#s IN (:done)", false},
+		{"attribute_exists(#s)", true},
+		{"attribute_exists(missing)", false},
+		{"attribute_not_exists(missing)", true},
+		{"attribute_exists(empty)", true},
+		{"attribute_type(tags, :typeSS)", true},
+		{"begins_with(id, :ord)", true},
+		{"begins_with(raw, :prefix)", true},
+		{"begins_with(#s, :ord)", false},
+		{"contains(tags, :a)", true},
+		{"contains(list, :x)", true},
+		{"contains(#s, :ord)", false},
+		{"size(tags) = :two", true},
+		{"size(list) > :two", false},
+		{"#n.inner.deep = :value", true},
+		{"#n.inner.missing = :value", false},
+		{"list[0] = :x", true},
+		{"list[5] = :x", false},
+		// mismatched types never compare
+		{"#s > :five", false},
+	}
+	for _, test := range tests {
+		exprs := newExpressions(names, values)
+		c, err := exprs.condition(aws.String(test.expr))
+		if err != nil {
+			t.Errorf("%s: %v", test.expr, err)
+			continue
+		}
+		got, err := exprs.check(c, exprItem())
+		if err != nil {
+			t.Errorf("%s: %v", test.expr, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s = %v, want %v", test.expr, got, test.want)
+		}
+	}
+}
+
+func TestInvalidExpressions(t *testing.T) {
+	values := map[string]*dynamodb.AttributeValue{":v": {S: aws.String("v")}}
+	tests := []string{
+		"",
+		"a =",
+		"a = :missing",
+		"#missing = :v",
+		"(a = :v",
+		"a = :v AND",
+		"a BETWEEN :v",
+		"a IN :v",
+		"unknown_function(a)",
+		"attribute_exists(:v)",
+		"begins_with(a)",
+		"a = :v extra",
+		"size(a)",
+	}
+	for _, expr := range tests {
+		exprs := newExpressions(nil, values)
+		c, err := exprs.parser.parseCondition(expr)
+		if err == nil {
+			// some errors are only found when evaluated
+			_, err = exprs.check(c, exprItem())
+		}
+		if err == nil {
+			t.Errorf("%q was accepted", expr)
+		}
+	}
+}
+
+func TestUnusedExpressionAttributes(t *testing.T) {
+	exprs := newExpressions(
+		map[string]*string{"#a": aws.String("a"), "#unused": aws.String("b")},
+		map[string]*dynamodb.AttributeValue{":v": {S: aws.String("v")}},
+	)
+	if _, err := exprs.condition(aws.String("#a = :v")); err != nil {
+		t.Fatal(err)
+	}
+	if err := exprs.done(); err == nil {
+		t.Error("unused attribute name was accepted")
+	}
+}
+
+func TestUpdateExpressions(t *testing.T) {
+	values := map[string]*dynamodb.AttributeValue{
+		":one":   {N: aws.String("1")},
+		":done":  {S: aws.String("Completed")},
+		":c":     {SS: []*string{aws.String("c")}},
+		":a":     {SS: []*string{aws.String("a")}},
+		":more":  {L: []*dynamodb.AttributeValue{{S: aws.String("y")}}},
+		":init":  {N: aws.String("100")},
+		":deep":  {S: aws.String("changed")},
+		":first": {N: aws.String("7")},
+	}
+	exprs := newExpressions(nil, values)
+	actions, err := exprs.parser.parseUpdate("SET count = count + :one, status = :done, list = list_append(list, :more), " +
+		"total = if_not_exists(total, :init), nested.inner.deep = :deep, created = if_not_exists(id, :init) " +
+		"REMOVE empty ADD tags :c, visits :first DELETE raw_set :a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	item := exprItem()
+	item["raw_set"] = &dynamodb.AttributeValue{SS: []*string{aws.String("a"), aws.String("z")}}
+	if err := applyUpdate(item, actions, values); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]*dynamodb.AttributeValue{
+		"count":   {N: aws.String("6")},
+		"status":  {S: aws.String("Completed")},
+		"tags":    {SS: []*string{aws.String("a"), aws.String("b"), aws.String("c")}},
+		"list":    {L: []*dynamodb.AttributeValue{{S: aws.String("x")}, {N: aws.String("1")}, {S: aws.String("y")}}},
+		"total":   {N: aws.String("100")},
+		"created": {S: aws.String("order-1")},
+		"visits":  {N: aws.String("7")},
+		"raw_set": {SS: []*string{aws.String("z")}},
+	}
+	for name, v := range want {
+		if !equal(item[name], v) {
+			t.Errorf("%s = %v, want %v", name, item[name], v)
+		}
+	}
+	if got := item["nested"].M["inner"].M["deep"]; aws.StringValue(got.S) != "changed" {
+		t.Errorf("nested.inner.deep = %v, want changed", got)
+	}
+	if _, ok := item["empty"]; ok {
+		t.Error("removed attribute is still set")
+	}
+}
+
+func TestInvalidUpdateExpressions(t *testing.T) {
+	values := map[string]*dynamodb.AttributeValue{":v": {S: aws.String("v")}}
+	tests := []string{
+		"UPSERT a = :v",
+		"SET a = :v SET b = :v",
+		"SET a = :v, a = :v",
+		"SET a = :v, a.b = :v",
+		"SET a :v",
+		"ADD a b",
+	}
+	for _, expr := range tests {
+		if _, err := newExpressions(nil, values).parser.parseUpdate(expr); err == nil {
+			t.Errorf("%q was accepted", expr)
+		}
+	}
+	// type errors are found when applied
+	exprs := newExpressions(nil, values)
+	actions, err := exprs.parser.parseUpdate("SET status = status + :v")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := applyUpdate(exprItem(), actions, values); err == nil {
+		t.Error("adding a string was accepted")
+	}
+}
+
+func TestProjectionExpressions(t *testing.T) {
+	paths, err := newExpressions(map[string]*string{"#s": aws.String("status")}, nil).parser.parseProjection("id, #s, nested.inner.deep, list[1]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := project(exprItem(), paths)
+	if len(got) != 4 {
+		t.Fatalf("projected %d attributes, want 4: %v", len(got), got)
+	}
+	if aws.StringValue(got["nested"].M["inner"].M["deep"].S) != "value" {
+		t.Errorf("nested path wasn't projected: %v", got["nested"])
+	}
+	if l := got["list"].L; len(l) != 1 || aws.StringValue(l[0].N) != "1" {
+		t.Errorf("list element wasn't projected: %v", got["list"])
+	}
+}
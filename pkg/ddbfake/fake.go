@@ -0,0 +1,1614 @@
+// Package ddbfake provides an in-memory DynamoDB implementing dynamodbiface.DynamoDBAPI
+// so code using ddbstore can be exercised in go test without DynamoDB Local.
+package ddbfake
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams"
+)
+
+const (
+	// errCodeValidation is returned by dynamodb for invalid requests, the sdk has no constant for it
+	errCodeValidation = "ValidationException"
+	// maxItemSize is the dynamodb limit of a single item
+	maxItemSize = 400 * 1024
+	// maxPageSize is the dynamodb limit of data returned by a single Query or Scan call
+	maxPageSize = 1024 * 1024
+	// maxTransactItems is the dynamodb limit of items in a single transaction
+	maxTransactItems = 25
+	// transactTokenTTL is how long client request tokens of transactions are remembered
+	transactTokenTTL = 10 * time.Minute
+
+	region    = "local"
+	accountID = "000000000000"
+)
+
+// DB is an in-memory DynamoDB. Tables are created with CreateTable like in DynamoDB;
+// operations the fake doesn't implement panic through the embedded nil interface.
+type DB struct {
+	dynamodbiface.DynamoDBAPI
+
+	// Fail is called before every operation with its name e.g. "PutItem", a returned error
+	// is returned by the operation. It allows tests to inject throttling or outages.
+	Fail func(op string) error
+
+	mu          sync.Mutex
+	tables      map[string]*table
+	tokens      map[string]time.Time
+	sequence    int64
+	subscribers []func(tableName string, record *dynamodbstreams.Record)
+}
+
+// New return empty in-memory dynamodb
+func New() *DB {
+	return &DB{
+		tables: map[string]*table{},
+		tokens: map[string]time.Time{},
+	}
+}
+
+// index is a secondary index of the table
+type index struct {
+	name              string
+	hashKey, rangeKey string
+	projection        *dynamodb.Projection
+	global            bool
+}
+
+type table struct {
+	desc              *dynamodb.TableDescription
+	hashKey, rangeKey string
+	indexes           map[string]*index
+	items             map[string]map[string]*dynamodb.AttributeValue
+	ttl               *dynamodb.TimeToLiveDescription
+	tags              map[string]string
+	shards            []*shard
+}
+
+// keyOf return storage key of the item
+func (t *table) keyOf(item map[string]*dynamodb.AttributeValue) string {
+	return keyString(item, t.hashKey, t.rangeKey)
+}
+
+// keyAttrs return copy of key attributes of the item
+func (t *table) keyAttrs(item map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue {
+	key := map[string]*dynamodb.AttributeValue{t.hashKey: clone(item[t.hashKey])}
+	if t.rangeKey != "" {
+		key[t.rangeKey] = clone(item[t.rangeKey])
+	}
+	return key
+}
+
+// attrType return declared type of key attribute
+func (t *table) attrType(name string) string {
+	for _, def := range t.desc.AttributeDefinitions {
+		if aws.StringValue(def.AttributeName) == name {
+			return aws.StringValue(def.AttributeType)
+		}
+	}
+	return ""
+}
+
+func (db *DB) fail(op string) error {
+	if db.Fail != nil {
+		return db.Fail(op)
+	}
+	return nil
+}
+
+func validationError(format string, args ...interface{}) error {
+	return awserr.New(errCodeValidation, fmt.Sprintf(format, args...), nil)
+}
+
+func notFoundError(tableName string) error {
+	return awserr.New(dynamodb.ErrCodeResourceNotFoundException, "Requested resource not found: Table: "+tableName+" not found", nil)
+}
+
+func conditionFailedError() error {
+	return awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "The conditional request failed", nil)
+}
+
+// table return table by name, db.mu must be held
+func (db *DB) table(tableName *string) (*table, error) {
+	t, ok := db.tables[aws.StringValue(tableName)]
+	if !ok {
+		return nil, notFoundError(aws.StringValue(tableName))
+	}
+	return t, nil
+}
+
+// keySchema return hash and range key names of key schema
+func keySchema(schema []*dynamodb.KeySchemaElement) (hashKey, rangeKey string) {
+	for _, k := range schema {
+		if aws.StringValue(k.KeyType) == dynamodb.KeyTypeHash {
+			hashKey = aws.StringValue(k.AttributeName)
+		} else {
+			rangeKey = aws.StringValue(k.AttributeName)
+		}
+	}
+	return hashKey, rangeKey
+}
+
+func tableArn(tableName string) string {
+	return fmt.Sprintf("arn:aws:dynamodb:%s:%s:table/%s", region, accountID, tableName)
+}
+
+// CreateTable implements dynamodbiface.DynamoDBAPI, tables are ACTIVE immediately
+func (db *DB) CreateTable(input *dynamodb.CreateTableInput) (*dynamodb.CreateTableOutput, error) {
+	if err := db.fail("CreateTable"); err != nil {
+		return nil, err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	name := aws.StringValue(input.TableName)
+	if _, ok := db.tables[name]; ok {
+		return nil, awserr.New(dynamodb.ErrCodeResourceInUseException, "Table already exists: "+name, nil)
+	}
+	hashKey, rangeKey := keySchema(input.KeySchema)
+	if hashKey == "" {
+		return nil, validationError("No Hash Key specified in schema")
+	}
+	billingMode := aws.StringValue(input.BillingMode)
+	if billingMode == "" {
+		billingMode = dynamodb.BillingModeProvisioned
+	}
+	now := time.Now()
+	t := &table{
+		hashKey:  hashKey,
+		rangeKey: rangeKey,
+		indexes:  map[string]*index{},
+		items:    map[string]map[string]*dynamodb.AttributeValue{},
+		tags:     map[string]string{},
+		desc: &dynamodb.TableDescription{
+			TableName:            aws.String(name),
+			TableArn:             aws.String(tableArn(name)),
+			TableStatus:          aws.String(dynamodb.TableStatusActive),
+			CreationDateTime:     aws.Time(now),
+			AttributeDefinitions: input.AttributeDefinitions,
+			KeySchema:            input.KeySchema,
+			BillingModeSummary:   &dynamodb.BillingModeSummary{BillingMode: aws.String(billingMode)},
+			ProvisionedThroughput: &dynamodb.ProvisionedThroughputDescription{
+				ReadCapacityUnits:  aws.Int64(0),
+				WriteCapacityUnits: aws.Int64(0),
+			},
+			ItemCount:      aws.Int64(0),
+			TableSizeBytes: aws.Int64(0),
+		},
+	}
+	for _, def := range append(keyNames(input.KeySchema), indexKeyNames(input)...) {
+		if t.attrType(def) == "" {
+			return nil, validationError("One or more parameter values were invalid: Some index key attributes are not defined in AttributeDefinitions. Keys: [%s]", def)
+		}
+	}
+	if input.ProvisionedThroughput != nil {
+		t.desc.ProvisionedThroughput.ReadCapacityUnits = input.ProvisionedThroughput.ReadCapacityUnits
+		t.desc.ProvisionedThroughput.WriteCapacityUnits = input.ProvisionedThroughput.WriteCapacityUnits
+	}
+	for _, gsi := range input.GlobalSecondaryIndexes {
+		t.addGlobalIndex(gsi)
+	}
+	for _, lsi := range input.LocalSecondaryIndexes {
+		h, r := keySchema(lsi.KeySchema)
+		t.indexes[aws.StringValue(lsi.IndexName)] = &index{
+			name: aws.StringValue(lsi.IndexName), hashKey: h, rangeKey: r, projection: lsi.Projection,
+		}
+		t.desc.LocalSecondaryIndexes = append(t.desc.LocalSecondaryIndexes, &dynamodb.LocalSecondaryIndexDescription{
+			IndexName:  lsi.IndexName,
+			IndexArn:   aws.String(tableArn(name) + "/index/" + aws.StringValue(lsi.IndexName)),
+			KeySchema:  lsi.KeySchema,
+			Projection: lsi.Projection,
+		})
+	}
+	db.setStream(t, input.StreamSpecification)
+	for _, tag := range input.Tags {
+		t.tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	db.tables[name] = t
+	return &dynamodb.CreateTableOutput{TableDescription: t.describe()}, nil
+}
+
+func keyNames(schema []*dynamodb.KeySchemaElement) []string {
+	var names []string
+	for _, k := range schema {
+		names = append(names, aws.StringValue(k.AttributeName))
+	}
+	return names
+}
+
+func indexKeyNames(input *dynamodb.CreateTableInput) []string {
+	var names []string
+	for _, gsi := range input.GlobalSecondaryIndexes {
+		names = append(names, keyNames(gsi.KeySchema)...)
+	}
+	for _, lsi := range input.LocalSecondaryIndexes {
+		names = append(names, keyNames(lsi.KeySchema)...)
+	}
+	return names
+}
+
+func (t *table) addGlobalIndex(gsi *dynamodb.GlobalSecondaryIndex) {
+	h, r := keySchema(gsi.KeySchema)
+	t.indexes[aws.StringValue(gsi.IndexName)] = &index{
+		name: aws.StringValue(gsi.IndexName), hashKey: h, rangeKey: r, projection: gsi.Projection, global: true,
+	}
+	throughput := &dynamodb.ProvisionedThroughputDescription{ReadCapacityUnits: aws.Int64(0), WriteCapacityUnits: aws.Int64(0)}
+	if gsi.ProvisionedThroughput != nil {
+		throughput.ReadCapacityUnits = gsi.ProvisionedThroughput.ReadCapacityUnits
+		throughput.WriteCapacityUnits = gsi.ProvisionedThroughput.WriteCapacityUnits
+	}
+	t.desc.GlobalSecondaryIndexes = append(t.desc.GlobalSecondaryIndexes, &dynamodb.GlobalSecondaryIndexDescription{
+		IndexName:             gsi.IndexName,
+		IndexArn:              aws.String(aws.StringValue(t.desc.TableArn) + "/index/" + aws.StringValue(gsi.IndexName)),
+		IndexStatus:           aws.String(dynamodb.IndexStatusActive),
+		KeySchema:             gsi.KeySchema,
+		Projection:            gsi.Projection,
+		ProvisionedThroughput: throughput,
+	})
+}
+
+// setStream enable or disable the table stream, db.mu must be held
+func (db *DB) setStream(t *table, spec *dynamodb.StreamSpecification) {
+	if spec == nil {
+		return
+	}
+	t.desc.StreamSpecification = spec
+	if aws.BoolValue(spec.StreamEnabled) {
+		label := time.Now().UTC().Format("2006-01-02T15:04:05.000")
+		t.desc.LatestStreamLabel = aws.String(label)
+		t.desc.LatestStreamArn = aws.String(aws.StringValue(t.desc.TableArn) + "/stream/" + label)
+		// a new stream starts with a new open shard, records of the previous one are not kept
+		t.shards = nil
+		db.openShard(t)
+	} else if len(t.shards) > 0 {
+		t.shards[len(t.shards)-1].closed = true
+	}
+}
+
+// streamViewType return stream view type of the table, empty when the stream is disabled
+func (t *table) streamViewType() string {
+	spec := t.desc.StreamSpecification
+	if spec == nil || !aws.BoolValue(spec.StreamEnabled) {
+		return ""
+	}
+	return aws.StringValue(spec.StreamViewType)
+}
+
+// describe return copy of table description with current item count
+func (t *table) describe() *dynamodb.TableDescription {
+	desc := *t.desc
+	size := 0
+	for _, item := range t.items {
+		size += itemSize(item)
+	}
+	desc.ItemCount = aws.Int64(int64(len(t.items)))
+	desc.TableSizeBytes = aws.Int64(int64(size))
+	return &desc
+}
+
+// DescribeTable implements dynamodbiface.DynamoDBAPI
+func (db *DB) DescribeTable(input *dynamodb.DescribeTableInput) (*dynamodb.DescribeTableOutput, error) {
+	if err := db.fail("DescribeTable"); err != nil {
+		return nil, err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	t, err := db.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	return &dynamodb.DescribeTableOutput{Table: t.describe()}, nil
+}
+
+// DeleteTable implements dynamodbiface.DynamoDBAPI
+func (db *DB) DeleteTable(input *dynamodb.DeleteTableInput) (*dynamodb.DeleteTableOutput, error) {
+	if err := db.fail("DeleteTable"); err != nil {
+		return nil, err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	t, err := db.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	delete(db.tables, aws.StringValue(input.TableName))
+	desc := t.describe()
+	desc.TableStatus = aws.String(dynamodb.TableStatusDeleting)
+	return &dynamodb.DeleteTableOutput{TableDescription: desc}, nil
+}
+
+// ListTables implements dynamodbiface.DynamoDBAPI
+func (db *DB) ListTables(input *dynamodb.ListTablesInput) (*dynamodb.ListTablesOutput, error) {
+	if err := db.fail("ListTables"); err != nil {
+		return nil, err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var names []string
+	for name := range db.tables {
+		if name > aws.StringValue(input.ExclusiveStartTableName) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	output := &dynamodb.ListTablesOutput{}
+	limit := int(aws.Int64Value(input.Limit))
+	if limit == 0 {
+		limit = 100
+	}
+	if len(names) > limit {
+		names = names[:limit]
+		output.LastEvaluatedTableName = aws.String(names[limit-1])
+	}
+	output.TableNames = aws.StringSlice(names)
+	return output, nil
+}
+
+// UpdateTable implements dynamodbiface.DynamoDBAPI for billing mode, throughput,
+// stream and global secondary index changes
+func (db *DB) UpdateTable(input *dynamodb.UpdateTableInput) (*dynamodb.UpdateTableOutput, error) {
+	if err := db.fail("UpdateTable"); err != nil {
+		return nil, err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	t, err := db.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	if input.BillingMode != nil {
+		t.desc.BillingModeSummary = &dynamodb.BillingModeSummary{BillingMode: input.BillingMode}
+	}
+	if input.ProvisionedThroughput != nil {
+		t.desc.ProvisionedThroughput.ReadCapacityUnits = input.ProvisionedThroughput.ReadCapacityUnits
+		t.desc.ProvisionedThroughput.WriteCapacityUnits = input.ProvisionedThroughput.WriteCapacityUnits
+	}
+	if input.StreamSpecification != nil {
+		if aws.BoolValue(input.StreamSpecification.StreamEnabled) && t.streamViewType() != "" {
+			return nil, validationError("Table already has an enabled stream")
+		}
+		db.setStream(t, input.StreamSpecification)
+	}
+	for _, def := range input.AttributeDefinitions {
+		if t.attrType(aws.StringValue(def.AttributeName)) == "" {
+			t.desc.AttributeDefinitions = append(t.desc.AttributeDefinitions, def)
+		}
+	}
+	for _, update := range input.GlobalSecondaryIndexUpdates {
+		switch {
+		case update.Create != nil:
+			if _, ok := t.indexes[aws.StringValue(update.Create.IndexName)]; ok {
+				return nil, validationError("Attempting to create an index which already exists")
+			}
+			t.addGlobalIndex(&dynamodb.GlobalSecondaryIndex{
+				IndexName:             update.Create.IndexName,
+				KeySchema:             update.Create.KeySchema,
+				Projection:            update.Create.Projection,
+				ProvisionedThroughput: update.Create.ProvisionedThroughput,
+			})
+		case update.Delete != nil:
+			name := aws.StringValue(update.Delete.IndexName)
+			delete(t.indexes, name)
+			var kept []*dynamodb.GlobalSecondaryIndexDescription
+			for _, gsi := range t.desc.GlobalSecondaryIndexes {
+				if aws.StringValue(gsi.IndexName) != name {
+					kept = append(kept, gsi)
+				}
+			}
+			t.desc.GlobalSecondaryIndexes = kept
+		}
+	}
+	return &dynamodb.UpdateTableOutput{TableDescription: t.describe()}, nil
+}
+
+// DescribeTimeToLive implements dynamodbiface.DynamoDBAPI
+func (db *DB) DescribeTimeToLive(input *dynamodb.DescribeTimeToLiveInput) (*dynamodb.DescribeTimeToLiveOutput, error) {
+	if err := db.fail("DescribeTimeToLive"); err != nil {
+		return nil, err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	t, err := db.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	ttl := t.ttl
+	if ttl == nil {
+		ttl = &dynamodb.TimeToLiveDescription{TimeToLiveStatus: aws.String(dynamodb.TimeToLiveStatusDisabled)}
+	}
+	return &dynamodb.DescribeTimeToLiveOutput{TimeToLiveDescription: ttl}, nil
+}
+
+// UpdateTimeToLive implements dynamodbiface.DynamoDBAPI, expired items are not deleted by the fake
+func (db *DB) UpdateTimeToLive(input *dynamodb.UpdateTimeToLiveInput) (*dynamodb.UpdateTimeToLiveOutput, error) {
+	if err := db.fail("UpdateTimeToLive"); err != nil {
+		return nil, err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	t, err := db.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	status := dynamodb.TimeToLiveStatusDisabled
+	if aws.BoolValue(input.TimeToLiveSpecification.Enabled) {
+		status = dynamodb.TimeToLiveStatusEnabled
+	}
+	t.ttl = &dynamodb.TimeToLiveDescription{
+		AttributeName:    input.TimeToLiveSpecification.AttributeName,
+		TimeToLiveStatus: aws.String(status),
+	}
+	return &dynamodb.UpdateTimeToLiveOutput{TimeToLiveSpecification: input.TimeToLiveSpecification}, nil
+}
+
+// tableByArn return table by its arn, db.mu must be held
+func (db *DB) tableByArn(arn *string) (*table, error) {
+	for _, t := range db.tables {
+		if aws.StringValue(t.desc.TableArn) == aws.StringValue(arn) {
+			return t, nil
+		}
+	}
+	return nil, awserr.New(dynamodb.ErrCodeResourceNotFoundException, "Requested resource not found: "+aws.StringValue(arn), nil)
+}
+
+// TagResource implements dynamodbiface.DynamoDBAPI
+func (db *DB) TagResource(input *dynamodb.TagResourceInput) (*dynamodb.TagResourceOutput, error) {
+	if err := db.fail("TagResource"); err != nil {
+		return nil, err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	t, err := db.tableByArn(input.ResourceArn)
+	if err != nil {
+		return nil, err
+	}
+	for _, tag := range input.Tags {
+		t.tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	return &dynamodb.TagResourceOutput{}, nil
+}
+
+// UntagResource implements dynamodbiface.DynamoDBAPI
+func (db *DB) UntagResource(input *dynamodb.UntagResourceInput) (*dynamodb.UntagResourceOutput, error) {
+	if err := db.fail("UntagResource"); err != nil {
+		return nil, err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	t, err := db.tableByArn(input.ResourceArn)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range input.TagKeys {
+		delete(t.tags, aws.StringValue(key))
+	}
+	return &dynamodb.UntagResourceOutput{}, nil
+}
+
+// ListTagsOfResource implements dynamodbiface.DynamoDBAPI
+func (db *DB) ListTagsOfResource(input *dynamodb.ListTagsOfResourceInput) (*dynamodb.ListTagsOfResourceOutput, error) {
+	if err := db.fail("ListTagsOfResource"); err != nil {
+		return nil, err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	t, err := db.tableByArn(input.ResourceArn)
+	if err != nil {
+		return nil, err
+	}
+	output := &dynamodb.ListTagsOfResourceOutput{}
+	keys := make([]string, 0, len(t.tags))
+	for key := range t.tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		output.Tags = append(output.Tags, &dynamodb.Tag{Key: aws.String(key), Value: aws.String(t.tags[key])})
+	}
+	return output, nil
+}
+
+// Subscribe register fn called with every stream record of tables having stream enabled,
+// records are delivered synchronously after the write which produced them
+func (db *DB) Subscribe(fn func(tableName string, record *dynamodbstreams.Record)) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.subscribers = append(db.subscribers, fn)
+}
+
+// Records return all stream records emitted by the table so far
+func (db *DB) Records(tableName string) []*dynamodbstreams.Record {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	t, ok := db.tables[tableName]
+	if !ok {
+		return nil
+	}
+	var records []*dynamodbstreams.Record
+	for _, sh := range t.shards {
+		records = append(records, sh.records...)
+	}
+	return records
+}
+
+// emitted is a stream record waiting to be delivered to subscribers
+type emitted struct {
+	tableName string
+	record    *dynamodbstreams.Record
+}
+
+// deliver call subscribers with records, it must be called without db.mu held
+func (db *DB) deliver(records []emitted) {
+	db.mu.Lock()
+	subscribers := append([]func(string, *dynamodbstreams.Record){}, db.subscribers...)
+	db.mu.Unlock()
+	for _, e := range records {
+		for _, fn := range subscribers {
+			fn(e.tableName, e.record)
+		}
+	}
+}
+
+// write is a prepared change of a single item, new is nil for deletes
+type write struct {
+	table    *table
+	key      string
+	old, new map[string]*dynamodb.AttributeValue
+}
+
+// commit store prepared change and record it to the stream, db.mu must be held
+func (db *DB) commit(w *write) []emitted {
+	if w.new == nil {
+		if w.old == nil {
+			return nil
+		}
+		delete(w.table.items, w.key)
+	} else {
+		w.table.items[w.key] = w.new
+	}
+	viewType := w.table.streamViewType()
+	// like dynamodb, a write which doesn't change the item emits no stream record
+	if viewType == "" || (w.old != nil && w.new != nil && equal(&dynamodb.AttributeValue{M: w.old}, &dynamodb.AttributeValue{M: w.new})) {
+		return nil
+	}
+	eventName := dynamodbstreams.OperationTypeModify
+	switch {
+	case w.old == nil:
+		eventName = dynamodbstreams.OperationTypeInsert
+	case w.new == nil:
+		eventName = dynamodbstreams.OperationTypeRemove
+	}
+	image := w.new
+	if image == nil {
+		image = w.old
+	}
+	db.sequence++
+	record := &dynamodbstreams.Record{
+		AwsRegion:    aws.String(region),
+		EventID:      aws.String(fmt.Sprintf("%d", db.sequence)),
+		EventName:    aws.String(eventName),
+		EventSource:  aws.String("aws:dynamodb"),
+		EventVersion: aws.String("1.1"),
+		Dynamodb: &dynamodbstreams.StreamRecord{
+			ApproximateCreationDateTime: aws.Time(time.Now()),
+			Keys:                        cloneItem(w.table.keyAttrs(image)),
+			SequenceNumber:              aws.String(fmt.Sprintf("%021d", db.sequence)),
+			SizeBytes:                   aws.Int64(int64(itemSize(image))),
+			StreamViewType:              aws.String(viewType),
+		},
+	}
+	if viewType == dynamodbstreams.StreamViewTypeNewImage || viewType == dynamodbstreams.StreamViewTypeNewAndOldImages {
+		record.Dynamodb.NewImage = cloneItem(w.new)
+	}
+	if viewType == dynamodbstreams.StreamViewTypeOldImage || viewType == dynamodbstreams.StreamViewTypeNewAndOldImages {
+		record.Dynamodb.OldImage = cloneItem(w.old)
+	}
+	sh := db.openShard(w.table)
+	sh.records = append(sh.records, record)
+	return []emitted{{aws.StringValue(w.table.desc.TableName), record}}
+}
+
+// validateValue reject values dynamodb would not store
+func validateValue(av *dynamodb.AttributeValue) error {
+	switch typeOf(av) {
+	case "":
+		return validationError("Supplied AttributeValue is empty, must contain exactly one of the supported datatypes")
+	case typeN:
+		n, ok := parseNumber(*av.N)
+		if !ok {
+			return validationError("A value provided cannot be converted into a number")
+		}
+		av.N = aws.String(formatNumber(n))
+	case typeSS, typeNS, typeBS:
+		elements := setElements(av)
+		if len(elements) == 0 {
+			return validationError("One or more parameter values were invalid: An %s may not be empty", typeOf(av))
+		}
+		if len(unique(elements)) != len(elements) {
+			return validationError("One or more parameter values were invalid: Input collection contains duplicates")
+		}
+		for i, n := range av.NS {
+			r, ok := parseNumber(*n)
+			if !ok {
+				return validationError("A value provided cannot be converted into a number")
+			}
+			av.NS[i] = aws.String(formatNumber(r))
+		}
+	case typeM:
+		for _, v := range av.M {
+			if err := validateValue(v); err != nil {
+				return err
+			}
+		}
+	case typeL:
+		for _, v := range av.L {
+			if err := validateValue(v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// validateItem check key attributes and values of the item to be stored, normalizing numbers
+func (t *table) validateItem(item map[string]*dynamodb.AttributeValue) error {
+	if err := t.validateKey(item, false); err != nil {
+		return err
+	}
+	for _, v := range item {
+		if err := validateValue(v); err != nil {
+			return err
+		}
+	}
+	for _, idx := range t.indexes {
+		for _, name := range []string{idx.hashKey, idx.rangeKey} {
+			if v, ok := item[name]; ok && name != "" && typeOf(v) != t.attrType(name) {
+				return validationError("One or more parameter values were invalid: Type mismatch for Index Key %s Expected: %s Actual: %s IndexName: %s", name, t.attrType(name), typeOf(v), idx.name)
+			}
+		}
+	}
+	if itemSize(item) > maxItemSize {
+		return validationError("Item size has exceeded the maximum allowed size")
+	}
+	return nil
+}
+
+// validateKey check the item has key attributes of declared types, with exact only key attributes are allowed
+func (t *table) validateKey(key map[string]*dynamodb.AttributeValue, exact bool) error {
+	for _, name := range []string{t.hashKey, t.rangeKey} {
+		if name == "" {
+			continue
+		}
+		v, ok := key[name]
+		if !ok {
+			return validationError("One of the required keys was not given a value")
+		}
+		if typeOf(v) != t.attrType(name) {
+			return validationError("One or more parameter values were invalid: Type mismatch for key %s expected: %s actual: %s", name, t.attrType(name), typeOf(v))
+		}
+		if (v.S != nil && *v.S == "") || (v.B != nil && len(v.B) == 0) {
+			return validationError("One or more parameter values are not valid. The AttributeValue for a key attribute cannot contain an empty string value. Key: %s", name)
+		}
+		if err := validateValue(v); err != nil {
+			return err
+		}
+	}
+	if exact && len(key) != len(t.keyAttrs(key)) {
+		return validationError("The provided key element does not match the schema")
+	}
+	return nil
+}
+
+// expressions of a single request sharing attribute names and values
+type expressions struct {
+	parser *parser
+	values map[string]*dynamodb.AttributeValue
+}
+
+func newExpressions(names map[string]*string, values map[string]*dynamodb.AttributeValue) *expressions {
+	return &expressions{parser: newParser(names, values), values: values}
+}
+
+// condition parse condition expression, nil when empty
+func (e *expressions) condition(expr *string) (condition, error) {
+	if aws.StringValue(expr) == "" {
+		return nil, nil
+	}
+	c, err := e.parser.parseCondition(*expr)
+	if err != nil {
+		return nil, validationError("Invalid ConditionExpression: %v", err)
+	}
+	return c, nil
+}
+
+// check evaluate condition against the item, nil condition always passes
+func (e *expressions) check(c condition, item map[string]*dynamodb.AttributeValue) (bool, error) {
+	if c == nil {
+		return true, nil
+	}
+	ok, err := (&evaluator{item: item, values: e.values}).eval(c)
+	if err != nil {
+		return false, validationError("%v", err)
+	}
+	return ok, nil
+}
+
+// done return error when some attribute names or values were not used by the expressions
+func (e *expressions) done() error {
+	if err := e.parser.checkUnused(); err != nil {
+		return validationError("%v", err)
+	}
+	return nil
+}
+
+// preparePut return change putting the item if the condition holds, db.mu must be held
+func (db *DB) preparePut(tableName *string, item map[string]*dynamodb.AttributeValue, cond *string, names map[string]*string, values map[string]*dynamodb.AttributeValue) (*write, error) {
+	t, err := db.table(tableName)
+	if err != nil {
+		return nil, err
+	}
+	item = cloneItem(item)
+	if err := t.validateItem(item); err != nil {
+		return nil, err
+	}
+	exprs := newExpressions(names, values)
+	c, err := exprs.condition(cond)
+	if err != nil {
+		return nil, err
+	}
+	if err := exprs.done(); err != nil {
+		return nil, err
+	}
+	key := t.keyOf(item)
+	old := t.items[key]
+	ok, err := exprs.check(c, old)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, conditionFailedError()
+	}
+	return &write{table: t, key: key, old: old, new: item}, nil
+}
+
+// prepareUpdate return change applying update expression to the item, creating it when missing
+func (db *DB) prepareUpdate(tableName *string, key map[string]*dynamodb.AttributeValue, update, cond *string, names map[string]*string, values map[string]*dynamodb.AttributeValue) (*write, []string, error) {
+	t, err := db.table(tableName)
+	if err != nil {
+		return nil, nil, err
+	}
+	key = cloneItem(key)
+	if err := t.validateKey(key, true); err != nil {
+		return nil, nil, err
+	}
+	exprs := newExpressions(names, values)
+	c, err := exprs.condition(cond)
+	if err != nil {
+		return nil, nil, err
+	}
+	var actions []updateAction
+	if aws.StringValue(update) != "" {
+		if actions, err = exprs.parser.parseUpdate(*update); err != nil {
+			return nil, nil, validationError("Invalid UpdateExpression: %v", err)
+		}
+	}
+	if err := exprs.done(); err != nil {
+		return nil, nil, err
+	}
+	storageKey := t.keyOf(key)
+	old := t.items[storageKey]
+	ok, err := exprs.check(c, old)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !ok {
+		return nil, nil, conditionFailedError()
+	}
+	item := cloneItem(old)
+	if item == nil {
+		item = key
+	}
+	var updated []string
+	for _, action := range actions {
+		name := action.path[0].name
+		if name == t.hashKey || name == t.rangeKey {
+			return nil, nil, validationError("One or more parameter values were invalid: Cannot update attribute %s. This attribute is part of the key", name)
+		}
+		updated = append(updated, name)
+	}
+	if err := applyUpdate(item, actions, values); err != nil {
+		return nil, nil, validationError("%v", err)
+	}
+	if err := t.validateItem(item); err != nil {
+		return nil, nil, err
+	}
+	return &write{table: t, key: storageKey, old: old, new: item}, updated, nil
+}
+
+// prepareDelete return change deleting the item if the condition holds
+func (db *DB) prepareDelete(tableName *string, key map[string]*dynamodb.AttributeValue, cond *string, names map[string]*string, values map[string]*dynamodb.AttributeValue) (*write, error) {
+	t, err := db.table(tableName)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.validateKey(key, true); err != nil {
+		return nil, err
+	}
+	exprs := newExpressions(names, values)
+	c, err := exprs.condition(cond)
+	if err != nil {
+		return nil, err
+	}
+	if err := exprs.done(); err != nil {
+		return nil, err
+	}
+	storageKey := t.keyOf(key)
+	old := t.items[storageKey]
+	ok, err := exprs.check(c, old)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, conditionFailedError()
+	}
+	return &write{table: t, key: storageKey, old: old}, nil
+}
+
+// readCapacity return capacity units consumed by reading given bytes
+func readCapacity(bytes int, consistent bool) float64 {
+	units := float64((bytes + 4095) / 4096)
+	if units == 0 {
+		units = 1
+	}
+	if !consistent {
+		units /= 2
+	}
+	return units
+}
+
+// writeCapacity return capacity units consumed by writing given item
+func writeCapacity(w *write) float64 {
+	bytes := itemSize(w.new)
+	if old := itemSize(w.old); old > bytes {
+		bytes = old
+	}
+	units := float64((bytes + 1023) / 1024)
+	if units == 0 {
+		units = 1
+	}
+	return units
+}
+
+// consumed return consumed capacity when it was requested
+func consumed(tableName *string, returnConsumed *string, units float64) *dynamodb.ConsumedCapacity {
+	if aws.StringValue(returnConsumed) == "" || aws.StringValue(returnConsumed) == dynamodb.ReturnConsumedCapacityNone {
+		return nil
+	}
+	return &dynamodb.ConsumedCapacity{
+		TableName:     tableName,
+		CapacityUnits: aws.Float64(units),
+		Table:         &dynamodb.Capacity{CapacityUnits: aws.Float64(units)},
+	}
+}
+
+// GetItem implements dynamodbiface.DynamoDBAPI
+func (db *DB) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	if err := db.fail("GetItem"); err != nil {
+		return nil, err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	t, err := db.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.validateKey(input.Key, true); err != nil {
+		return nil, err
+	}
+	exprs := newExpressions(input.ExpressionAttributeNames, nil)
+	var paths []path
+	if aws.StringValue(input.ProjectionExpression) != "" {
+		if paths, err = exprs.parser.parseProjection(*input.ProjectionExpression); err != nil {
+			return nil, validationError("Invalid ProjectionExpression: %v", err)
+		}
+	}
+	if err := exprs.done(); err != nil {
+		return nil, err
+	}
+	item := t.items[t.keyOf(input.Key)]
+	output := &dynamodb.GetItemOutput{
+		ConsumedCapacity: consumed(input.TableName, input.ReturnConsumedCapacity, readCapacity(itemSize(item), aws.BoolValue(input.ConsistentRead))),
+	}
+	if item != nil {
+		output.Item = cloneItem(item)
+		if paths != nil {
+			output.Item = project(item, paths)
+		}
+	}
+	return output, nil
+}
+
+// PutItem implements dynamodbiface.DynamoDBAPI
+func (db *DB) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	if err := db.fail("PutItem"); err != nil {
+		return nil, err
+	}
+	db.mu.Lock()
+	w, err := db.preparePut(input.TableName, input.Item, input.ConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+	if err != nil {
+		db.mu.Unlock()
+		return nil, err
+	}
+	records := db.commit(w)
+	db.mu.Unlock()
+	db.deliver(records)
+	output := &dynamodb.PutItemOutput{
+		ConsumedCapacity: consumed(input.TableName, input.ReturnConsumedCapacity, writeCapacity(w)),
+	}
+	switch aws.StringValue(input.ReturnValues) {
+	case "", dynamodb.ReturnValueNone:
+	case dynamodb.ReturnValueAllOld:
+		output.Attributes = cloneItem(w.old)
+	default:
+		return nil, validationError("ReturnValues can only be ALL_OLD or NONE")
+	}
+	return output, nil
+}
+
+// UpdateItem implements dynamodbiface.DynamoDBAPI
+func (db *DB) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	if err := db.fail("UpdateItem"); err != nil {
+		return nil, err
+	}
+	db.mu.Lock()
+	w, updated, err := db.prepareUpdate(input.TableName, input.Key, input.UpdateExpression, input.ConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+	if err != nil {
+		db.mu.Unlock()
+		return nil, err
+	}
+	records := db.commit(w)
+	db.mu.Unlock()
+	db.deliver(records)
+	output := &dynamodb.UpdateItemOutput{
+		ConsumedCapacity: consumed(input.TableName, input.ReturnConsumedCapacity, writeCapacity(w)),
+	}
+	pick := func(item map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue {
+		out := map[string]*dynamodb.AttributeValue{}
+		for _, name := range updated {
+			if v, ok := item[name]; ok {
+				out[name] = clone(v)
+			}
+		}
+		return out
+	}
+	switch aws.StringValue(input.ReturnValues) {
+	case "", dynamodb.ReturnValueNone:
+	case dynamodb.ReturnValueAllOld:
+		output.Attributes = cloneItem(w.old)
+	case dynamodb.ReturnValueAllNew:
+		output.Attributes = cloneItem(w.new)
+	case dynamodb.ReturnValueUpdatedOld:
+		output.Attributes = pick(w.old)
+	case dynamodb.ReturnValueUpdatedNew:
+		output.Attributes = pick(w.new)
+	}
+	return output, nil
+}
+
+// DeleteItem implements dynamodbiface.DynamoDBAPI
+func (db *DB) DeleteItem(input *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+	if err := db.fail("DeleteItem"); err != nil {
+		return nil, err
+	}
+	db.mu.Lock()
+	w, err := db.prepareDelete(input.TableName, input.Key, input.ConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+	if err != nil {
+		db.mu.Unlock()
+		return nil, err
+	}
+	records := db.commit(w)
+	db.mu.Unlock()
+	db.deliver(records)
+	output := &dynamodb.DeleteItemOutput{
+		ConsumedCapacity: consumed(input.TableName, input.ReturnConsumedCapacity, writeCapacity(w)),
+	}
+	if aws.StringValue(input.ReturnValues) == dynamodb.ReturnValueAllOld {
+		output.Attributes = cloneItem(w.old)
+	}
+	return output, nil
+}
+
+// source is the table or one of its indexes read by Query and Scan
+type source struct {
+	table             *table
+	index             *index
+	hashKey, rangeKey string
+}
+
+// source return table or index to read, db.mu must be held
+func (db *DB) source(tableName, indexName *string, consistentRead *bool) (*source, error) {
+	t, err := db.table(tableName)
+	if err != nil {
+		return nil, err
+	}
+	s := &source{table: t, hashKey: t.hashKey, rangeKey: t.rangeKey}
+	if aws.StringValue(indexName) != "" {
+		idx, ok := t.indexes[*indexName]
+		if !ok {
+			return nil, validationError("The table does not have the specified index: %s", *indexName)
+		}
+		if idx.global && aws.BoolValue(consistentRead) {
+			return nil, validationError("Consistent reads are not supported on global secondary indexes")
+		}
+		s.index, s.hashKey, s.rangeKey = idx, idx.hashKey, idx.rangeKey
+	}
+	return s, nil
+}
+
+// items return items of the source with index projection applied, sparse indexes skip
+// items without index keys
+func (s *source) items() []map[string]*dynamodb.AttributeValue {
+	var out []map[string]*dynamodb.AttributeValue
+	for _, item := range s.table.items {
+		if s.index == nil {
+			out = append(out, item)
+			continue
+		}
+		if item[s.hashKey] == nil || (s.rangeKey != "" && item[s.rangeKey] == nil) {
+			continue
+		}
+		out = append(out, s.project(item))
+	}
+	return out
+}
+
+// project return item as stored in the index
+func (s *source) project(item map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue {
+	projectionType := dynamodb.ProjectionTypeAll
+	if s.index.projection != nil {
+		projectionType = aws.StringValue(s.index.projection.ProjectionType)
+	}
+	if projectionType == dynamodb.ProjectionTypeAll {
+		return item
+	}
+	out := s.lastKey(item)
+	if projectionType == dynamodb.ProjectionTypeInclude {
+		for _, name := range s.index.projection.NonKeyAttributes {
+			if v, ok := item[aws.StringValue(name)]; ok {
+				out[aws.StringValue(name)] = v
+			}
+		}
+	}
+	return out
+}
+
+// lastKey return LastEvaluatedKey of the item, index reads include table key too
+func (s *source) lastKey(item map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue {
+	key := s.table.keyAttrs(item)
+	if s.index != nil {
+		key[s.hashKey] = clone(item[s.hashKey])
+		if s.rangeKey != "" {
+			key[s.rangeKey] = clone(item[s.rangeKey])
+		}
+	}
+	return key
+}
+
+// less order items by range key then by table key, the order of Query results
+func (s *source) less(a, b map[string]*dynamodb.AttributeValue) bool {
+	if s.rangeKey != "" {
+		if c, ok := compare(a[s.rangeKey], b[s.rangeKey]); ok && c != 0 {
+			return c < 0
+		}
+	}
+	return s.table.keyOf(a) < s.table.keyOf(b)
+}
+
+// page collect one page of items following the start key, up to limit evaluated items
+// or 1MB of data. It returns matched items, number of evaluated items and the last evaluated key.
+func page(s *source, sorted []map[string]*dynamodb.AttributeValue, startKey map[string]*dynamodb.AttributeValue, limit int64, less func(a, b map[string]*dynamodb.AttributeValue) bool, match func(map[string]*dynamodb.AttributeValue) (bool, error)) ([]map[string]*dynamodb.AttributeValue, int64, map[string]*dynamodb.AttributeValue, error) {
+	start := 0
+	if startKey != nil {
+		start = sort.Search(len(sorted), func(i int) bool {
+			return less(startKey, sorted[i])
+		})
+	}
+	var (
+		out     []map[string]*dynamodb.AttributeValue
+		scanned int64
+		bytes   int
+	)
+	for i := start; i < len(sorted); i++ {
+		item := sorted[i]
+		scanned++
+		bytes += itemSize(item)
+		ok, err := match(item)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		if ok {
+			out = append(out, item)
+		}
+		if (limit > 0 && scanned == limit) || bytes >= maxPageSize {
+			if i+1 < len(sorted) || limit > 0 {
+				return out, scanned, s.lastKey(item), nil
+			}
+		}
+	}
+	return out, scanned, nil, nil
+}
+
+// Query implements dynamodbiface.DynamoDBAPI
+func (db *DB) Query(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+	if err := db.fail("Query"); err != nil {
+		return nil, err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	s, err := db.source(input.TableName, input.IndexName, input.ConsistentRead)
+	if err != nil {
+		return nil, err
+	}
+	if aws.StringValue(input.KeyConditionExpression) == "" {
+		return nil, validationError("Either the KeyConditions or KeyConditionExpression parameter must be specified in the request")
+	}
+	exprs := newExpressions(input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+	keyCond, err := exprs.parser.parseCondition(*input.KeyConditionExpression)
+	if err != nil {
+		return nil, validationError("Invalid KeyConditionExpression: %v", err)
+	}
+	if err := s.validateKeyCondition(keyCond); err != nil {
+		return nil, err
+	}
+	filter, err := exprs.condition(input.FilterExpression)
+	if err != nil {
+		return nil, err
+	}
+	var paths []path
+	if aws.StringValue(input.ProjectionExpression) != "" {
+		if paths, err = exprs.parser.parseProjection(*input.ProjectionExpression); err != nil {
+			return nil, validationError("Invalid ProjectionExpression: %v", err)
+		}
+	}
+	if err := exprs.done(); err != nil {
+		return nil, err
+	}
+	var candidates []map[string]*dynamodb.AttributeValue
+	for _, item := range s.items() {
+		ok, err := exprs.check(keyCond, item)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			candidates = append(candidates, item)
+		}
+	}
+	less := s.less
+	if input.ScanIndexForward != nil && !*input.ScanIndexForward {
+		less = func(a, b map[string]*dynamodb.AttributeValue) bool { return s.less(b, a) }
+	}
+	sort.Slice(candidates, func(i, j int) bool { return less(candidates[i], candidates[j]) })
+	items, scanned, lastKey, err := page(s, candidates, input.ExclusiveStartKey, aws.Int64Value(input.Limit), less, func(item map[string]*dynamodb.AttributeValue) (bool, error) {
+		return exprs.check(filter, item)
+	})
+	if err != nil {
+		return nil, err
+	}
+	output := &dynamodb.QueryOutput{
+		Count:            aws.Int64(int64(len(items))),
+		ScannedCount:     aws.Int64(scanned),
+		LastEvaluatedKey: lastKey,
+		ConsumedCapacity: consumed(input.TableName, input.ReturnConsumedCapacity, readCapacity(totalSize(items), aws.BoolValue(input.ConsistentRead))),
+	}
+	if aws.StringValue(input.Select) != dynamodb.SelectCount {
+		output.Items = projectAll(items, paths)
+	}
+	return output, nil
+}
+
+// validateKeyCondition check key condition uses equality on the hash key and at most
+// one condition on the range key
+func (s *source) validateKeyCondition(c condition) error {
+	var conds []condition
+	var split func(c condition) error
+	split = func(c condition) error {
+		switch c := c.(type) {
+		case *andCond:
+			if err := split(c.l); err != nil {
+				return err
+			}
+			return split(c.r)
+		case *orCond, *notCond, *inCond:
+			return validationError("Invalid operator used in KeyConditionExpression")
+		}
+		conds = append(conds, c)
+		return nil
+	}
+	if err := split(c); err != nil {
+		return err
+	}
+	hashFound := false
+	for _, c := range conds {
+		var target operand
+		switch c := c.(type) {
+		case *compareCond:
+			if c.op == "<>" {
+				return validationError("Unsupported operator on KeyConditionExpression: operator: <>")
+			}
+			target = c.l
+			if c.op == "=" && keyName(target) == s.hashKey {
+				hashFound = true
+				continue
+			}
+		case *betweenCond:
+			target = c.v
+		case *funcCond:
+			if c.name != "begins_with" {
+				return validationError("Invalid KeyConditionExpression: Invalid function name; function: %s", c.name)
+			}
+			target = c.args[0]
+		}
+		if name := keyName(target); name != s.rangeKey || name == "" {
+			return validationError("Query condition missed key schema element: %s", s.hashKey)
+		}
+	}
+	if !hashFound {
+		return validationError("Query condition missed key schema element: %s", s.hashKey)
+	}
+	if len(conds) > 2 {
+		return validationError("KeyConditionExpressions must only contain one condition per key")
+	}
+	return nil
+}
+
+// keyName return attribute name of top level path operand
+func keyName(op operand) string {
+	if p, ok := op.(*pathOperand); ok && len(p.path) == 1 {
+		return p.path[0].name
+	}
+	return ""
+}
+
+func totalSize(items []map[string]*dynamodb.AttributeValue) int {
+	total := 0
+	for _, item := range items {
+		total += itemSize(item)
+	}
+	return total
+}
+
+// projectAll return copies of items with projection applied
+func projectAll(items []map[string]*dynamodb.AttributeValue, paths []path) []map[string]*dynamodb.AttributeValue {
+	out := make([]map[string]*dynamodb.AttributeValue, 0, len(items))
+	for _, item := range items {
+		if paths != nil {
+			out = append(out, project(item, paths))
+		} else {
+			out = append(out, cloneItem(item))
+		}
+	}
+	return out
+}
+
+// segmentOf return parallel scan segment of the item
+func segmentOf(s *source, item map[string]*dynamodb.AttributeValue, total int64) int64 {
+	h := uint32(2166136261)
+	for _, c := range []byte(keyString(item, s.hashKey)) {
+		h = (h ^ uint32(c)) * 16777619
+	}
+	return int64(h) % total
+}
+
+// Scan implements dynamodbiface.DynamoDBAPI
+func (db *DB) Scan(input *dynamodb.ScanInput) (*dynamodb.ScanOutput, error) {
+	if err := db.fail("Scan"); err != nil {
+		return nil, err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	s, err := db.source(input.TableName, input.IndexName, input.ConsistentRead)
+	if err != nil {
+		return nil, err
+	}
+	total := aws.Int64Value(input.TotalSegments)
+	if (input.Segment != nil) != (input.TotalSegments != nil) || (total > 0 && aws.Int64Value(input.Segment) >= total) {
+		return nil, validationError("The Segment parameter is required but was not present in the request when parameter TotalSegments is present")
+	}
+	exprs := newExpressions(input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+	filter, err := exprs.condition(input.FilterExpression)
+	if err != nil {
+		return nil, err
+	}
+	var paths []path
+	if aws.StringValue(input.ProjectionExpression) != "" {
+		if paths, err = exprs.parser.parseProjection(*input.ProjectionExpression); err != nil {
+			return nil, validationError("Invalid ProjectionExpression: %v", err)
+		}
+	}
+	if err := exprs.done(); err != nil {
+		return nil, err
+	}
+	var candidates []map[string]*dynamodb.AttributeValue
+	for _, item := range s.items() {
+		if total > 0 && segmentOf(s, item, total) != aws.Int64Value(input.Segment) {
+			continue
+		}
+		candidates = append(candidates, item)
+	}
+	// scan order is stable but unrelated to range keys, like in dynamodb
+	less := func(a, b map[string]*dynamodb.AttributeValue) bool {
+		return keyString(a, s.hashKey, s.rangeKey)+s.table.keyOf(a) < keyString(b, s.hashKey, s.rangeKey)+s.table.keyOf(b)
+	}
+	sort.Slice(candidates, func(i, j int) bool { return less(candidates[i], candidates[j]) })
+	items, scanned, lastKey, err := page(s, candidates, input.ExclusiveStartKey, aws.Int64Value(input.Limit), less, func(item map[string]*dynamodb.AttributeValue) (bool, error) {
+		return exprs.check(filter, item)
+	})
+	if err != nil {
+		return nil, err
+	}
+	output := &dynamodb.ScanOutput{
+		Count:            aws.Int64(int64(len(items))),
+		ScannedCount:     aws.Int64(scanned),
+		LastEvaluatedKey: lastKey,
+		ConsumedCapacity: consumed(input.TableName, input.ReturnConsumedCapacity, readCapacity(totalSize(items), aws.BoolValue(input.ConsistentRead))),
+	}
+	if aws.StringValue(input.Select) != dynamodb.SelectCount {
+		output.Items = projectAll(items, paths)
+	}
+	return output, nil
+}
+
+// BatchGetItem implements dynamodbiface.DynamoDBAPI, all keys are always processed
+func (db *DB) BatchGetItem(input *dynamodb.BatchGetItemInput) (*dynamodb.BatchGetItemOutput, error) {
+	if err := db.fail("BatchGetItem"); err != nil {
+		return nil, err
+	}
+	count := 0
+	for _, keys := range input.RequestItems {
+		count += len(keys.Keys)
+	}
+	if count > 100 {
+		return nil, validationError("Too many items requested for the BatchGetItem call")
+	}
+	output := &dynamodb.BatchGetItemOutput{
+		Responses:       map[string][]map[string]*dynamodb.AttributeValue{},
+		UnprocessedKeys: map[string]*dynamodb.KeysAndAttributes{},
+	}
+	for tableName, keys := range input.RequestItems {
+		seen := map[string]bool{}
+		for _, key := range keys.Keys {
+			if k := keyString(key, sortedNames(key)...); seen[k] {
+				return nil, validationError("Provided list of item keys contains duplicates")
+			} else {
+				seen[k] = true
+			}
+			got, err := db.GetItem(&dynamodb.GetItemInput{
+				TableName:                aws.String(tableName),
+				Key:                      key,
+				ConsistentRead:           keys.ConsistentRead,
+				ProjectionExpression:     keys.ProjectionExpression,
+				ExpressionAttributeNames: keys.ExpressionAttributeNames,
+			})
+			if err != nil {
+				return nil, err
+			}
+			if got.Item != nil {
+				output.Responses[tableName] = append(output.Responses[tableName], got.Item)
+			}
+		}
+	}
+	return output, nil
+}
+
+func sortedNames(item map[string]*dynamodb.AttributeValue) []string {
+	names := make([]string, 0, len(item))
+	for name := range item {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// BatchWriteItem implements dynamodbiface.DynamoDBAPI, all requests are always processed
+func (db *DB) BatchWriteItem(input *dynamodb.BatchWriteItemInput) (*dynamodb.BatchWriteItemOutput, error) {
+	if err := db.fail("BatchWriteItem"); err != nil {
+		return nil, err
+	}
+	count := 0
+	for _, reqs := range input.RequestItems {
+		count += len(reqs)
+	}
+	if count > 25 {
+		return nil, validationError("Too many items requested for the BatchWriteItem call")
+	}
+	db.mu.Lock()
+	var writes []*write
+	seen := map[string]bool{}
+	for tableName, reqs := range input.RequestItems {
+		for _, req := range reqs {
+			var (
+				w   *write
+				err error
+			)
+			switch {
+			case req.PutRequest != nil:
+				w, err = db.preparePut(aws.String(tableName), req.PutRequest.Item, nil, nil, nil)
+			case req.DeleteRequest != nil:
+				w, err = db.prepareDelete(aws.String(tableName), req.DeleteRequest.Key, nil, nil, nil)
+			default:
+				err = validationError("Supplied AttributeValue has neither PutRequest nor DeleteRequest")
+			}
+			if err != nil {
+				db.mu.Unlock()
+				return nil, err
+			}
+			if seen[tableName+"/"+w.key] {
+				db.mu.Unlock()
+				return nil, validationError("Provided list of item keys contains duplicates")
+			}
+			seen[tableName+"/"+w.key] = true
+			writes = append(writes, w)
+		}
+	}
+	var records []emitted
+	for _, w := range writes {
+		records = append(records, db.commit(w)...)
+	}
+	db.mu.Unlock()
+	db.deliver(records)
+	return &dynamodb.BatchWriteItemOutput{
+		UnprocessedItems: map[string][]*dynamodb.WriteRequest{},
+	}, nil
+}
+
+// TransactWriteItems implements dynamodbiface.DynamoDBAPI. All conditions are checked
+// before anything is written; when any fails the transaction is canceled with a reason per item.
+func (db *DB) TransactWriteItems(input *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+	if err := db.fail("TransactWriteItems"); err != nil {
+		return nil, err
+	}
+	if len(input.TransactItems) == 0 || len(input.TransactItems) > maxTransactItems {
+		return nil, validationError("Member must have length less than or equal to %d", maxTransactItems)
+	}
+	db.mu.Lock()
+	now := time.Now()
+	if token := aws.StringValue(input.ClientRequestToken); token != "" {
+		if at, ok := db.tokens[token]; ok && now.Sub(at) < transactTokenTTL {
+			db.mu.Unlock()
+			return &dynamodb.TransactWriteItemsOutput{}, nil
+		}
+	}
+	var (
+		writes  []*write
+		reasons = make([]string, len(input.TransactItems))
+		failed  bool
+		seen    = map[string]bool{}
+	)
+	for i, item := range input.TransactItems {
+		var (
+			w         *write
+			err       error
+			tableName *string
+		)
+		switch {
+		case item.ConditionCheck != nil:
+			c := item.ConditionCheck
+			tableName = c.TableName
+			// a condition check is a delete which is never committed
+			w, err = db.prepareDelete(c.TableName, c.Key, c.ConditionExpression, c.ExpressionAttributeNames, c.ExpressionAttributeValues)
+			if w != nil {
+				w = &write{table: w.table, key: w.key}
+			}
+		case item.Put != nil:
+			p := item.Put
+			tableName = p.TableName
+			w, err = db.preparePut(p.TableName, p.Item, p.ConditionExpression, p.ExpressionAttributeNames, p.ExpressionAttributeValues)
+		case item.Update != nil:
+			u := item.Update
+			tableName = u.TableName
+			w, _, err = db.prepareUpdate(u.TableName, u.Key, u.UpdateExpression, u.ConditionExpression, u.ExpressionAttributeNames, u.ExpressionAttributeValues)
+		case item.Delete != nil:
+			d := item.Delete
+			tableName = d.TableName
+			w, err = db.prepareDelete(d.TableName, d.Key, d.ConditionExpression, d.ExpressionAttributeNames, d.ExpressionAttributeValues)
+		default:
+			db.mu.Unlock()
+			return nil, validationError("TransactItems can only contain one of Check, Put, Update or Delete")
+		}
+		reasons[i] = "None"
+		if aerr, ok := err.(awserr.Error); ok {
+			switch aerr.Code() {
+			case dynamodb.ErrCodeConditionalCheckFailedException:
+				reasons[i] = "ConditionalCheckFailed"
+				failed = true
+				continue
+			case errCodeValidation:
+				reasons[i] = "ValidationError"
+				failed = true
+				continue
+			}
+		}
+		if err != nil {
+			db.mu.Unlock()
+			return nil, err
+		}
+		id := aws.StringValue(tableName) + "/" + w.key
+		if seen[id] {
+			db.mu.Unlock()
+			return nil, validationError("Transaction request cannot include multiple operations on one item")
+		}
+		seen[id] = true
+		writes = append(writes, w)
+	}
+	if failed {
+		db.mu.Unlock()
+		return nil, awserr.New(dynamodb.ErrCodeTransactionCanceledException,
+			"Transaction cancelled, please refer cancellation reasons for specific reasons ["+strings.Join(reasons, ", ")+"]", nil)
+	}
+	var records []emitted
+	for _, w := range writes {
+		if w.old == nil && w.new == nil {
+			continue
+		}
+		records = append(records, db.commit(w)...)
+	}
+	if token := aws.StringValue(input.ClientRequestToken); token != "" {
+		db.tokens[token] = now
+	}
+	db.mu.Unlock()
+	db.deliver(records)
+	return &dynamodb.TransactWriteItemsOutput{}, nil
+}
+
+// TransactGetItems implements dynamodbiface.DynamoDBAPI, items are read at once under a single lock
+func (db *DB) TransactGetItems(input *dynamodb.TransactGetItemsInput) (*dynamodb.TransactGetItemsOutput, error) {
+	if err := db.fail("TransactGetItems"); err != nil {
+		return nil, err
+	}
+	if len(input.TransactItems) == 0 || len(input.TransactItems) > maxTransactItems {
+		return nil, validationError("Member must have length less than or equal to %d", maxTransactItems)
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	output := &dynamodb.TransactGetItemsOutput{}
+	for _, item := range input.TransactItems {
+		get := item.Get
+		if get == nil {
+			return nil, validationError("TransactItems can only contain Get")
+		}
+		t, err := db.table(get.TableName)
+		if err != nil {
+			return nil, err
+		}
+		if err := t.validateKey(get.Key, true); err != nil {
+			return nil, err
+		}
+		exprs := newExpressions(get.ExpressionAttributeNames, nil)
+		var paths []path
+		if aws.StringValue(get.ProjectionExpression) != "" {
+			if paths, err = exprs.parser.parseProjection(*get.ProjectionExpression); err != nil {
+				return nil, validationError("Invalid ProjectionExpression: %v", err)
+			}
+		}
+		if err := exprs.done(); err != nil {
+			return nil, err
+		}
+		response := &dynamodb.ItemResponse{}
+		if stored := t.items[t.keyOf(get.Key)]; stored != nil {
+			response.Item = cloneItem(stored)
+			if paths != nil {
+				response.Item = project(stored, paths)
+			}
+		}
+		output.Responses = append(output.Responses, response)
+	}
+	return output, nil
+}
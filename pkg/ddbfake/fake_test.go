@@ -0,0 +1,443 @@
+package ddbfake
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// newTable return db with table "events" keyed by id and n, indexed by status
+func newTable(t *testing.T) *DB {
+	t.Helper()
+	db := New()
+	_, err := db.CreateTable(&dynamodb.CreateTableInput{
+		TableName: aws.String("events"),
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{AttributeName: aws.String("id"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+			{AttributeName: aws.String("n"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeN)},
+			{AttributeName: aws.String("status"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+		},
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{AttributeName: aws.String("id"), KeyType: aws.String(dynamodb.KeyTypeHash)},
+			{AttributeName: aws.String("n"), KeyType: aws.String(dynamodb.KeyTypeRange)},
+		},
+		GlobalSecondaryIndexes: []*dynamodb.GlobalSecondaryIndex{{
+			IndexName: aws.String("status"),
+			KeySchema: []*dynamodb.KeySchemaElement{
+				{AttributeName: aws.String("status"), KeyType: aws.String(dynamodb.KeyTypeHash)},
+			},
+			Projection: &dynamodb.Projection{ProjectionType: aws.String(dynamodb.ProjectionTypeKeysOnly)},
+		}},
+		BillingMode: aws.String(dynamodb.BillingModePayPerRequest),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func event(id string, n int, attrs ...string) map[string]*dynamodb.AttributeValue {
+	item := map[string]*dynamodb.AttributeValue{
+		"id": {S: aws.String(id)},
+		"n":  {N: aws.String(fmt.Sprint(n))},
+	}
+	for i := 0; i+1 < len(attrs); i += 2 {
+		item[attrs[i]] = &dynamodb.AttributeValue{S: aws.String(attrs[i+1])}
+	}
+	return item
+}
+
+func key(id string, n int) map[string]*dynamodb.AttributeValue {
+	return event(id, n)
+}
+
+func errCode(err error) string {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code()
+	}
+	return ""
+}
+
+func putEvents(t *testing.T, db *DB, items ...map[string]*dynamodb.AttributeValue) {
+	t.Helper()
+	for _, item := range items {
+		if _, err := db.PutItem(&dynamodb.PutItemInput{TableName: aws.String("events"), Item: item}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPutGetDelete(t *testing.T) {
+	db := newTable(t)
+	putEvents(t, db, event("a", 1, "status", "Started"))
+	got, err := db.GetItem(&dynamodb.GetItemInput{TableName: aws.String("events"), Key: key("a", 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aws.StringValue(got.Item["status"].S) != "Started" {
+		t.Errorf("got %v", got.Item)
+	}
+	// returned items are copies
+	got.Item["status"].S = aws.String("changed")
+	got, _ = db.GetItem(&dynamodb.GetItemInput{TableName: aws.String("events"), Key: key("a", 1)})
+	if aws.StringValue(got.Item["status"].S) != "Started" {
+		t.Error("stored item was changed through a returned item")
+	}
+	out, err := db.PutItem(&dynamodb.PutItemInput{
+		TableName:    aws.String("events"),
+		Item:         event("a", 1, "status", "Completed"),
+		ReturnValues: aws.String(dynamodb.ReturnValueAllOld),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aws.StringValue(out.Attributes["status"].S) != "Started" {
+		t.Errorf("ALL_OLD returned %v", out.Attributes)
+	}
+	if _, err := db.DeleteItem(&dynamodb.DeleteItemInput{TableName: aws.String("events"), Key: key("a", 1)}); err != nil {
+		t.Fatal(err)
+	}
+	got, _ = db.GetItem(&dynamodb.GetItemInput{TableName: aws.String("events"), Key: key("a", 1)})
+	if got.Item != nil {
+		t.Errorf("deleted item was found: %v", got.Item)
+	}
+}
+
+func TestInvalidItems(t *testing.T) {
+	db := newTable(t)
+	tests := map[string]map[string]*dynamodb.AttributeValue{
+		"missing range key": {"id": {S: aws.String("a")}},
+		"wrong key type":    {"id": {S: aws.String("a")}, "n": {S: aws.String("1")}},
+		"too large":         event("a", 1, "payload", strings.Repeat("x", maxItemSize)),
+	}
+	for name, item := range tests {
+		_, err := db.PutItem(&dynamodb.PutItemInput{TableName: aws.String("events"), Item: item})
+		if errCode(err) != errCodeValidation {
+			t.Errorf("%s: got %v, want validation error", name, err)
+		}
+	}
+	_, err := db.GetItem(&dynamodb.GetItemInput{TableName: aws.String("missing"), Key: key("a", 1)})
+	if errCode(err) != dynamodb.ErrCodeResourceNotFoundException {
+		t.Errorf("got %v for missing table", err)
+	}
+}
+
+func TestConditionalWrites(t *testing.T) {
+	db := newTable(t)
+	notExists := &dynamodb.PutItemInput{
+		TableName:           aws.String("events"),
+		Item:                event("a", 1, "status", "Started"),
+		ConditionExpression: aws.String("attribute_not_exists(id)"),
+	}
+	if _, err := db.PutItem(notExists); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.PutItem(notExists); errCode(err) != dynamodb.ErrCodeConditionalCheckFailedException {
+		t.Errorf("second create: got %v", err)
+	}
+	update := &dynamodb.UpdateItemInput{
+		TableName:                 aws.String("events"),
+		Key:                       key("a", 1),
+		UpdateExpression:          aws.String("SET #s = :new"),
+		ConditionExpression:       aws.String("#s = :old"),
+		ExpressionAttributeNames:  map[string]*string{"#s": aws.String("status")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":old": {S: aws.String("Started")}, ":new": {S: aws.String("Completed")}},
+		ReturnValues:              aws.String(dynamodb.ReturnValueUpdatedNew),
+	}
+	out, err := db.UpdateItem(update)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Attributes) != 1 || aws.StringValue(out.Attributes["status"].S) != "Completed" {
+		t.Errorf("UPDATED_NEW returned %v", out.Attributes)
+	}
+	if _, err := db.UpdateItem(update); errCode(err) != dynamodb.ErrCodeConditionalCheckFailedException {
+		t.Errorf("stale update: got %v", err)
+	}
+	// an update may not change keys
+	_, err = db.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:                 aws.String("events"),
+		Key:                       key("a", 1),
+		UpdateExpression:          aws.String("SET id = :v"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":v": {S: aws.String("b")}},
+	})
+	if errCode(err) != errCodeValidation {
+		t.Errorf("key update: got %v", err)
+	}
+	_, err = db.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName:                 aws.String("events"),
+		Key:                       key("a", 1),
+		ConditionExpression:       aws.String("#s = :s"),
+		ExpressionAttributeNames:  map[string]*string{"#s": aws.String("status")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":s": {S: aws.String("Started")}},
+	})
+	if errCode(err) != dynamodb.ErrCodeConditionalCheckFailedException {
+		t.Errorf("conditional delete: got %v", err)
+	}
+}
+
+func TestTransactWriteItems(t *testing.T) {
+	db := newTable(t)
+	putEvents(t, db, event("a", 1, "status", "Started"))
+	put := func(id string) *dynamodb.TransactWriteItem {
+		return &dynamodb.TransactWriteItem{Put: &dynamodb.Put{TableName: aws.String("events"), Item: event(id, 1)}}
+	}
+	check := &dynamodb.TransactWriteItem{ConditionCheck: &dynamodb.ConditionCheck{
+		TableName:                 aws.String("events"),
+		Key:                       key("a", 1),
+		ConditionExpression:       aws.String("#s = :s"),
+		ExpressionAttributeNames:  map[string]*string{"#s": aws.String("status")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":s": {S: aws.String("Completed")}},
+	}}
+	_, err := db.TransactWriteItems(&dynamodb.TransactWriteItemsInput{TransactItems: []*dynamodb.TransactWriteItem{put("b"), check}})
+	if errCode(err) != dynamodb.ErrCodeTransactionCanceledException {
+		t.Fatalf("got %v, want canceled transaction", err)
+	}
+	if !strings.Contains(err.Error(), "[None, ConditionalCheckFailed]") {
+		t.Errorf("cancellation reasons missing: %v", err)
+	}
+	if got, _ := db.GetItem(&dynamodb.GetItemInput{TableName: aws.String("events"), Key: key("b", 1)}); got.Item != nil {
+		t.Error("canceled transaction wrote an item")
+	}
+	// the same item twice
+	_, err = db.TransactWriteItems(&dynamodb.TransactWriteItemsInput{TransactItems: []*dynamodb.TransactWriteItem{put("b"), put("b")}})
+	if errCode(err) != errCodeValidation {
+		t.Errorf("duplicate item: got %v", err)
+	}
+	var items []*dynamodb.TransactWriteItem
+	for i := 0; i <= maxTransactItems; i++ {
+		items = append(items, put(fmt.Sprint("item-", i)))
+	}
+	if _, err := db.TransactWriteItems(&dynamodb.TransactWriteItemsInput{TransactItems: items}); errCode(err) != errCodeValidation {
+		t.Errorf("%d items: got %v", len(items), err)
+	}
+	// a retried token is applied once
+	input := &dynamodb.TransactWriteItemsInput{
+		TransactItems: []*dynamodb.TransactWriteItem{{Update: &dynamodb.Update{
+			TableName:                 aws.String("events"),
+			Key:                       key("a", 1),
+			UpdateExpression:          aws.String("ADD visits :one"),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":one": {N: aws.String("1")}},
+		}}},
+		ClientRequestToken: aws.String("token"),
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := db.TransactWriteItems(input); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := db.TransactGetItems(&dynamodb.TransactGetItemsInput{TransactItems: []*dynamodb.TransactGetItem{
+		{Get: &dynamodb.Get{TableName: aws.String("events"), Key: key("a", 1)}},
+		{Get: &dynamodb.Get{TableName: aws.String("events"), Key: key("missing", 1)}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Responses) != 2 || got.Responses[1].Item != nil {
+		t.Fatalf("got %v", got.Responses)
+	}
+	if visits := aws.StringValue(got.Responses[0].Item["visits"].N); visits != "1" {
+		t.Errorf("visits = %s, want 1", visits)
+	}
+}
+
+func TestQueryPaging(t *testing.T) {
+	db := newTable(t)
+	for i := 0; i < 10; i++ {
+		putEvents(t, db, event("a", i))
+	}
+	putEvents(t, db, event("b", 0))
+	var (
+		got      []string
+		startKey map[string]*dynamodb.AttributeValue
+		pages    int
+	)
+	for {
+		out, err := db.Query(&dynamodb.QueryInput{
+			TableName:                 aws.String("events"),
+			KeyConditionExpression:    aws.String("id = :id AND n >= :from"),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":id": {S: aws.String("a")}, ":from": {N: aws.String("1")}},
+			ScanIndexForward:          aws.Bool(false),
+			Limit:                     aws.Int64(3),
+			ExclusiveStartKey:         startKey,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages++
+		for _, item := range out.Items {
+			got = append(got, aws.StringValue(item["n"].N))
+		}
+		if startKey = out.LastEvaluatedKey; startKey == nil {
+			break
+		}
+	}
+	if want := "9 8 7 6 5 4 3 2 1"; strings.Join(got, " ") != want {
+		t.Errorf("got %v, want %s", got, want)
+	}
+	// a full last page still returns a key, like dynamodb
+	if pages != 4 {
+		t.Errorf("got %d pages, want 4", pages)
+	}
+	_, err := db.Query(&dynamodb.QueryInput{
+		TableName:                 aws.String("events"),
+		KeyConditionExpression:    aws.String("n = :n"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":n": {N: aws.String("1")}},
+	})
+	if errCode(err) != errCodeValidation {
+		t.Errorf("query without hash key: got %v", err)
+	}
+}
+
+func TestQueryIndex(t *testing.T) {
+	db := newTable(t)
+	putEvents(t, db, event("a", 1, "status", "Started", "note", "x"), event("b", 1, "status", "Completed"), event("c", 1))
+	out, err := db.Query(&dynamodb.QueryInput{
+		TableName:                 aws.String("events"),
+		IndexName:                 aws.String("status"),
+		KeyConditionExpression:    aws.String("#s = :s"),
+		ExpressionAttributeNames:  map[string]*string{"#s": aws.String("status")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":s": {S: aws.String("Started")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Items) != 1 {
+		t.Fatalf("got %v", out.Items)
+	}
+	// keys only projection
+	if _, ok := out.Items[0]["note"]; ok || len(out.Items[0]) != 3 {
+		t.Errorf("index returned %v", out.Items[0])
+	}
+	// items without the index key are not in the index
+	scan, err := db.Scan(&dynamodb.ScanInput{TableName: aws.String("events"), IndexName: aws.String("status")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aws.Int64Value(scan.Count) != 2 {
+		t.Errorf("index scan returned %d items, want 2", aws.Int64Value(scan.Count))
+	}
+	_, err = db.Query(&dynamodb.QueryInput{
+		TableName:                 aws.String("events"),
+		IndexName:                 aws.String("status"),
+		ConsistentRead:            aws.Bool(true),
+		KeyConditionExpression:    aws.String("#s = :s"),
+		ExpressionAttributeNames:  map[string]*string{"#s": aws.String("status")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":s": {S: aws.String("Started")}},
+	})
+	if errCode(err) != errCodeValidation {
+		t.Errorf("consistent read of global index: got %v", err)
+	}
+}
+
+func TestScanPagingAndSegments(t *testing.T) {
+	db := newTable(t)
+	// large items fill a 1MB page before the limit is reached
+	payload := strings.Repeat("x", 300*1024)
+	for i := 0; i < 8; i++ {
+		putEvents(t, db, event(fmt.Sprint("item-", i), 0, "payload", payload))
+	}
+	seen := map[string]bool{}
+	for segment := int64(0); segment < 3; segment++ {
+		var startKey map[string]*dynamodb.AttributeValue
+		for {
+			out, err := db.Scan(&dynamodb.ScanInput{
+				TableName:         aws.String("events"),
+				Segment:           aws.Int64(segment),
+				TotalSegments:     aws.Int64(3),
+				FilterExpression:  aws.String("attribute_exists(payload)"),
+				ExclusiveStartKey: startKey,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if aws.Int64Value(out.ScannedCount) > 4 {
+				t.Errorf("page of %d items exceeds 1MB", aws.Int64Value(out.ScannedCount))
+			}
+			for _, item := range out.Items {
+				id := aws.StringValue(item["id"].S)
+				if seen[id] {
+					t.Errorf("%s returned twice", id)
+				}
+				seen[id] = true
+			}
+			if startKey = out.LastEvaluatedKey; startKey == nil {
+				break
+			}
+		}
+	}
+	if len(seen) != 8 {
+		t.Errorf("segments returned %d items, want 8", len(seen))
+	}
+	_, err := db.Scan(&dynamodb.ScanInput{TableName: aws.String("events"), Segment: aws.Int64(3), TotalSegments: aws.Int64(3)})
+	if errCode(err) != errCodeValidation {
+		t.Errorf("segment out of range: got %v", err)
+	}
+	out, err := db.Scan(&dynamodb.ScanInput{TableName: aws.String("events"), Select: aws.String(dynamodb.SelectCount), Limit: aws.Int64(2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Items != nil || aws.Int64Value(out.Count) != 2 || out.LastEvaluatedKey == nil {
+		t.Errorf("count scan returned %d items, count %d, key %v", len(out.Items), aws.Int64Value(out.Count), out.LastEvaluatedKey)
+	}
+}
+
+func TestBatchLimits(t *testing.T) {
+	db := newTable(t)
+	var writes []*dynamodb.WriteRequest
+	for i := 0; i < 26; i++ {
+		writes = append(writes, &dynamodb.WriteRequest{PutRequest: &dynamodb.PutRequest{Item: event("a", i)}})
+	}
+	_, err := db.BatchWriteItem(&dynamodb.BatchWriteItemInput{RequestItems: map[string][]*dynamodb.WriteRequest{"events": writes}})
+	if errCode(err) != errCodeValidation {
+		t.Errorf("26 writes: got %v", err)
+	}
+	out, err := db.BatchWriteItem(&dynamodb.BatchWriteItemInput{RequestItems: map[string][]*dynamodb.WriteRequest{"events": writes[:25]}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out.UnprocessedItems) != 0 {
+		t.Errorf("unprocessed items %v", out.UnprocessedItems)
+	}
+	dup := []*dynamodb.WriteRequest{writes[0], {DeleteRequest: &dynamodb.DeleteRequest{Key: key("a", 0)}}}
+	_, err = db.BatchWriteItem(&dynamodb.BatchWriteItemInput{RequestItems: map[string][]*dynamodb.WriteRequest{"events": dup}})
+	if errCode(err) != errCodeValidation {
+		t.Errorf("duplicate writes: got %v", err)
+	}
+	var keys []map[string]*dynamodb.AttributeValue
+	for i := 0; i < 101; i++ {
+		keys = append(keys, key("a", i))
+	}
+	_, err = db.BatchGetItem(&dynamodb.BatchGetItemInput{RequestItems: map[string]*dynamodb.KeysAndAttributes{"events": {Keys: keys}}})
+	if errCode(err) != errCodeValidation {
+		t.Errorf("101 keys: got %v", err)
+	}
+	got, err := db.BatchGetItem(&dynamodb.BatchGetItemInput{RequestItems: map[string]*dynamodb.KeysAndAttributes{"events": {Keys: keys[:100]}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(got.Responses["events"]); n != 25 {
+		t.Errorf("got %d items, want 25", n)
+	}
+}
+
+func TestFail(t *testing.T) {
+	db := newTable(t)
+	db.Fail = func(op string) error {
+		if op == "PutItem" {
+			return awserr.New(dynamodb.ErrCodeProvisionedThroughputExceededException, "throttled", nil)
+		}
+		return nil
+	}
+	_, err := db.PutItem(&dynamodb.PutItemInput{TableName: aws.String("events"), Item: event("a", 1)})
+	if errCode(err) != dynamodb.ErrCodeProvisionedThroughputExceededException {
+		t.Errorf("got %v", err)
+	}
+	if _, err := db.GetItem(&dynamodb.GetItemInput{TableName: aws.String("events"), Key: key("a", 1)}); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,246 @@
+package ddbfake
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams/dynamodbstreamsiface"
+)
+
+// maxGetRecords is the dynamodb streams limit of records returned by a single GetRecords call
+const maxGetRecords = 1000
+
+// shard of a table stream, records are appended to the last open shard of the table
+type shard struct {
+	id, parent string
+	records    []*dynamodbstreams.Record
+	closed     bool
+}
+
+// openShard return shard receiving new records of the table, db.mu must be held
+func (db *DB) openShard(t *table) *shard {
+	if n := len(t.shards); n > 0 && !t.shards[n-1].closed {
+		return t.shards[n-1]
+	}
+	db.sequence++
+	sh := &shard{id: fmt.Sprintf("shardId-%020d-%08x", db.sequence, len(t.shards))}
+	if n := len(t.shards); n > 0 {
+		sh.parent = t.shards[n-1].id
+	}
+	t.shards = append(t.shards, sh)
+	return sh
+}
+
+// SplitShard close the shard receiving records of the table stream and open its child,
+// like dynamodb does when it rolls shards over
+func (db *DB) SplitShard(tableName string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	t, err := db.table(aws.String(tableName))
+	if err != nil {
+		return err
+	}
+	if t.streamViewType() == "" {
+		return validationError("Table %s has no enabled stream", tableName)
+	}
+	db.openShard(t).closed = true
+	db.openShard(t)
+	return nil
+}
+
+// Streams return dynamodb streams client reading stream records of tables of db
+func (db *DB) Streams() *Streams {
+	return &Streams{db: db}
+}
+
+// Streams is an in-memory DynamoDB Streams serving records written to tables of a DB.
+// Operations the fake doesn't implement panic through the embedded nil interface.
+type Streams struct {
+	dynamodbstreamsiface.DynamoDBStreamsAPI
+
+	db *DB
+}
+
+// streamTable return table of the stream arn, db.mu must be held
+func (s *Streams) streamTable(streamArn *string) (*table, error) {
+	for _, t := range s.db.tables {
+		if t.desc.LatestStreamArn != nil && *t.desc.LatestStreamArn == aws.StringValue(streamArn) {
+			return t, nil
+		}
+	}
+	return nil, awserr.New(dynamodbstreams.ErrCodeResourceNotFoundException, "Requested resource not found: Stream: "+aws.StringValue(streamArn)+" not found", nil)
+}
+
+// shard return shard of the stream by id, db.mu must be held
+func (s *Streams) shard(streamArn, shardID *string) (*shard, error) {
+	t, err := s.streamTable(streamArn)
+	if err != nil {
+		return nil, err
+	}
+	for _, sh := range t.shards {
+		if sh.id == aws.StringValue(shardID) {
+			return sh, nil
+		}
+	}
+	return nil, awserr.New(dynamodbstreams.ErrCodeResourceNotFoundException, "Requested resource not found: Shard: "+aws.StringValue(shardID)+" not found", nil)
+}
+
+// ListStreams implements dynamodbstreamsiface.DynamoDBStreamsAPI
+func (s *Streams) ListStreams(input *dynamodbstreams.ListStreamsInput) (*dynamodbstreams.ListStreamsOutput, error) {
+	if err := s.db.fail("ListStreams"); err != nil {
+		return nil, err
+	}
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	output := &dynamodbstreams.ListStreamsOutput{}
+	for name, t := range s.db.tables {
+		if t.desc.LatestStreamArn == nil || (input.TableName != nil && *input.TableName != name) {
+			continue
+		}
+		output.Streams = append(output.Streams, &dynamodbstreams.Stream{
+			StreamArn:   t.desc.LatestStreamArn,
+			StreamLabel: t.desc.LatestStreamLabel,
+			TableName:   aws.String(name),
+		})
+	}
+	sort.Slice(output.Streams, func(i, j int) bool {
+		return *output.Streams[i].StreamArn < *output.Streams[j].StreamArn
+	})
+	return output, nil
+}
+
+// DescribeStream implements dynamodbstreamsiface.DynamoDBStreamsAPI
+func (s *Streams) DescribeStream(input *dynamodbstreams.DescribeStreamInput) (*dynamodbstreams.DescribeStreamOutput, error) {
+	if err := s.db.fail("DescribeStream"); err != nil {
+		return nil, err
+	}
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	t, err := s.streamTable(input.StreamArn)
+	if err != nil {
+		return nil, err
+	}
+	status := dynamodbstreams.StreamStatusEnabled
+	if t.streamViewType() == "" {
+		status = dynamodbstreams.StreamStatusDisabled
+	}
+	desc := &dynamodbstreams.StreamDescription{
+		StreamArn:               t.desc.LatestStreamArn,
+		StreamLabel:             t.desc.LatestStreamLabel,
+		StreamStatus:            aws.String(status),
+		StreamViewType:          t.desc.StreamSpecification.StreamViewType,
+		TableName:               t.desc.TableName,
+		KeySchema:               t.desc.KeySchema,
+		CreationRequestDateTime: t.desc.CreationDateTime,
+	}
+	started := input.ExclusiveStartShardId == nil
+	limit := int(aws.Int64Value(input.Limit))
+	for _, sh := range t.shards {
+		if !started {
+			started = sh.id == *input.ExclusiveStartShardId
+			continue
+		}
+		if limit > 0 && len(desc.Shards) == limit {
+			desc.LastEvaluatedShardId = desc.Shards[limit-1].ShardId
+			break
+		}
+		seqRange := &dynamodbstreams.SequenceNumberRange{}
+		if len(sh.records) > 0 {
+			seqRange.StartingSequenceNumber = sh.records[0].Dynamodb.SequenceNumber
+			if sh.closed {
+				seqRange.EndingSequenceNumber = sh.records[len(sh.records)-1].Dynamodb.SequenceNumber
+			}
+		}
+		shard := &dynamodbstreams.Shard{ShardId: aws.String(sh.id), SequenceNumberRange: seqRange}
+		if sh.parent != "" {
+			shard.ParentShardId = aws.String(sh.parent)
+		}
+		desc.Shards = append(desc.Shards, shard)
+	}
+	return &dynamodbstreams.DescribeStreamOutput{StreamDescription: desc}, nil
+}
+
+// iterator encode position within a shard as shard iterator
+func iterator(streamArn, shardID string, position int) *string {
+	return aws.String(fmt.Sprintf("%s|%s|%d", streamArn, shardID, position))
+}
+
+// GetShardIterator implements dynamodbstreamsiface.DynamoDBStreamsAPI
+func (s *Streams) GetShardIterator(input *dynamodbstreams.GetShardIteratorInput) (*dynamodbstreams.GetShardIteratorOutput, error) {
+	if err := s.db.fail("GetShardIterator"); err != nil {
+		return nil, err
+	}
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	sh, err := s.shard(input.StreamArn, input.ShardId)
+	if err != nil {
+		return nil, err
+	}
+	seq := aws.StringValue(input.SequenceNumber)
+	position := 0
+	switch aws.StringValue(input.ShardIteratorType) {
+	case dynamodbstreams.ShardIteratorTypeTrimHorizon:
+	case dynamodbstreams.ShardIteratorTypeLatest:
+		position = len(sh.records)
+	case dynamodbstreams.ShardIteratorTypeAtSequenceNumber, dynamodbstreams.ShardIteratorTypeAfterSequenceNumber:
+		if seq == "" {
+			return nil, validationError("Sequence number is required for iterator type %s", *input.ShardIteratorType)
+		}
+		after := *input.ShardIteratorType == dynamodbstreams.ShardIteratorTypeAfterSequenceNumber
+		position = sort.Search(len(sh.records), func(i int) bool {
+			current := *sh.records[i].Dynamodb.SequenceNumber
+			if after {
+				return current > seq
+			}
+			return current >= seq
+		})
+	default:
+		return nil, validationError("Invalid ShardIteratorType: %s", aws.StringValue(input.ShardIteratorType))
+	}
+	return &dynamodbstreams.GetShardIteratorOutput{
+		ShardIterator: iterator(aws.StringValue(input.StreamArn), sh.id, position),
+	}, nil
+}
+
+// GetRecords implements dynamodbstreamsiface.DynamoDBStreamsAPI, NextShardIterator is nil
+// once all records of a closed shard were read
+func (s *Streams) GetRecords(input *dynamodbstreams.GetRecordsInput) (*dynamodbstreams.GetRecordsOutput, error) {
+	if err := s.db.fail("GetRecords"); err != nil {
+		return nil, err
+	}
+	parts := strings.Split(aws.StringValue(input.ShardIterator), "|")
+	if len(parts) != 3 {
+		return nil, validationError("Invalid ShardIterator")
+	}
+	position, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return nil, validationError("Invalid ShardIterator")
+	}
+	limit := int(aws.Int64Value(input.Limit))
+	if limit <= 0 || limit > maxGetRecords {
+		limit = maxGetRecords
+	}
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	sh, err := s.shard(aws.String(parts[0]), aws.String(parts[1]))
+	if err != nil {
+		return nil, err
+	}
+	end := position + limit
+	if end > len(sh.records) {
+		end = len(sh.records)
+	}
+	output := &dynamodbstreams.GetRecordsOutput{Records: []*dynamodbstreams.Record{}}
+	if position < end {
+		output.Records = append(output.Records, sh.records[position:end]...)
+	}
+	if end < len(sh.records) || !sh.closed {
+		output.NextShardIterator = iterator(parts[0], parts[1], end)
+	}
+	return output, nil
+}
@@ -0,0 +1,175 @@
+package ddbfake
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams"
+)
+
+func streamArn(t *testing.T, db *DB) *string {
+	t.Helper()
+	_, err := db.UpdateTable(&dynamodb.UpdateTableInput{
+		TableName: aws.String("events"),
+		StreamSpecification: &dynamodb.StreamSpecification{
+			StreamEnabled:  aws.Bool(true),
+			StreamViewType: aws.String(dynamodb.StreamViewTypeNewAndOldImages),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := db.DescribeTable(&dynamodb.DescribeTableInput{TableName: aws.String("events")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out.Table.LatestStreamArn
+}
+
+func shards(t *testing.T, s *Streams, arn *string) []*dynamodbstreams.Shard {
+	t.Helper()
+	out, err := s.DescribeStream(&dynamodbstreams.DescribeStreamInput{StreamArn: arn})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out.StreamDescription.Shards
+}
+
+func readShard(t *testing.T, s *Streams, arn *string, shard *dynamodbstreams.Shard, iteratorType string, seq *string) ([]*dynamodbstreams.Record, bool) {
+	t.Helper()
+	it, err := s.GetShardIterator(&dynamodbstreams.GetShardIteratorInput{
+		StreamArn:         arn,
+		ShardId:           shard.ShardId,
+		ShardIteratorType: aws.String(iteratorType),
+		SequenceNumber:    seq,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []*dynamodbstreams.Record
+	iterator := it.ShardIterator
+	for iterator != nil {
+		out, err := s.GetRecords(&dynamodbstreams.GetRecordsInput{ShardIterator: iterator})
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, out.Records...)
+		if len(out.Records) == 0 {
+			// an open shard has no more records for now
+			return records, false
+		}
+		iterator = out.NextShardIterator
+	}
+	return records, true
+}
+
+func TestStreamRecords(t *testing.T) {
+	db := newTable(t)
+	arn := streamArn(t, db)
+	s := db.Streams()
+	putEvents(t, db, event("a", 1, "status", "Started"), event("a", 1, "status", "Completed"))
+	if _, err := db.DeleteItem(&dynamodb.DeleteItemInput{TableName: aws.String("events"), Key: key("a", 1)}); err != nil {
+		t.Fatal(err)
+	}
+	list := shards(t, s, arn)
+	if len(list) != 1 {
+		t.Fatalf("got %d shards, want 1", len(list))
+	}
+	records, closed := readShard(t, s, arn, list[0], dynamodbstreams.ShardIteratorTypeTrimHorizon, nil)
+	if closed {
+		t.Error("open shard was closed")
+	}
+	want := []string{dynamodbstreams.OperationTypeInsert, dynamodbstreams.OperationTypeModify, dynamodbstreams.OperationTypeRemove}
+	if len(records) != len(want) {
+		t.Fatalf("got %d records, want %d", len(records), len(want))
+	}
+	for i, r := range records {
+		if aws.StringValue(r.EventName) != want[i] {
+			t.Errorf("record %d is %s, want %s", i, aws.StringValue(r.EventName), want[i])
+		}
+	}
+	modify := records[1].Dynamodb
+	if aws.StringValue(modify.OldImage["status"].S) != "Started" || aws.StringValue(modify.NewImage["status"].S) != "Completed" {
+		t.Errorf("modify images %v -> %v", modify.OldImage, modify.NewImage)
+	}
+	// an unchanged put emits nothing
+	putEvents(t, db, event("b", 1), event("b", 1))
+	if records, _ := readShard(t, s, arn, list[0], dynamodbstreams.ShardIteratorTypeTrimHorizon, nil); len(records) != 4 {
+		t.Errorf("got %d records, want 4", len(records))
+	}
+	// iterators at and after a sequence number
+	seq := records[1].Dynamodb.SequenceNumber
+	at, _ := readShard(t, s, arn, list[0], dynamodbstreams.ShardIteratorTypeAtSequenceNumber, seq)
+	after, _ := readShard(t, s, arn, list[0], dynamodbstreams.ShardIteratorTypeAfterSequenceNumber, seq)
+	if len(at) != 3 || len(after) != 2 {
+		t.Errorf("got %d records at and %d after the sequence number, want 3 and 2", len(at), len(after))
+	}
+	if latest, _ := readShard(t, s, arn, list[0], dynamodbstreams.ShardIteratorTypeLatest, nil); len(latest) != 0 {
+		t.Errorf("LATEST returned %d records", len(latest))
+	}
+}
+
+func TestSplitShard(t *testing.T) {
+	db := newTable(t)
+	arn := streamArn(t, db)
+	s := db.Streams()
+	putEvents(t, db, event("a", 1))
+	if err := db.SplitShard("events"); err != nil {
+		t.Fatal(err)
+	}
+	putEvents(t, db, event("a", 2))
+	list := shards(t, s, arn)
+	if len(list) != 2 {
+		t.Fatalf("got %d shards, want 2", len(list))
+	}
+	if aws.StringValue(list[1].ParentShardId) != aws.StringValue(list[0].ShardId) {
+		t.Errorf("child shard has parent %q, want %q", aws.StringValue(list[1].ParentShardId), aws.StringValue(list[0].ShardId))
+	}
+	if list[0].SequenceNumberRange.EndingSequenceNumber == nil || list[1].SequenceNumberRange.EndingSequenceNumber != nil {
+		t.Error("only the parent shard should be closed")
+	}
+	parent, closed := readShard(t, s, arn, list[0], dynamodbstreams.ShardIteratorTypeTrimHorizon, nil)
+	if !closed || len(parent) != 1 {
+		t.Errorf("parent shard returned %d records, closed %v", len(parent), closed)
+	}
+	child, _ := readShard(t, s, arn, list[1], dynamodbstreams.ShardIteratorTypeTrimHorizon, nil)
+	if len(child) != 1 || aws.StringValue(child[0].Dynamodb.Keys["n"].N) != "2" {
+		t.Errorf("child shard returned %v", child)
+	}
+	if aws.StringValue(child[0].Dynamodb.SequenceNumber) <= aws.StringValue(parent[0].Dynamodb.SequenceNumber) {
+		t.Error("sequence numbers of the child shard must follow its parent")
+	}
+}
+
+func TestGetRecordsLimit(t *testing.T) {
+	db := newTable(t)
+	arn := streamArn(t, db)
+	s := db.Streams()
+	for i := 0; i < maxGetRecords+5; i++ {
+		putEvents(t, db, event("a", i))
+	}
+	shard := shards(t, s, arn)[0]
+	it, err := s.GetShardIterator(&dynamodbstreams.GetShardIteratorInput{
+		StreamArn:         arn,
+		ShardId:           shard.ShardId,
+		ShardIteratorType: aws.String(dynamodbstreams.ShardIteratorTypeTrimHorizon),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := s.GetRecords(&dynamodbstreams.GetRecordsInput{ShardIterator: it.ShardIterator, Limit: aws.Int64(5000)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Records) != maxGetRecords {
+		t.Errorf("got %d records, want %d", len(out.Records), maxGetRecords)
+	}
+	out, err = s.GetRecords(&dynamodbstreams.GetRecordsInput{ShardIterator: out.NextShardIterator, Limit: aws.Int64(2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Records) != 2 || out.NextShardIterator == nil {
+		t.Errorf("got %d records, next iterator %v", len(out.Records), out.NextShardIterator)
+	}
+}
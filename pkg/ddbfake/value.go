@@ -0,0 +1,316 @@
+package ddbfake
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/big"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// attribute type names as used by attribute_type function and key schema
+const (
+	typeS    = "S"
+	typeN    = "N"
+	typeB    = "B"
+	typeBOOL = "BOOL"
+	typeNULL = "NULL"
+	typeM    = "M"
+	typeL    = "L"
+	typeSS   = "SS"
+	typeNS   = "NS"
+	typeBS   = "BS"
+)
+
+// typeOf return dynamodb type name of the value
+func typeOf(av *dynamodb.AttributeValue) string {
+	switch {
+	case av == nil:
+		return ""
+	case av.S != nil:
+		return typeS
+	case av.N != nil:
+		return typeN
+	case av.B != nil:
+		return typeB
+	case av.BOOL != nil:
+		return typeBOOL
+	case av.NULL != nil:
+		return typeNULL
+	case av.M != nil:
+		return typeM
+	case av.L != nil:
+		return typeL
+	case av.SS != nil:
+		return typeSS
+	case av.NS != nil:
+		return typeNS
+	case av.BS != nil:
+		return typeBS
+	}
+	return ""
+}
+
+// clone return deep copy of the value so stored items never alias caller's data
+func clone(av *dynamodb.AttributeValue) *dynamodb.AttributeValue {
+	if av == nil {
+		return nil
+	}
+	out := &dynamodb.AttributeValue{}
+	if av.S != nil {
+		out.S = aws.String(*av.S)
+	}
+	if av.N != nil {
+		out.N = aws.String(*av.N)
+	}
+	if av.B != nil {
+		out.B = append([]byte{}, av.B...)
+	}
+	if av.BOOL != nil {
+		out.BOOL = aws.Bool(*av.BOOL)
+	}
+	if av.NULL != nil {
+		out.NULL = aws.Bool(*av.NULL)
+	}
+	if av.M != nil {
+		out.M = cloneItem(av.M)
+	}
+	if av.L != nil {
+		out.L = make([]*dynamodb.AttributeValue, len(av.L))
+		for i, v := range av.L {
+			out.L[i] = clone(v)
+		}
+	}
+	if av.SS != nil {
+		out.SS = make([]*string, len(av.SS))
+		for i, s := range av.SS {
+			out.SS[i] = aws.String(*s)
+		}
+	}
+	if av.NS != nil {
+		out.NS = make([]*string, len(av.NS))
+		for i, n := range av.NS {
+			out.NS[i] = aws.String(*n)
+		}
+	}
+	if av.BS != nil {
+		out.BS = make([][]byte, len(av.BS))
+		for i, b := range av.BS {
+			out.BS[i] = append([]byte{}, b...)
+		}
+	}
+	return out
+}
+
+// cloneItem return deep copy of the item
+func cloneItem(item map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue {
+	if item == nil {
+		return nil
+	}
+	out := make(map[string]*dynamodb.AttributeValue, len(item))
+	for name, av := range item {
+		out[name] = clone(av)
+	}
+	return out
+}
+
+// parseNumber parse dynamodb number to exact rational
+func parseNumber(s string) (*big.Rat, bool) {
+	return new(big.Rat).SetString(strings.TrimSpace(s))
+}
+
+// formatNumber return canonical representation of the number without trailing zeros
+func formatNumber(r *big.Rat) string {
+	if r.IsInt() {
+		return r.Num().String()
+	}
+	s := strings.TrimRight(r.FloatString(38), "0")
+	return strings.TrimSuffix(s, ".")
+}
+
+// compare return -1, 0 or 1 comparing values of the same scalar type, ok is false
+// when the values are not comparable
+func compare(a, b *dynamodb.AttributeValue) (int, bool) {
+	ta, tb := typeOf(a), typeOf(b)
+	if ta != tb {
+		return 0, false
+	}
+	switch ta {
+	case typeS:
+		return strings.Compare(*a.S, *b.S), true
+	case typeN:
+		x, okx := parseNumber(*a.N)
+		y, oky := parseNumber(*b.N)
+		if !okx || !oky {
+			return 0, false
+		}
+		return x.Cmp(y), true
+	case typeB:
+		return bytes.Compare(a.B, b.B), true
+	}
+	return 0, false
+}
+
+// equal report whether two values are equal, sets compare regardless of element order
+func equal(a, b *dynamodb.AttributeValue) bool {
+	ta, tb := typeOf(a), typeOf(b)
+	if ta != tb || ta == "" {
+		return false
+	}
+	switch ta {
+	case typeS, typeN, typeB:
+		c, ok := compare(a, b)
+		return ok && c == 0
+	case typeBOOL:
+		return *a.BOOL == *b.BOOL
+	case typeNULL:
+		return true
+	case typeM:
+		if len(a.M) != len(b.M) {
+			return false
+		}
+		for name, v := range a.M {
+			if !equal(v, b.M[name]) {
+				return false
+			}
+		}
+		return true
+	case typeL:
+		if len(a.L) != len(b.L) {
+			return false
+		}
+		for i := range a.L {
+			if !equal(a.L[i], b.L[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	ea, eb := setElements(a), setElements(b)
+	if len(ea) != len(eb) {
+		return false
+	}
+	for i := range ea {
+		if !equal(ea[i], eb[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// setElements return elements of a set as scalar values sorted for comparison
+func setElements(av *dynamodb.AttributeValue) []*dynamodb.AttributeValue {
+	var out []*dynamodb.AttributeValue
+	for _, s := range av.SS {
+		out = append(out, &dynamodb.AttributeValue{S: s})
+	}
+	for _, n := range av.NS {
+		out = append(out, &dynamodb.AttributeValue{N: n})
+	}
+	for _, b := range av.BS {
+		out = append(out, &dynamodb.AttributeValue{B: b})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		c, _ := compare(out[i], out[j])
+		return c < 0
+	})
+	return out
+}
+
+// setFromElements build a set of given type from scalar elements, nil when there are none
+// since dynamodb doesn't store empty sets
+func setFromElements(setType string, elements []*dynamodb.AttributeValue) *dynamodb.AttributeValue {
+	if len(elements) == 0 {
+		return nil
+	}
+	out := &dynamodb.AttributeValue{}
+	for _, e := range elements {
+		switch setType {
+		case typeSS:
+			out.SS = append(out.SS, aws.String(*e.S))
+		case typeNS:
+			out.NS = append(out.NS, aws.String(*e.N))
+		case typeBS:
+			out.BS = append(out.BS, append([]byte{}, e.B...))
+		}
+	}
+	return out
+}
+
+// size return the value of size function: length of strings and binaries
+// or number of elements of collections
+func size(av *dynamodb.AttributeValue) (int, bool) {
+	switch typeOf(av) {
+	case typeS:
+		return len(*av.S), true
+	case typeB:
+		return len(av.B), true
+	case typeM:
+		return len(av.M), true
+	case typeL:
+		return len(av.L), true
+	case typeSS:
+		return len(av.SS), true
+	case typeNS:
+		return len(av.NS), true
+	case typeBS:
+		return len(av.BS), true
+	}
+	return 0, false
+}
+
+// itemSize return approximate size of the item as accounted by dynamodb
+func itemSize(item map[string]*dynamodb.AttributeValue) int {
+	total := 0
+	for name, av := range item {
+		total += len(name) + valueSize(av)
+	}
+	return total
+}
+
+func valueSize(av *dynamodb.AttributeValue) int {
+	switch typeOf(av) {
+	case typeS:
+		return len(*av.S)
+	case typeN:
+		return len(*av.N)/2 + 1
+	case typeB:
+		return len(av.B)
+	case typeBOOL, typeNULL:
+		return 1
+	case typeM:
+		total := 3
+		for name, v := range av.M {
+			total += 1 + len(name) + valueSize(v)
+		}
+		return total
+	case typeL:
+		total := 3
+		for _, v := range av.L {
+			total += 1 + valueSize(v)
+		}
+		return total
+	}
+	total := 0
+	for _, e := range setElements(av) {
+		total += valueSize(e)
+	}
+	return total
+}
+
+// keyString return canonical string of key attributes used to index stored items
+func keyString(item map[string]*dynamodb.AttributeValue, names ...string) string {
+	var b strings.Builder
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		v, _ := json.Marshal(item[name])
+		b.Write(v)
+		b.WriteByte('|')
+	}
+	return b.String()
+}
@@ -0,0 +1,346 @@
+package ddbstore
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/golang/protobuf/proto"
+)
+
+const (
+	// maxBatchWriteItems is the DynamoDB limit of write requests in a single BatchWriteItem call
+	maxBatchWriteItems = 25
+	// maxBatchGetItems is the DynamoDB limit of keys in a single BatchGetItem call
+	maxBatchGetItems = 100
+)
+
+var (
+	ErrUnprocessedItem = errors.New("item left unprocessed after retries")
+	ErrDuplicateKey    = errors.New("key written more than once in batch")
+)
+
+// BatchOptions configure how unprocessed items of a batch are retried
+type BatchOptions struct {
+	// MaxAttempts is the number of BatchWriteItem calls made for a single chunk
+	MaxAttempts int
+	// BaseDelay is the backoff before the first retry, doubled on every next one
+	BaseDelay time.Duration
+	// MaxDelay caps the backoff between two retries
+	MaxDelay time.Duration
+}
+
+// DefaultBatchOptions used by batch functions when no options are provided
+var DefaultBatchOptions = BatchOptions{
+	MaxAttempts: 8,
+	BaseDelay:   50 * time.Millisecond,
+	MaxDelay:    5 * time.Second,
+}
+
+// backoff return jittered exponential delay before given retry attempt
+func (o BatchOptions) backoff(attempt int) time.Duration {
+	delay := o.MaxDelay
+	if attempt < 32 {
+		if d := o.BaseDelay << uint(attempt); d > 0 && d < o.MaxDelay {
+			delay = d
+		}
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(delay)))
+}
+
+// withDefaults return the options with fields left zero or negative taken from DefaultBatchOptions
+func (o BatchOptions) withDefaults() BatchOptions {
+	defaults := DefaultBatchOptions
+	if o.MaxAttempts <= 0 {
+		o.MaxAttempts = defaults.MaxAttempts
+	}
+	if o.BaseDelay <= 0 {
+		o.BaseDelay = defaults.BaseDelay
+	}
+	if o.MaxDelay <= 0 {
+		o.MaxDelay = defaults.MaxDelay
+	}
+	return o
+}
+
+// batchOptions return the first provided options or the defaults
+func batchOptions(opts []BatchOptions) BatchOptions {
+	if len(opts) > 0 {
+		return opts[0].withDefaults()
+	}
+	return DefaultBatchOptions
+}
+
+// BatchItemError describe a single write request which failed within a batch
+type BatchItemError struct {
+	// Index of the item in the slice given to the batch function
+	Index   int
+	Request *dynamodb.WriteRequest
+	Err     error
+}
+
+func (e *BatchItemError) Error() string {
+	return fmt.Sprintf("batch item %d: %v", e.Index, e.Err)
+}
+
+// BatchError is returned when some of the batch items could not be written
+type BatchError struct {
+	Items []*BatchItemError
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("%d batch items failed, first: %v", len(e.Items), e.Items[0])
+}
+
+// BatchPutProtoToDdb put items to dynamodb in batch directly from proto message
+func BatchPutProtoToDdb(ins []proto.Message, ddbClient dynamodbiface.DynamoDBAPI, tableName string, opts ...BatchOptions) error {
+	reqs := make([]*dynamodb.WriteRequest, 0, len(ins))
+	for _, in := range ins {
+		attrs, err := encodeItem(in, "", tableName)
+		if err != nil {
+			return err
+		}
+		reqs = append(reqs, &dynamodb.WriteRequest{
+			PutRequest: &dynamodb.PutRequest{
+				Item: attrs,
+			},
+		})
+	}
+	return BatchWriteToDdb(reqs, ddbClient, tableName, batchOptions(opts))
+}
+
+// BatchDeleteProtoFromDdb remove items from dynamodb in batch directly from instance ids
+func BatchDeleteProtoFromDdb(instanceIDs []string, ddbClient dynamodbiface.DynamoDBAPI, tableName string, opts ...BatchOptions) error {
+	// duplicated keys are rejected by BatchWriteItem so every id is deleted once,
+	// failures report the index of its first occurrence
+	ids := make([]string, 0, len(instanceIDs))
+	first := make(map[string]int, len(instanceIDs))
+	reqs := make([]*dynamodb.WriteRequest, 0, len(instanceIDs))
+	for i, instanceID := range instanceIDs {
+		if !verifyInstanceID(instanceID) {
+			return ErrKeyMismatched
+		}
+		if _, ok := first[instanceID]; ok {
+			continue
+		}
+		first[instanceID] = i
+		ids = append(ids, instanceID)
+		reqs = append(reqs, &dynamodb.WriteRequest{
+			DeleteRequest: &dynamodb.DeleteRequest{
+				Key: keyFor(instanceID),
+			},
+		})
+	}
+	err := BatchWriteToDdb(reqs, ddbClient, tableName, batchOptions(opts))
+	failed := map[string]bool{}
+	if batchErr, ok := err.(*BatchError); ok {
+		for _, item := range batchErr.Items {
+			failed[ids[item.Index]] = true
+			item.Index = first[ids[item.Index]]
+		}
+	} else if err != nil {
+		return err
+	}
+	for _, instanceID := range ids {
+		if failed[instanceID] {
+			continue
+		}
+		if err := deleteBlobs(instanceID, tableName); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// BatchWriteToDdb send write requests in chunks of 25 and retry unprocessed items
+// with jittered exponential backoff. Requests which are still failing when the retry budget
+// is exhausted are reported individually through *BatchError. DynamoDB rejects a batch writing
+// a key twice, so requests sharing a key return ErrDuplicateKey before anything is written.
+func BatchWriteToDdb(reqs []*dynamodb.WriteRequest, ddbClient dynamodbiface.DynamoDBAPI, tableName string, opts BatchOptions) error {
+	opts = opts.withDefaults()
+	// unprocessed items come back as new values so we match them by their key
+	index := make(map[string]int, len(reqs))
+	for i, req := range reqs {
+		id := writeRequestID(req)
+		if _, ok := index[id]; ok {
+			return ErrDuplicateKey
+		}
+		index[id] = i
+	}
+	var failed []*BatchItemError
+	for start := 0; start < len(reqs); start += maxBatchWriteItems {
+		end := start + maxBatchWriteItems
+		if end > len(reqs) {
+			end = len(reqs)
+		}
+		pending, err := batchWriteChunk(ddbClient, reqs[start:end], tableName, opts)
+		if err == nil {
+			err = ErrUnprocessedItem
+		}
+		for _, req := range pending {
+			failed = append(failed, &BatchItemError{
+				Index:   index[writeRequestID(req)],
+				Request: req,
+				Err:     err,
+			})
+		}
+	}
+	if len(failed) > 0 {
+		return &BatchError{Items: failed}
+	}
+	return nil
+}
+
+// batchWriteChunk write a single chunk and return requests left unprocessed
+// together with the last error returned by dynamodb if any
+func batchWriteChunk(ddbClient dynamodbiface.DynamoDBAPI, chunk []*dynamodb.WriteRequest, tableName string, opts BatchOptions) ([]*dynamodb.WriteRequest, error) {
+	pending := chunk
+	var lastErr error
+	for attempt := 0; len(pending) > 0 && attempt < opts.MaxAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(opts.backoff(attempt - 1))
+		}
+		batchInput := &dynamodb.BatchWriteItemInput{}
+		batchInput.SetRequestItems(map[string][]*dynamodb.WriteRequest{
+			tableName: pending,
+		})
+		output, err := ddbClient.BatchWriteItem(batchInput)
+		if err != nil {
+			if isRetryable(err) {
+				lastErr = err
+				continue
+			}
+			return pending, err
+		}
+		lastErr = nil
+		pending = output.UnprocessedItems[tableName]
+	}
+	return pending, lastErr
+}
+
+// writeRequestID return identity of write request built from its hash key
+func writeRequestID(req *dynamodb.WriteRequest) string {
+	if req.DeleteRequest != nil {
+		return req.DeleteRequest.Key["uuid"].String()
+	}
+	return req.PutRequest.Item["uuid"].String()
+}
+
+// BatchGetProtoFromDdb get items from dynamodb in batch and parse them to proto messages
+// of the same type as given proto. Returned slice follows the order of instance ids,
+// items which do not exist are left nil.
+func BatchGetProtoFromDdb(in proto.Message, instanceIDs []string, ddbClient dynamodbiface.DynamoDBAPI, tableName string, opts ...BatchOptions) ([]proto.Message, error) {
+	opt := batchOptions(opts)
+	// duplicated keys are rejected by BatchGetItem so every id is requested once
+	ids := make([]string, 0, len(instanceIDs))
+	seen := make(map[string]bool, len(instanceIDs))
+	for _, instanceID := range instanceIDs {
+		if !verifyProto(in, instanceID) {
+			return nil, ErrKeyMismatched
+		}
+		if !seen[instanceID] {
+			seen[instanceID] = true
+			ids = append(ids, instanceID)
+		}
+	}
+	found := make(map[string]proto.Message, len(ids))
+	for start := 0; start < len(ids); start += maxBatchGetItems {
+		end := start + maxBatchGetItems
+		if end > len(ids) {
+			end = len(ids)
+		}
+		keys := make([]map[string]*dynamodb.AttributeValue, 0, end-start)
+		for _, instanceID := range ids[start:end] {
+			keys = append(keys, keyFor(instanceID))
+		}
+		items, err := batchGetChunk(ddbClient, keys, tableName, opt)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			out, err := decodeItem(in, item, tableName)
+			if err != nil {
+				return nil, err
+			}
+			if v, ok := item["uuid"]; ok && v.S != nil {
+				found[*v.S] = out
+			}
+		}
+	}
+	outs := make([]proto.Message, len(instanceIDs))
+	for i, instanceID := range instanceIDs {
+		outs[i] = found[instanceID]
+	}
+	return outs, nil
+}
+
+// batchGetChunk read a single chunk of keys retrying unprocessed keys with backoff
+func batchGetChunk(ddbClient dynamodbiface.DynamoDBAPI, keys []map[string]*dynamodb.AttributeValue, tableName string, opts BatchOptions) ([]map[string]*dynamodb.AttributeValue, error) {
+	items := make([]map[string]*dynamodb.AttributeValue, 0, len(keys))
+	pending := &dynamodb.KeysAndAttributes{Keys: keys}
+	var lastErr error
+	for attempt := 0; pending != nil && len(pending.Keys) > 0 && attempt < opts.MaxAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(opts.backoff(attempt - 1))
+		}
+		batchInput := &dynamodb.BatchGetItemInput{}
+		batchInput.SetRequestItems(map[string]*dynamodb.KeysAndAttributes{
+			tableName: pending,
+		})
+		output, err := ddbClient.BatchGetItem(batchInput)
+		if err != nil {
+			if isRetryable(err) {
+				lastErr = err
+				continue
+			}
+			return nil, err
+		}
+		lastErr = nil
+		items = append(items, output.Responses[tableName]...)
+		pending = output.UnprocessedKeys[tableName]
+	}
+	if pending != nil && len(pending.Keys) > 0 {
+		if lastErr != nil {
+			return nil, lastErr
+		}
+		return nil, ErrUnprocessedItem
+	}
+	return items, nil
+}
+
+// isRetryable report whether ddb error is caused by throttling or a transient server failure
+func isRetryable(err error) bool {
+	if _, ok := err.(*ThrottledError); ok {
+		return true
+	}
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case dynamodb.ErrCodeProvisionedThroughputExceededException,
+			dynamodb.ErrCodeRequestLimitExceeded,
+			dynamodb.ErrCodeInternalServerError,
+			"ThrottlingException":
+			return true
+		}
+	}
+	return false
+}
+
+// isThrottle report whether dynamodb rejected the request for exceeding capacity
+func isThrottle(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case dynamodb.ErrCodeProvisionedThroughputExceededException,
+			dynamodb.ErrCodeRequestLimitExceeded,
+			"ThrottlingException":
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,260 @@
+package ddbstore
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/golang/protobuf/proto"
+
+	pb "go-grpc-kubernetes/proto/orderservice"
+)
+
+func TestBatchZeroOptionsUseDefaults(t *testing.T) {
+	db, tableName := newOrdersTable(t, TableOptions{})
+	throttled := 0
+	db.Fail = func(op string) error {
+		if op == "BatchWriteItem" && throttled < 2 {
+			throttled++
+			return awserr.New(dynamodb.ErrCodeProvisionedThroughputExceededException, "throttled", nil)
+		}
+		return nil
+	}
+	var orders []proto.Message
+	var ids []string
+	for i := 0; i < 30; i++ {
+		id := fmt.Sprintf("order-%02d", i)
+		orders = append(orders, &pb.Order{Uuid: id, Quantity: int32(i + 1)})
+		ids = append(ids, id)
+	}
+	if err := BatchPutProtoToDdb(orders, db, tableName, BatchOptions{}); err != nil {
+		t.Fatalf("BatchPutProtoToDdb with zero options: %v", err)
+	}
+	got, err := BatchGetProtoFromDdb(&pb.Order{}, ids, db, tableName, BatchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, order := range got {
+		if order == nil || order.(*pb.Order).Quantity != int32(i+1) {
+			t.Fatalf("order %s = %v, want quantity %d", ids[i], order, i+1)
+		}
+	}
+	if err := BatchDeleteProtoFromDdb(ids, db, tableName, BatchOptions{MaxAttempts: -1}); err != nil {
+		t.Fatalf("BatchDeleteProtoFromDdb with negative attempts: %v", err)
+	}
+	got, err = BatchGetProtoFromDdb(&pb.Order{}, ids, db, tableName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, order := range got {
+		if order != nil {
+			t.Fatalf("order %s = %v after delete, want nil", ids[i], order)
+		}
+	}
+}
+
+func TestBatchGetProtoFromDdb(t *testing.T) {
+	db, tableName := newOrdersTable(t, TableOptions{})
+	var orders []proto.Message
+	for i := 0; i < 150; i++ {
+		orders = append(orders, &pb.Order{Uuid: fmt.Sprintf("order-%03d", i), Quantity: int32(i + 1)})
+	}
+	if err := BatchPutProtoToDdb(orders, db, tableName); err != nil {
+		t.Fatal(err)
+	}
+	// more ids than a single BatchGetItem call takes, with a duplicate and a missing item
+	ids := []string{"missing", "order-000", "order-000"}
+	for i := 1; i < 150; i++ {
+		ids = append(ids, fmt.Sprintf("order-%03d", i))
+	}
+	got, err := BatchGetProtoFromDdb(&pb.Order{}, ids, db, tableName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(ids) {
+		t.Fatalf("got %d messages for %d ids", len(got), len(ids))
+	}
+	if got[0] != nil {
+		t.Errorf("missing item = %v, want nil", got[0])
+	}
+	for i, id := range ids[1:] {
+		if order, ok := got[i+1].(*pb.Order); !ok || order.Uuid != id {
+			t.Errorf("message %d = %v, want %s", i+1, got[i+1], id)
+		}
+	}
+	if err := BatchDeleteProtoFromDdb(ids[1:], db, tableName); err != nil {
+		t.Fatal(err)
+	}
+	if got, err = BatchGetProtoFromDdb(&pb.Order{}, ids[1:3], db, tableName); err != nil || got[0] != nil || got[1] != nil {
+		t.Errorf("deleted items: got %v, %v", got, err)
+	}
+}
+
+// unprocessingDB is a dynamodb leaving the write requests and read keys of items it is told to
+// unprocessed, as dynamodb does when a partition exceeds its capacity
+type unprocessingDB struct {
+	dynamodbiface.DynamoDBAPI
+	// unprocessed return whether the item with the id is left unprocessed by the call
+	unprocessed func(call int, id string) bool
+	calls       int
+}
+
+func (db *unprocessingDB) BatchWriteItem(input *dynamodb.BatchWriteItemInput) (*dynamodb.BatchWriteItemOutput, error) {
+	db.calls++
+	processed := map[string][]*dynamodb.WriteRequest{}
+	unprocessed := map[string][]*dynamodb.WriteRequest{}
+	for tableName, reqs := range input.RequestItems {
+		for _, req := range reqs {
+			var key map[string]*dynamodb.AttributeValue
+			if req.PutRequest != nil {
+				key = req.PutRequest.Item
+			} else {
+				key = req.DeleteRequest.Key
+			}
+			if db.unprocessed(db.calls, aws.StringValue(key["uuid"].S)) {
+				unprocessed[tableName] = append(unprocessed[tableName], req)
+			} else {
+				processed[tableName] = append(processed[tableName], req)
+			}
+		}
+	}
+	if len(processed) > 0 {
+		if _, err := db.DynamoDBAPI.BatchWriteItem(&dynamodb.BatchWriteItemInput{RequestItems: processed}); err != nil {
+			return nil, err
+		}
+	}
+	return &dynamodb.BatchWriteItemOutput{UnprocessedItems: unprocessed}, nil
+}
+
+func (db *unprocessingDB) BatchGetItem(input *dynamodb.BatchGetItemInput) (*dynamodb.BatchGetItemOutput, error) {
+	db.calls++
+	processed := map[string]*dynamodb.KeysAndAttributes{}
+	unprocessed := map[string]*dynamodb.KeysAndAttributes{}
+	for tableName, keys := range input.RequestItems {
+		for _, key := range keys.Keys {
+			target := processed
+			if db.unprocessed(db.calls, aws.StringValue(key["uuid"].S)) {
+				target = unprocessed
+			}
+			if target[tableName] == nil {
+				target[tableName] = &dynamodb.KeysAndAttributes{}
+			}
+			target[tableName].Keys = append(target[tableName].Keys, key)
+		}
+	}
+	output := &dynamodb.BatchGetItemOutput{UnprocessedKeys: unprocessed}
+	if len(processed) > 0 {
+		out, err := db.DynamoDBAPI.BatchGetItem(&dynamodb.BatchGetItemInput{RequestItems: processed})
+		if err != nil {
+			return nil, err
+		}
+		output.Responses = out.Responses
+	}
+	return output, nil
+}
+
+// quickRetry retries batches without waiting
+var quickRetry = BatchOptions{MaxAttempts: 3, BaseDelay: time.Microsecond, MaxDelay: time.Microsecond}
+
+func TestBatchWriteRetriesUnprocessedItems(t *testing.T) {
+	db, tableName := newOrdersTable(t, TableOptions{})
+	// every other order is left unprocessed by the first call of its chunk
+	client := &unprocessingDB{DynamoDBAPI: db, unprocessed: func(call int, id string) bool {
+		var n int
+		fmt.Sscanf(id, "order-%d", &n)
+		return call <= 2 && n%2 == 0
+	}}
+	var orders []proto.Message
+	var ids []string
+	for i := 0; i < 30; i++ {
+		id := fmt.Sprintf("order-%02d", i)
+		orders = append(orders, &pb.Order{Uuid: id, Quantity: int32(i + 1)})
+		ids = append(ids, id)
+	}
+	if err := BatchPutProtoToDdb(orders, client, tableName, quickRetry); err != nil {
+		t.Fatal(err)
+	}
+	if client.calls != 4 {
+		t.Errorf("made %d calls, want 2 chunks written in 2 calls each", client.calls)
+	}
+	got, err := BatchGetProtoFromDdb(&pb.Order{}, ids, db, tableName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, order := range got {
+		if order == nil {
+			t.Errorf("order %s wasn't written", ids[i])
+		}
+	}
+}
+
+func TestBatchWriteReportsItemsLeftUnprocessed(t *testing.T) {
+	db, tableName := newOrdersTable(t, TableOptions{})
+	client := &unprocessingDB{DynamoDBAPI: db, unprocessed: func(call int, id string) bool {
+		return id == "order-1" || id == "order-27"
+	}}
+	var orders []proto.Message
+	for i := 0; i < 30; i++ {
+		orders = append(orders, &pb.Order{Uuid: fmt.Sprintf("order-%d", i)})
+	}
+	err := BatchPutProtoToDdb(orders, client, tableName, quickRetry)
+	batchErr, ok := err.(*BatchError)
+	if !ok {
+		t.Fatalf("got %v, want *BatchError", err)
+	}
+	var failed []string
+	for _, item := range batchErr.Items {
+		if item.Err != ErrUnprocessedItem {
+			t.Errorf("item %d failed with %v, want ErrUnprocessedItem", item.Index, item.Err)
+		}
+		failed = append(failed, fmt.Sprintf("%d:%s", item.Index, aws.StringValue(item.Request.PutRequest.Item["uuid"].S)))
+	}
+	if fmt.Sprint(failed) != "[1:order-1 27:order-27]" {
+		t.Errorf("got failed items %v", failed)
+	}
+	// every chunk is retried until the attempts run out
+	if client.calls != 2*quickRetry.MaxAttempts {
+		t.Errorf("made %d calls, want %d", client.calls, 2*quickRetry.MaxAttempts)
+	}
+	if got, err := BatchGetProtoFromDdb(&pb.Order{}, []string{"order-0", "order-1"}, db, tableName); err != nil || got[0] == nil || got[1] != nil {
+		t.Errorf("got %v, %v, want only the processed order written", got, err)
+	}
+}
+
+func TestBatchGetRetriesUnprocessedKeys(t *testing.T) {
+	db, tableName := newOrdersTable(t, TableOptions{})
+	putOrders(t, db, tableName, "order-1", "order-2", "order-3")
+	client := &unprocessingDB{DynamoDBAPI: db, unprocessed: func(call int, id string) bool {
+		return call == 1 && id != "order-1"
+	}}
+	got, err := BatchGetProtoFromDdb(&pb.Order{}, []string{"order-1", "order-2", "order-3"}, client, tableName, quickRetry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, order := range got {
+		if order == nil {
+			t.Errorf("order %d wasn't read", i+1)
+		}
+	}
+	client = &unprocessingDB{DynamoDBAPI: db, unprocessed: func(call int, id string) bool {
+		return id == "order-2"
+	}}
+	if _, err := BatchGetProtoFromDdb(&pb.Order{}, []string{"order-1", "order-2"}, client, tableName, quickRetry); err != ErrUnprocessedItem {
+		t.Errorf("got %v, want ErrUnprocessedItem", err)
+	}
+}
+
+func TestBatchPutRejectsDuplicateKeys(t *testing.T) {
+	db, tableName := newOrdersTable(t, TableOptions{})
+	orders := []proto.Message{&pb.Order{Uuid: "order-1"}, &pb.Order{Uuid: "order-2"}, &pb.Order{Uuid: "order-1", Quantity: 2}}
+	if err := BatchPutProtoToDdb(orders, db, tableName); err != ErrDuplicateKey {
+		t.Errorf("got %v, want ErrDuplicateKey", err)
+	}
+	if got, err := BatchGetProtoFromDdb(&pb.Order{}, []string{"order-2"}, db, tableName); err != nil || got[0] != nil {
+		t.Errorf("got %v, %v, want nothing written", got, err)
+	}
+}
@@ -0,0 +1,429 @@
+package ddbstore
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+var (
+	ErrBlobNotFound = errors.New("blob not found")
+	ErrItemTooLarge = errors.New("item too large even with all attributes offloaded")
+)
+
+const (
+	// attributes of pointer stored in place of offloaded attribute
+	blobRef  = "blob_ref"
+	blobSize = "blob_size"
+
+	defaultOffloadAttributeSize = 64 * 1024
+	// leave headroom under the 400KB dynamodb item limit
+	defaultOffloadMaxItemSize = 350 * 1024
+
+	// errCodeValidation is the code of requests dynamodb refuses as invalid, e.g. items over 400KB
+	errCodeValidation = "ValidationException"
+)
+
+// BlobStore keeps attributes which are too large to be stored in dynamodb
+type BlobStore interface {
+	Put(key string, data []byte) error
+	// Get return ErrBlobNotFound when there is no blob under the key
+	Get(key string) ([]byte, error)
+	// Delete remove the blob under the key, a missing blob is not an error
+	Delete(key string) error
+	// DeleteAll remove all blobs which keys start with prefix
+	DeleteAll(prefix string) error
+}
+
+// S3BlobStore keeps blobs in S3 bucket under optional prefix
+type S3BlobStore struct {
+	Bucket string
+	Prefix string
+	S3     s3iface.S3API
+}
+
+// NewS3BlobStore return blob store writing to given bucket
+func NewS3BlobStore(bucket, prefix string, sess *session.Session) *S3BlobStore {
+	return &S3BlobStore{
+		Bucket: bucket,
+		Prefix: prefix,
+		S3:     s3.New(sess),
+	}
+}
+
+// Put implements BlobStore
+func (b *S3BlobStore) Put(key string, data []byte) error {
+	_, err := b.S3.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(b.Bucket),
+		Key:    aws.String(b.Prefix + key),
+		Body:   bytes.NewReader(data),
+	})
+	return err
+}
+
+// Get implements BlobStore
+func (b *S3BlobStore) Get(key string) ([]byte, error) {
+	output, err := b.S3.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(b.Bucket),
+		Key:    aws.String(b.Prefix + key),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+		return nil, ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer output.Body.Close()
+	return ioutil.ReadAll(output.Body)
+}
+
+// Delete implements BlobStore
+func (b *S3BlobStore) Delete(key string) error {
+	_, err := b.S3.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(b.Bucket),
+		Key:    aws.String(b.Prefix + key),
+	})
+	return err
+}
+
+// DeleteAll implements BlobStore
+func (b *S3BlobStore) DeleteAll(prefix string) error {
+	var objects []*s3.ObjectIdentifier
+	err := b.S3.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(b.Bucket),
+		Prefix: aws.String(b.Prefix + prefix),
+	}, func(page *s3.ListObjectsV2Output, last bool) bool {
+		for _, object := range page.Contents {
+			objects = append(objects, &s3.ObjectIdentifier{Key: object.Key})
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	// DeleteObjects accepts up to 1000 keys
+	for start := 0; start < len(objects); start += 1000 {
+		end := start + 1000
+		if end > len(objects) {
+			end = len(objects)
+		}
+		output, err := b.S3.DeleteObjects(&s3.DeleteObjectsInput{
+			Bucket: aws.String(b.Bucket),
+			Delete: &s3.Delete{
+				Objects: objects[start:end],
+				Quiet:   aws.Bool(true),
+			},
+		})
+		if err != nil {
+			return err
+		}
+		// objects which couldn't be deleted are reported in the output of a successful call
+		if len(output.Errors) > 0 {
+			failed := output.Errors[0]
+			return fmt.Errorf("delete %d blobs under %s: %s: %s: %s", len(output.Errors), prefix,
+				aws.StringValue(failed.Key), aws.StringValue(failed.Code), aws.StringValue(failed.Message))
+		}
+	}
+	return nil
+}
+
+// FileBlobStore keeps blobs as files under a local directory, meant for dev and tests
+type FileBlobStore struct {
+	Dir string
+}
+
+func (b *FileBlobStore) path(key string) string {
+	return filepath.Join(b.Dir, filepath.FromSlash(path.Clean("/"+key)))
+}
+
+// Put implements BlobStore
+func (b *FileBlobStore) Put(key string, data []byte) error {
+	p := b.path(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(p, data, 0644)
+}
+
+// Get implements BlobStore
+func (b *FileBlobStore) Get(key string) ([]byte, error) {
+	data, err := ioutil.ReadFile(b.path(key))
+	if os.IsNotExist(err) {
+		return nil, ErrBlobNotFound
+	}
+	return data, err
+}
+
+// Delete implements BlobStore
+func (b *FileBlobStore) Delete(key string) error {
+	err := os.Remove(b.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// DeleteAll implements BlobStore
+func (b *FileBlobStore) DeleteAll(prefix string) error {
+	dir := b.path(path.Dir(prefix))
+	base := path.Base(prefix)
+	if strings.HasSuffix(prefix, "/") {
+		dir, base = b.path(prefix), ""
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), base) {
+			if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Offload moves attributes which don't fit in dynamodb item to blob store, keeping a pointer in the item.
+// Every write puts its blobs under new keys and blobs it replaced are deleted once it committed.
+// Batch puts and transactions don't return the replaced item, so its blobs stay until the item is deleted.
+type Offload struct {
+	Store BlobStore
+	// AttributeSize offloads every attribute larger than it, 64KB by default
+	AttributeSize int
+	// MaxItemSize is the size of item kept in dynamodb, when an item is larger its biggest
+	// attributes are offloaded until it fits, 350KB by default
+	MaxItemSize int
+}
+
+// blobPrefix return prefix of all blobs of the item, the id is hex encoded so no prefix of
+// an item is the prefix of another one and ids can't address paths outside the table
+func blobPrefix(tableName, instanceID string) string {
+	return tableName + "/" + hex.EncodeToString([]byte(instanceID)) + "/"
+}
+
+// newBlobKey return a key no other write uses for the attribute, so a blob is never overwritten
+// and the stored item keeps pointing to its own blobs when a later write doesn't commit
+func newBlobKey(prefix, name string) (string, error) {
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	return prefix + name + "." + hex.EncodeToString(suffix), nil
+}
+
+// offload replace large attributes with pointers to blobs in place. Attributes of stored which
+// are not written count towards the size of the item, so updates are checked against the merged item.
+func (o *Offload) offload(tableName string, attrs, stored map[string]*dynamodb.AttributeValue) error {
+	attributeSize, maxItemSize := o.AttributeSize, o.MaxItemSize
+	if attributeSize == 0 {
+		attributeSize = defaultOffloadAttributeSize
+	}
+	if maxItemSize == 0 {
+		maxItemSize = defaultOffloadMaxItemSize
+	}
+	sizes := make(map[string]int, len(attrs))
+	names := make([]string, 0, len(attrs))
+	total := 0
+	for name, av := range stored {
+		if _, ok := attrs[name]; !ok {
+			total += len(name) + attrSize(av)
+		}
+	}
+	for name, av := range attrs {
+		if name == "uuid" {
+			total += len(name) + attrSize(av)
+			continue
+		}
+		sizes[name] = len(name) + attrSize(av)
+		names = append(names, name)
+		total += sizes[name]
+	}
+	// biggest attributes first so the fewest blobs are written
+	sort.Slice(names, func(i, j int) bool {
+		return sizes[names[i]] > sizes[names[j]]
+	})
+	var instanceID string
+	if key := attrs["uuid"]; key != nil {
+		instanceID = aws.StringValue(key.S)
+	}
+	prefix := blobPrefix(tableName, instanceID)
+	var written []string
+	for _, name := range names {
+		if sizes[name] <= attributeSize && total <= maxItemSize {
+			break
+		}
+		data, err := json.Marshal(attrs[name])
+		if err != nil {
+			return err
+		}
+		key, err := newBlobKey(prefix, name)
+		if err != nil {
+			return err
+		}
+		if err := o.Store.Put(key, data); err != nil {
+			o.delete(written)
+			return err
+		}
+		written = append(written, key)
+		attrs[name] = &dynamodb.AttributeValue{
+			M: map[string]*dynamodb.AttributeValue{
+				blobRef:  {S: aws.String(key)},
+				blobSize: {N: aws.String(strconv.Itoa(len(data)))},
+			},
+		}
+		total += len(name) + attrSize(attrs[name]) - sizes[name]
+	}
+	if total > maxItemSize {
+		o.delete(written)
+		return ErrItemTooLarge
+	}
+	return nil
+}
+
+// blobKeys return keys of blobs the item points to
+func blobKeys(attrs map[string]*dynamodb.AttributeValue) map[string]bool {
+	keys := map[string]bool{}
+	for _, av := range attrs {
+		if av != nil && av.M != nil && av.M[blobRef] != nil {
+			keys[aws.StringValue(av.M[blobRef].S)] = true
+		}
+	}
+	return keys
+}
+
+// delete remove blobs which no item points to, failures only leave unused blobs behind
+// until the item is deleted so they are logged
+func (o *Offload) delete(keys []string) {
+	for _, key := range keys {
+		if err := o.Store.Delete(key); err != nil {
+			fmt.Printf("ddbstore:Offload: delete blob %s: %v\n", key, err)
+		}
+	}
+}
+
+// releaseBlobs delete blobs the item pointed to before a committed write and no longer points to
+// after it. Blob keys are never reused so a released blob can't be referenced by a later write.
+func releaseBlobs(tableName string, before, after map[string]bool) {
+	offload := optionsFor(tableName).Offload
+	if offload == nil {
+		return
+	}
+	var superseded []string
+	for key := range before {
+		if !after[key] {
+			superseded = append(superseded, key)
+		}
+	}
+	offload.delete(superseded)
+}
+
+// discardBlobs delete blobs offloaded for a write which didn't commit, only call it when the
+// write certainly failed, e.g. it was rejected, since the item may point to blobs of a write
+// whose outcome is unknown
+func discardBlobs(tableName string, attrs map[string]*dynamodb.AttributeValue) {
+	offload := optionsFor(tableName).Offload
+	if offload == nil {
+		return
+	}
+	var keys []string
+	for key := range blobKeys(attrs) {
+		keys = append(keys, key)
+	}
+	offload.delete(keys)
+}
+
+// rejected report whether dynamodb refused the write without applying it
+func rejected(err error) bool {
+	var canceled *TransactionCanceledError
+	if errors.As(err, &canceled) {
+		return true
+	}
+	aerr, ok := err.(awserr.Error)
+	if !ok {
+		return false
+	}
+	switch aerr.Code() {
+	case dynamodb.ErrCodeConditionalCheckFailedException, dynamodb.ErrCodeTransactionCanceledException, errCodeValidation:
+		return true
+	}
+	return false
+}
+
+// rehydrate replace pointers with attributes read from blob store in place
+func (o *Offload) rehydrate(attrs map[string]*dynamodb.AttributeValue) error {
+	for name, av := range attrs {
+		if av.M == nil || av.M[blobRef] == nil {
+			continue
+		}
+		data, err := o.Store.Get(aws.StringValue(av.M[blobRef].S))
+		if err != nil {
+			return err
+		}
+		out := &dynamodb.AttributeValue{}
+		if err := json.Unmarshal(data, out); err != nil {
+			return err
+		}
+		attrs[name] = out
+	}
+	return nil
+}
+
+// attrSize return approximate size of attribute value as accounted by dynamodb
+func attrSize(av *dynamodb.AttributeValue) int {
+	switch {
+	case av == nil:
+		return 0
+	case av.S != nil:
+		return len(*av.S)
+	case av.N != nil:
+		return len(*av.N)
+	case av.B != nil:
+		return len(av.B)
+	case av.BOOL != nil, av.NULL != nil:
+		return 1
+	case av.M != nil:
+		size := 3
+		for name, v := range av.M {
+			size += 1 + len(name) + attrSize(v)
+		}
+		return size
+	case av.L != nil:
+		size := 3
+		for _, v := range av.L {
+			size += 1 + attrSize(v)
+		}
+		return size
+	}
+	size := 0
+	for _, s := range av.SS {
+		size += len(*s)
+	}
+	for _, n := range av.NS {
+		size += len(*n)
+	}
+	for _, b := range av.BS {
+		size += len(b)
+	}
+	return size
+}
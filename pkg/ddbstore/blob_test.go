@@ -0,0 +1,176 @@
+package ddbstore
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/expression"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+
+	pb "go-grpc-kubernetes/proto/orderservice"
+)
+
+// countBlobs return number of blobs in the directory of a file blob store
+func countBlobs(t *testing.T, dir string) int {
+	t.Helper()
+	count := 0
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			count++
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestOffloadedUpdateReleasesReplacedBlob(t *testing.T) {
+	dir := t.TempDir()
+	db, tableName := newOrdersTable(t, TableOptions{Offload: &Offload{Store: &FileBlobStore{Dir: dir}, AttributeSize: 10}})
+	for _, name := range []string{strings.Repeat("a", 100), strings.Repeat("b", 100)} {
+		if _, err := PutProtoToDdb(&pb.Order{Uuid: "order-1", CustomerName: name}, "order-1", db, tableName); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out, _, err := GetProtoFromDdb(&pb.Order{}, "order-1", db, tableName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := out.(*pb.Order).CustomerName; name != strings.Repeat("b", 100) {
+		t.Errorf("got customer_name %q, want the second write", name)
+	}
+	if n := countBlobs(t, dir); n != 1 {
+		t.Errorf("got %d blobs, want only the one of the stored item", n)
+	}
+}
+
+func TestOffloadedWriteNotCommittedKeepsStoredBlob(t *testing.T) {
+	dir := t.TempDir()
+	db, tableName := newOrdersTable(t, TableOptions{Offload: &Offload{Store: &FileBlobStore{Dir: dir}, AttributeSize: 10}})
+	if _, err := PutProtoToDdb(&pb.Order{Uuid: "order-1", CustomerName: strings.Repeat("a", 100)}, "order-1", db, tableName); err != nil {
+		t.Fatal(err)
+	}
+	notExists := expression.AttributeNotExists(expression.Name("uuid"))
+	err := NewTransaction().
+		Put(&pb.Order{Uuid: "order-1", CustomerName: strings.Repeat("b", 100)}, "order-1", tableName, &notExists).
+		Commit(db)
+	var canceled *TransactionCanceledError
+	if !errors.As(err, &canceled) {
+		t.Fatalf("got %v, want the transaction canceled", err)
+	}
+	out, _, err := GetProtoFromDdb(&pb.Order{}, "order-1", db, tableName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := out.(*pb.Order).CustomerName; name != strings.Repeat("a", 100) {
+		t.Errorf("got customer_name %q of the canceled write, want the stored one", name)
+	}
+	if n := countBlobs(t, dir); n != 1 {
+		t.Errorf("got %d blobs, want the blob of the canceled write deleted", n)
+	}
+}
+
+func TestOffloadedUpdateChecksMergedItemSize(t *testing.T) {
+	dir := t.TempDir()
+	offload := &Offload{Store: &FileBlobStore{Dir: dir}, AttributeSize: 1000, MaxItemSize: 350}
+	db, tableName := newOrdersTable(t, TableOptions{Offload: offload})
+	if _, err := PutProtoToDdb(&pb.Order{Uuid: "order-1", CustomerName: strings.Repeat("a", 150)}, "order-1", db, tableName); err != nil {
+		t.Fatal(err)
+	}
+	// the update alone fits, the updated item doesn't
+	if _, err := PutProtoToDdb(&pb.Order{Uuid: "order-1", ShippingAddress: strings.Repeat("b", 250)}, "order-1", db, tableName); err != nil {
+		t.Fatal(err)
+	}
+	output, err := db.GetItem(&dynamodb.GetItemInput{Key: keyFor("order-1"), TableName: aws.String(tableName)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if av := output.Item["shipping_address"]; av == nil || av.M[blobRef] == nil {
+		t.Errorf("shipping_address is stored as %v, want a pointer to a blob", av)
+	}
+	out, _, err := GetProtoFromDdb(&pb.Order{}, "order-1", db, tableName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if order := out.(*pb.Order); len(order.CustomerName) != 150 || len(order.ShippingAddress) != 250 {
+		t.Errorf("got customer_name of %d and shipping_address of %d bytes, want 150 and 250", len(order.CustomerName), len(order.ShippingAddress))
+	}
+
+	offload.MaxItemSize = 100
+	_, err = PutProtoToDdb(&pb.Order{Uuid: "order-1", CustomerEmail: "a@example.com"}, "order-1", db, tableName)
+	if !errors.Is(err, ErrItemTooLarge) {
+		t.Errorf("got %v, want ErrItemTooLarge", err)
+	}
+}
+
+func TestDeleteKeepsBlobsOfOtherItems(t *testing.T) {
+	dir := t.TempDir()
+	db, tableName := newOrdersTable(t, TableOptions{Offload: &Offload{Store: &FileBlobStore{Dir: dir}, AttributeSize: 10}})
+	name := strings.Repeat("a", 100)
+	for _, id := range []string{"a", "ab", "b"} {
+		if _, err := PutProtoToDdb(&pb.Order{Uuid: id, CustomerName: name}, id, db, tableName); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// ids which could address the blobs of other items or the whole table are rejected
+	for _, id := range []string{"a/b", "x/..", "..", ""} {
+		if err := DeleteProtoFromDdb(id, db, tableName); err != ErrKeyMismatched {
+			t.Errorf("deleting %q: got %v, want ErrKeyMismatched", id, err)
+		}
+		if err := BatchDeleteProtoFromDdb([]string{"b", id}, db, tableName); err != ErrKeyMismatched {
+			t.Errorf("batch deleting %q: got %v, want ErrKeyMismatched", id, err)
+		}
+		if err := NewTransaction().Delete(id, tableName, nil).Commit(db); err != ErrKeyMismatched {
+			t.Errorf("deleting %q in a transaction: got %v, want ErrKeyMismatched", id, err)
+		}
+	}
+	if err := DeleteProtoFromDdb("a", db, tableName); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"ab", "b"} {
+		out, _, err := GetProtoFromDdb(&pb.Order{}, id, db, tableName)
+		if err != nil {
+			t.Fatalf("reading %s: %v", id, err)
+		}
+		if out.(*pb.Order).CustomerName != name {
+			t.Errorf("got %v", out)
+		}
+	}
+	if n := countBlobs(t, dir); n != 2 {
+		t.Errorf("got %d blobs, want the blobs of the items left", n)
+	}
+}
+
+// failingDeleteS3 is an s3 bucket which lists a single object and fails to delete it
+type failingDeleteS3 struct {
+	s3iface.S3API
+}
+
+func (failingDeleteS3) ListObjectsV2Pages(input *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool) error {
+	fn(&s3.ListObjectsV2Output{Contents: []*s3.Object{{Key: aws.String(aws.StringValue(input.Prefix) + "name.0")}}}, true)
+	return nil
+}
+
+func (failingDeleteS3) DeleteObjects(input *s3.DeleteObjectsInput) (*s3.DeleteObjectsOutput, error) {
+	return &s3.DeleteObjectsOutput{Errors: []*s3.Error{{
+		Key:     input.Delete.Objects[0].Key,
+		Code:    aws.String("AccessDenied"),
+		Message: aws.String("Access Denied"),
+	}}}, nil
+}
+
+func TestS3DeleteAllReportsObjectErrors(t *testing.T) {
+	store := &S3BlobStore{Bucket: "blobs", Prefix: "orders/", S3: failingDeleteS3{}}
+	err := store.DeleteAll("table/6f72646572/")
+	if err == nil || !strings.Contains(err.Error(), "AccessDenied") {
+		t.Errorf("got %v, want the failed object reported", err)
+	}
+}
@@ -0,0 +1,516 @@
+package ddbstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// actions of bulk operations
+const (
+	BulkIndex  = "index"
+	BulkDelete = "delete"
+	// BulkCreate indexes the document unless it exists
+	BulkCreate = "create"
+)
+
+// refresh policies of bulk requests
+const (
+	RefreshFalse   = "false"
+	RefreshTrue    = "true"
+	RefreshWaitFor = "wait_for"
+)
+
+var (
+	ErrUnknownRefreshPolicy = errors.New("unknown refresh policy")
+	ErrBulkIndexerClosed    = errors.New("bulk indexer closed")
+	ErrUnknownMessage       = errors.New("items in binary format can't be indexed without the message type of the table")
+)
+
+// BulkOperation is a single index or delete of a document sent in a _bulk request
+type BulkOperation struct {
+	Action     string
+	Index      string
+	DocumentID string
+	// Body is the json document of index operations
+	Body []byte
+}
+
+// size return number of bytes the operation takes in the _bulk request body
+func (op *BulkOperation) size() int {
+	return len(op.Action) + len(op.Index) + len(op.DocumentID) + len(op.Body) + 32
+}
+
+// BulkItemError is an operation elasticsearch didn't apply
+type BulkItemError struct {
+	// Position of the operation in the operations given to Apply
+	Position   int
+	Action     string
+	Index      string
+	DocumentID string
+	Status     int
+	Type       string
+	Reason     string
+}
+
+// BulkError lists operations of a bulk which failed after retries
+type BulkError struct {
+	Items []BulkItemError
+}
+
+func (e *BulkError) Error() string {
+	first := e.Items[0]
+	return fmt.Sprintf("%d bulk operations failed, first %s %s/%s: [%d] %s: %s",
+		len(e.Items), first.Action, first.Index, first.DocumentID, first.Status, first.Type, first.Reason)
+}
+
+// BatchIndexer applies many index and delete operations at once, operations of the same document
+// are applied in the given order. It is implemented by *BulkIndexer.
+type BatchIndexer interface {
+	Apply(ctx context.Context, ops []BulkOperation) error
+}
+
+// BulkOptions configure NewBulkIndexer
+type BulkOptions struct {
+	// MaxActions is the max number of operations sent in a single _bulk request
+	MaxActions int
+	// MaxBytes is the max size of a _bulk request body
+	MaxBytes int
+	// FlushInterval is the longest time buffered operations wait before they are sent
+	FlushInterval time.Duration
+	// Refresh is false, true or wait_for refresh policy of _bulk requests
+	Refresh string
+	// Retry configure backoff of operations elasticsearch rejected for load
+	Retry BatchOptions
+}
+
+// DefaultBulkOptions used for options left zero
+var DefaultBulkOptions = BulkOptions{
+	MaxActions:    500,
+	MaxBytes:      5 << 20,
+	FlushInterval: time.Second,
+	Refresh:       RefreshFalse,
+	Retry:         DefaultBatchOptions,
+}
+
+// ValidRefreshPolicy return error unless policy is false, true or wait_for
+func ValidRefreshPolicy(policy string) error {
+	switch policy {
+	case RefreshFalse, RefreshTrue, RefreshWaitFor:
+		return nil
+	}
+	return fmt.Errorf("%w: %q", ErrUnknownRefreshPolicy, policy)
+}
+
+// BulkIndexer groups index and delete operations into _bulk requests. Update and Remove buffer
+// operations which are sent once MaxActions or MaxBytes is reached, FlushInterval passed or on Flush,
+// while Apply sends the given operations right away. Operations elasticsearch rejected for load
+// are retried with backoff, other failed operations are reported as *BulkError.
+type BulkIndexer struct {
+	es   *Elasticsearch
+	opts BulkOptions
+
+	mu      sync.Mutex
+	targets map[string]reindexTarget
+	pending []BulkOperation
+	bytes   int
+	// err of flushes in background, reported by the next Flush
+	err    error
+	closed bool
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// NewBulkIndexer return bulk indexer sending requests with the es client
+func NewBulkIndexer(es *Elasticsearch, opts BulkOptions) (*BulkIndexer, error) {
+	defaults := DefaultBulkOptions
+	if opts.MaxActions == 0 {
+		opts.MaxActions = defaults.MaxActions
+	}
+	if opts.MaxBytes == 0 {
+		opts.MaxBytes = defaults.MaxBytes
+	}
+	if opts.FlushInterval == 0 {
+		opts.FlushInterval = defaults.FlushInterval
+	}
+	if opts.Refresh == "" {
+		opts.Refresh = defaults.Refresh
+	}
+	opts.Retry = opts.Retry.withDefaults()
+	if err := ValidRefreshPolicy(opts.Refresh); err != nil {
+		return nil, err
+	}
+	b := &BulkIndexer{
+		es:      es,
+		opts:    opts,
+		targets: map[string]reindexTarget{},
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go b.flushEvery(opts.FlushInterval)
+	return b, nil
+}
+
+// flushEvery send buffered operations every interval until the indexer is closed
+func (b *BulkIndexer) flushEvery(interval time.Duration) {
+	defer close(b.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-ticker.C:
+			if err := b.Flush(context.Background()); err != nil {
+				fmt.Printf("ddbstore:BulkIndexer: %v\n", err)
+				b.mu.Lock()
+				if b.err == nil {
+					b.err = err
+				}
+				b.mu.Unlock()
+			}
+		}
+	}
+}
+
+// Update implements DocumentIndexer, it buffers index operation of the item
+func (b *BulkIndexer) Update(d *Details, item map[string]events.DynamoDBAttributeValue) error {
+	op, err := IndexOperation(d, item)
+	if err != nil {
+		return err
+	}
+	return b.add(op)
+}
+
+// Remove implements DocumentIndexer, it buffers delete operation of the item
+func (b *BulkIndexer) Remove(d *Details, item map[string]events.DynamoDBAttributeValue) error {
+	return b.add(DeleteOperation(d, item))
+}
+
+// add buffer the operation and send the buffer once it is full
+func (b *BulkIndexer) add(op BulkOperation) error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return ErrBulkIndexerClosed
+	}
+	b.pending = append(b.pending, op)
+	b.bytes += op.size()
+	full := len(b.pending) >= b.opts.MaxActions || b.bytes >= b.opts.MaxBytes
+	b.mu.Unlock()
+	if full {
+		return b.Flush(context.Background())
+	}
+	return nil
+}
+
+// Flush send buffered operations, it returns errors of operations failed since the last Flush
+func (b *BulkIndexer) Flush(ctx context.Context) error {
+	b.mu.Lock()
+	ops := b.pending
+	b.pending, b.bytes = nil, 0
+	err := b.err
+	b.err = nil
+	b.mu.Unlock()
+	if applyErr := b.Apply(ctx, ops); applyErr != nil {
+		return applyErr
+	}
+	return err
+}
+
+// Close stop background flushes and send buffered operations
+func (b *BulkIndexer) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	b.mu.Unlock()
+	close(b.stop)
+	<-b.done
+	return b.Flush(context.Background())
+}
+
+// Apply send the operations in _bulk requests of at most MaxActions and MaxBytes. Index and delete
+// operations of an index being reindexed are applied to the new index as well.
+func (b *BulkIndexer) Apply(ctx context.Context, ops []BulkOperation) error {
+	ops, origins := b.dualWrites(ctx, ops)
+	var failed []BulkItemError
+	for start := 0; start < len(ops); {
+		end, size := start, 0
+		for end < len(ops) && end-start < b.opts.MaxActions && (end == start || size+ops[end].size() <= b.opts.MaxBytes) {
+			size += ops[end].size()
+			end++
+		}
+		chunk := make([]int, 0, end-start)
+		for i := start; i < end; i++ {
+			chunk = append(chunk, i)
+		}
+		failed = append(failed, b.send(ctx, ops, chunk)...)
+		start = end
+	}
+	if len(failed) > 0 {
+		for i := range failed {
+			failed[i].Position = origins[failed[i].Position]
+		}
+		return &BulkError{Items: failed}
+	}
+	return nil
+}
+
+// reindexTarget is the cached reindex alias of an index
+type reindexTarget struct {
+	alias   string
+	checked time.Time
+}
+
+// reindexAlias return reindex alias of the index when it exists, looked up once per reindexTargetsTTL
+func (b *BulkIndexer) reindexAlias(ctx context.Context, index string) string {
+	b.mu.Lock()
+	target, ok := b.targets[index]
+	b.mu.Unlock()
+	if ok && time.Since(target.checked) < reindexTargetsTTL {
+		return target.alias
+	}
+	indices, err := b.es.AliasIndices(ctx, ReindexAlias(index))
+	if err != nil {
+		// keep writing where we did, the lookup is repeated after the TTL
+		fmt.Printf("ddbstore:BulkIndexer: %v\n", err)
+	} else if len(indices) > 0 {
+		target.alias = ReindexAlias(index)
+	} else {
+		target.alias = ""
+	}
+	target.checked = time.Now()
+	b.mu.Lock()
+	b.targets[index] = target
+	b.mu.Unlock()
+	return target.alias
+}
+
+// dualWrites return the operations with copies writing to reindex aliases right after the originals,
+// origins map positions of returned operations to positions of given ones
+func (b *BulkIndexer) dualWrites(ctx context.Context, ops []BulkOperation) ([]BulkOperation, []int) {
+	out := make([]BulkOperation, 0, len(ops))
+	origins := make([]int, 0, len(ops))
+	for i, op := range ops {
+		out = append(out, op)
+		origins = append(origins, i)
+		if op.Action == BulkCreate {
+			continue
+		}
+		if alias := b.reindexAlias(ctx, op.Index); alias != "" {
+			op.Index = alias
+			out = append(out, op)
+			origins = append(origins, i)
+		}
+	}
+	return out, origins
+}
+
+// bulkResult is the result of a single operation in the _bulk response
+type bulkResult struct {
+	Status int `json:"status"`
+	Error  struct {
+		Type   string `json:"type"`
+		Reason string `json:"reason"`
+	} `json:"error"`
+}
+
+// bulkResponse is the part of the _bulk response reporting results of operations,
+// every item has a single key which is the action of the operation
+type bulkResponse struct {
+	Errors bool                    `json:"errors"`
+	Items  []map[string]bulkResult `json:"items"`
+}
+
+// retryableStatus report whether elasticsearch rejected the request for load
+func retryableStatus(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// send apply operations at positions, retrying the ones rejected for load. When an operation of
+// a document is retried so are the later operations of the same document, so they are applied in order.
+func (b *BulkIndexer) send(ctx context.Context, ops []BulkOperation, positions []int) []BulkItemError {
+	var failed []BulkItemError
+	for attempt := 0; len(positions) > 0; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				for _, i := range positions {
+					failed = append(failed, itemError(ops, i, 0, "context", ctx.Err().Error()))
+				}
+				return failed
+			case <-time.After(b.opts.Retry.backoff(attempt - 1)):
+			}
+		}
+		last := attempt+1 >= b.opts.Retry.MaxAttempts
+		results, err := b.bulk(ctx, ops, positions)
+		if err != nil {
+			status := 0
+			if statusErr, ok := err.(*bulkStatusError); ok {
+				status = statusErr.status
+			}
+			if !last && (status == 0 || retryableStatus(status)) && ctx.Err() == nil {
+				fmt.Printf("ddbstore:BulkIndexer: retrying %d operations: %v\n", len(positions), err)
+				continue
+			}
+			for _, i := range positions {
+				failed = append(failed, itemError(ops, i, status, "request", err.Error()))
+			}
+			return failed
+		}
+		var retry []int
+		retried := map[string]bool{}
+		for n, i := range positions {
+			result := results[n]
+			key := ops[i].Index + "/" + ops[i].DocumentID
+			switch {
+			case retried[key]:
+				retry = append(retry, i)
+			case result.Status < 300, ops[i].Action == BulkDelete && result.Status == http.StatusNotFound,
+				ops[i].Action == BulkCreate && result.Status == http.StatusConflict:
+			case retryableStatus(result.Status) && !last:
+				retried[key] = true
+				retry = append(retry, i)
+			default:
+				failed = append(failed, itemError(ops, i, result.Status, result.Error.Type, result.Error.Reason))
+			}
+		}
+		positions = retry
+	}
+	return failed
+}
+
+// itemError return error of operation at position i
+func itemError(ops []BulkOperation, i, status int, errType, reason string) BulkItemError {
+	return BulkItemError{
+		Position:   i,
+		Action:     ops[i].Action,
+		Index:      ops[i].Index,
+		DocumentID: ops[i].DocumentID,
+		Status:     status,
+		Type:       errType,
+		Reason:     reason,
+	}
+}
+
+// bulkStatusError is a _bulk request elasticsearch failed as a whole
+type bulkStatusError struct {
+	status int
+	body   string
+}
+
+func (e *bulkStatusError) Error() string {
+	return fmt.Sprintf("[%d] bulk request failed: %s", e.status, e.body)
+}
+
+// bulk send a single _bulk request with operations at positions and return their results in order
+func (b *BulkIndexer) bulk(ctx context.Context, ops []BulkOperation, positions []int) ([]bulkResult, error) {
+	var body bytes.Buffer
+	for _, i := range positions {
+		op := ops[i]
+		meta := map[string]map[string]string{op.Action: {"_index": op.Index, "_id": op.DocumentID}}
+		line, err := json.Marshal(meta)
+		if err != nil {
+			return nil, err
+		}
+		body.Write(line)
+		body.WriteByte('\n')
+		if op.Action != BulkDelete {
+			body.Write(op.Body)
+			body.WriteByte('\n')
+		}
+	}
+	res, err := b.es.Bulk(
+		&body,
+		b.es.Bulk.WithRefresh(b.opts.Refresh),
+		b.es.Bulk.WithContext(ctx),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+		return nil, &bulkStatusError{status: res.StatusCode, body: slim.ReplaceAllString(string(msg), " ")}
+	}
+	var resp bulkResponse
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		return nil, err
+	}
+	if len(resp.Items) != len(positions) {
+		return nil, fmt.Errorf("bulk response has %d items for %d operations", len(resp.Items), len(positions))
+	}
+	results := make([]bulkResult, len(positions))
+	for n, item := range resp.Items {
+		for _, result := range item {
+			results[n] = result
+		}
+	}
+	return results, nil
+}
+
+// document return json document indexed for the item, redacted attributes left out.
+// Items in binary format are decoded so their fields are indexed rather than the binary attribute.
+func document(d *Details, item map[string]events.DynamoDBAttributeValue) ([]byte, error) {
+	tmp := EventStreamToMap(item)
+	if _, ok := tmp[protoAttribute]; ok {
+		decoded, err := binaryDocument(tmp, d.TableName)
+		if err != nil {
+			return nil, err
+		}
+		tmp = decoded
+	}
+	for _, name := range d.Redacted {
+		delete(tmp, name)
+	}
+	var i interface{}
+	if err := dynamodbattribute.UnmarshalMap(tmp, &i); err != nil {
+		return nil, err
+	}
+	return json.Marshal(i)
+}
+
+// binaryDocument return attributes of the item in binary format as they are in json format
+func binaryDocument(attrs map[string]*dynamodb.AttributeValue, tableName string) (map[string]*dynamodb.AttributeValue, error) {
+	opts := optionsFor(tableName)
+	if opts.Message == nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownMessage, tableName)
+	}
+	msg, err := decodeItem(opts.Message, attrs, tableName)
+	if err != nil {
+		return nil, err
+	}
+	return protoToAttrs(msg, opts.EmitDefaults)
+}
+
+// IndexOperation return bulk operation indexing the item
+func IndexOperation(d *Details, item map[string]events.DynamoDBAttributeValue) (BulkOperation, error) {
+	body, err := document(d, item)
+	if err != nil {
+		return BulkOperation{}, err
+	}
+	return BulkOperation{Action: BulkIndex, Index: d.index(), DocumentID: d.docID(item), Body: body}, nil
+}
+
+// DeleteOperation return bulk operation deleting document of the item
+func DeleteOperation(d *Details, item map[string]events.DynamoDBAttributeValue) BulkOperation {
+	return BulkOperation{Action: BulkDelete, Index: d.index(), DocumentID: d.docID(item)}
+}
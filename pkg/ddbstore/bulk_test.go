@@ -0,0 +1,188 @@
+package ddbstore
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// bulkStub is an elasticsearch answering _bulk requests with the status of each operation given by
+// item, or failing the whole request with the status given by request when it isn't 200
+type bulkStub struct {
+	mu sync.Mutex
+	// requests lists "action id" of the operations of every _bulk request
+	requests [][]string
+	request  func(call int) int
+	item     func(call int, action, id string) (int, string)
+}
+
+func (s *bulkStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	if r.URL.Path != "/_bulk" {
+		// no index is being reindexed
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{}`))
+		return
+	}
+	call := len(s.requests)
+	var ops []string
+	var items []map[string]map[string]interface{}
+	lines := bufio.NewScanner(r.Body)
+	for lines.Scan() {
+		var meta map[string]map[string]string
+		json.Unmarshal(lines.Bytes(), &meta)
+		for action, target := range meta {
+			if action != BulkDelete {
+				lines.Scan()
+			}
+			ops = append(ops, action+" "+target["_id"])
+			status, errType := http.StatusOK, ""
+			if s.item != nil {
+				status, errType = s.item(call, action, target["_id"])
+			}
+			result := map[string]interface{}{"_index": target["_index"], "_id": target["_id"], "status": status}
+			if errType != "" {
+				result["error"] = map[string]string{"type": errType, "reason": errType + " of " + target["_id"]}
+			}
+			items = append(items, map[string]map[string]interface{}{action: result})
+		}
+	}
+	s.requests = append(s.requests, ops)
+	if s.request != nil {
+		if status := s.request(call); status != http.StatusOK {
+			w.WriteHeader(status)
+			w.Write([]byte(`{"error":{"type":"es_rejected_execution_exception"},"status":` + strconv.Itoa(status) + `}`))
+			return
+		}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"errors": true, "items": items})
+}
+
+func newTestBulkIndexer(t *testing.T, stub *bulkStub, opts BulkOptions) *BulkIndexer {
+	t.Helper()
+	srv := httptest.NewServer(stub)
+	t.Cleanup(srv.Close)
+	es, err := NewElasticsearchWithOptions(ElasticsearchOptions{Addresses: []string{srv.URL}, Auth: ElasticsearchAuthNone})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.Retry = quickRetry
+	b, err := NewBulkIndexer(es, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+	return b
+}
+
+func bulkOps(actions ...string) []BulkOperation {
+	ops := make([]BulkOperation, len(actions))
+	for i, a := range actions {
+		parts := strings.Fields(a)
+		ops[i] = BulkOperation{Action: parts[0], Index: "orders", DocumentID: parts[1]}
+		if parts[0] != BulkDelete {
+			ops[i].Body = []byte(`{"uuid":"` + parts[1] + `"}`)
+		}
+	}
+	return ops
+}
+
+func TestBulkRetriesOperationsRejectedForLoad(t *testing.T) {
+	stub := &bulkStub{item: func(call int, action, id string) (int, string) {
+		switch {
+		case call == 0 && id == "order-2":
+			return http.StatusTooManyRequests, "es_rejected_execution_exception"
+		case call == 0 && id == "order-3" && action == BulkIndex:
+			return http.StatusServiceUnavailable, "unavailable_shards_exception"
+		}
+		return http.StatusOK, ""
+	}}
+	b := newTestBulkIndexer(t, stub, BulkOptions{})
+	ops := bulkOps("index order-1", "index order-2", "index order-3", "delete order-3", "index order-4")
+	if err := b.Apply(context.Background(), ops); err != nil {
+		t.Fatal(err)
+	}
+	// the delete of order-3 succeeded but is sent again after the retried index so it stays deleted
+	want := [][]string{
+		{"index order-1", "index order-2", "index order-3", "delete order-3", "index order-4"},
+		{"index order-2", "index order-3", "delete order-3"},
+	}
+	if !reflect.DeepEqual(stub.requests, want) {
+		t.Errorf("sent %v, want %v", stub.requests, want)
+	}
+}
+
+func TestBulkReportsFailedOperations(t *testing.T) {
+	stub := &bulkStub{item: func(call int, action, id string) (int, string) {
+		switch id {
+		case "order-1":
+			return http.StatusBadRequest, "mapper_parsing_exception"
+		case "order-2":
+			return http.StatusNotFound, "not_found"
+		case "order-3":
+			return http.StatusConflict, "version_conflict_engine_exception"
+		case "order-4":
+			return http.StatusTooManyRequests, "es_rejected_execution_exception"
+		}
+		return http.StatusOK, ""
+	}}
+	b := newTestBulkIndexer(t, stub, BulkOptions{})
+	// deleting a missing document and creating an existing one aren't failures
+	ops := bulkOps("index order-1", "delete order-2", "create order-3", "index order-4", "index order-5")
+	err := b.Apply(context.Background(), ops)
+	var bulkErr *BulkError
+	if !errors.As(err, &bulkErr) {
+		t.Fatalf("got %v, want *BulkError", err)
+	}
+	want := []BulkItemError{
+		{Position: 0, Action: BulkIndex, Index: "orders", DocumentID: "order-1", Status: http.StatusBadRequest, Type: "mapper_parsing_exception", Reason: "mapper_parsing_exception of order-1"},
+		{Position: 3, Action: BulkIndex, Index: "orders", DocumentID: "order-4", Status: http.StatusTooManyRequests, Type: "es_rejected_execution_exception", Reason: "es_rejected_execution_exception of order-4"},
+	}
+	if !reflect.DeepEqual(bulkErr.Items, want) {
+		t.Errorf("got failed operations %+v, want %+v", bulkErr.Items, want)
+	}
+	if len(stub.requests) != quickRetry.MaxAttempts {
+		t.Errorf("sent %d requests, want order-4 retried until the attempts ran out", len(stub.requests))
+	}
+	if !strings.HasPrefix(err.Error(), "2 bulk operations failed, first index orders/order-1: [400] mapper_parsing_exception") {
+		t.Errorf("got error %q", err)
+	}
+}
+
+func TestBulkRetriesFailedRequests(t *testing.T) {
+	stub := &bulkStub{request: func(call int) int {
+		if call == 0 {
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusOK
+	}}
+	b := newTestBulkIndexer(t, stub, BulkOptions{MaxActions: 2})
+	if err := b.Apply(context.Background(), bulkOps("index order-1", "index order-2", "index order-3")); err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{{"index order-1", "index order-2"}, {"index order-1", "index order-2"}, {"index order-3"}}
+	if !reflect.DeepEqual(stub.requests, want) {
+		t.Errorf("sent %v, want the rejected request retried and chunks of MaxActions", stub.requests)
+	}
+
+	stub = &bulkStub{request: func(call int) int { return http.StatusBadRequest }}
+	b = newTestBulkIndexer(t, stub, BulkOptions{})
+	err := b.Apply(context.Background(), bulkOps("index order-1", "delete order-2"))
+	var bulkErr *BulkError
+	if !errors.As(err, &bulkErr) || len(bulkErr.Items) != 2 || bulkErr.Items[1].Status != http.StatusBadRequest || bulkErr.Items[1].Type != "request" {
+		t.Fatalf("got %v, want both operations failed with the request", err)
+	}
+	if len(stub.requests) != 1 {
+		t.Errorf("sent %d requests, want a bad request not retried", len(stub.requests))
+	}
+}
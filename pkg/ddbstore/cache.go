@@ -0,0 +1,167 @@
+package ddbstore
+
+import (
+	"container/list"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// Cache is an in-process LRU cache of proto messages with time to live
+type Cache struct {
+	mu    sync.Mutex
+	size  int
+	ttl   time.Duration
+	ll    *list.List
+	items map[string]*list.Element
+	// loads of keys in flight, invalidating a key while it loads keeps the loaded message out
+	loads    map[string]*cacheLoad
+	disabled bool
+	// now is replaced by a fake clock in tests
+	now func() time.Time
+
+	vars                                   *expvar.Map
+	hits, misses, evictions, invalidations expvar.Int
+}
+
+type cacheLoad struct {
+	// pending is the number of loads of the key in flight
+	pending int
+	// generation is incremented on every invalidation of the key
+	generation uint64
+}
+
+type cacheEntry struct {
+	key     string
+	msg     proto.Message
+	expires time.Time
+}
+
+// NewCache return a new cache holding up to size messages for ttl each
+func NewCache(size int, ttl time.Duration) *Cache {
+	c := &Cache{
+		size:  size,
+		ttl:   ttl,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+		loads: make(map[string]*cacheLoad),
+		now:   time.Now,
+		vars:  new(expvar.Map).Init(),
+	}
+	c.vars.Set("hits", &c.hits)
+	c.vars.Set("misses", &c.misses)
+	c.vars.Set("evictions", &c.evictions)
+	c.vars.Set("invalidations", &c.invalidations)
+	return c
+}
+
+// Vars return cache metrics: hits, misses, evictions and invalidations,
+// they can be exposed with expvar.Publish
+func (c *Cache) Vars() *expvar.Map {
+	return c.vars
+}
+
+// Get return copy of cached message if present and not expired
+func (c *Cache) Get(key string) (proto.Message, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+	entry := el.Value.(*cacheEntry)
+	if c.now().After(entry.expires) {
+		c.removeElement(el)
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	c.hits.Add(1)
+	return proto.Clone(entry.msg), true
+}
+
+// Load return the cached message or the one loaded by fn, which is cached unless the key
+// was invalidated while it loaded since the loaded message may be older than the change
+func (c *Cache) Load(key string, fn func() (proto.Message, error)) (proto.Message, error) {
+	if msg, ok := c.Get(key); ok {
+		return msg, nil
+	}
+	c.mu.Lock()
+	load, ok := c.loads[key]
+	if !ok {
+		load = &cacheLoad{}
+		c.loads[key] = load
+	}
+	load.pending++
+	generation := load.generation
+	c.mu.Unlock()
+	msg, err := fn()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if load.pending--; load.pending == 0 {
+		delete(c.loads, key)
+	}
+	if err == nil && load.generation == generation {
+		c.set(key, msg)
+	}
+	return msg, err
+}
+
+// Set store copy of message under the key, evicting the least recently used one when full
+func (c *Cache) Set(key string, msg proto.Message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.set(key, msg)
+}
+
+// set is Set with c.mu held
+func (c *Cache) set(key string, msg proto.Message) {
+	if c.disabled {
+		return
+	}
+	entry := &cacheEntry{
+		key:     key,
+		msg:     proto.Clone(msg),
+		expires: c.now().Add(c.ttl),
+	}
+	if el, ok := c.items[key]; ok {
+		el.Value = entry
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.ll.PushFront(entry)
+	for c.ll.Len() > c.size {
+		c.removeElement(c.ll.Back())
+		c.evictions.Add(1)
+	}
+}
+
+// Invalidate remove the key from cache
+func (c *Cache) Invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if load, ok := c.loads[key]; ok {
+		load.generation++
+	}
+	if el, ok := c.items[key]; ok {
+		c.removeElement(el)
+		c.invalidations.Add(1)
+	}
+}
+
+// Disable empty the cache and stop caching messages, e.g. once invalidations can't be followed
+func (c *Cache) Disable() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.disabled = true
+	c.ll.Init()
+	c.items = make(map[string]*list.Element)
+}
+
+func (c *Cache) removeElement(el *list.Element) {
+	c.ll.Remove(el)
+	delete(c.items, el.Value.(*cacheEntry).key)
+}
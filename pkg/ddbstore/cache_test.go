@@ -0,0 +1,137 @@
+package ddbstore
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	pb "go-grpc-kubernetes/proto/orderservice"
+)
+
+// newTestCache return a cache whose clock only moves when the test sets it
+func newTestCache(size int, ttl time.Duration) (*Cache, *time.Time) {
+	now := time.Unix(1000, 0)
+	c := NewCache(size, ttl)
+	c.now = func() time.Time { return now }
+	return c, &now
+}
+
+func cachedUUID(c *Cache, key string) string {
+	msg, ok := c.Get(key)
+	if !ok {
+		return ""
+	}
+	return msg.(*pb.Order).Uuid
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c, _ := newTestCache(2, time.Minute)
+	c.Set("order-1", &pb.Order{Uuid: "order-1"})
+	c.Set("order-2", &pb.Order{Uuid: "order-2"})
+	// reading order-1 leaves order-2 the least recently used
+	if uuid := cachedUUID(c, "order-1"); uuid != "order-1" {
+		t.Fatalf("got %q, want order-1 cached", uuid)
+	}
+	c.Set("order-3", &pb.Order{Uuid: "order-3"})
+	if uuid := cachedUUID(c, "order-2"); uuid != "" {
+		t.Errorf("got %q, want order-2 evicted", uuid)
+	}
+	for _, key := range []string{"order-1", "order-3"} {
+		if uuid := cachedUUID(c, key); uuid != key {
+			t.Errorf("got %q, want %s cached", uuid, key)
+		}
+	}
+	if c.evictions.Value() != 1 || c.hits.Value() != 3 || c.misses.Value() != 1 {
+		t.Errorf("got %d evictions, %d hits and %d misses, want 1, 3 and 1", c.evictions.Value(), c.hits.Value(), c.misses.Value())
+	}
+}
+
+func TestCacheExpiresMessages(t *testing.T) {
+	c, now := newTestCache(2, time.Minute)
+	c.Set("order-1", &pb.Order{Uuid: "order-1"})
+	*now = now.Add(time.Minute)
+	if uuid := cachedUUID(c, "order-1"); uuid != "order-1" {
+		t.Errorf("got %q, want order-1 cached until its ttl passed", uuid)
+	}
+	*now = now.Add(time.Nanosecond)
+	if uuid := cachedUUID(c, "order-1"); uuid != "" {
+		t.Errorf("got %q, want order-1 expired", uuid)
+	}
+}
+
+func TestCacheReturnsCopies(t *testing.T) {
+	c, _ := newTestCache(2, time.Minute)
+	order := &pb.Order{Uuid: "order-1", Quantity: 1}
+	c.Set("order-1", order)
+	order.Quantity = 2
+	cached, _ := c.Get("order-1")
+	cached.(*pb.Order).Quantity = 3
+	if cached, _ := c.Get("order-1"); cached.(*pb.Order).Quantity != 1 {
+		t.Errorf("got %v, want the message as it was set", cached)
+	}
+}
+
+func TestCacheInvalidate(t *testing.T) {
+	c, _ := newTestCache(2, time.Minute)
+	c.Set("order-1", &pb.Order{Uuid: "order-1"})
+	c.Invalidate("order-1")
+	c.Invalidate("order-2")
+	if uuid := cachedUUID(c, "order-1"); uuid != "" {
+		t.Errorf("got %q, want order-1 invalidated", uuid)
+	}
+	if c.invalidations.Value() != 1 {
+		t.Errorf("got %d invalidations, want only the cached key counted", c.invalidations.Value())
+	}
+}
+
+func TestCacheLoadSkipsMessagesInvalidatedWhileLoading(t *testing.T) {
+	c, _ := newTestCache(2, time.Minute)
+	msg, err := c.Load("order-1", func() (proto.Message, error) {
+		// the order changed after it was read
+		c.Invalidate("order-1")
+		return &pb.Order{Uuid: "order-1", Quantity: 1}, nil
+	})
+	if err != nil || msg.(*pb.Order).Quantity != 1 {
+		t.Fatalf("got %v, %v, want the loaded order", msg, err)
+	}
+	if uuid := cachedUUID(c, "order-1"); uuid != "" {
+		t.Errorf("got %q, want the stale order kept out", uuid)
+	}
+	loads := 0
+	load := func() (proto.Message, error) {
+		loads++
+		return &pb.Order{Uuid: "order-1"}, nil
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := c.Load("order-1", load); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if loads != 1 {
+		t.Errorf("loaded %d times, want the order cached after the first load", loads)
+	}
+	if len(c.loads) != 0 {
+		t.Errorf("got %d loads left in flight", len(c.loads))
+	}
+	failed := errors.New("failed")
+	if _, err := c.Load("order-2", func() (proto.Message, error) { return nil, failed }); err != failed {
+		t.Errorf("got %v, want the error of the load", err)
+	}
+	if _, ok := c.Get("order-2"); ok {
+		t.Error("failed load was cached")
+	}
+}
+
+func TestCacheDisable(t *testing.T) {
+	c, _ := newTestCache(2, time.Minute)
+	c.Set("order-1", &pb.Order{Uuid: "order-1"})
+	c.Disable()
+	c.Set("order-2", &pb.Order{Uuid: "order-2"})
+	for _, key := range []string{"order-1", "order-2"} {
+		if uuid := cachedUUID(c, key); uuid != "" {
+			t.Errorf("got %q from a disabled cache", uuid)
+		}
+	}
+}
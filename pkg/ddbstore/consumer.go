@@ -0,0 +1,553 @@
+package ddbstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/dynamodb/expression"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams/dynamodbstreamsiface"
+)
+
+// attributes of items of the lease table
+const (
+	leaseStreamAttribute     = "stream_arn"
+	leaseShardAttribute      = "shard_id"
+	leaseOwnerAttribute      = "owner"
+	leaseExpiresAttribute    = "expires"
+	leaseCheckpointAttribute = "checkpoint"
+	leaseFinishedAttribute   = "finished"
+)
+
+var (
+	// ErrLeaseLost is returned when another consumer took over the shard lease
+	ErrLeaseLost = errors.New("shard lease taken over by another consumer")
+)
+
+// StreamHandler handle a batch of stream records, it has the signature of the lambda handler
+// so the same handlers serve lambda and StreamConsumer
+type StreamHandler func(ctx context.Context, event events.DynamoDBEvent) (StreamBatchResponse, error)
+
+// StreamConsumerOptions configure NewStreamConsumer
+type StreamConsumerOptions struct {
+	// LeaseTable keeps shard leases and checkpoints, see LeaseTableSpec
+	LeaseTable string
+	// Owner identifies the consumer in leases, e.g. pod name. It must be unique among consumers.
+	Owner string
+	// LeaseDuration is how long a shard stays leased to a consumer which stopped renewing it
+	LeaseDuration time.Duration
+	// PollInterval is the pause between GetRecords calls returning no records
+	PollInterval time.Duration
+	// ShardsInterval is how often shards are discovered and unowned leases taken
+	ShardsInterval time.Duration
+	// BatchSize is the max number of records given to the handler at once
+	BatchSize int64
+	// StartAt is TRIM_HORIZON or LATEST position of shards without checkpoint. Children of split
+	// shards always start at TRIM_HORIZON so records written after a split are not missed.
+	StartAt string
+	// Retry configure backoff of batches the handler failed
+	Retry BatchOptions
+}
+
+// DefaultStreamConsumerOptions used for options left zero
+var DefaultStreamConsumerOptions = StreamConsumerOptions{
+	LeaseDuration:  30 * time.Second,
+	PollInterval:   watchIdleInterval,
+	ShardsInterval: watchShardsInterval,
+	BatchSize:      100,
+	StartAt:        dynamodbstreams.ShardIteratorTypeTrimHorizon,
+	Retry:          DefaultBatchOptions,
+}
+
+// LeaseTableSpec return spec of the table keeping leases and checkpoints of stream consumers,
+// a single lease table can serve consumers of many streams
+func LeaseTableSpec(tableName string) *TableSpec {
+	return &TableSpec{
+		TableName: tableName,
+		HashKey:   leaseStreamAttribute,
+		RangeKey:  leaseShardAttribute,
+		AttributeTypes: map[string]string{
+			leaseStreamAttribute: dynamodb.ScalarAttributeTypeS,
+			leaseShardAttribute:  dynamodb.ScalarAttributeTypeS,
+		},
+		BillingMode: dynamodb.BillingModePayPerRequest,
+	}
+}
+
+// lease of a shard read from the lease table
+type lease struct {
+	owner      string
+	expires    time.Time
+	checkpoint string
+	finished   bool
+}
+
+func leaseFromItem(item map[string]*dynamodb.AttributeValue) *lease {
+	l := &lease{}
+	if v := item[leaseOwnerAttribute]; v != nil {
+		l.owner = aws.StringValue(v.S)
+	}
+	if v := item[leaseExpiresAttribute]; v != nil && v.N != nil {
+		ms, _ := strconv.ParseInt(*v.N, 10, 64)
+		l.expires = time.Unix(0, ms*int64(time.Millisecond))
+	}
+	if v := item[leaseCheckpointAttribute]; v != nil {
+		l.checkpoint = aws.StringValue(v.S)
+	}
+	if v := item[leaseFinishedAttribute]; v != nil {
+		l.finished = aws.BoolValue(v.BOOL)
+	}
+	return l
+}
+
+func millis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// StreamConsumer reads the table stream and hands its records to a handler. Shards are leased
+// in the lease table so many consumers share the stream, each shard is read by a single consumer
+// from its checkpoint, and children of a split shard are read only after their parent is finished
+// so records of an item are handled in order.
+type StreamConsumer struct {
+	streams   dynamodbstreamsiface.DynamoDBStreamsAPI
+	ddbClient dynamodbiface.DynamoDBAPI
+	tableName string
+	handler   StreamHandler
+	opts      StreamConsumerOptions
+
+	mu      sync.Mutex
+	running map[string]bool
+}
+
+// NewStreamConsumer return consumer of the table stream, ddbClient reads the table and the lease table
+func NewStreamConsumer(streamsClient dynamodbstreamsiface.DynamoDBStreamsAPI, ddbClient dynamodbiface.DynamoDBAPI, tableName string, handler StreamHandler, opts StreamConsumerOptions) *StreamConsumer {
+	defaults := DefaultStreamConsumerOptions
+	if opts.LeaseDuration == 0 {
+		opts.LeaseDuration = defaults.LeaseDuration
+	}
+	if opts.PollInterval == 0 {
+		opts.PollInterval = defaults.PollInterval
+	}
+	if opts.ShardsInterval == 0 {
+		opts.ShardsInterval = defaults.ShardsInterval
+	}
+	if opts.BatchSize == 0 {
+		opts.BatchSize = defaults.BatchSize
+	}
+	if opts.StartAt == "" {
+		opts.StartAt = defaults.StartAt
+	}
+	opts.Retry = opts.Retry.withDefaults()
+	return &StreamConsumer{
+		streams:   streamsClient,
+		ddbClient: ddbClient,
+		tableName: tableName,
+		handler:   handler,
+		opts:      opts,
+		running:   map[string]bool{},
+	}
+}
+
+// Run consume the stream until ctx is done, then leases of shards being read are released
+// so other consumers take them over without waiting for expiry
+func (c *StreamConsumer) Run(ctx context.Context) error {
+	table, err := DescribeTable(c.tableName, c.ddbClient)
+	if err != nil {
+		return err
+	}
+	if table.LatestStreamArn == nil {
+		return ErrStreamNotEnabled
+	}
+	streamArn := *table.LatestStreamArn
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	// finished shards wake the discovery so their children are read right away
+	wake := make(chan struct{}, 1)
+	for {
+		if err := c.takeShards(ctx, streamArn, &wg, wake); err != nil {
+			fmt.Printf("ddbstore:StreamConsumer: %v\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-wake:
+		case <-time.After(c.opts.ShardsInterval):
+		}
+	}
+}
+
+// takeShards start reading shards which are ready to be read and not leased by another consumer
+func (c *StreamConsumer) takeShards(ctx context.Context, streamArn string, wg *sync.WaitGroup, wake chan struct{}) error {
+	shards, err := c.describeShards(streamArn)
+	if err != nil {
+		return err
+	}
+	leases, err := c.loadLeases(streamArn)
+	if err != nil {
+		return err
+	}
+	listed := make(map[string]bool, len(shards))
+	for _, shard := range shards {
+		listed[aws.StringValue(shard.ShardId)] = true
+	}
+	now := time.Now()
+	for _, shard := range shards {
+		shardID := aws.StringValue(shard.ShardId)
+		c.mu.Lock()
+		running := c.running[shardID]
+		c.mu.Unlock()
+		if running {
+			continue
+		}
+		l := leases[shardID]
+		if l != nil && (l.finished || (l.owner != c.opts.Owner && l.expires.After(now))) {
+			continue
+		}
+		// a parent still listed must be finished first, trimmed parents are gone for good
+		parent := aws.StringValue(shard.ParentShardId)
+		if parent != "" && listed[parent] && (leases[parent] == nil || !leases[parent].finished) {
+			continue
+		}
+		l, err := c.acquire(streamArn, shardID)
+		if err == ErrLeaseLost {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		startAt := c.opts.StartAt
+		if parent != "" {
+			startAt = dynamodbstreams.ShardIteratorTypeTrimHorizon
+		}
+		c.mu.Lock()
+		c.running[shardID] = true
+		c.mu.Unlock()
+		wg.Add(1)
+		go func(shardID string, l *lease, startAt string) {
+			defer wg.Done()
+			err := c.readShard(ctx, streamArn, shardID, l.checkpoint, startAt, wake)
+			if err != nil {
+				fmt.Printf("ddbstore:StreamConsumer: shard %s: %v\n", shardID, err)
+			}
+			c.mu.Lock()
+			delete(c.running, shardID)
+			c.mu.Unlock()
+		}(shardID, l, startAt)
+	}
+	return nil
+}
+
+// describeShards return all shards of the stream following pagination
+func (c *StreamConsumer) describeShards(streamArn string) ([]*dynamodbstreams.Shard, error) {
+	var shards []*dynamodbstreams.Shard
+	input := &dynamodbstreams.DescribeStreamInput{
+		StreamArn: aws.String(streamArn),
+	}
+	for {
+		output, err := c.streams.DescribeStream(input)
+		if err != nil {
+			return nil, err
+		}
+		shards = append(shards, output.StreamDescription.Shards...)
+		if output.StreamDescription.LastEvaluatedShardId == nil {
+			return shards, nil
+		}
+		input.ExclusiveStartShardId = output.StreamDescription.LastEvaluatedShardId
+	}
+}
+
+// loadLeases return leases of shards of the stream by shard id
+func (c *StreamConsumer) loadLeases(streamArn string) (map[string]*lease, error) {
+	keyCond := expression.Key(leaseStreamAttribute).Equal(expression.Value(streamArn))
+	expr, err := expression.NewBuilder().WithKeyCondition(keyCond).Build()
+	if err != nil {
+		return nil, err
+	}
+	input := &dynamodb.QueryInput{
+		TableName:                 aws.String(c.opts.LeaseTable),
+		KeyConditionExpression:    expr.KeyCondition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ConsistentRead:            aws.Bool(true),
+	}
+	leases := map[string]*lease{}
+	for {
+		output, err := c.ddbClient.Query(input)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range output.Items {
+			if v := item[leaseShardAttribute]; v != nil {
+				leases[aws.StringValue(v.S)] = leaseFromItem(item)
+			}
+		}
+		if len(output.LastEvaluatedKey) == 0 {
+			return leases, nil
+		}
+		input.ExclusiveStartKey = output.LastEvaluatedKey
+	}
+}
+
+// leaseKey return key of the shard lease
+func leaseKey(streamArn, shardID string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		leaseStreamAttribute: {S: aws.String(streamArn)},
+		leaseShardAttribute:  {S: aws.String(shardID)},
+	}
+}
+
+// acquire take the shard lease if it is free, expired or already ours
+func (c *StreamConsumer) acquire(streamArn, shardID string) (*lease, error) {
+	now := time.Now()
+	update := expression.Set(expression.Name(leaseOwnerAttribute), expression.Value(c.opts.Owner)).
+		Set(expression.Name(leaseExpiresAttribute), expression.Value(millis(now.Add(c.opts.LeaseDuration))))
+	cond := expression.AttributeNotExists(expression.Name(leaseShardAttribute)).
+		Or(expression.Name(leaseOwnerAttribute).Equal(expression.Value(c.opts.Owner))).
+		Or(expression.Name(leaseExpiresAttribute).LessThan(expression.Value(millis(now))))
+	cond = cond.And(expression.AttributeNotExists(expression.Name(leaseFinishedAttribute)))
+	output, err := c.updateLease(streamArn, shardID, update, cond)
+	if err != nil {
+		return nil, err
+	}
+	return leaseFromItem(output.Attributes), nil
+}
+
+// checkpoint record the last handled sequence number of the shard and renew the lease,
+// finished marks the shard read to its end
+func (c *StreamConsumer) checkpoint(streamArn, shardID, sequenceNumber string, finished bool) error {
+	update := expression.Set(expression.Name(leaseExpiresAttribute), expression.Value(millis(time.Now().Add(c.opts.LeaseDuration))))
+	if sequenceNumber != "" {
+		update = update.Set(expression.Name(leaseCheckpointAttribute), expression.Value(sequenceNumber))
+	}
+	if finished {
+		update = update.Set(expression.Name(leaseFinishedAttribute), expression.Value(true))
+	}
+	cond := expression.Name(leaseOwnerAttribute).Equal(expression.Value(c.opts.Owner))
+	_, err := c.updateLease(streamArn, shardID, update, cond)
+	return err
+}
+
+// release expire our lease of the shard so another consumer can take it over at once
+func (c *StreamConsumer) release(streamArn, shardID string) error {
+	update := expression.Set(expression.Name(leaseExpiresAttribute), expression.Value(0))
+	cond := expression.Name(leaseOwnerAttribute).Equal(expression.Value(c.opts.Owner))
+	_, err := c.updateLease(streamArn, shardID, update, cond)
+	return err
+}
+
+// updateLease update the lease item if the condition holds, a failed condition gives ErrLeaseLost
+func (c *StreamConsumer) updateLease(streamArn, shardID string, update expression.UpdateBuilder, cond expression.ConditionBuilder) (*dynamodb.UpdateItemOutput, error) {
+	expr, err := expression.NewBuilder().WithUpdate(update).WithCondition(cond).Build()
+	if err != nil {
+		return nil, err
+	}
+	output, err := c.ddbClient.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:                 aws.String(c.opts.LeaseTable),
+		Key:                       leaseKey(streamArn, shardID),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ReturnValues:              aws.String(dynamodb.ReturnValueAllNew),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return nil, ErrLeaseLost
+	}
+	return output, err
+}
+
+// shardIterator return iterator after the checkpoint, or at startAt when there is none,
+// AT_SEQUENCE_NUMBER startAt is positioned at sequence number at
+func (c *StreamConsumer) shardIterator(streamArn, shardID, checkpoint, startAt, at string) (*string, error) {
+	input := &dynamodbstreams.GetShardIteratorInput{
+		StreamArn:         aws.String(streamArn),
+		ShardId:           aws.String(shardID),
+		ShardIteratorType: aws.String(startAt),
+	}
+	if startAt == dynamodbstreams.ShardIteratorTypeAtSequenceNumber {
+		input.SequenceNumber = aws.String(at)
+	}
+	if checkpoint != "" {
+		input.ShardIteratorType = aws.String(dynamodbstreams.ShardIteratorTypeAfterSequenceNumber)
+		input.SequenceNumber = aws.String(checkpoint)
+	}
+	output, err := c.streams.GetShardIterator(input)
+	if err != nil {
+		return nil, err
+	}
+	return output.ShardIterator, nil
+}
+
+// eventRecord convert stream record to lambda event record
+func eventRecord(record *dynamodbstreams.Record, streamArn string) events.DynamoDBEventRecord {
+	r := events.DynamoDBEventRecord{
+		AWSRegion:      aws.StringValue(record.AwsRegion),
+		EventID:        aws.StringValue(record.EventID),
+		EventName:      aws.StringValue(record.EventName),
+		EventSource:    aws.StringValue(record.EventSource),
+		EventVersion:   aws.StringValue(record.EventVersion),
+		EventSourceArn: streamArn,
+	}
+	if change := record.Dynamodb; change != nil {
+		r.Change = events.DynamoDBStreamRecord{
+			ApproximateCreationDateTime: events.SecondsEpochTime{Time: aws.TimeValue(change.ApproximateCreationDateTime)},
+			Keys:                        MapToEventStream(change.Keys),
+			NewImage:                    MapToEventStream(change.NewImage),
+			OldImage:                    MapToEventStream(change.OldImage),
+			SequenceNumber:              aws.StringValue(change.SequenceNumber),
+			SizeBytes:                   aws.Int64Value(change.SizeBytes),
+			StreamViewType:              aws.StringValue(change.StreamViewType),
+		}
+	}
+	return r
+}
+
+// handle give records to the handler and return the index of the first record it failed, -1 when none
+func (c *StreamConsumer) handle(ctx context.Context, streamArn string, records []*dynamodbstreams.Record) int {
+	event := events.DynamoDBEvent{Records: make([]events.DynamoDBEventRecord, len(records))}
+	for i, record := range records {
+		event.Records[i] = eventRecord(record, streamArn)
+	}
+	resp, err := c.handler(ctx, event)
+	if err != nil {
+		fmt.Printf("ddbstore:StreamConsumer: handler: %v\n", err)
+		return 0
+	}
+	if len(resp.BatchItemFailures) == 0 {
+		return -1
+	}
+	failed := len(records)
+	for _, failure := range resp.BatchItemFailures {
+		for i, record := range event.Records {
+			if record.Change.SequenceNumber == failure.ItemIdentifier && i < failed {
+				failed = i
+			}
+		}
+	}
+	if failed == len(records) {
+		// an unknown identifier fails the whole batch like lambda does
+		return 0
+	}
+	return failed
+}
+
+// readShard read records of the shard from the checkpoint until the shard is finished,
+// the lease is lost or ctx is done
+func (c *StreamConsumer) readShard(ctx context.Context, streamArn, shardID, checkpoint, startAt string, wake chan struct{}) error {
+	// at is the sequence number new iterators start at until the first checkpoint
+	at := ""
+	iterator, err := c.shardIterator(streamArn, shardID, checkpoint, startAt, at)
+	if err != nil {
+		return err
+	}
+	renewAt := time.Now().Add(c.opts.LeaseDuration / 2)
+	attempt := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return c.release(streamArn, shardID)
+		default:
+		}
+		// the lease is renewed while polling and while failed batches are retried
+		if time.Now().After(renewAt) {
+			if err := c.checkpoint(streamArn, shardID, checkpoint, false); err != nil {
+				return err
+			}
+			renewAt = time.Now().Add(c.opts.LeaseDuration / 2)
+		}
+		output, err := c.streams.GetRecords(&dynamodbstreams.GetRecordsInput{
+			ShardIterator: iterator,
+			Limit:         aws.Int64(c.opts.BatchSize),
+		})
+		if aerr, ok := err.(awserr.Error); ok {
+			switch aerr.Code() {
+			case dynamodbstreams.ErrCodeExpiredIteratorException:
+				if iterator, err = c.shardIterator(streamArn, shardID, checkpoint, startAt, at); err != nil {
+					return err
+				}
+				continue
+			case dynamodbstreams.ErrCodeTrimmedDataAccessException:
+				// records after the checkpoint are older than 24 hours and gone, the rest is still read
+				fmt.Printf("ddbstore:StreamConsumer: shard %s: records after %q were trimmed\n", shardID, checkpoint)
+				checkpoint, startAt, at = "", dynamodbstreams.ShardIteratorTypeTrimHorizon, ""
+				if iterator, err = c.shardIterator(streamArn, shardID, checkpoint, startAt, at); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		if err != nil {
+			if isRetryable(err) || isStreamThrottle(err) {
+				time.Sleep(c.opts.Retry.backoff(attempt))
+				attempt++
+				continue
+			}
+			return err
+		}
+		if records := output.Records; len(records) > 0 {
+			if checkpoint == "" && at == "" {
+				// a new LATEST iterator would skip the records when the batch is retried
+				startAt, at = dynamodbstreams.ShardIteratorTypeAtSequenceNumber, aws.StringValue(records[0].Dynamodb.SequenceNumber)
+			}
+			failed := c.handle(ctx, streamArn, records)
+			if failed >= 0 {
+				// records before the failed one are done, the failed one is delivered again after backoff
+				if failed > 0 {
+					checkpoint = aws.StringValue(records[failed-1].Dynamodb.SequenceNumber)
+					if err := c.checkpoint(streamArn, shardID, checkpoint, false); err != nil {
+						return err
+					}
+				}
+				time.Sleep(c.opts.Retry.backoff(attempt))
+				attempt++
+				if iterator, err = c.shardIterator(streamArn, shardID, checkpoint, startAt, at); err != nil {
+					return err
+				}
+				continue
+			}
+			attempt = 0
+			checkpoint = aws.StringValue(records[len(records)-1].Dynamodb.SequenceNumber)
+			if err := c.checkpoint(streamArn, shardID, checkpoint, false); err != nil {
+				return err
+			}
+			renewAt = time.Now().Add(c.opts.LeaseDuration / 2)
+		}
+		if output.NextShardIterator == nil {
+			if err := c.checkpoint(streamArn, shardID, checkpoint, true); err != nil {
+				return err
+			}
+			select {
+			case wake <- struct{}{}:
+			default:
+			}
+			return nil
+		}
+		iterator = output.NextShardIterator
+		if len(output.Records) == 0 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(c.opts.PollInterval):
+			}
+		}
+	}
+}
+
+// isStreamThrottle report whether dynamodb streams rejected the request for exceeding its limits
+func isStreamThrottle(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case dynamodbstreams.ErrCodeLimitExceededException, dynamodbstreams.ErrCodeInternalServerError:
+			return true
+		}
+	}
+	return false
+}
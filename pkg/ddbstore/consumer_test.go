@@ -0,0 +1,279 @@
+package ddbstore
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams"
+
+	"go-grpc-kubernetes/pkg/ddbfake"
+)
+
+// recorder is a stream handler remembering ids of handled records in order
+type recorder struct {
+	mu  sync.Mutex
+	ids []string
+	// fail return whether the record of the item fails its batch
+	fail func(id string) bool
+}
+
+func (r *recorder) handle(ctx context.Context, event events.DynamoDBEvent) (StreamBatchResponse, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, record := range event.Records {
+		id := record.Change.Keys["uuid"].String()
+		if r.fail != nil && r.fail(id) {
+			return StreamBatchResponse{BatchItemFailures: []StreamBatchItemFailure{{ItemIdentifier: record.Change.SequenceNumber}}}, nil
+		}
+		r.ids = append(r.ids, id)
+	}
+	return StreamBatchResponse{}, nil
+}
+
+func (r *recorder) handled() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string{}, r.ids...)
+}
+
+// waitHandled wait until the recorder handled n records
+func (r *recorder) waitHandled(t *testing.T, n int) []string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if ids := r.handled(); len(ids) >= n {
+			return ids
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("handled %v, want %d records", r.handled(), n)
+	return nil
+}
+
+// newLeaseTable create lease table of stream consumers in db
+func newLeaseTable(t *testing.T, db *ddbfake.DB) string {
+	t.Helper()
+	if _, err := EnsureTable(LeaseTableSpec("leases"), db, ReconcileOptions{AllowCreate: true}); err != nil {
+		t.Fatal(err)
+	}
+	return "leases"
+}
+
+// startConsumer run consumer until the returned stop is called
+func startConsumer(t *testing.T, db *ddbfake.DB, tableName, owner string, handler StreamHandler, opts StreamConsumerOptions) (stop func()) {
+	t.Helper()
+	opts.Owner = owner
+	opts.PollInterval = 5 * time.Millisecond
+	opts.ShardsInterval = 10 * time.Millisecond
+	opts.Retry = BatchOptions{BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}
+	c := NewStreamConsumer(db.Streams(), db, tableName, handler, opts)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- c.Run(ctx)
+	}()
+	return func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestStreamConsumerRetriesFailedRecord(t *testing.T) {
+	db, tableName := newOrdersTable(t, TableOptions{})
+	leases := newLeaseTable(t, db)
+	failures := 0
+	r := &recorder{fail: func(id string) bool {
+		// the second record fails twice, records before it stay handled
+		if id == "order-2" && failures < 2 {
+			failures++
+			return true
+		}
+		return false
+	}}
+	putOrders(t, db, tableName, "order-1", "order-2", "order-3")
+	stop := startConsumer(t, db, tableName, "consumer-1", r.handle, StreamConsumerOptions{LeaseTable: leases})
+	defer stop()
+	ids := r.waitHandled(t, 3)
+	if fmt.Sprint(ids) != "[order-1 order-2 order-3]" {
+		t.Errorf("handled %v, want every record once in order", ids)
+	}
+}
+
+// streamShards return arn and shards of the table stream
+func streamShards(t *testing.T, db *ddbfake.DB, tableName string) (string, []*dynamodbstreams.Shard) {
+	t.Helper()
+	table, err := DescribeTable(tableName, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := db.Streams().DescribeStream(&dynamodbstreams.DescribeStreamInput{StreamArn: table.LatestStreamArn})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return aws.StringValue(table.LatestStreamArn), out.StreamDescription.Shards
+}
+
+// leaseOf return lease of the shard, nil when there is none
+func leaseOf(t *testing.T, db *ddbfake.DB, leases, streamArn, shardID string) *lease {
+	t.Helper()
+	out, err := db.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(leases),
+		Key:            leaseKey(streamArn, shardID),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Item == nil {
+		return nil
+	}
+	return leaseFromItem(out.Item)
+}
+
+// waitLease wait until the shard is leased to owner
+func waitLease(t *testing.T, db *ddbfake.DB, leases, streamArn, shardID, owner string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if l := leaseOf(t, db, leases, streamArn, shardID); l != nil && l.owner == owner && l.expires.After(time.Now()) {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("shard %s wasn't leased to %s", shardID, owner)
+}
+
+func TestStreamConsumerReadsParentShardFirst(t *testing.T) {
+	db, tableName := newOrdersTable(t, TableOptions{})
+	leases := newLeaseTable(t, db)
+	putOrders(t, db, tableName, "order-1")
+	if err := db.SplitShard(tableName); err != nil {
+		t.Fatal(err)
+	}
+	putOrders(t, db, tableName, "order-2")
+	failed := false
+	r := &recorder{fail: func(id string) bool {
+		// a retried parent keeps the child waiting
+		if id == "order-1" && !failed {
+			failed = true
+			return true
+		}
+		return false
+	}}
+	stop := startConsumer(t, db, tableName, "consumer-1", r.handle, StreamConsumerOptions{LeaseTable: leases})
+	defer stop()
+	if ids := r.waitHandled(t, 2); fmt.Sprint(ids) != "[order-1 order-2]" {
+		t.Errorf("handled %v, want the parent shard before its child", ids)
+	}
+	streamArn, shards := streamShards(t, db, tableName)
+	if l := leaseOf(t, db, leases, streamArn, aws.StringValue(shards[0].ShardId)); l == nil || !l.finished {
+		t.Errorf("parent shard lease %+v isn't finished", l)
+	}
+}
+
+func TestStreamConsumerResumesFromCheckpoint(t *testing.T) {
+	db, tableName := newOrdersTable(t, TableOptions{})
+	leases := newLeaseTable(t, db)
+	putOrders(t, db, tableName, "order-1")
+	first := &recorder{}
+	stop := startConsumer(t, db, tableName, "consumer-1", first.handle, StreamConsumerOptions{LeaseTable: leases})
+	first.waitHandled(t, 1)
+	// a stopped consumer releases its lease, the next one takes over at once after the checkpoint
+	stop()
+	putOrders(t, db, tableName, "order-2")
+	second := &recorder{}
+	stop = startConsumer(t, db, tableName, "consumer-2", second.handle, StreamConsumerOptions{LeaseTable: leases, LeaseDuration: time.Hour})
+	defer stop()
+	if ids := second.waitHandled(t, 1); fmt.Sprint(ids) != "[order-2]" {
+		t.Errorf("handled %v after resume, want [order-2]", ids)
+	}
+}
+
+func TestStreamConsumerTakesOverExpiredLease(t *testing.T) {
+	db, tableName := newOrdersTable(t, TableOptions{})
+	leases := newLeaseTable(t, db)
+	putOrders(t, db, tableName, "order-1", "order-2")
+	streamArn, shards := streamShards(t, db, tableName)
+	shardID := aws.StringValue(shards[0].ShardId)
+	// a consumer which crashed after handling order-1 leaves its lease to expire
+	expires := time.Now().Add(200 * time.Millisecond)
+	item := leaseKey(streamArn, shardID)
+	item[leaseOwnerAttribute] = &dynamodb.AttributeValue{S: aws.String("crashed")}
+	item[leaseExpiresAttribute] = &dynamodb.AttributeValue{N: aws.String(fmt.Sprint(millis(expires)))}
+	item[leaseCheckpointAttribute] = &dynamodb.AttributeValue{S: db.Records(tableName)[0].Dynamodb.SequenceNumber}
+	if _, err := db.PutItem(&dynamodb.PutItemInput{TableName: aws.String(leases), Item: item}); err != nil {
+		t.Fatal(err)
+	}
+	r := &recorder{}
+	stop := startConsumer(t, db, tableName, "consumer-2", r.handle, StreamConsumerOptions{LeaseTable: leases})
+	defer stop()
+	ids := r.waitHandled(t, 1)
+	if time.Now().Before(expires) {
+		t.Error("lease was taken over before it expired")
+	}
+	if fmt.Sprint(ids) != "[order-2]" {
+		t.Errorf("handled %v, want [order-2] after the checkpoint", ids)
+	}
+	waitLease(t, db, leases, streamArn, shardID, "consumer-2")
+}
+
+func TestStreamConsumerRenewsLeaseWhileRetrying(t *testing.T) {
+	db, tableName := newOrdersTable(t, TableOptions{})
+	leases := newLeaseTable(t, db)
+	streamArn, shards := streamShards(t, db, tableName)
+	shardID := aws.StringValue(shards[0].ShardId)
+	putOrders(t, db, tableName, "order-1")
+	until := time.Now().Add(400 * time.Millisecond)
+	first := &recorder{fail: func(id string) bool { return time.Now().Before(until) }}
+	opts := StreamConsumerOptions{LeaseTable: leases, LeaseDuration: 100 * time.Millisecond}
+	stop := startConsumer(t, db, tableName, "consumer-1", first.handle, opts)
+	defer stop()
+	waitLease(t, db, leases, streamArn, shardID, "consumer-1")
+	second := &recorder{}
+	stopSecond := startConsumer(t, db, tableName, "consumer-2", second.handle, opts)
+	defer stopSecond()
+	first.waitHandled(t, 1)
+	if ids := second.handled(); len(ids) > 0 {
+		t.Errorf("lease of a retrying consumer was taken over, the other consumer handled %v", ids)
+	}
+}
+
+func TestStreamConsumerRetriesFailedRecordFromLatest(t *testing.T) {
+	db, tableName := newOrdersTable(t, TableOptions{})
+	leases := newLeaseTable(t, db)
+	putOrders(t, db, tableName, "order-0")
+	reading := make(chan struct{})
+	var once sync.Once
+	db.Fail = func(op string) error {
+		if op == "GetRecords" {
+			once.Do(func() { close(reading) })
+		}
+		return nil
+	}
+	failures := 0
+	r := &recorder{fail: func(id string) bool {
+		if failures < 2 {
+			failures++
+			return true
+		}
+		return false
+	}}
+	stop := startConsumer(t, db, tableName, "consumer-1", r.handle, StreamConsumerOptions{
+		LeaseTable: leases,
+		StartAt:    dynamodbstreams.ShardIteratorTypeLatest,
+	})
+	defer stop()
+	<-reading
+	putOrders(t, db, tableName, "order-1")
+	if ids := r.waitHandled(t, 1); fmt.Sprint(ids) != "[order-1]" {
+		t.Errorf("handled %v, want the failed record retried", ids)
+	}
+}
@@ -0,0 +1,313 @@
+package ddbstore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/golang/protobuf/descriptor"
+	"github.com/golang/protobuf/proto"
+)
+
+var (
+	ErrUnknownKey     = errors.New("unknown wrapping key")
+	ErrInvalidKey     = errors.New("master key must be 32 bytes")
+	ErrCiphertextSize = errors.New("ciphertext too short")
+	ErrMissingItemKey = errors.New("encrypted attributes require the item key")
+)
+
+const (
+	// attributes of encrypted envelope stored in place of sensitive attribute
+	envelopeKeyID      = "kid"
+	envelopeDataKey    = "dek"
+	envelopeCiphertext = "ct"
+)
+
+// KeyProvider generate and unwrap data keys used for envelope encryption
+type KeyProvider interface {
+	// GenerateDataKey return a new plaintext data key, its wrapped form and id of the wrapping key
+	GenerateDataKey() (plaintext, wrapped []byte, keyID string, err error)
+	// DecryptDataKey unwrap data key wrapped by the key with given id
+	DecryptDataKey(keyID string, wrapped []byte) ([]byte, error)
+}
+
+// FileKeyProvider wraps data keys with AES-GCM master keys read from local files, meant for dev
+type FileKeyProvider struct {
+	current string
+	keys    map[string][]byte
+}
+
+// NewFileKeyProvider read base64 encoded 32 byte master keys from files. The first key wraps
+// new data keys, the others are only used to unwrap data keys wrapped before key rotation.
+func NewFileKeyProvider(paths ...string) (*FileKeyProvider, error) {
+	p := &FileKeyProvider{
+		keys: make(map[string][]byte, len(paths)),
+	}
+	for _, path := range paths {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+		if err != nil {
+			return nil, err
+		}
+		if len(key) != 32 {
+			return nil, ErrInvalidKey
+		}
+		// key id is derived from the key itself so renaming the file doesn't matter
+		sum := sha256.Sum256(key)
+		keyID := "file:" + hex.EncodeToString(sum[:8])
+		if p.current == "" {
+			p.current = keyID
+		}
+		p.keys[keyID] = key
+	}
+	return p, nil
+}
+
+// GenerateDataKey implements KeyProvider
+func (p *FileKeyProvider) GenerateDataKey() ([]byte, []byte, string, error) {
+	plaintext := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, plaintext); err != nil {
+		return nil, nil, "", err
+	}
+	wrapped, err := seal(p.keys[p.current], plaintext, []byte(p.current))
+	if err != nil {
+		return nil, nil, "", err
+	}
+	return plaintext, wrapped, p.current, nil
+}
+
+// DecryptDataKey implements KeyProvider
+func (p *FileKeyProvider) DecryptDataKey(keyID string, wrapped []byte) ([]byte, error) {
+	key, ok := p.keys[keyID]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	return open(key, wrapped, []byte(keyID))
+}
+
+// KMSKeyProvider wraps data keys with AWS KMS customer master key
+type KMSKeyProvider struct {
+	KeyID string
+	KMS   kmsiface.KMSAPI
+}
+
+// NewKMSKeyProvider return KMS key provider using given key id, arn or alias
+func NewKMSKeyProvider(keyID string, sess *session.Session) *KMSKeyProvider {
+	return &KMSKeyProvider{
+		KeyID: keyID,
+		KMS:   kms.New(sess),
+	}
+}
+
+// GenerateDataKey implements KeyProvider
+func (p *KMSKeyProvider) GenerateDataKey() ([]byte, []byte, string, error) {
+	output, err := p.KMS.GenerateDataKey(&kms.GenerateDataKeyInput{
+		KeyId:   aws.String(p.KeyID),
+		KeySpec: aws.String(kms.DataKeySpecAes256),
+	})
+	if err != nil {
+		return nil, nil, "", err
+	}
+	return output.Plaintext, output.CiphertextBlob, aws.StringValue(output.KeyId), nil
+}
+
+// DecryptDataKey implements KeyProvider
+func (p *KMSKeyProvider) DecryptDataKey(keyID string, wrapped []byte) ([]byte, error) {
+	output, err := p.KMS.Decrypt(&kms.DecryptInput{
+		CiphertextBlob: wrapped,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return output.Plaintext, nil
+}
+
+// seal encrypt plaintext with AES-GCM and prepend the random nonce
+func seal(key, plaintext, aad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+// open decrypt ciphertext produced by seal
+func open(key, ciphertext, aad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, ErrCiphertextSize
+	}
+	nonce := ciphertext[:gcm.NonceSize()]
+	return gcm.Open(nil, nonce, ciphertext[gcm.NonceSize():], aad)
+}
+
+// Encryption of sensitive attributes with data keys wrapped by key provider.
+// Every encrypted attribute is replaced with an envelope map holding the wrapping key id,
+// the wrapped data key and the ciphertext, so items can be partially updated safely.
+type Encryption struct {
+	Provider KeyProvider
+	// Attributes encrypted before writing and decrypted after reading
+	Attributes []string
+}
+
+// envelopeAAD return additional data authenticated with the attribute ciphertext, it binds the
+// envelope to the table, item and attribute so it can't be copied to another item and still decrypt
+func envelopeAAD(tableName, instanceID, name string) []byte {
+	return []byte(strings.Join([]string{tableName, instanceID, name}, "\x00"))
+}
+
+// itemKey return the key of the item which ciphertexts are bound to
+func itemKey(attrs map[string]*dynamodb.AttributeValue) (string, error) {
+	if key := attrs["uuid"]; key != nil && key.S != nil {
+		return *key.S, nil
+	}
+	return "", ErrMissingItemKey
+}
+
+// encrypt replace sensitive attributes of the item of the table with encrypted envelopes in place
+func (e *Encryption) encrypt(tableName string, attrs map[string]*dynamodb.AttributeValue) error {
+	var (
+		instanceID       string
+		dataKey, wrapped []byte
+		keyID            string
+	)
+	for _, name := range e.Attributes {
+		av, ok := attrs[name]
+		if !ok {
+			continue
+		}
+		// a single data key is shared by all sensitive attributes of the item
+		if dataKey == nil {
+			var err error
+			if instanceID, err = itemKey(attrs); err != nil {
+				return err
+			}
+			if dataKey, wrapped, keyID, err = e.Provider.GenerateDataKey(); err != nil {
+				return err
+			}
+		}
+		plaintext, err := json.Marshal(av)
+		if err != nil {
+			return err
+		}
+		ciphertext, err := seal(dataKey, plaintext, envelopeAAD(tableName, instanceID, name))
+		if err != nil {
+			return err
+		}
+		attrs[name] = &dynamodb.AttributeValue{
+			M: map[string]*dynamodb.AttributeValue{
+				envelopeKeyID:      {S: aws.String(keyID)},
+				envelopeDataKey:    {B: wrapped},
+				envelopeCiphertext: {B: ciphertext},
+			},
+		}
+	}
+	return nil
+}
+
+// decrypt replace encrypted envelopes of sensitive attributes of the item of the table with their
+// plaintext values in place, attributes stored before encryption was enabled are left untouched
+func (e *Encryption) decrypt(tableName string, attrs map[string]*dynamodb.AttributeValue) error {
+	dataKeys := map[string][]byte{}
+	for _, name := range e.Attributes {
+		av, ok := attrs[name]
+		if !ok || av.M == nil || av.M[envelopeCiphertext] == nil {
+			continue
+		}
+		wrapped := av.M[envelopeDataKey].B
+		dataKey, ok := dataKeys[string(wrapped)]
+		if !ok {
+			var err error
+			if dataKey, err = e.Provider.DecryptDataKey(aws.StringValue(av.M[envelopeKeyID].S), wrapped); err != nil {
+				return err
+			}
+			dataKeys[string(wrapped)] = dataKey
+		}
+		instanceID, err := itemKey(attrs)
+		if err != nil {
+			return err
+		}
+		plaintext, err := open(dataKey, av.M[envelopeCiphertext].B, envelopeAAD(tableName, instanceID, name))
+		if err != nil {
+			return err
+		}
+		out := &dynamodb.AttributeValue{}
+		if err := json.Unmarshal(plaintext, out); err != nil {
+			return err
+		}
+		attrs[name] = out
+	}
+	return nil
+}
+
+// SensitiveAttributes return attribute names of message fields having bool field option
+// described by ext set to true, e.g. [(sensitive) = true]
+func SensitiveAttributes(msg descriptor.Message, ext *proto.ExtensionDesc) []string {
+	_, md := descriptor.ForMessage(msg)
+	var names []string
+	for _, field := range md.GetField() {
+		if field.Options == nil || !proto.HasExtension(field.Options, ext) {
+			continue
+		}
+		v, err := proto.GetExtension(field.Options, ext)
+		if err != nil {
+			continue
+		}
+		if b, ok := v.(*bool); ok && *b {
+			names = append(names, field.GetName())
+		}
+	}
+	return names
+}
+
+// clearFields reset top level fields of the message whose attribute names are listed, in place
+func clearFields(msg proto.Message, attributes []string) {
+	if len(attributes) == 0 {
+		return
+	}
+	v := reflect.ValueOf(msg)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return
+	}
+	v = v.Elem()
+	for i, prop := range proto.GetProperties(v.Type()).Prop {
+		for _, name := range attributes {
+			if prop.OrigName == name {
+				field := v.Field(i)
+				field.Set(reflect.Zero(field.Type()))
+			}
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package ddbstore
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+
+	"go-grpc-kubernetes/pkg/ddbfake"
+	pb "go-grpc-kubernetes/proto/orderservice"
+)
+
+// newFileKeyProvider return key provider of a random master key
+func newFileKeyProvider(t *testing.T) *FileKeyProvider {
+	t.Helper()
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "master.key")
+	if err := ioutil.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(key)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	provider, err := NewFileKeyProvider(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return provider
+}
+
+// encryptedOrdersTable return orders table encrypting customer_email and its key provider
+func encryptedOrdersTable(t *testing.T) (*FileKeyProvider, *ddbfake.DB, string) {
+	t.Helper()
+	provider := newFileKeyProvider(t)
+	db, tableName := newOrdersTable(t, TableOptions{
+		Encryption: &Encryption{Provider: provider, Attributes: []string{"customer_email"}},
+	})
+	return provider, db, tableName
+}
+
+func TestEncryptedAttributeRoundTrip(t *testing.T) {
+	_, db, tableName := encryptedOrdersTable(t)
+	if _, err := PutProtoToDdb(&pb.Order{Uuid: "order-1", CustomerEmail: "a@example.com"}, "order-1", db, tableName); err != nil {
+		t.Fatal(err)
+	}
+	output, err := db.GetItem(&dynamodb.GetItemInput{Key: keyFor("order-1"), TableName: aws.String(tableName)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if av := output.Item["customer_email"]; av == nil || av.M[envelopeCiphertext] == nil {
+		t.Fatalf("customer_email is stored as %v, want an envelope", av)
+	}
+	out, _, err := GetProtoFromDdb(&pb.Order{}, "order-1", db, tableName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if email := out.(*pb.Order).CustomerEmail; email != "a@example.com" {
+		t.Errorf("got customer_email %q, want a@example.com", email)
+	}
+}
+
+func TestEnvelopeCopiedToAnotherItemDoesntDecrypt(t *testing.T) {
+	_, db, tableName := encryptedOrdersTable(t)
+	for _, order := range []*pb.Order{
+		{Uuid: "order-1", CustomerEmail: "victim@example.com"},
+		{Uuid: "order-2", CustomerEmail: "attacker@example.com"},
+	} {
+		if _, err := PutProtoToDdb(order, order.Uuid, db, tableName); err != nil {
+			t.Fatal(err)
+		}
+	}
+	output, err := db.GetItem(&dynamodb.GetItemInput{Key: keyFor("order-1"), TableName: aws.String(tableName)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.UpdateItem(&dynamodb.UpdateItemInput{
+		Key:                       keyFor("order-2"),
+		TableName:                 aws.String(tableName),
+		UpdateExpression:          aws.String("SET customer_email = :v"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":v": output.Item["customer_email"]},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, _, err := GetProtoFromDdb(&pb.Order{}, "order-2", db, tableName); err == nil {
+		t.Fatalf("envelope of order-1 decrypted in order-2 as %q", out.(*pb.Order).CustomerEmail)
+	}
+}
+
+func TestEnvelopeNotBoundToItemDoesntDecrypt(t *testing.T) {
+	provider, db, tableName := encryptedOrdersTable(t)
+	dataKey, wrapped, keyID, err := provider.GenerateDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := json.Marshal(&dynamodb.AttributeValue{S: aws.String("old@example.com")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// sealed with the attribute name only, so it could have been copied from any item
+	ciphertext, err := seal(dataKey, plaintext, []byte("customer_email"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(tableName),
+		Item: map[string]*dynamodb.AttributeValue{
+			"uuid": {S: aws.String("order-1")},
+			"customer_email": {M: map[string]*dynamodb.AttributeValue{
+				envelopeKeyID:      {S: aws.String(keyID)},
+				envelopeDataKey:    {B: wrapped},
+				envelopeCiphertext: {B: ciphertext},
+			}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, _, err := GetProtoFromDdb(&pb.Order{}, "order-1", db, tableName); err == nil {
+		t.Errorf("got %v, want the envelope rejected", out)
+	}
+}
@@ -4,11 +4,13 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"sort"
+	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
 	"github.com/golang/protobuf/jsonpb"
 	"github.com/golang/protobuf/proto"
 )
@@ -19,35 +21,68 @@ var (
 )
 
 func verifyProto(in proto.Message, instanceID string) bool {
-	if instanceID == "" {
+	return verifyInstanceID(instanceID)
+}
+
+// verifyInstanceID reject empty ids and ids which could address blobs of other items
+func verifyInstanceID(instanceID string) bool {
+	if instanceID == "" || strings.Contains(instanceID, "/") || strings.Contains(instanceID, "..") {
 		return false
 	}
 	return true
 }
 
-// GetProtoFromDdb get item from dynamodb directly and parse to proto message
-func GetProtoFromDdb(in proto.Message, instanceID string, ddbSession *session.Session, tableName string) (proto.Message, error) {
-	if !verifyProto(in, instanceID) {
-		return nil, ErrKeyMismatched
-	}
-	ddbClient := dynamodb.New(ddbSession)
-	input := &dynamodb.GetItemInput{
-		Key: map[string]*dynamodb.AttributeValue{
-			"uuid": {
-				S: aws.String(instanceID),
-			},
+// keyFor return ddb key attributes of given instance id
+func keyFor(instanceID string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"uuid": {
+			S: aws.String(instanceID),
 		},
-		TableName: aws.String(tableName),
 	}
-	output, err := ddbClient.GetItem(input)
+}
+
+// protoToAttrs marshal proto message into ddb attributes through its json representation,
+// with emitDefaults zero valued scalar fields are kept while unset messages are still left out
+func protoToAttrs(in proto.Message, emitDefaults bool) (map[string]*dynamodb.AttributeValue, error) {
+	var bIn []byte
+	wIn := bytes.NewBuffer(bIn)
+	marshaller := new(jsonpb.Marshaler)
+	marshaller.OrigName = true
+	marshaller.EmitDefaults = emitDefaults
+	err := marshaller.Marshal(wIn, in)
 	if err != nil {
 		return nil, err
 	}
-	if len(output.Item) == 0 {
-		return nil, ErrItemNotFound
+	mIn := &map[string]interface{}{}
+	err = json.Unmarshal(wIn.Bytes(), mIn)
+	if err != nil {
+		return nil, err
+	}
+	// empty strings and lists are zero values too, dynamodb accepts them outside keys
+	encoder := dynamodbattribute.NewEncoder(func(e *dynamodbattribute.Encoder) {
+		e.NullEmptyString = !emitDefaults
+		e.EnableEmptyCollections = emitDefaults
+	})
+	av, err := encoder.Encode(mIn)
+	if err != nil {
+		return nil, err
+	}
+	attrs := av.M
+	if attrs == nil {
+		attrs = map[string]*dynamodb.AttributeValue{}
 	}
+	for name, av := range attrs {
+		if av.NULL != nil {
+			delete(attrs, name)
+		}
+	}
+	return attrs, nil
+}
+
+// attrsToProto unmarshal ddb attributes into a new message of the same type as given proto
+func attrsToProto(in proto.Message, attrs map[string]*dynamodb.AttributeValue) (proto.Message, error) {
 	mOut := &map[string]interface{}{}
-	err = dynamodbattribute.UnmarshalMap(output.Item, mOut)
+	err := dynamodbattribute.UnmarshalMap(attrs, mOut)
 	if err != nil {
 		return nil, err
 	}
@@ -64,110 +99,149 @@ func GetProtoFromDdb(in proto.Message, instanceID string, ddbSession *session.Se
 	return out, nil
 }
 
-// PutProtoToDdb put item to dynamodb directly from proto message
-func PutProtoToDdb(in proto.Message, instanceID string, ddbSession *session.Session, tableName string) (proto.Message, error) {
-	out, err := GetProtoFromDdb(in, instanceID, ddbSession, tableName)
-	if err == nil {
-		// item with key already existed, we need to merge the payload
-		proto.Merge(out, in)
-	} else if err == ErrKeyMismatched {
-		return nil, err
-	} else {
-		out = proto.Clone(in)
-	}
-	var bIn []byte
-	wIn := bytes.NewBuffer(bIn)
-	marshaller := new(jsonpb.Marshaler)
-	marshaller.OrigName = true
-	err = marshaller.Marshal(wIn, out)
+// encodeItem marshal proto message into ddb item applying options of the table, the key is
+// set from instanceID unless it is empty and the message holds it
+func encodeItem(in proto.Message, instanceID string, tableName string) (map[string]*dynamodb.AttributeValue, error) {
+	return encodeUpdate(in, instanceID, nil, tableName)
+}
+
+// encodeUpdate is encodeItem of attributes updated in the stored item, whose attributes
+// which are not written count towards the size of the item when offloading
+func encodeUpdate(in proto.Message, instanceID string, stored map[string]*dynamodb.AttributeValue, tableName string) (map[string]*dynamodb.AttributeValue, error) {
+	opts := optionsFor(tableName)
+	attrs, err := protoToAttrs(in, opts.EmitDefaults)
 	if err != nil {
 		return nil, err
 	}
-	mIn := &map[string]interface{}{}
-	err = json.Unmarshal(wIn.Bytes(), mIn)
-	if err != nil {
-		return nil, err
+	if opts.Format == FormatBinary {
+		if attrs, err = binaryAttrs(in, attrs, opts.Projected); err != nil {
+			return nil, err
+		}
 	}
-	attrs, err := dynamodbattribute.MarshalMap(mIn)
-	if err != nil {
-		return nil, err
+	// encrypted attributes and offloaded blobs are bound to the key
+	if instanceID != "" {
+		attrs["uuid"] = keyFor(instanceID)["uuid"]
 	}
-	input := &dynamodb.PutItemInput{
-		Item:      attrs,
-		TableName: aws.String(tableName),
+	if enc := opts.encryption(); enc != nil {
+		if err := enc.encrypt(tableName, attrs); err != nil {
+			return nil, err
+		}
 	}
-	ddbClient := dynamodb.New(ddbSession)
-	_, err = ddbClient.PutItem(input)
-	if err != nil {
-		return nil, err
+	// offloaded blobs hold already encrypted values
+	if opts.Offload != nil {
+		if err := opts.Offload.offload(tableName, attrs, stored); err != nil {
+			return nil, err
+		}
 	}
-	return out, nil
+	return attrs, nil
 }
 
-// BatchPutProtoToDdb put items to dynamodb in batch directly from proto message
-func BatchPutProtoToDdb(ins []proto.Message, ddbSession *session.Session, tableName string) error {
-	ddbclient := dynamodb.New(ddbSession)
-	inputs := make([]*dynamodb.WriteRequest, 0)
-	for _, req := range ins {
-		var bIn []byte
-		wIn := bytes.NewBuffer(bIn)
-		marshaller := new(jsonpb.Marshaler)
-		marshaller.OrigName = true
-		err := marshaller.Marshal(wIn, req)
-		if err != nil {
-			return err
+// decodeItem unmarshal ddb item of the table into a new message of the same type as given proto
+func decodeItem(in proto.Message, attrs map[string]*dynamodb.AttributeValue, tableName string) (proto.Message, error) {
+	opts := optionsFor(tableName)
+	if opts.Offload != nil {
+		if err := opts.Offload.rehydrate(attrs); err != nil {
+			return nil, err
 		}
-		mIn := &map[string]interface{}{}
-		err = json.Unmarshal(wIn.Bytes(), mIn)
-		if err != nil {
-			return err
+	}
+	if enc := opts.encryption(); enc != nil {
+		if err := enc.decrypt(tableName, attrs); err != nil {
+			return nil, err
 		}
-		attrs, err := dynamodbattribute.MarshalMap(mIn)
+	}
+	// items not converted to binary format yet are still read from json layout
+	if av := attrs[protoAttribute]; av != nil && av.B != nil {
+		return binaryToProto(in, av.B)
+	}
+	return attrsToProto(in, attrs)
+}
+
+// GetProtoFromDdb get item from dynamodb directly and parse to proto message. It also return names of
+// fields stored in the item, telling fields stored with zero value apart from unset ones.
+func GetProtoFromDdb(in proto.Message, instanceID string, ddbClient dynamodbiface.DynamoDBAPI, tableName string) (proto.Message, []string, error) {
+	if !verifyProto(in, instanceID) {
+		return nil, nil, ErrKeyMismatched
+	}
+	input := &dynamodb.GetItemInput{
+		Key:       keyFor(instanceID),
+		TableName: aws.String(tableName),
+	}
+	output, err := ddbClient.GetItem(input)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(output.Item) == 0 {
+		return nil, nil, ErrItemNotFound
+	}
+	// decoding replaces encrypted and offloaded attributes in place
+	stored := make(map[string]*dynamodb.AttributeValue, len(output.Item))
+	for name, av := range output.Item {
+		stored[name] = av
+	}
+	out, err := decodeItem(in, output.Item, tableName)
+	if err != nil {
+		return nil, nil, err
+	}
+	fields, err := storedFields(out, stored)
+	if err != nil {
+		return nil, nil, err
+	}
+	return out, fields, nil
+}
+
+// storedFields return sorted names of fields stored in decoded item. Binary protobuf doesn't keep
+// zero valued proto3 scalars, so for items in binary format only projected ones can be told apart.
+func storedFields(out proto.Message, attrs map[string]*dynamodb.AttributeValue) ([]string, error) {
+	names := map[string]bool{}
+	// the binary attribute may be stored encrypted or offloaded
+	if _, ok := attrs[protoAttribute]; ok {
+		set, err := protoToAttrs(out, false)
 		if err != nil {
-			return err
-		}
-		input := &dynamodb.WriteRequest{
-			PutRequest: &dynamodb.PutRequest{
-				Item: attrs,
-			},
+			return nil, err
 		}
-		inputs = append(inputs, input)
-		if len(inputs) >= 25 {
-			batchInput := &dynamodb.BatchWriteItemInput{}
-			batchInput.SetRequestItems(map[string][]*dynamodb.WriteRequest{
-				tableName: inputs,
-			})
-			_, err := ddbclient.BatchWriteItem(batchInput)
-			if err != nil {
-				return err
-			}
-			inputs = make([]*dynamodb.WriteRequest, 0)
+		for name := range set {
+			names[name] = true
 		}
 	}
-	if len(inputs) > 0 {
-		batchInput := &dynamodb.BatchWriteItemInput{}
-		batchInput.SetRequestItems(map[string][]*dynamodb.WriteRequest{
-			tableName: inputs,
-		})
-		_, err := ddbclient.BatchWriteItem(batchInput)
-		if err != nil {
-			return err
+	for name := range attrs {
+		if name != protoAttribute && name != versionAttribute {
+			names[name] = true
 		}
 	}
-	return nil
+	fields := make([]string, 0, len(names))
+	for name := range names {
+		fields = append(fields, name)
+	}
+	sort.Strings(fields)
+	return fields, nil
+}
+
+// PutProtoToDdb put item to dynamodb directly from proto message,
+// fields set in the message are merged atomically into the existing item
+func PutProtoToDdb(in proto.Message, instanceID string, ddbClient dynamodbiface.DynamoDBAPI, tableName string) (proto.Message, error) {
+	return UpdateProtoInDdb(in, instanceID, UpdateOptions{}, ddbClient, tableName)
 }
 
 // DeleteProtoFromDdb remove item from dynamodb directly from instance meta
-func DeleteProtoFromDdb(instanceID string, ddbSession *session.Session, tableName string) error {
-	ddbClient := dynamodb.New(ddbSession)
+func DeleteProtoFromDdb(instanceID string, ddbClient dynamodbiface.DynamoDBAPI, tableName string) error {
+	if !verifyInstanceID(instanceID) {
+		return ErrKeyMismatched
+	}
 	input := &dynamodb.DeleteItemInput{
-		Key: map[string]*dynamodb.AttributeValue{
-			"uuid": {
-				S: aws.String(instanceID),
-			},
-		},
+		Key:       keyFor(instanceID),
 		TableName: aws.String(tableName),
 	}
 	_, err := ddbClient.DeleteItem(input)
-	return err
+	if err != nil {
+		return err
+	}
+	return deleteBlobs(instanceID, tableName)
+}
+
+// deleteBlobs remove blobs offloaded from the item if the table offloads attributes
+func deleteBlobs(instanceID string, tableName string) error {
+	if offload := optionsFor(tableName).Offload; offload != nil {
+		return offload.Store.DeleteAll(blobPrefix(tableName, instanceID))
+	}
+	return nil
 }
@@ -0,0 +1,120 @@
+package ddbstore
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/expression"
+	"github.com/golang/protobuf/proto"
+
+	"go-grpc-kubernetes/pkg/ddbfake"
+	pb "go-grpc-kubernetes/proto/orderservice"
+)
+
+// newOrdersTable return in-memory dynamodb with an orders table named after the test and configured with opts
+func newOrdersTable(t *testing.T, opts TableOptions) (*ddbfake.DB, string) {
+	t.Helper()
+	db := ddbfake.New()
+	tableName := "orders-" + strings.NewReplacer("/", "-", " ", "-").Replace(t.Name())
+	_, err := EnsureTable(&TableSpec{
+		TableName:      tableName,
+		HashKey:        "uuid",
+		AttributeTypes: map[string]string{"uuid": dynamodb.ScalarAttributeTypeS},
+		BillingMode:    dynamodb.BillingModePayPerRequest,
+		StreamViewType: dynamodb.StreamViewTypeNewAndOldImages,
+	}, db, ReconcileOptions{AllowCreate: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ConfigureTable(tableName, opts)
+	return db, tableName
+}
+
+// putOrders put orders with given ids to the table
+func putOrders(t *testing.T, db *ddbfake.DB, tableName string, ids ...string) {
+	t.Helper()
+	for _, id := range ids {
+		if _, err := PutProtoToDdb(&pb.Order{Uuid: id, Quantity: 1}, id, db, tableName); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestGetProtoFromDdbReportsStoredFields(t *testing.T) {
+	for _, emitDefaults := range []bool{false, true} {
+		db, tableName := newOrdersTable(t, TableOptions{EmitDefaults: emitDefaults})
+		if _, err := PutProtoToDdb(&pb.Order{Uuid: "order-1", Status: pb.Status_Started, Currency: "EUR"}, "order-1", db, tableName); err != nil {
+			t.Fatal(err)
+		}
+		out, fields, err := GetProtoFromDdb(&pb.Order{}, "order-1", db, tableName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if currency := out.(*pb.Order).Currency; currency != "EUR" {
+			t.Errorf("got currency %q, want EUR", currency)
+		}
+		stored := map[string]bool{}
+		for _, name := range fields {
+			stored[name] = true
+		}
+		if !stored["currency"] || stored["status"] != emitDefaults {
+			t.Errorf("with EmitDefaults %v got stored fields %v", emitDefaults, fields)
+		}
+	}
+}
+
+func TestScanMatchesZeroValuedStatus(t *testing.T) {
+	db, tableName := newOrdersTable(t, TableOptions{EmitDefaults: true})
+	for _, order := range []*pb.Order{{Uuid: "order-1", Status: pb.Status_Started}, {Uuid: "order-2", Status: pb.Status_Completed}} {
+		if _, err := PutProtoToDdb(order, order.Uuid, db, tableName); err != nil {
+			t.Fatal(err)
+		}
+	}
+	filter := expression.Name("status").Equal(expression.Value(pb.Status_Started.String()))
+	it, err := ScanProtoFromDdb(&pb.Order{}, QueryInput{Filter: &filter}, db, tableName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for it.Next() {
+		ids = append(ids, it.Message().(*pb.Order).Uuid)
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0] != "order-1" {
+		t.Errorf("got started orders %v, want order-1", ids)
+	}
+}
+
+func TestPutGetDeleteProto(t *testing.T) {
+	db, tableName := newOrdersTable(t, TableOptions{})
+	if _, err := PutProtoToDdb(&pb.Order{Uuid: "order-1", Quantity: 2, Currency: "EUR"}, "order-1", db, tableName); err != nil {
+		t.Fatal(err)
+	}
+	// a put merges set fields into the stored item
+	out, err := PutProtoToDdb(&pb.Order{Uuid: "order-1", Amount: 9.5}, "order-1", db, tableName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if order := out.(*pb.Order); order.Quantity != 2 || order.Currency != "EUR" || order.Amount != 9.5 {
+		t.Errorf("put returned %v", order)
+	}
+	got, _, err := GetProtoFromDdb(&pb.Order{}, "order-1", db, tableName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(got, out) {
+		t.Errorf("got %v, want %v", got, out)
+	}
+	if err := DeleteProtoFromDdb("order-1", db, tableName); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := GetProtoFromDdb(&pb.Order{}, "order-1", db, tableName); err != ErrItemNotFound {
+		t.Errorf("got %v for deleted item, want ErrItemNotFound", err)
+	}
+	if _, _, err := GetProtoFromDdb(&pb.Order{}, "", db, tableName); err != ErrKeyMismatched {
+		t.Errorf("got %v for empty id, want ErrKeyMismatched", err)
+	}
+}
@@ -0,0 +1,363 @@
+package ddbstore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// attributes of items of the dead letter table
+const (
+	deadLetterIDAttribute       = "id"
+	deadLetterRecordAttribute   = "record"
+	deadLetterErrorAttribute    = "error"
+	deadLetterAttemptsAttribute = "attempts"
+	deadLetterFailedAtAttribute = "failed_at"
+	deadLetterExpiresAttribute  = "expires_at"
+)
+
+// attemptsIDPrefix prefix ids of dead letter table items counting failed attempts of records,
+// table names never contain it so they don't collide with letters
+const attemptsIDPrefix = "attempts#"
+
+// attemptsTTL is how long failed attempts of a record are counted, stream records expire after 24 hours
+const attemptsTTL = 48 * time.Hour
+
+// maxTrackedAttempts bounds the number of records FileDeadLetterSink counts attempts of
+const maxTrackedAttempts = 10000
+
+// DeadLetter is a stream record which couldn't be indexed within the retry budget
+type DeadLetter struct {
+	Record   events.DynamoDBEventRecord `json:"record"`
+	Error    string                     `json:"error"`
+	Attempts int                        `json:"attempts"`
+	FailedAt time.Time                  `json:"failed_at"`
+}
+
+// ID return unique id of the dead letter, the table and sequence number of its record
+func (l *DeadLetter) ID() string {
+	tableName, err := TableFromStreamArn(l.Record.EventSourceArn)
+	if err != nil {
+		tableName = l.Record.EventSourceArn
+	}
+	return tableName + "/" + l.Record.Change.SequenceNumber
+}
+
+// DeadLetterSink keeps dead letters until they are replayed
+type DeadLetterSink interface {
+	Put(ctx context.Context, letter *DeadLetter) error
+	// Drain call fn with every dead letter, letters fn handled without error are removed
+	Drain(ctx context.Context, fn func(*DeadLetter) error) error
+	// Attempt count a failed attempt of the record and return the number of attempts counted so far,
+	// the count outlives the indexer so the retry budget holds across restarts and lambda cold starts
+	Attempt(ctx context.Context, record events.DynamoDBEventRecord) (int, error)
+}
+
+// FileDeadLetterSink keeps dead letters as NDJSON lines of a local file and counts failed attempts
+// in a json file of the same path with .attempts appended. A single process may write the files at a time.
+type FileDeadLetterSink struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+// Put implements DeadLetterSink, it appends the letter to the file and forgets attempts of its record
+func (s *FileDeadLetterSink) Put(ctx context.Context, letter *DeadLetter) error {
+	line, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.OpenFile(s.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	attempts, err := s.readAttempts()
+	if err != nil {
+		return err
+	}
+	if _, ok := attempts[letter.ID()]; !ok {
+		return nil
+	}
+	delete(attempts, letter.ID())
+	return s.writeAttempts(attempts)
+}
+
+// Attempt implements DeadLetterSink, counts are forgotten all at once when maxTrackedAttempts
+// records have failed without being dead lettered
+func (s *FileDeadLetterSink) Attempt(ctx context.Context, record events.DynamoDBEventRecord) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	attempts, err := s.readAttempts()
+	if err != nil {
+		return 0, err
+	}
+	id := (&DeadLetter{Record: record}).ID()
+	if _, ok := attempts[id]; !ok && len(attempts) >= maxTrackedAttempts {
+		attempts = map[string]int{}
+	}
+	attempts[id]++
+	if err := s.writeAttempts(attempts); err != nil {
+		return 0, err
+	}
+	return attempts[id], nil
+}
+
+// readAttempts return attempts counted by letter id
+func (s *FileDeadLetterSink) readAttempts() (map[string]int, error) {
+	attempts := map[string]int{}
+	b, err := ioutil.ReadFile(s.Path + ".attempts")
+	if os.IsNotExist(err) {
+		return attempts, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &attempts); err != nil {
+		return nil, err
+	}
+	return attempts, nil
+}
+
+// writeAttempts replace the attempts file atomically
+func (s *FileDeadLetterSink) writeAttempts(attempts map[string]int) error {
+	b, err := json.Marshal(attempts)
+	if err != nil {
+		return err
+	}
+	path := s.Path + ".attempts"
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Drain implements DeadLetterSink, letters which weren't handled are written back to the file
+func (s *FileDeadLetterSink) Drain(ctx context.Context, fn func(*DeadLetter) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.Open(s.Path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var kept [][]byte
+	var drainErr error
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			f.Close()
+			return err
+		}
+		line = bytes.TrimSpace(line)
+		switch {
+		case len(line) == 0:
+		case drainErr != nil:
+			kept = append(kept, line)
+		case ctx.Err() != nil:
+			drainErr = ctx.Err()
+			kept = append(kept, line)
+		default:
+			letter := &DeadLetter{}
+			if drainErr = json.Unmarshal(line, letter); drainErr != nil {
+				kept = append(kept, line)
+			} else if err := fn(letter); err != nil {
+				fmt.Printf("ddbstore:FileDeadLetterSink: %s: %v\n", letter.ID(), err)
+				kept = append(kept, line)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	f.Close()
+	// rewrite the file in place atomically so a crash never loses letters
+	tmp, err := ioutil.TempFile(filepath.Dir(s.Path), filepath.Base(s.Path)+".*")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	for _, line := range kept {
+		w.Write(line)
+		w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.Path); err != nil {
+		return err
+	}
+	return drainErr
+}
+
+// DeadLetterTableSpec return spec of the table keeping dead letters of DynamoDeadLetterSink,
+// attempt counts expire with the time to live of expires_at
+func DeadLetterTableSpec(tableName string) *TableSpec {
+	return &TableSpec{
+		TableName:      tableName,
+		HashKey:        deadLetterIDAttribute,
+		AttributeTypes: map[string]string{deadLetterIDAttribute: dynamodb.ScalarAttributeTypeS},
+		BillingMode:    dynamodb.BillingModePayPerRequest,
+		TTLAttribute:   deadLetterExpiresAttribute,
+	}
+}
+
+// DynamoDeadLetterSink keeps dead letters in a dynamodb table, see DeadLetterTableSpec.
+// The record is stored as its lambda event json. Failed attempts of records are counted in
+// items of the same table which expire after attemptsTTL.
+type DynamoDeadLetterSink struct {
+	DdbClient dynamodbiface.DynamoDBAPI
+	TableName string
+}
+
+// Put implements DeadLetterSink, a letter of the same record replaces the previous one
+func (s *DynamoDeadLetterSink) Put(ctx context.Context, letter *DeadLetter) error {
+	record, err := json.Marshal(letter.Record)
+	if err != nil {
+		return err
+	}
+	_, err = s.DdbClient.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(s.TableName),
+		Item: map[string]*dynamodb.AttributeValue{
+			deadLetterIDAttribute:       {S: aws.String(letter.ID())},
+			deadLetterRecordAttribute:   {S: aws.String(string(record))},
+			deadLetterErrorAttribute:    {S: aws.String(letter.Error)},
+			deadLetterAttemptsAttribute: {N: aws.String(strconv.Itoa(letter.Attempts))},
+			deadLetterFailedAtAttribute: {S: aws.String(letter.FailedAt.UTC().Format(time.RFC3339Nano))},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = s.DdbClient.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: aws.String(s.TableName),
+		Key:       map[string]*dynamodb.AttributeValue{deadLetterIDAttribute: {S: aws.String(attemptsIDPrefix + letter.ID())}},
+	})
+	return err
+}
+
+// Attempt implements DeadLetterSink, it adds the attempt to the count of the record atomically
+// so concurrent invocations don't lose attempts
+func (s *DynamoDeadLetterSink) Attempt(ctx context.Context, record events.DynamoDBEventRecord) (int, error) {
+	output, err := s.DdbClient.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:        aws.String(s.TableName),
+		Key:              map[string]*dynamodb.AttributeValue{deadLetterIDAttribute: {S: aws.String(attemptsIDPrefix + (&DeadLetter{Record: record}).ID())}},
+		UpdateExpression: aws.String("ADD #attempts :one SET #expires = :expires"),
+		ExpressionAttributeNames: map[string]*string{
+			"#attempts": aws.String(deadLetterAttemptsAttribute),
+			"#expires":  aws.String(deadLetterExpiresAttribute),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":one":     {N: aws.String("1")},
+			":expires": {N: aws.String(strconv.FormatInt(time.Now().Add(attemptsTTL).Unix(), 10))},
+		},
+		ReturnValues: aws.String(dynamodb.ReturnValueUpdatedNew),
+	})
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(aws.StringValue(output.Attributes[deadLetterAttemptsAttribute].N))
+}
+
+// Drain implements DeadLetterSink, it scans the table and deletes letters fn handled
+func (s *DynamoDeadLetterSink) Drain(ctx context.Context, fn func(*DeadLetter) error) error {
+	input := &dynamodb.ScanInput{
+		TableName:      aws.String(s.TableName),
+		ConsistentRead: aws.Bool(true),
+	}
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		output, err := s.DdbClient.Scan(input)
+		if err != nil {
+			return err
+		}
+		for _, item := range output.Items {
+			if strings.HasPrefix(aws.StringValue(item[deadLetterIDAttribute].S), attemptsIDPrefix) {
+				continue
+			}
+			letter, err := deadLetterFromItem(item)
+			if err != nil {
+				return err
+			}
+			if err := fn(letter); err != nil {
+				fmt.Printf("ddbstore:DynamoDeadLetterSink: %s: %v\n", letter.ID(), err)
+				continue
+			}
+			_, err = s.DdbClient.DeleteItem(&dynamodb.DeleteItemInput{
+				TableName: aws.String(s.TableName),
+				Key:       map[string]*dynamodb.AttributeValue{deadLetterIDAttribute: item[deadLetterIDAttribute]},
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if len(output.LastEvaluatedKey) == 0 {
+			return nil
+		}
+		input.ExclusiveStartKey = output.LastEvaluatedKey
+	}
+}
+
+// deadLetterFromItem return dead letter stored in the item
+func deadLetterFromItem(item map[string]*dynamodb.AttributeValue) (*DeadLetter, error) {
+	letter := &DeadLetter{}
+	if v := item[deadLetterRecordAttribute]; v != nil {
+		if err := json.Unmarshal([]byte(aws.StringValue(v.S)), &letter.Record); err != nil {
+			return nil, err
+		}
+	}
+	if v := item[deadLetterErrorAttribute]; v != nil {
+		letter.Error = aws.StringValue(v.S)
+	}
+	if v := item[deadLetterAttemptsAttribute]; v != nil {
+		letter.Attempts, _ = strconv.Atoi(aws.StringValue(v.N))
+	}
+	if v := item[deadLetterFailedAtAttribute]; v != nil {
+		letter.FailedAt, _ = time.Parse(time.RFC3339Nano, aws.StringValue(v.S))
+	}
+	return letter, nil
+}
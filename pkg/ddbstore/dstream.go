@@ -1,40 +1,39 @@
 package ddbstore
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
-	"io"
 	"net/http"
-	"os"
 	"regexp"
 	"strings"
+	"time"
 
 	"encoding/json"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
-	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
-	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
-	"github.com/sha1sum/aws_signing_client"
 
 	"github.com/elastic/go-elasticsearch/v7"
+
+	"go-grpc-kubernetes/pkg/env"
 )
 
 var (
-	ErrHashKeyNotFound = errors.New("hash key not found")
-	slim               = regexp.MustCompile(`\s+`)
+	ErrHashKeyNotFound  = errors.New("hash key not found")
+	ErrClusterUnhealthy = errors.New("elasticsearch cluster unhealthy")
+	slim                = regexp.MustCompile(`\s+`)
 )
 
 // GetEnv return env variable if key existed or returning the fallback
+//
+// Deprecated: use env.Get of go-grpc-kubernetes/pkg/env
 func GetEnv(key, fallback string) string {
-	if val := os.Getenv(key); val != "" {
-		return val
-	}
-	return fallback
+	return env.Get(key, fallback)
 }
 
 // DynamoDetails is a wrapper around the DynamoDBAPI interface,
@@ -46,6 +45,8 @@ type DynamoDetails struct {
 // Details is the data needed to index the most recent dataoff to elasticsearch
 type Details struct {
 	HashKey, RangeKey, TableName string
+	// Redacted attributes are never indexed, these are the sensitive and encrypted ones of the table
+	Redacted []string
 }
 
 // GetFromKeys return the details for ES from given hash and range keys
@@ -57,17 +58,27 @@ func (d *DynamoDetails) GetFromKeys(tableName string, hashKey, rangeKey string)
 		TableName: tableName,
 		HashKey:   hashKey,
 		RangeKey:  rangeKey,
+		Redacted:  redactedAttributes(tableName),
 	}
 	return
 }
 
+// redactedAttributes return attributes of the table which must not be indexed
+func redactedAttributes(tableName string) []string {
+	opts := optionsFor(tableName)
+	redacted := append([]string{}, opts.Sensitive...)
+	if opts.Encryption != nil {
+		redacted = append(redacted, opts.Encryption.Attributes...)
+	}
+	return redacted
+}
+
 // Get Extracts out the attribute Value of Hash Key and Range key from the describe table output
 func (d *DynamoDetails) Get(tableName string) (details *Details, err error) {
-	var out *dynamodb.DescribeTableOutput
-	req, out := d.DescribeTableRequest(&dynamodb.DescribeTableInput{
+	out, err := d.DescribeTable(&dynamodb.DescribeTableInput{
 		TableName: aws.String(tableName),
 	})
-	if err = req.Send(); err != nil {
+	if err != nil {
 		return nil, err
 	}
 	// We NEED a hash key to uniquely identify records
@@ -83,6 +94,7 @@ func (d *DynamoDetails) Get(tableName string) (details *Details, err error) {
 		TableName: tableName,
 		HashKey:   hashKey,
 		RangeKey:  rangeKey,
+		Redacted:  redactedAttributes(tableName),
 	}
 	return
 }
@@ -119,10 +131,15 @@ func (d *Details) docID(item map[string]events.DynamoDBAttributeValue) (id strin
 
 // index return automated unique ddb table name as elasticsearch index
 func (d *Details) index() string {
-	return strings.ToLower(d.TableName)
+	return SearchIndexName(d.TableName)
+}
+
+// SearchIndexName return elasticsearch index of documents of the table
+func SearchIndexName(tableName string) string {
+	return strings.ToLower(tableName)
 }
 
-// EventStreamToMap to convert inconsistent ddb stream to ddb attrs
+// EventStreamToMap to convert inconsistent ddb stream to ddb attrs, it is the inverse of MapToEventStream
 func EventStreamToMap(attribute interface{}) map[string]*dynamodb.AttributeValue {
 	m := make(map[string]*dynamodb.AttributeValue)
 	tmp := make(map[string]events.DynamoDBAttributeValue)
@@ -133,31 +150,84 @@ func EventStreamToMap(attribute interface{}) map[string]*dynamodb.AttributeValue
 		tmp = t.Map()
 	}
 	for k, v := range tmp {
-		switch v.DataType() {
-		case events.DataTypeString:
-			s := v.String()
-			m[k] = &dynamodb.AttributeValue{
-				S: &s,
-			}
-		case events.DataTypeBoolean:
-			b := v.Boolean()
-			m[k] = &dynamodb.AttributeValue{
-				BOOL: &b,
-			}
-		case events.DataTypeMap:
-			m[k] = &dynamodb.AttributeValue{
-				M: EventStreamToMap(v),
-			}
-		case events.DataTypeNumber:
-			n := v.Number()
-			m[k] = &dynamodb.AttributeValue{
-				N: &n,
-			}
+		m[k] = ddbAttribute(v)
+	}
+	return m
+}
+
+// ddbAttribute convert single lambda event attribute value to ddb attribute value
+func ddbAttribute(v events.DynamoDBAttributeValue) *dynamodb.AttributeValue {
+	switch v.DataType() {
+	case events.DataTypeString:
+		return &dynamodb.AttributeValue{S: aws.String(v.String())}
+	case events.DataTypeNumber:
+		return &dynamodb.AttributeValue{N: aws.String(v.Number())}
+	case events.DataTypeBinary:
+		return &dynamodb.AttributeValue{B: v.Binary()}
+	case events.DataTypeBoolean:
+		return &dynamodb.AttributeValue{BOOL: aws.Bool(v.Boolean())}
+	case events.DataTypeMap:
+		return &dynamodb.AttributeValue{M: EventStreamToMap(v)}
+	case events.DataTypeList:
+		list := make([]*dynamodb.AttributeValue, len(v.List()))
+		for i, item := range v.List() {
+			list[i] = ddbAttribute(item)
 		}
+		return &dynamodb.AttributeValue{L: list}
+	case events.DataTypeStringSet:
+		return &dynamodb.AttributeValue{SS: aws.StringSlice(v.StringSet())}
+	case events.DataTypeNumberSet:
+		return &dynamodb.AttributeValue{NS: aws.StringSlice(v.NumberSet())}
+	case events.DataTypeBinarySet:
+		return &dynamodb.AttributeValue{BS: v.BinarySet()}
+	}
+	return &dynamodb.AttributeValue{NULL: aws.Bool(true)}
+}
+
+// MapToEventStream convert ddb attrs to attribute values of lambda stream events,
+// so records read from dynamodb streams directly go to the same handlers
+func MapToEventStream(attrs map[string]*dynamodb.AttributeValue) map[string]events.DynamoDBAttributeValue {
+	if attrs == nil {
+		return nil
+	}
+	m := make(map[string]events.DynamoDBAttributeValue, len(attrs))
+	for k, v := range attrs {
+		m[k] = eventAttribute(v)
 	}
 	return m
 }
 
+// eventAttribute convert single ddb attribute value to lambda event attribute value
+func eventAttribute(av *dynamodb.AttributeValue) events.DynamoDBAttributeValue {
+	switch {
+	case av == nil:
+		return events.NewNullAttribute()
+	case av.S != nil:
+		return events.NewStringAttribute(*av.S)
+	case av.N != nil:
+		return events.NewNumberAttribute(*av.N)
+	case av.B != nil:
+		return events.NewBinaryAttribute(av.B)
+	case av.BOOL != nil:
+		return events.NewBooleanAttribute(*av.BOOL)
+	case av.M != nil:
+		return events.NewMapAttribute(MapToEventStream(av.M))
+	case av.L != nil:
+		list := make([]events.DynamoDBAttributeValue, len(av.L))
+		for i, v := range av.L {
+			list[i] = eventAttribute(v)
+		}
+		return events.NewListAttribute(list)
+	case av.SS != nil:
+		return events.NewStringSetAttribute(aws.StringValueSlice(av.SS))
+	case av.NS != nil:
+		return events.NewNumberSetAttribute(aws.StringValueSlice(av.NS))
+	case av.BS != nil:
+		return events.NewBinarySetAttribute(av.BS)
+	}
+	return events.NewNullAttribute()
+}
+
 // AWSSigningTransport for signer awsv4 with Elasticsearch
 type AWSSigningTransport struct {
 	HTTPClient *http.Client
@@ -176,7 +246,7 @@ type Elasticsearch struct {
 // GetSession return aws session with appropriate credentials
 func GetSession() (*session.Session, error) {
 	return session.NewSession(&aws.Config{
-		Region: aws.String(GetEnv("AWS_REGION", GetEnv("REGION", "us-east-1"))),
+		Region: aws.String(env.Get("AWS_REGION", env.Get("REGION", "us-east-1"))),
 	})
 }
 
@@ -193,23 +263,30 @@ func NewElasticsearch() (*Elasticsearch, error) {
 // NewElasticsearchWithSession return a new Elasticsearch client instance
 // with AWS v4 signer from provided session
 func NewElasticsearchWithSession(sess *session.Session) (*Elasticsearch, error) {
-	signer := v4.NewSigner(sess.Config.Credentials)
-	awsclient, err := aws_signing_client.New(signer, nil, "es", *sess.Config.Region)
+	return NewElasticsearchWithOptions(ElasticsearchOptions{Auth: ElasticsearchAuthSigV4, Session: sess})
+}
+
+// WaitHealthy wait up to timeout for the cluster to be at least yellow, i.e. all primary shards assigned
+func (es *Elasticsearch) WaitHealthy(ctx context.Context, timeout time.Duration) error {
+	res, err := es.Cluster.Health(
+		es.Cluster.Health.WithWaitForStatus("yellow"),
+		es.Cluster.Health.WithTimeout(timeout),
+		es.Cluster.Health.WithContext(ctx),
+	)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	signingTransport := AWSSigningTransport{
-		HTTPClient: awsclient,
+	defer res.Body.Close()
+	var health struct {
+		Status string `json:"status"`
 	}
-	es, err := elasticsearch.NewClient(elasticsearch.Config{
-		Transport: http.RoundTripper(signingTransport),
-	})
-	if err != nil {
-		return nil, err
+	if err := json.NewDecoder(res.Body).Decode(&health); err != nil {
+		return err
+	}
+	if res.IsError() || health.Status == "red" {
+		return fmt.Errorf("%w: [%v] status %s", ErrClusterUnhealthy, res.Status(), health.Status)
 	}
-	esclient := new(Elasticsearch)
-	esclient.Client = es
-	return esclient, nil
+	return nil
 }
 
 // Update takes a reference to a dstream.Details object;
@@ -217,24 +294,13 @@ func NewElasticsearchWithSession(sess *session.Session) (*Elasticsearch, error)
 // And an item map[string]events.DynamoDBAttributeValue which will be turned into JSON
 // then indexed into Elasticsearch
 func (es *Elasticsearch) Update(d *Details, item map[string]events.DynamoDBAttributeValue) error {
-	res, err := es.Info()
+	body, err := document(d, item)
 	if err != nil {
 		return err
 	}
-	defer res.Body.Close()
-	fmt.Printf("ddbstore:elasticsearch:Update: %v\n", slim.ReplaceAllString(res.String(), " "))
-	tmp := EventStreamToMap(item)
-	var i interface{}
-	if err := dynamodbattribute.UnmarshalMap(tmp, &i); err != nil {
-		return err
-	}
-	body, err := json.Marshal(i)
-	if err != nil {
-		return err
-	}
-	res, err = es.Index(
+	res, err := es.Index(
 		d.index(),
-		strings.NewReader(string(body)),
+		bytes.NewReader(body),
 		es.Index.WithRefresh("true"),
 		es.Index.WithDocumentID(d.docID(item)),
 		es.Index.WithContext(context.Background()),
@@ -252,16 +318,7 @@ func (es *Elasticsearch) Update(d *Details, item map[string]events.DynamoDBAttri
 
 // Remove removes index from reference of dstream.Details object
 func (es *Elasticsearch) Remove(d *Details, item map[string]events.DynamoDBAttributeValue) error {
-	res, err := es.Info()
-	if err != nil {
-		return err
-	}
-	tmp := EventStreamToMap(item)
-	var i interface{}
-	if err := dynamodbattribute.UnmarshalMap(tmp, &i); err != nil {
-		return err
-	}
-	res, err = es.Delete(
+	res, err := es.Delete(
 		d.index(),
 		d.docID(item),
 		es.Delete.WithRefresh("true"),
@@ -277,42 +334,3 @@ func (es *Elasticsearch) Remove(d *Details, item map[string]events.DynamoDBAttri
 	fmt.Printf("ddbstore:elasticsearch:Remove: %v\n", slim.ReplaceAllString(res.String(), " "))
 	return nil
 }
-
-// BuildQuery for elasticsearch client
-func (es *Elasticsearch) BuildQuery(query string, after ...string) io.Reader {
-	var b strings.Builder
-	b.WriteString("{\n")
-	b.WriteString(query)
-	if len(after) > 0 && after[0] != "" && after[0] != "null" {
-		b.WriteString(",\n")
-		b.WriteString(fmt.Sprintf(`	"search_after": %s`, after))
-	}
-	b.WriteString("\n}")
-	fmt.Printf("%s\n", b.String())
-	return strings.NewReader(b.String())
-}
-
-type SearchResults struct {
-	Total int         `json:"total"`
-	Hits  interface{} `json:"hits"`
-}
-
-// Query for elasticsearch client
-func (es *Elasticsearch) Query(d *Details, query, sort string, size int, result interface{}) error {
-	res, err := es.Search(
-		es.Search.WithIndex(d.index()),
-		es.Search.WithQuery(query),
-		es.Search.WithSort(sort),
-		es.Search.WithSize(size),
-		es.Search.WithContext(context.Background()),
-	)
-	if err != nil {
-		return err
-	}
-	defer res.Body.Close()
-	if res.IsError() {
-		return errors.New(fmt.Sprintf("[%v] Error seaching query=(%v) sort=(%v) size=(%v)", res.Status(), query, sort, size))
-	}
-	decoder := json.NewDecoder(res.Body)
-	return decoder.Decode(&result)
-}
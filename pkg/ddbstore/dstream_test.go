@@ -0,0 +1,156 @@
+package ddbstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+	"testing/quick"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// generatedItem is a generated dynamodb item holding attributes of every type, nested up to a few levels
+type generatedItem map[string]*dynamodb.AttributeValue
+
+// Generate implements quick.Generator
+func (generatedItem) Generate(r *rand.Rand, size int) reflect.Value {
+	return reflect.ValueOf(generatedItem(generateAttrs(r, 3)))
+}
+
+func generateAttrs(r *rand.Rand, depth int) map[string]*dynamodb.AttributeValue {
+	attrs := map[string]*dynamodb.AttributeValue{}
+	for i, n := 0, r.Intn(6); i < n; i++ {
+		attrs[fmt.Sprintf("attr_%d", i)] = generateAttr(r, depth)
+	}
+	return attrs
+}
+
+func generateString(r *rand.Rand) string {
+	v, _ := quick.Value(reflect.TypeOf(""), r)
+	return v.String()
+}
+
+func generateNumber(r *rand.Rand) string {
+	switch r.Intn(3) {
+	case 0:
+		return fmt.Sprint(r.Int63() - r.Int63())
+	case 1:
+		return fmt.Sprint(r.NormFloat64() * 1e6)
+	}
+	// more digits than float64 keeps, numbers must pass as strings
+	return fmt.Sprintf("%d%d.%d", r.Int63(), r.Int63(), r.Int63())
+}
+
+func generateBytes(r *rand.Rand) []byte {
+	b := make([]byte, r.Intn(20))
+	r.Read(b)
+	return b
+}
+
+func generateAttr(r *rand.Rand, depth int) *dynamodb.AttributeValue {
+	kinds := 8
+	if depth > 0 {
+		kinds = 10
+	}
+	switch r.Intn(kinds) {
+	case 0:
+		return &dynamodb.AttributeValue{S: aws.String(generateString(r))}
+	case 1:
+		return &dynamodb.AttributeValue{N: aws.String(generateNumber(r))}
+	case 2:
+		return &dynamodb.AttributeValue{B: generateBytes(r)}
+	case 3:
+		return &dynamodb.AttributeValue{BOOL: aws.Bool(r.Intn(2) == 0)}
+	case 4:
+		return &dynamodb.AttributeValue{NULL: aws.Bool(true)}
+	case 5:
+		set := []*string{}
+		for i, n := 0, 1+r.Intn(4); i < n; i++ {
+			set = append(set, aws.String(generateString(r)))
+		}
+		return &dynamodb.AttributeValue{SS: set}
+	case 6:
+		set := []*string{}
+		for i, n := 0, 1+r.Intn(4); i < n; i++ {
+			set = append(set, aws.String(generateNumber(r)))
+		}
+		return &dynamodb.AttributeValue{NS: set}
+	case 7:
+		set := [][]byte{}
+		for i, n := 0, 1+r.Intn(4); i < n; i++ {
+			set = append(set, generateBytes(r))
+		}
+		return &dynamodb.AttributeValue{BS: set}
+	case 8:
+		return &dynamodb.AttributeValue{M: generateAttrs(r, depth-1)}
+	}
+	list := []*dynamodb.AttributeValue{}
+	for i, n := 0, r.Intn(4); i < n; i++ {
+		list = append(list, generateAttr(r, depth-1))
+	}
+	return &dynamodb.AttributeValue{L: list}
+}
+
+func TestEventStreamRoundTrip(t *testing.T) {
+	// dynamodb attributes survive conversion to lambda event attributes and back
+	toEvent := func(in generatedItem) bool {
+		out := EventStreamToMap(MapToEventStream(in))
+		if !reflect.DeepEqual(map[string]*dynamodb.AttributeValue(in), out) {
+			t.Logf("got %v, want %v", out, in)
+			return false
+		}
+		return true
+	}
+	// lambda event attributes, as decoded from the lambda json payload, survive conversion to dynamodb
+	// attributes and back
+	fromEvent := func(in generatedItem) bool {
+		payload, err := json.Marshal(MapToEventStream(in))
+		if err != nil {
+			t.Log(err)
+			return false
+		}
+		var event map[string]events.DynamoDBAttributeValue
+		if err := json.Unmarshal(payload, &event); err != nil {
+			t.Log(err)
+			return false
+		}
+		out := MapToEventStream(EventStreamToMap(event))
+		if !reflect.DeepEqual(event, out) {
+			t.Logf("got %v, want %v", out, event)
+			return false
+		}
+		return reflect.DeepEqual(map[string]*dynamodb.AttributeValue(in), EventStreamToMap(event))
+	}
+	config := &quick.Config{MaxCount: 500}
+	if err := quick.Check(toEvent, config); err != nil {
+		t.Error(err)
+	}
+	if err := quick.Check(fromEvent, config); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEventStreamEmptyValues(t *testing.T) {
+	in := map[string]*dynamodb.AttributeValue{
+		"empty_string": {S: aws.String("")},
+		"empty_binary": {B: []byte{}},
+		"empty_map":    {M: map[string]*dynamodb.AttributeValue{}},
+		"empty_list":   {L: []*dynamodb.AttributeValue{}},
+		"null":         {NULL: aws.Bool(true)},
+		"false":        {BOOL: aws.Bool(false)},
+		"zero":         {N: aws.String("0")},
+		"nested": {M: map[string]*dynamodb.AttributeValue{
+			"list": {L: []*dynamodb.AttributeValue{{M: map[string]*dynamodb.AttributeValue{"null": {NULL: aws.Bool(true)}}}}},
+		}},
+	}
+	if out := EventStreamToMap(MapToEventStream(in)); !reflect.DeepEqual(in, out) {
+		t.Errorf("got %v, want %v", out, in)
+	}
+	if MapToEventStream(nil) != nil {
+		t.Error("nil image converted to non-nil event attributes")
+	}
+}
@@ -0,0 +1,173 @@
+package ddbstore
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/elastic/go-elasticsearch/v7"
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+	"github.com/elastic/go-elasticsearch/v7/estransport"
+	"github.com/sha1sum/aws_signing_client"
+
+	"go-grpc-kubernetes/pkg/env"
+)
+
+// authentication of requests to elasticsearch
+const (
+	// ElasticsearchAuthSigV4 signs requests with AWS credentials for Amazon Elasticsearch Service
+	ElasticsearchAuthSigV4 = "sigv4"
+	// ElasticsearchAuthBasic sends username and password
+	ElasticsearchAuthBasic = "basic"
+	// ElasticsearchAuthAPIKey sends an API key
+	ElasticsearchAuthAPIKey = "apikey"
+	// ElasticsearchAuthNone sends no credentials, e.g. to a local container
+	ElasticsearchAuthNone = "none"
+)
+
+// defaultElasticsearchURL is the address of a local cluster
+const defaultElasticsearchURL = "http://localhost:9200"
+
+var (
+	ErrUnknownElasticsearchAuth = errors.New("unknown elasticsearch authentication")
+	ErrMissingCredentials       = errors.New("missing elasticsearch credentials")
+	ErrInvalidCACert            = errors.New("no certificate found in CA file")
+)
+
+// ValidElasticsearchAuth return an error unless auth is sigv4, basic, apikey or none
+func ValidElasticsearchAuth(auth string) error {
+	switch auth {
+	case ElasticsearchAuthSigV4, ElasticsearchAuthBasic, ElasticsearchAuthAPIKey, ElasticsearchAuthNone:
+		return nil
+	}
+	return fmt.Errorf("%w: %q", ErrUnknownElasticsearchAuth, auth)
+}
+
+// ElasticsearchOptions configure NewElasticsearchWithOptions
+type ElasticsearchOptions struct {
+	// Addresses of cluster nodes, ELASTICSEARCH_URL is used when empty and http://localhost:9200 without it
+	Addresses []string
+	// Auth is sigv4, basic, apikey or none, sigv4 by default
+	Auth string
+	// Username and Password of basic auth
+	Username, Password string
+	// APIKey is the base64 encoded id:api_key of apikey auth
+	APIKey string
+	// CACert is a PEM file of certificate authorities trusted besides the system ones
+	CACert string
+	// ClientCert and ClientKey are PEM files of the client certificate of mutual TLS
+	ClientCert, ClientKey string
+	// Session provides credentials and region of sigv4 auth, the default session when nil
+	Session *session.Session
+}
+
+// tlsConfig return TLS configuration of the options, nil when the defaults do
+func (o ElasticsearchOptions) tlsConfig() (*tls.Config, error) {
+	if o.CACert == "" && o.ClientCert == "" && o.ClientKey == "" {
+		return nil, nil
+	}
+	config := &tls.Config{}
+	if o.CACert != "" {
+		pem, err := ioutil.ReadFile(o.CACert)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidCACert, o.CACert)
+		}
+		config.RootCAs = pool
+	}
+	if o.ClientCert != "" || o.ClientKey != "" {
+		cert, err := tls.LoadX509KeyPair(o.ClientCert, o.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// NewElasticsearchWithOptions return a new Elasticsearch client of the cluster at the addresses,
+// authenticated as configured by the options
+func NewElasticsearchWithOptions(opts ElasticsearchOptions) (*Elasticsearch, error) {
+	if opts.Auth == "" {
+		opts.Auth = ElasticsearchAuthSigV4
+	}
+	if err := ValidElasticsearchAuth(opts.Auth); err != nil {
+		return nil, err
+	}
+	if len(opts.Addresses) == 0 {
+		opts.Addresses = env.List("ELASTICSEARCH_URL")
+	}
+	if len(opts.Addresses) == 0 {
+		opts.Addresses = []string{defaultElasticsearchURL}
+	}
+	// the transport is built here rather than by elasticsearch.NewClient, which refuses
+	// explicit addresses while ELASTICSEARCH_URL is set
+	config := estransport.Config{}
+	for _, address := range opts.Addresses {
+		u, err := url.Parse(strings.TrimRight(address, "/"))
+		if err != nil {
+			return nil, err
+		}
+		config.URLs = append(config.URLs, u)
+	}
+	tlsConfig, err := opts.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	var transport http.RoundTripper
+	if tlsConfig != nil {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.TLSClientConfig = tlsConfig
+		transport = t
+	}
+	switch opts.Auth {
+	case ElasticsearchAuthSigV4:
+		sess := opts.Session
+		if sess == nil {
+			if sess, err = GetSession(); err != nil {
+				return nil, err
+			}
+		}
+		region := aws.StringValue(sess.Config.Region)
+		if region == "" {
+			region = env.Get("AWS_REGION", env.Get("REGION", "us-east-1"))
+		}
+		var client *http.Client
+		if transport != nil {
+			client = &http.Client{Transport: transport}
+		}
+		awsclient, err := aws_signing_client.New(v4.NewSigner(sess.Config.Credentials), client, "es", region)
+		if err != nil {
+			return nil, err
+		}
+		transport = AWSSigningTransport{HTTPClient: awsclient}
+	case ElasticsearchAuthBasic:
+		// the transport only sends basic auth with both of them
+		if opts.Username == "" || opts.Password == "" {
+			return nil, fmt.Errorf("%w: basic auth requires a username and password", ErrMissingCredentials)
+		}
+		config.Username, config.Password = opts.Username, opts.Password
+	case ElasticsearchAuthAPIKey:
+		if opts.APIKey == "" {
+			return nil, fmt.Errorf("%w: apikey auth requires an API key", ErrMissingCredentials)
+		}
+		config.APIKey = opts.APIKey
+	}
+	config.Transport = transport
+	tp := estransport.New(config)
+	return &Elasticsearch{Client: &elasticsearch.Client{Transport: tp, API: esapi.New(tp)}}, nil
+}
@@ -0,0 +1,198 @@
+package ddbstore
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// lastRequest keeps the last request an elasticsearch stub received
+type lastRequest struct {
+	*http.Request
+}
+
+func (l *lastRequest) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	l.Request = r
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"cluster_name":"orders"}`))
+}
+
+// writePEM write the pem block to a file of the test and return its path
+func writePEM(t *testing.T, name, blockType string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// clientCertificate write a self-signed client certificate and its key and return their paths
+func clientCertificate(t *testing.T) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "orders-indexer"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return writePEM(t, "client.pem", "CERTIFICATE", der), writePEM(t, "client-key.pem", "EC PRIVATE KEY", keyDER)
+}
+
+// info make a request with the client and return the request the stub received
+func info(t *testing.T, es *Elasticsearch, last *lastRequest) *http.Request {
+	t.Helper()
+	res, err := es.Info()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		t.Fatalf("info failed: %s", res)
+	}
+	return last.Request
+}
+
+func TestNewElasticsearchAuth(t *testing.T) {
+	last := &lastRequest{}
+	srv := httptest.NewServer(last)
+	defer srv.Close()
+	for _, tc := range []struct {
+		opts          ElasticsearchOptions
+		authorization string
+	}{
+		{ElasticsearchOptions{Auth: ElasticsearchAuthNone}, ""},
+		{ElasticsearchOptions{Auth: ElasticsearchAuthBasic, Username: "indexer", Password: "secret"}, "Basic aW5kZXhlcjpzZWNyZXQ="},
+		{ElasticsearchOptions{Auth: ElasticsearchAuthAPIKey, APIKey: "aWQ6a2V5"}, "APIKey aWQ6a2V5"},
+	} {
+		tc.opts.Addresses = []string{srv.URL + "/"}
+		es, err := NewElasticsearchWithOptions(tc.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := info(t, es, last)
+		if got := req.Header.Get("Authorization"); !strings.HasPrefix(got, tc.authorization) || (tc.authorization == "") != (got == "") {
+			t.Errorf("%q auth sent Authorization %q, want %q", tc.opts.Auth, got, tc.authorization)
+		}
+	}
+}
+
+func TestNewElasticsearchRejectsOptions(t *testing.T) {
+	notPEM := filepath.Join(t.TempDir(), "ca.pem")
+	if err := ioutil.WriteFile(notPEM, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		opts ElasticsearchOptions
+		err  error
+	}{
+		{ElasticsearchOptions{Auth: "kerberos"}, ErrUnknownElasticsearchAuth},
+		{ElasticsearchOptions{Auth: ElasticsearchAuthBasic, Password: "secret"}, ErrMissingCredentials},
+		{ElasticsearchOptions{Auth: ElasticsearchAuthBasic, Username: "indexer"}, ErrMissingCredentials},
+		{ElasticsearchOptions{Auth: ElasticsearchAuthAPIKey}, ErrMissingCredentials},
+		{ElasticsearchOptions{Auth: ElasticsearchAuthNone, CACert: notPEM}, ErrInvalidCACert},
+	} {
+		if _, err := NewElasticsearchWithOptions(tc.opts); !errors.Is(err, tc.err) {
+			t.Errorf("%+v: got %v, want %v", tc.opts, err, tc.err)
+		}
+	}
+	for _, opts := range []ElasticsearchOptions{
+		{Auth: ElasticsearchAuthNone, CACert: filepath.Join(t.TempDir(), "missing.pem")},
+		{Auth: ElasticsearchAuthNone, ClientCert: notPEM, ClientKey: notPEM},
+		{Auth: ElasticsearchAuthNone, Addresses: []string{"http://es:9200/%zz"}},
+	} {
+		if _, err := NewElasticsearchWithOptions(opts); err == nil {
+			t.Errorf("%+v: got no error", opts)
+		}
+	}
+}
+
+func TestNewElasticsearchTLS(t *testing.T) {
+	last := &lastRequest{}
+	srv := httptest.NewUnstartedServer(last)
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	// the handshake of the untrusting client fails on purpose
+	srv.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	srv.StartTLS()
+	defer srv.Close()
+	caCert := writePEM(t, "ca.pem", "CERTIFICATE", srv.Certificate().Raw)
+	certFile, keyFile := clientCertificate(t)
+
+	es, err := NewElasticsearchWithOptions(ElasticsearchOptions{
+		Addresses:  []string{srv.URL},
+		Auth:       ElasticsearchAuthBasic,
+		Username:   "indexer",
+		Password:   "secret",
+		CACert:     caCert,
+		ClientCert: certFile,
+		ClientKey:  keyFile,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := info(t, es, last)
+	if len(req.TLS.PeerCertificates) != 1 || req.TLS.PeerCertificates[0].Subject.CommonName != "orders-indexer" {
+		t.Errorf("got client certificates %v, want orders-indexer", req.TLS.PeerCertificates)
+	}
+	if user, _, ok := req.BasicAuth(); !ok || user != "indexer" {
+		t.Errorf("got basic auth of %q, want indexer over TLS", user)
+	}
+
+	// requests signed with sigv4 go over TLS of the options too
+	sess, err := session.NewSession(&aws.Config{
+		Region:      aws.String("eu-west-1"),
+		Credentials: credentials.NewStaticCredentials("AKID", "SECRET", ""),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	es, err = NewElasticsearchWithOptions(ElasticsearchOptions{Addresses: []string{srv.URL}, Session: sess, CACert: caCert, ClientCert: certFile, ClientKey: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = info(t, es, last)
+	if auth := req.Header.Get("Authorization"); !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/") || !strings.Contains(auth, "/eu-west-1/es/") {
+		t.Errorf("got Authorization %q, want it signed for es in eu-west-1", auth)
+	}
+
+	// the server certificate isn't trusted without the CA file
+	es, err = NewElasticsearchWithOptions(ElasticsearchOptions{Addresses: []string{srv.URL}, Auth: ElasticsearchAuthNone, ClientCert: certFile, ClientKey: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res, err := es.Info(); err == nil {
+		res.Body.Close()
+		t.Error("request to an untrusted server succeeded")
+	}
+}
@@ -0,0 +1,357 @@
+package ddbstore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+)
+
+var (
+	ErrUnknownExportFormat = errors.New("unknown export format")
+	ErrSegmentsChanged     = errors.New("checkpoint was written with a different number of workers")
+)
+
+// ExportFormat of files written by ExportTable and read by ImportTable
+type ExportFormat string
+
+const (
+	// ExportNDJSON writes one message per line in proto json mapping
+	ExportNDJSON ExportFormat = "ndjson"
+	// ExportDelimited writes binary protobuf messages each prefixed with its varint encoded length
+	ExportDelimited ExportFormat = "pb"
+)
+
+// SegmentCheckpoint is the progress of a single parallel scan segment
+type SegmentCheckpoint struct {
+	StartKey map[string]*dynamodb.AttributeValue `json:"start_key,omitempty"`
+	Done     bool                                `json:"done,omitempty"`
+}
+
+// Checkpoint records progress of export or import so an interrupted run can be resumed.
+// It is saved after every page written to the file or batch written to the table.
+type Checkpoint struct {
+	// Segments of export parallel scan
+	Segments []*SegmentCheckpoint `json:"segments,omitempty"`
+	// Offset is the number of bytes written to the export file or read from the import file
+	Offset int64 `json:"offset"`
+	// Items exported or imported so far
+	Items int64 `json:"items"`
+
+	path string
+}
+
+// LoadCheckpoint read checkpoint from file, a missing file gives an empty checkpoint
+// which is saved to that file as the run progresses. Empty path disables saving.
+func LoadCheckpoint(path string) (*Checkpoint, error) {
+	cp := &Checkpoint{path: path}
+	if path == "" {
+		return cp, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cp, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, cp); err != nil {
+		return nil, err
+	}
+	return cp, nil
+}
+
+// save write checkpoint atomically so a crash never leaves a truncated file
+func (c *Checkpoint) save() error {
+	if c.path == "" {
+		return nil
+	}
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
+
+// TransferOptions configure ExportTable and ImportTable
+type TransferOptions struct {
+	Format ExportFormat
+	// Workers is the number of parallel scan segments of export, it must not change when resuming
+	Workers int
+	// Rate limits items read or written per second, 0 is unlimited
+	Rate float64
+	// Batch configure retries of throttled scans and batch writes
+	Batch BatchOptions
+	// IncludeSensitive exports sensitive attributes of the table in plaintext, otherwise they are
+	// left out and importing the export doesn't restore them
+	IncludeSensitive bool
+}
+
+// pacer spreads items evenly so at most rate items per second pass through it
+type pacer struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func newPacer(rate float64) *pacer {
+	if rate <= 0 {
+		return &pacer{}
+	}
+	return &pacer{interval: time.Duration(float64(time.Second) / rate)}
+}
+
+// wait block until n more items may pass
+func (p *pacer) wait(n int) {
+	if p.interval == 0 {
+		return
+	}
+	p.mu.Lock()
+	now := time.Now()
+	if p.next.Before(now) {
+		p.next = now
+	}
+	at := p.next
+	p.next = p.next.Add(time.Duration(n) * p.interval)
+	p.mu.Unlock()
+	time.Sleep(time.Until(at))
+}
+
+// encodeRecord append message in export format to buf
+func encodeRecord(buf *bytes.Buffer, msg proto.Message, format ExportFormat) error {
+	switch format {
+	case ExportNDJSON:
+		marshaller := jsonpb.Marshaler{OrigName: true}
+		if err := marshaller.Marshal(buf, msg); err != nil {
+			return err
+		}
+		return buf.WriteByte('\n')
+	case ExportDelimited:
+		b, err := proto.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		var size [binary.MaxVarintLen64]byte
+		buf.Write(size[:binary.PutUvarint(size[:], uint64(len(b)))])
+		buf.Write(b)
+		return nil
+	}
+	return ErrUnknownExportFormat
+}
+
+// decodeRecord read next message in export format, returning it with the number of bytes read
+func decodeRecord(r *bufio.Reader, in proto.Message, format ExportFormat) (proto.Message, int64, error) {
+	out := proto.Clone(in)
+	out.Reset()
+	switch format {
+	case ExportNDJSON:
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF && len(line) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		if err := jsonpb.Unmarshal(bytes.NewReader(line), out); err != nil {
+			return nil, 0, err
+		}
+		return out, int64(len(line)), nil
+	case ExportDelimited:
+		size, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, 0, err
+		}
+		b := make([]byte, size)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, 0, err
+		}
+		if err := proto.Unmarshal(b, out); err != nil {
+			return nil, 0, err
+		}
+		var prefix [binary.MaxVarintLen64]byte
+		return out, int64(binary.PutUvarint(prefix[:], size)) + int64(size), nil
+	}
+	return nil, 0, ErrUnknownExportFormat
+}
+
+// ExportTable write all items of the table decoded to messages of the same type as given proto
+// to w, scanning the table in parallel segments. When resuming, w must be positioned at cp.Offset
+// since pages written after the last saved checkpoint are exported again. Sensitive attributes
+// are left out unless opts.IncludeSensitive is set.
+func ExportTable(in proto.Message, w io.Writer, cp *Checkpoint, opts TransferOptions, ddbClient dynamodbiface.DynamoDBAPI, tableName string) error {
+	if opts.Format != ExportNDJSON && opts.Format != ExportDelimited {
+		return ErrUnknownExportFormat
+	}
+	if opts.Workers < 1 {
+		opts.Workers = 1
+	}
+	opts.Batch = opts.Batch.withDefaults()
+	if cp.Segments == nil {
+		cp.Segments = make([]*SegmentCheckpoint, opts.Workers)
+		for i := range cp.Segments {
+			cp.Segments[i] = &SegmentCheckpoint{}
+		}
+	}
+	if len(cp.Segments) != opts.Workers {
+		return ErrSegmentsChanged
+	}
+	var redacted []string
+	if !opts.IncludeSensitive {
+		redacted = redactedAttributes(tableName)
+	}
+	limiter := newPacer(opts.Rate)
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+		stop     = make(chan struct{})
+	)
+	fail := func(err error) {
+		once.Do(func() {
+			firstErr = err
+			close(stop)
+		})
+	}
+	for segment, progress := range cp.Segments {
+		if progress.Done {
+			continue
+		}
+		wg.Add(1)
+		go func(segment int, startKey map[string]*dynamodb.AttributeValue) {
+			defer wg.Done()
+			input := &dynamodb.ScanInput{
+				TableName:     aws.String(tableName),
+				Segment:       aws.Int64(int64(segment)),
+				TotalSegments: aws.Int64(int64(opts.Workers)),
+			}
+			for attempt := 0; ; {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				input.ExclusiveStartKey = startKey
+				output, err := ddbClient.Scan(input)
+				if err != nil {
+					if isRetryable(err) && attempt+1 < opts.Batch.MaxAttempts {
+						time.Sleep(opts.Batch.backoff(attempt))
+						attempt++
+						continue
+					}
+					fail(err)
+					return
+				}
+				attempt = 0
+				limiter.wait(len(output.Items))
+				var buf bytes.Buffer
+				for _, item := range output.Items {
+					msg, err := decodeItem(in, item, tableName)
+					if err != nil {
+						fail(err)
+						return
+					}
+					clearFields(msg, redacted)
+					if err := encodeRecord(&buf, msg, opts.Format); err != nil {
+						fail(err)
+						return
+					}
+				}
+				startKey = output.LastEvaluatedKey
+				// a page is written and checkpointed at once so the file never runs ahead of checkpoint
+				mu.Lock()
+				_, err = w.Write(buf.Bytes())
+				if err == nil {
+					cp.Offset += int64(buf.Len())
+					cp.Items += int64(len(output.Items))
+					cp.Segments[segment] = &SegmentCheckpoint{StartKey: startKey, Done: startKey == nil}
+					err = cp.save()
+				}
+				mu.Unlock()
+				if err != nil {
+					fail(err)
+					return
+				}
+				if startKey == nil {
+					return
+				}
+			}
+		}(segment, progress.StartKey)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// ImportTable put all messages read from r to the table with batch writes. When resuming,
+// r must be positioned at cp.Offset. Import is idempotent so records written after
+// the last saved checkpoint are simply written again.
+func ImportTable(in proto.Message, r io.Reader, cp *Checkpoint, opts TransferOptions, ddbClient dynamodbiface.DynamoDBAPI, tableName string) error {
+	if opts.Format != ExportNDJSON && opts.Format != ExportDelimited {
+		return ErrUnknownExportFormat
+	}
+	opts.Batch = opts.Batch.withDefaults()
+	reader := bufio.NewReader(r)
+	limiter := newPacer(opts.Rate)
+	var (
+		reqs  []*dynamodb.WriteRequest
+		index = map[string]int{}
+		read  int64
+	)
+	flush := func() error {
+		if len(reqs) == 0 {
+			return nil
+		}
+		limiter.wait(len(reqs))
+		if err := BatchWriteToDdb(reqs, ddbClient, tableName, opts.Batch); err != nil {
+			return err
+		}
+		cp.Offset += read
+		cp.Items += int64(len(reqs))
+		reqs, index, read = nil, map[string]int{}, 0
+		return cp.save()
+	}
+	for {
+		msg, n, err := decodeRecord(reader, in, opts.Format)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		attrs, err := encodeItem(msg, "", tableName)
+		if err != nil {
+			return err
+		}
+		read += n
+		req := &dynamodb.WriteRequest{PutRequest: &dynamodb.PutRequest{Item: attrs}}
+		// a resumed export may contain an item twice, batch writes reject duplicate keys
+		if i, ok := index[writeRequestID(req)]; ok {
+			reqs[i] = req
+			continue
+		}
+		index[writeRequestID(req)] = len(reqs)
+		reqs = append(reqs, req)
+		if len(reqs) == maxBatchWriteItems {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return flush()
+}
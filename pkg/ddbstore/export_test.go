@@ -0,0 +1,29 @@
+package ddbstore
+
+import (
+	"bytes"
+	"testing"
+
+	pb "go-grpc-kubernetes/proto/orderservice"
+)
+
+func TestExportLeavesOutSensitiveAttributes(t *testing.T) {
+	db, tableName := newOrdersTable(t, TableOptions{Sensitive: []string{"customer_email"}})
+	if _, err := PutProtoToDdb(&pb.Order{Uuid: "order-1", CustomerEmail: "a@example.com", Quantity: 2}, "order-1", db, tableName); err != nil {
+		t.Fatal(err)
+	}
+	for _, include := range []bool{false, true} {
+		var buf bytes.Buffer
+		opts := TransferOptions{Format: ExportNDJSON, IncludeSensitive: include}
+		if err := ExportTable(&pb.Order{}, &buf, &Checkpoint{}, opts, db, tableName); err != nil {
+			t.Fatal(err)
+		}
+		exported := bytes.Contains(buf.Bytes(), []byte("a@example.com"))
+		if exported != include {
+			t.Errorf("with IncludeSensitive %v export is %s", include, buf.Bytes())
+		}
+		if !bytes.Contains(buf.Bytes(), []byte("order-1")) {
+			t.Errorf("export lost the order: %s", buf.Bytes())
+		}
+	}
+}
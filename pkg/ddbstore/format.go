@@ -0,0 +1,289 @@
+package ddbstore
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/dynamodb/expression"
+	"github.com/golang/protobuf/proto"
+)
+
+var (
+	ErrUnsupportedInBinaryFormat = errors.New("add and remove are not supported by binary format")
+	ErrConcurrentUpdate          = errors.New("item kept changing concurrently")
+)
+
+// Format of items stored in the table
+type Format int
+
+const (
+	// FormatJSON stores every field as top level attribute derived from proto json mapping
+	FormatJSON Format = iota
+	// FormatBinary stores the whole message as binary protobuf in a single attribute,
+	// only the key and projected attributes are kept at top level for indexes and filters
+	FormatBinary
+)
+
+const (
+	// protoAttribute holds binary protobuf of items in FormatBinary
+	protoAttribute = "proto"
+	// versionAttribute is incremented on every update of items in FormatBinary for optimistic locking
+	versionAttribute = "version"
+	// binaryUpdateAttempts bounds retries of read-merge-write when the item changes concurrently
+	binaryUpdateAttempts = 5
+)
+
+// binaryAttrs return item in binary format: the key and projected attributes from attrs
+// of the json layout and the whole message marshalled to binary protobuf
+func binaryAttrs(in proto.Message, attrs map[string]*dynamodb.AttributeValue, projected []string) (map[string]*dynamodb.AttributeValue, error) {
+	b, err := proto.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+	out := map[string]*dynamodb.AttributeValue{
+		protoAttribute: {B: b},
+	}
+	for _, name := range append([]string{"uuid"}, projected...) {
+		if av, ok := attrs[name]; ok {
+			out[name] = av
+		}
+	}
+	return out, nil
+}
+
+// encryption return encryption of the table, in FormatBinary the binary attribute is encrypted
+// as well since it holds sensitive fields
+func (o TableOptions) encryption() *Encryption {
+	if o.Encryption == nil || o.Format != FormatBinary {
+		return o.Encryption
+	}
+	attributes := make([]string, 0, len(o.Encryption.Attributes)+1)
+	attributes = append(attributes, o.Encryption.Attributes...)
+	return &Encryption{
+		Provider:   o.Encryption.Provider,
+		Attributes: append(attributes, protoAttribute),
+	}
+}
+
+// binaryToProto unmarshal binary protobuf into a new message of the same type as given proto
+func binaryToProto(in proto.Message, b []byte) (proto.Message, error) {
+	out := proto.Clone(in)
+	out.Reset()
+	if err := proto.Unmarshal(b, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// updateBinary merge proto message into the item stored in binary format. The item is read,
+// merged and written back on condition its version didn't change, retrying when it did.
+// It is written in the format of the table, a table back in json format converts the item to json.
+func updateBinary(in proto.Message, instanceID string, opts UpdateOptions, ddbClient dynamodbiface.DynamoDBAPI, tableName string) (proto.Message, error) {
+	if len(opts.Add) > 0 || len(opts.Remove) > 0 {
+		return nil, ErrUnsupportedInBinaryFormat
+	}
+	for attempt := 0; attempt < binaryUpdateAttempts; attempt++ {
+		output, err := ddbClient.GetItem(&dynamodb.GetItemInput{
+			Key:            keyFor(instanceID),
+			TableName:      aws.String(tableName),
+			ConsistentRead: aws.Bool(true),
+		})
+		if err != nil {
+			return nil, err
+		}
+		var (
+			out       proto.Message
+			condition expression.ConditionBuilder
+			version   int64
+		)
+		// decoding replaces pointers of the stored item with the blobs they point to
+		stored := blobKeys(output.Item)
+		if len(output.Item) == 0 {
+			out = proto.Clone(in)
+			condition = expression.AttributeNotExists(expression.Name("uuid"))
+		} else {
+			if v := output.Item[versionAttribute]; v != nil && v.N != nil {
+				if version, err = strconv.ParseInt(*v.N, 10, 64); err != nil {
+					return nil, err
+				}
+				condition = expression.Name(versionAttribute).Equal(expression.Value(version))
+			} else {
+				// items written in json format or by batch puts have no version yet
+				condition = expression.AttributeNotExists(expression.Name(versionAttribute))
+			}
+			if out, err = decodeItem(in, output.Item, tableName); err != nil {
+				return nil, err
+			}
+			proto.Merge(out, in)
+			// merge skips zero values, explicitly set fields overwrite the stored ones
+			if len(opts.Fields) > 0 {
+				if out, err = mergeFields(out, in, opts.Fields); err != nil {
+					return nil, err
+				}
+			}
+		}
+		attrs, err := encodeItem(out, instanceID, tableName)
+		if err != nil {
+			return nil, err
+		}
+		if optionsFor(tableName).Format == FormatBinary {
+			attrs[versionAttribute] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(version+1, 10))}
+		}
+		expr, err := expression.NewBuilder().WithCondition(condition).Build()
+		if err != nil {
+			return nil, err
+		}
+		_, err = ddbClient.PutItem(&dynamodb.PutItemInput{
+			Item:                      attrs,
+			TableName:                 aws.String(tableName),
+			ConditionExpression:       expr.Condition(),
+			ExpressionAttributeNames:  expr.Names(),
+			ExpressionAttributeValues: expr.Values(),
+		})
+		if rejected(err) {
+			discardBlobs(tableName, attrs)
+		}
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		releaseBlobs(tableName, stored, blobKeys(attrs))
+		return out, nil
+	}
+	return nil, ErrConcurrentUpdate
+}
+
+// mergeFields return out with given fields copied from in including zero values
+func mergeFields(out, in proto.Message, fields []string) (proto.Message, error) {
+	outAttrs, err := protoToAttrs(out, false)
+	if err != nil {
+		return nil, err
+	}
+	inAttrs, err := protoToAttrs(in, true)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range fields {
+		if av, ok := inAttrs[name]; ok {
+			outAttrs[name] = av
+		} else {
+			delete(outAttrs, name)
+		}
+	}
+	empty := proto.Clone(in)
+	empty.Reset()
+	return attrsToProto(empty, outAttrs)
+}
+
+// ConvertToBinary rewrite items of the table still stored in json format into binary format,
+// scanning the table with given number of workers. It can run in background next to live traffic,
+// an item is only rewritten while it is still stored as scanned, so items deleted or written
+// meanwhile by any replica are skipped.
+func ConvertToBinary(in proto.Message, workers int, ddbClient dynamodbiface.DynamoDBAPI, tableName string) (int64, error) {
+	filter := expression.AttributeNotExists(expression.Name(protoAttribute))
+	fields := fieldAttributes(in)
+	converted := make(chan struct{}, workers)
+	var count int64
+	done := make(chan struct{})
+	go func() {
+		for range converted {
+			count++
+		}
+		close(done)
+	}()
+	err := parallelScan(in, QueryInput{Filter: &filter}, workers, ddbClient, tableName, func(segment int64, it *Iterator) error {
+		stored := it.item()
+		attrs, err := encodeItem(it.Message(), "", tableName)
+		if err != nil {
+			return err
+		}
+		condition, names, values := unchangedCondition(stored, fields)
+		output, err := ddbClient.PutItem(&dynamodb.PutItemInput{
+			Item:                      attrs,
+			TableName:                 aws.String(tableName),
+			ConditionExpression:       aws.String(condition),
+			ExpressionAttributeNames:  names,
+			ExpressionAttributeValues: values,
+			ReturnValues:              aws.String(dynamodb.ReturnValueAllOld),
+		})
+		if rejected(err) {
+			discardBlobs(tableName, attrs)
+		}
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		releaseBlobs(tableName, blobKeys(output.Attributes), blobKeys(attrs))
+		converted <- struct{}{}
+		return nil
+	})
+	close(converted)
+	<-done
+	return count, err
+}
+
+// unchangedCondition return condition holding while the item is still stored as scanned: it exists,
+// is in json format, every scanned attribute has the same value and no other field was set since
+func unchangedCondition(stored map[string]*dynamodb.AttributeValue, fields []string) (string, map[string]*string, map[string]*dynamodb.AttributeValue) {
+	names := map[string]*string{"#uuid": aws.String("uuid"), "#proto": aws.String(protoAttribute)}
+	conditions := []string{"attribute_exists(#uuid)", "attribute_not_exists(#proto)"}
+	attributes := make([]string, 0, len(stored)+len(fields))
+	for name := range stored {
+		if name != "uuid" {
+			attributes = append(attributes, name)
+		}
+	}
+	for _, name := range fields {
+		if _, ok := stored[name]; !ok && name != "uuid" {
+			attributes = append(attributes, name)
+		}
+	}
+	sort.Strings(attributes)
+	var values map[string]*dynamodb.AttributeValue
+	for i, name := range attributes {
+		placeholder := "#a" + strconv.Itoa(i)
+		names[placeholder] = aws.String(name)
+		av, ok := stored[name]
+		if !ok {
+			conditions = append(conditions, "attribute_not_exists("+placeholder+")")
+			continue
+		}
+		if values == nil {
+			values = map[string]*dynamodb.AttributeValue{}
+		}
+		value := ":v" + strconv.Itoa(i)
+		values[value] = av
+		conditions = append(conditions, placeholder+" = "+value)
+	}
+	return strings.Join(conditions, " AND "), names, values
+}
+
+// fieldAttributes return attribute names of all fields of the message in json format
+func fieldAttributes(in proto.Message) []string {
+	t := reflect.TypeOf(in)
+	if t.Kind() != reflect.Ptr || t.Elem().Kind() != reflect.Struct {
+		return nil
+	}
+	props := proto.GetProperties(t.Elem())
+	var names []string
+	for _, prop := range props.Prop {
+		if prop.Tag > 0 {
+			names = append(names, prop.OrigName)
+		}
+	}
+	for name := range props.OneofTypes {
+		names = append(names, name)
+	}
+	return names
+}
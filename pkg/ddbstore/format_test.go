@@ -0,0 +1,172 @@
+package ddbstore
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+
+	pb "go-grpc-kubernetes/proto/orderservice"
+)
+
+// binaryOptions store orders in binary format
+var binaryOptions = TableOptions{Format: FormatBinary, Projected: []string{"status"}, Message: &pb.Order{}}
+
+func TestConvertToBinary(t *testing.T) {
+	db, tableName := newOrdersTable(t, TableOptions{})
+	for _, order := range []*pb.Order{{Uuid: "order-1", Quantity: 1}, {Uuid: "order-2", Quantity: 2}} {
+		if _, err := PutProtoToDdb(order, order.Uuid, db, tableName); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ConfigureTable(tableName, binaryOptions)
+	count, err := ConvertToBinary(&pb.Order{}, 2, db, tableName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("converted %d orders, want 2", count)
+	}
+	for i, id := range []string{"order-1", "order-2"} {
+		output, err := db.GetItem(&dynamodb.GetItemInput{Key: keyFor(id), TableName: aws.String(tableName)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if output.Item[protoAttribute] == nil || output.Item["quantity"] != nil {
+			t.Errorf("%s is stored as %v, want binary format", id, output.Item)
+		}
+		out, _, err := GetProtoFromDdb(&pb.Order{}, id, db, tableName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if quantity := out.(*pb.Order).Quantity; quantity != int32(i+1) {
+			t.Errorf("%s has quantity %d, want %d", id, quantity, i+1)
+		}
+	}
+}
+
+func TestConvertToBinarySkipsItemsChangedSinceScan(t *testing.T) {
+	db, tableName := newOrdersTable(t, TableOptions{})
+	for _, order := range []*pb.Order{{Uuid: "order-1", Quantity: 1}, {Uuid: "order-2", Quantity: 2}} {
+		if _, err := PutProtoToDdb(order, order.Uuid, db, tableName); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ConfigureTable(tableName, binaryOptions)
+	changed := false
+	db.Fail = func(op string) error {
+		if op != "PutItem" || changed {
+			return nil
+		}
+		changed = true
+		// another replica still writing json deletes one order and updates the other after the scan
+		if _, err := db.DeleteItem(&dynamodb.DeleteItemInput{Key: keyFor("order-1"), TableName: aws.String(tableName)}); err != nil {
+			t.Error(err)
+		}
+		_, err := db.UpdateItem(&dynamodb.UpdateItemInput{
+			Key:                       keyFor("order-2"),
+			TableName:                 aws.String(tableName),
+			UpdateExpression:          aws.String("SET quantity = :q, customer_name = :n"),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":q": {N: aws.String("5")}, ":n": {S: aws.String("a")}},
+		})
+		if err != nil {
+			t.Error(err)
+		}
+		return nil
+	}
+	count, err := ConvertToBinary(&pb.Order{}, 1, db, tableName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("converted %d orders changed since the scan, want 0", count)
+	}
+	output, err := db.GetItem(&dynamodb.GetItemInput{Key: keyFor("order-1"), TableName: aws.String(tableName)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output.Item != nil {
+		t.Errorf("deleted order-1 was resurrected as %v", output.Item)
+	}
+	out, _, err := GetProtoFromDdb(&pb.Order{}, "order-2", db, tableName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if order := out.(*pb.Order); order.Quantity != 5 || order.CustomerName != "a" {
+		t.Errorf("update of order-2 was overwritten, got %v", order)
+	}
+}
+
+func TestBinaryItemIsIndexedDecoded(t *testing.T) {
+	opts := binaryOptions
+	opts.Sensitive = []string{"customer_email"}
+	db, tableName := newOrdersTable(t, opts)
+	order := &pb.Order{Uuid: "order-1", Quantity: 3, Currency: "EUR", CustomerEmail: "a@example.com"}
+	if _, err := PutProtoToDdb(order, order.Uuid, db, tableName); err != nil {
+		t.Fatal(err)
+	}
+	output, err := db.GetItem(&dynamodb.GetItemInput{Key: keyFor("order-1"), TableName: aws.String(tableName)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := (&DynamoDetails{}).GetFromKeys(tableName, "uuid", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	op, err := IndexOperation(d, MapToEventStream(output.Item))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`"quantity":3`, `"currency":"EUR"`} {
+		if !bytes.Contains(op.Body, []byte(want)) {
+			t.Errorf("indexed document %s, want %s", op.Body, want)
+		}
+	}
+	for _, unwanted := range []string{`"proto"`, "a@example.com"} {
+		if bytes.Contains(op.Body, []byte(unwanted)) {
+			t.Errorf("indexed document %s contains %s", op.Body, unwanted)
+		}
+	}
+}
+
+func TestJSONUpdateConvertsBinaryItemBack(t *testing.T) {
+	db, tableName := newOrdersTable(t, binaryOptions)
+	if _, err := PutProtoToDdb(&pb.Order{Uuid: "order-1", Quantity: 1, Currency: "EUR"}, "order-1", db, tableName); err != nil {
+		t.Fatal(err)
+	}
+	// the table went back to json format after the order was stored in binary
+	ConfigureTable(tableName, TableOptions{})
+	if _, err := PutProtoToDdb(&pb.Order{Uuid: "order-1", Quantity: 2}, "order-1", db, tableName); err != nil {
+		t.Fatal(err)
+	}
+	output, err := db.GetItem(&dynamodb.GetItemInput{Key: keyFor("order-1"), TableName: aws.String(tableName)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output.Item[protoAttribute] != nil || output.Item[versionAttribute] != nil {
+		t.Errorf("order is stored as %v, want json format", output.Item)
+	}
+	out, _, err := GetProtoFromDdb(&pb.Order{}, "order-1", db, tableName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if order := out.(*pb.Order); order.Quantity != 2 || order.Currency != "EUR" {
+		t.Errorf("got %v, want the update merged into the stored order", order)
+	}
+	// a transaction can't merge the binary attribute so it is canceled
+	if _, err := PutProtoToDdb(&pb.Order{Uuid: "order-2", Quantity: 1}, "order-2", db, tableName); err != nil {
+		t.Fatal(err)
+	}
+	ConfigureTable(tableName, binaryOptions)
+	if _, err := PutProtoToDdb(&pb.Order{Uuid: "order-2", Quantity: 3}, "order-2", db, tableName); err != nil {
+		t.Fatal(err)
+	}
+	ConfigureTable(tableName, TableOptions{})
+	err = NewTransaction().Update(&pb.Order{Uuid: "order-2", Quantity: 4}, "order-2", UpdateOptions{}, tableName, nil).Commit(db)
+	var canceled *TransactionCanceledError
+	if !errors.As(err, &canceled) {
+		t.Errorf("got %v, want the transaction canceled", err)
+	}
+}
@@ -0,0 +1,305 @@
+package ddbstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+var (
+	ErrInvalidStreamArn = errors.New("invalid dynamodb stream arn")
+)
+
+// DocumentIndexer writes dynamodb items to a search index, it is implemented by *Elasticsearch
+type DocumentIndexer interface {
+	Update(d *Details, item map[string]events.DynamoDBAttributeValue) error
+	Remove(d *Details, item map[string]events.DynamoDBAttributeValue) error
+}
+
+// TableFromStreamArn return table name of stream arn like
+// arn:aws:dynamodb:eu-west-1:123456789012:table/orders-api-dev/stream/2019-11-01T00:00:00.000
+func TableFromStreamArn(arn string) (string, error) {
+	parts := strings.Split(arn, "/")
+	if len(parts) < 2 || !strings.HasSuffix(parts[0], ":table") || parts[1] == "" {
+		return "", fmt.Errorf("%w: %q", ErrInvalidStreamArn, arn)
+	}
+	return parts[1], nil
+}
+
+// StreamBatchItemFailure identify the first record of a batch which has to be delivered again
+type StreamBatchItemFailure struct {
+	ItemIdentifier string `json:"itemIdentifier"`
+}
+
+// StreamBatchResponse is the lambda response reporting partial batch failures,
+// the event source mapping must enable ReportBatchItemFailures
+type StreamBatchResponse struct {
+	BatchItemFailures []StreamBatchItemFailure `json:"batchItemFailures"`
+}
+
+// StreamIndexer applies dynamodb stream records to a search index: INSERT and MODIFY index
+// the new image of the item, REMOVE deletes its document
+type StreamIndexer struct {
+	details *DynamoDetails
+	index   DocumentIndexer
+
+	// deadLetters receives records failed maxAttempts times, nil keeps retrying them
+	deadLetters DeadLetterSink
+	maxAttempts int
+
+	mu     sync.Mutex
+	tables map[string]*Details
+}
+
+// NewStreamIndexer return indexer resolving key schema of tables with given client
+func NewStreamIndexer(ddbClient dynamodbiface.DynamoDBAPI, index DocumentIndexer) *StreamIndexer {
+	return &StreamIndexer{
+		details: &DynamoDetails{DynamoDBAPI: ddbClient},
+		index:   index,
+		tables:  map[string]*Details{},
+	}
+}
+
+// DeadLetter make the indexer put records failed maxAttempts times to the sink and move on to the
+// next records, instead of having the stream deliver them again until they expire
+func (ix *StreamIndexer) DeadLetter(sink DeadLetterSink, maxAttempts int) *StreamIndexer {
+	ix.deadLetters = sink
+	ix.maxAttempts = maxAttempts
+	return ix
+}
+
+// tableDetails return details of the table, described once per table
+func (ix *StreamIndexer) tableDetails(tableName string) (*Details, error) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if d, ok := ix.tables[tableName]; ok {
+		return d, nil
+	}
+	d, err := ix.details.Get(tableName)
+	if err != nil {
+		return nil, err
+	}
+	ix.tables[tableName] = d
+	return d, nil
+}
+
+// IndexRecord apply a single stream record to the index
+func (ix *StreamIndexer) IndexRecord(record events.DynamoDBEventRecord) error {
+	op, err := ix.operation(record)
+	if err != nil {
+		return err
+	}
+	d, err := ix.recordDetails(record)
+	if err != nil {
+		return err
+	}
+	if op == events.DynamoDBOperationTypeRemove {
+		return ix.index.Remove(d, record.Change.Keys)
+	}
+	return ix.index.Update(d, record.Change.NewImage)
+}
+
+// recordDetails return details of the table of the record
+func (ix *StreamIndexer) recordDetails(record events.DynamoDBEventRecord) (*Details, error) {
+	tableName, err := TableFromStreamArn(record.EventSourceArn)
+	if err != nil {
+		return nil, err
+	}
+	return ix.tableDetails(tableName)
+}
+
+// operation validate the record and return its operation type
+func (ix *StreamIndexer) operation(record events.DynamoDBEventRecord) (events.DynamoDBOperationType, error) {
+	switch op := events.DynamoDBOperationType(record.EventName); op {
+	case events.DynamoDBOperationTypeInsert, events.DynamoDBOperationTypeModify:
+		if len(record.Change.NewImage) == 0 {
+			return op, fmt.Errorf("record %s has no new image, stream view type must include new images", record.Change.SequenceNumber)
+		}
+		return op, nil
+	case events.DynamoDBOperationTypeRemove:
+		return op, nil
+	}
+	return "", fmt.Errorf("record %s has unknown event name %q", record.Change.SequenceNumber, record.EventName)
+}
+
+// bulkOperation return bulk operation applying the record
+func (ix *StreamIndexer) bulkOperation(record events.DynamoDBEventRecord) (BulkOperation, error) {
+	op, err := ix.operation(record)
+	if err != nil {
+		return BulkOperation{}, err
+	}
+	d, err := ix.recordDetails(record)
+	if err != nil {
+		return BulkOperation{}, err
+	}
+	if op == events.DynamoDBOperationTypeRemove {
+		return DeleteOperation(d, record.Change.Keys), nil
+	}
+	return IndexOperation(d, record.Change.NewImage)
+}
+
+// HandleEvent index records of the event in order. Processing stops at the first failed record
+// which is reported so the stream delivers it and the records after it again, the index is keyed
+// by item keys so records indexed twice leave the same documents. An index implementing
+// BatchIndexer gets all records of the event at once. With dead letters configured, a record
+// failed for the last attempt goes to the sink and the records after it are processed.
+func (ix *StreamIndexer) HandleEvent(ctx context.Context, event events.DynamoDBEvent) (StreamBatchResponse, error) {
+	resp := StreamBatchResponse{BatchItemFailures: []StreamBatchItemFailure{}}
+	records := event.Records
+	for len(records) > 0 {
+		failed, err := ix.apply(ctx, records)
+		if failed < 0 {
+			break
+		}
+		record := records[failed]
+		fmt.Printf("ddbstore:indexer: record %s %s: %v\n", record.EventName, record.Change.SequenceNumber, err)
+		if ctx.Err() != nil || !ix.deadLetter(ctx, record, err) {
+			resp.BatchItemFailures = append(resp.BatchItemFailures, StreamBatchItemFailure{ItemIdentifier: record.Change.SequenceNumber})
+			break
+		}
+		records = records[failed+1:]
+	}
+	return resp, nil
+}
+
+// apply index records in order and return position and error of the first failed record, -1 when none
+func (ix *StreamIndexer) apply(ctx context.Context, records []events.DynamoDBEventRecord) (int, error) {
+	if batch, ok := ix.index.(BatchIndexer); ok {
+		return ix.applyBatch(ctx, batch, records)
+	}
+	for i, record := range records {
+		if err := ctx.Err(); err != nil {
+			return i, err
+		}
+		if err := ix.IndexRecord(record); err != nil {
+			return i, err
+		}
+	}
+	return -1, nil
+}
+
+// applyBatch apply records up to the first one which can't be converted in a single batch
+func (ix *StreamIndexer) applyBatch(ctx context.Context, batch BatchIndexer, records []events.DynamoDBEventRecord) (int, error) {
+	failed, failure := -1, error(nil)
+	ops := make([]BulkOperation, 0, len(records))
+	for i, record := range records {
+		op, err := ix.bulkOperation(record)
+		if err != nil {
+			failed, failure = i, err
+			break
+		}
+		ops = append(ops, op)
+	}
+	if err := batch.Apply(ctx, ops); err != nil {
+		var bulkErr *BulkError
+		if !errors.As(err, &bulkErr) {
+			return 0, err
+		}
+		for _, item := range bulkErr.Items {
+			if failed < 0 || item.Position < failed {
+				failed = item.Position
+				failure = fmt.Errorf("[%d] %s: %s", item.Status, item.Type, item.Reason)
+			}
+		}
+	}
+	return failed, failure
+}
+
+// deadLetter count the failed attempt of the record in the sink and put the record to it once
+// it failed maxAttempts times, it reports whether the record is in the sink
+func (ix *StreamIndexer) deadLetter(ctx context.Context, record events.DynamoDBEventRecord, failure error) bool {
+	if ix.deadLetters == nil {
+		return false
+	}
+	attempts, err := ix.deadLetters.Attempt(ctx, record)
+	if err != nil {
+		fmt.Printf("ddbstore:indexer: count attempt of %s: %v\n", record.Change.SequenceNumber, err)
+		return false
+	}
+	if attempts < ix.maxAttempts {
+		return false
+	}
+	// replay reads the current item, the old image only takes space and sensitive attributes
+	// of the new image must not be kept in plaintext
+	record.Change.OldImage = nil
+	if tableName, err := TableFromStreamArn(record.EventSourceArn); err == nil {
+		record.Change.NewImage = redact(record.Change.NewImage, redactedAttributes(tableName))
+	}
+	letter := &DeadLetter{Record: record, Attempts: attempts, FailedAt: time.Now()}
+	if failure != nil {
+		letter.Error = failure.Error()
+	}
+	if err := ix.deadLetters.Put(ctx, letter); err != nil {
+		fmt.Printf("ddbstore:indexer: dead letter %s: %v\n", letter.ID(), err)
+		return false
+	}
+	return true
+}
+
+// redact return copy of the image without the attributes
+func redact(image map[string]events.DynamoDBAttributeValue, attributes []string) map[string]events.DynamoDBAttributeValue {
+	if len(image) == 0 || len(attributes) == 0 {
+		return image
+	}
+	out := make(map[string]events.DynamoDBAttributeValue, len(image))
+	for name, v := range image {
+		out[name] = v
+	}
+	for _, name := range attributes {
+		delete(out, name)
+	}
+	return out
+}
+
+// Replay re-drive dead letters of the sink, letters indexed successfully are removed from it.
+// The item of a letter is read from its table again and its current state is indexed, or its
+// document deleted when the item is gone, so replay never overwrites newer documents with the
+// image of an old record.
+func (ix *StreamIndexer) Replay(ctx context.Context, sink DeadLetterSink) (replayed int, err error) {
+	err = sink.Drain(ctx, func(letter *DeadLetter) error {
+		record, err := ix.currentRecord(letter.Record)
+		if err != nil {
+			return err
+		}
+		if _, err := ix.apply(ctx, []events.DynamoDBEventRecord{record}); err != nil {
+			return err
+		}
+		replayed++
+		return nil
+	})
+	return replayed, err
+}
+
+// currentRecord return record applying the current state of the item of the record
+func (ix *StreamIndexer) currentRecord(record events.DynamoDBEventRecord) (events.DynamoDBEventRecord, error) {
+	tableName, err := TableFromStreamArn(record.EventSourceArn)
+	if err != nil {
+		return record, err
+	}
+	output, err := ix.details.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(tableName),
+		Key:            EventStreamToMap(record.Change.Keys),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return record, err
+	}
+	current := record
+	current.Change.OldImage = nil
+	if len(output.Item) == 0 {
+		current.EventName = string(events.DynamoDBOperationTypeRemove)
+		current.Change.NewImage = nil
+		return current, nil
+	}
+	current.EventName = string(events.DynamoDBOperationTypeModify)
+	current.Change.NewImage = MapToEventStream(output.Item)
+	return current, nil
+}
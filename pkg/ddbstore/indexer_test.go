@@ -0,0 +1,186 @@
+package ddbstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// sensitiveImage return stream image of an order with a sensitive attribute
+func sensitiveImage() map[string]events.DynamoDBAttributeValue {
+	return map[string]events.DynamoDBAttributeValue{
+		"uuid":           events.NewStringAttribute("order-1"),
+		"customer_email": events.NewStringAttribute("a@example.com"),
+		"quantity":       events.NewNumberAttribute("2"),
+	}
+}
+
+func TestSensitiveAttributesNotIndexedWithoutEncryption(t *testing.T) {
+	_, tableName := newOrdersTable(t, TableOptions{Sensitive: []string{"customer_email"}})
+	d, err := (&DynamoDetails{}).GetFromKeys(tableName, "uuid", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	op, err := IndexOperation(d, sensitiveImage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(op.Body, []byte("customer_email")) || !bytes.Contains(op.Body, []byte("quantity")) {
+		t.Errorf("indexed document %s, want quantity without customer_email", op.Body)
+	}
+}
+
+func TestSensitiveAttributesNotDeadLettered(t *testing.T) {
+	_, tableName := newOrdersTable(t, TableOptions{Sensitive: []string{"customer_email"}})
+	sink := &FileDeadLetterSink{Path: filepath.Join(t.TempDir(), "dead-letters.ndjson")}
+	ix := (&StreamIndexer{}).DeadLetter(sink, 1)
+	record := events.DynamoDBEventRecord{
+		EventName:      "MODIFY",
+		EventSourceArn: "arn:aws:dynamodb:us-east-1:000000000000:table/" + tableName + "/stream/2020-01-01T00:00:00.000",
+		Change: events.DynamoDBStreamRecord{
+			SequenceNumber: "1",
+			NewImage:       sensitiveImage(),
+		},
+	}
+	if !ix.deadLetter(context.Background(), record, errors.New("rejected")) {
+		t.Fatal("record wasn't dead lettered")
+	}
+	var letters []*DeadLetter
+	err := sink.Drain(context.Background(), func(letter *DeadLetter) error {
+		letters = append(letters, letter)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 1 {
+		t.Fatalf("got %d dead letters, want 1", len(letters))
+	}
+	image := letters[0].Record.Change.NewImage
+	if _, ok := image["customer_email"]; ok {
+		t.Errorf("dead letter keeps customer_email: %v", image)
+	}
+	if _, ok := image["quantity"]; !ok {
+		t.Errorf("dead letter lost quantity: %v", image)
+	}
+	if _, ok := record.Change.NewImage["customer_email"]; !ok {
+		t.Error("redaction changed the image of the record")
+	}
+}
+
+// failingIndex is a DocumentIndexer failing documents of the ids in fail and recording the ids indexed
+type failingIndex struct {
+	fail    map[string]bool
+	indexed []string
+}
+
+func (ix *failingIndex) Update(d *Details, item map[string]events.DynamoDBAttributeValue) error {
+	id := item[d.HashKey].String()
+	if ix.fail[id] {
+		return errors.New("mapper_parsing_exception")
+	}
+	ix.indexed = append(ix.indexed, id)
+	return nil
+}
+
+func (ix *failingIndex) Remove(d *Details, item map[string]events.DynamoDBAttributeValue) error {
+	return ix.Update(d, item)
+}
+
+// modifyRecord return stream record of the order modified in the table
+func modifyRecord(tableName, seq, uuid string) events.DynamoDBEventRecord {
+	return events.DynamoDBEventRecord{
+		EventName:      "MODIFY",
+		EventSourceArn: "arn:aws:dynamodb:us-east-1:000000000000:table/" + tableName + "/stream/2020-01-01T00:00:00.000",
+		Change: events.DynamoDBStreamRecord{
+			SequenceNumber: seq,
+			Keys:           map[string]events.DynamoDBAttributeValue{"uuid": events.NewStringAttribute(uuid)},
+			NewImage:       map[string]events.DynamoDBAttributeValue{"uuid": events.NewStringAttribute(uuid)},
+		},
+	}
+}
+
+func TestHandleEventDeadLettersAcrossColdStarts(t *testing.T) {
+	db, tableName := newOrdersTable(t, TableOptions{})
+	if _, err := EnsureTable(DeadLetterTableSpec("dead-letters"), db, ReconcileOptions{AllowCreate: true}); err != nil {
+		t.Fatal(err)
+	}
+	sink := &DynamoDeadLetterSink{DdbClient: db, TableName: "dead-letters"}
+	index := &failingIndex{fail: map[string]bool{"order-2": true}}
+	records := []events.DynamoDBEventRecord{
+		modifyRecord(tableName, "1", "order-1"),
+		modifyRecord(tableName, "2", "order-2"),
+		modifyRecord(tableName, "3", "order-3"),
+	}
+	for invocation := 1; invocation <= 3; invocation++ {
+		// every invocation starts cold with a new indexer, the stream delivers the failed record again
+		ix := NewStreamIndexer(db, index).DeadLetter(sink, 3)
+		resp, err := ix.HandleEvent(context.Background(), events.DynamoDBEvent{Records: records})
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := json.Marshal(resp)
+		want := `{"batchItemFailures":[{"itemIdentifier":"2"}]}`
+		if invocation == 3 {
+			want = `{"batchItemFailures":[]}`
+		}
+		if string(b) != want {
+			t.Fatalf("invocation %d: got %s, want %s", invocation, b, want)
+		}
+		if invocation == 1 {
+			records = records[1:]
+		}
+	}
+	if !reflect.DeepEqual(index.indexed, []string{"order-1", "order-3"}) {
+		t.Errorf("indexed %v, want the records around the dead letter", index.indexed)
+	}
+
+	var letters []*DeadLetter
+	err := sink.Drain(context.Background(), func(letter *DeadLetter) error {
+		letters = append(letters, letter)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 1 || letters[0].Record.Change.SequenceNumber != "2" || letters[0].Attempts != 3 || letters[0].Error != "mapper_parsing_exception" {
+		t.Fatalf("got dead letters %v, want record 2 after 3 attempts", letters)
+	}
+	out, err := db.Scan(&dynamodb.ScanInput{TableName: aws.String("dead-letters")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Items) != 0 {
+		t.Errorf("got %v left in the table, want the attempts forgotten with the letter", out.Items)
+	}
+}
+
+func TestFileDeadLetterSinkCountsAttemptsAcrossProcesses(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dead-letters.ndjson")
+	record := modifyRecord("orders", "1", "order-1")
+	for want := 1; want <= 2; want++ {
+		// a new sink reads the counts of the previous process
+		attempts, err := (&FileDeadLetterSink{Path: path}).Attempt(context.Background(), record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attempts != want {
+			t.Errorf("got %d attempts, want %d", attempts, want)
+		}
+	}
+	sink := &FileDeadLetterSink{Path: path}
+	if err := sink.Put(context.Background(), &DeadLetter{Record: record, Attempts: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if attempts, err := sink.Attempt(context.Background(), record); err != nil || attempts != 1 {
+		t.Errorf("got %d, %v, want attempts counted again once the record was dead lettered", attempts, err)
+	}
+}
@@ -0,0 +1,369 @@
+package ddbstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/golang/protobuf/descriptor"
+	"github.com/golang/protobuf/proto"
+	pbdescriptor "github.com/golang/protobuf/protoc-gen-go/descriptor"
+)
+
+// Mapping is the elasticsearch mapping of documents of an index
+type Mapping struct {
+	// Dynamic false keeps attributes missing in the mapping in _source without indexing them
+	Dynamic    string                      `json:"dynamic,omitempty"`
+	Properties map[string]*MappingProperty `json:"properties"`
+}
+
+// MappingProperty is the mapping of a single document field
+type MappingProperty struct {
+	Type          string                      `json:"type,omitempty"`
+	Format        string                      `json:"format,omitempty"`
+	ScalingFactor float64                     `json:"scaling_factor,omitempty"`
+	IgnoreAbove   int                         `json:"ignore_above,omitempty"`
+	Fields        map[string]*MappingProperty `json:"fields,omitempty"`
+	Properties    map[string]*MappingProperty `json:"properties,omitempty"`
+}
+
+// String return the parts of the property which can't change without reindexing
+func (p *MappingProperty) String() string {
+	s := p.Type
+	if s == "" && p.Properties != nil {
+		s = "object"
+	}
+	if p.Format != "" {
+		s += " format=" + p.Format
+	}
+	if p.ScalingFactor != 0 {
+		s += fmt.Sprintf(" scaling_factor=%g", p.ScalingFactor)
+	}
+	return s
+}
+
+// MappingOptions configure MappingFromDescriptor for fields whose type can't be told from the descriptor
+type MappingOptions struct {
+	// Dates maps integer fields holding timestamps to their date format e.g. epoch_second
+	Dates map[string]string
+	// ScaledFloats maps money fields to their scaling factor e.g. 100 for cents
+	ScaledFloats map[string]float64
+	// Exclude lists fields which are never indexed e.g. SensitiveAttributes
+	Exclude []string
+}
+
+// idField report whether a string field holds an identifier, which is matched as a whole
+func idField(name string) bool {
+	return name == "uuid" || name == "id" || strings.HasSuffix(name, "_uuid") || strings.HasSuffix(name, "_id")
+}
+
+// MappingFromDescriptor return mapping of documents indexed from items stored from msg, fields are
+// named by their proto names. Ids and enums are keyword, other strings text with a keyword subfield,
+// well-known timestamps date, nested messages objects; options give dates and money of scalar fields.
+func MappingFromDescriptor(msg descriptor.Message, opts MappingOptions) *Mapping {
+	return &Mapping{
+		Dynamic:    "false",
+		Properties: messageProperties(msg, opts, ""),
+	}
+}
+
+// messageProperties return mapping properties of fields of msg, prefix is the path of msg in the document
+func messageProperties(msg descriptor.Message, opts MappingOptions, prefix string) map[string]*MappingProperty {
+	_, md := descriptor.ForMessage(msg)
+	properties := map[string]*MappingProperty{}
+	excluded := map[string]bool{}
+	for _, name := range opts.Exclude {
+		excluded[name] = true
+	}
+	for _, field := range md.GetField() {
+		path := prefix + field.GetName()
+		if excluded[path] {
+			continue
+		}
+		if p := fieldProperty(field, path, opts); p != nil {
+			properties[field.GetName()] = p
+		}
+	}
+	return properties
+}
+
+// fieldProperty return mapping property of the field at path, nil for fields which can't be indexed
+func fieldProperty(field *pbdescriptor.FieldDescriptorProto, path string, opts MappingOptions) *MappingProperty {
+	if format, ok := opts.Dates[path]; ok {
+		return &MappingProperty{Type: "date", Format: format}
+	}
+	if factor, ok := opts.ScaledFloats[path]; ok {
+		return &MappingProperty{Type: "scaled_float", ScalingFactor: factor}
+	}
+	switch field.GetType() {
+	case pbdescriptor.FieldDescriptorProto_TYPE_STRING:
+		if idField(field.GetName()) {
+			return &MappingProperty{Type: "keyword"}
+		}
+		return &MappingProperty{
+			Type:   "text",
+			Fields: map[string]*MappingProperty{"keyword": {Type: "keyword", IgnoreAbove: 256}},
+		}
+	case pbdescriptor.FieldDescriptorProto_TYPE_ENUM:
+		// jsonpb stores enums by name
+		return &MappingProperty{Type: "keyword"}
+	case pbdescriptor.FieldDescriptorProto_TYPE_BOOL:
+		return &MappingProperty{Type: "boolean"}
+	case pbdescriptor.FieldDescriptorProto_TYPE_INT32, pbdescriptor.FieldDescriptorProto_TYPE_SINT32,
+		pbdescriptor.FieldDescriptorProto_TYPE_SFIXED32:
+		return &MappingProperty{Type: "integer"}
+	case pbdescriptor.FieldDescriptorProto_TYPE_UINT32, pbdescriptor.FieldDescriptorProto_TYPE_FIXED32,
+		pbdescriptor.FieldDescriptorProto_TYPE_INT64, pbdescriptor.FieldDescriptorProto_TYPE_SINT64,
+		pbdescriptor.FieldDescriptorProto_TYPE_SFIXED64, pbdescriptor.FieldDescriptorProto_TYPE_UINT64,
+		pbdescriptor.FieldDescriptorProto_TYPE_FIXED64:
+		return &MappingProperty{Type: "long"}
+	case pbdescriptor.FieldDescriptorProto_TYPE_FLOAT:
+		return &MappingProperty{Type: "float"}
+	case pbdescriptor.FieldDescriptorProto_TYPE_DOUBLE:
+		return &MappingProperty{Type: "double"}
+	case pbdescriptor.FieldDescriptorProto_TYPE_BYTES:
+		return &MappingProperty{Type: "binary"}
+	case pbdescriptor.FieldDescriptorProto_TYPE_MESSAGE:
+		typeName := strings.TrimPrefix(field.GetTypeName(), ".")
+		switch typeName {
+		case "google.protobuf.Timestamp":
+			// jsonpb writes RFC 3339 strings
+			return &MappingProperty{Type: "date", Format: "strict_date_optional_time"}
+		case "google.protobuf.Duration", "google.protobuf.FieldMask":
+			return &MappingProperty{Type: "keyword"}
+		}
+		t := proto.MessageType(typeName)
+		if t == nil {
+			return nil
+		}
+		nested, ok := reflect.New(t.Elem()).Interface().(descriptor.Message)
+		if !ok {
+			return nil
+		}
+		return &MappingProperty{Properties: messageProperties(nested, opts, path+".")}
+	}
+	return nil
+}
+
+// mappingDrifts return differences of the existing properties from the wanted ones, missing
+// lists wanted properties the existing mapping doesn't have
+func mappingDrifts(prefix string, want, got map[string]*MappingProperty) (drifts []Drift, missing []string) {
+	names := make([]string, 0, len(want))
+	for name := range want {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		w, g := want[name], got[name]
+		path := prefix + name
+		if g == nil {
+			missing = append(missing, path)
+			continue
+		}
+		if w.String() != g.String() {
+			drifts = append(drifts, Drift{Field: "mapping:" + path, Want: w.String(), Got: g.String()})
+			continue
+		}
+		if w.Properties != nil {
+			d, m := mappingDrifts(path+".", w.Properties, g.Properties)
+			drifts = append(drifts, d...)
+			missing = append(missing, m...)
+		}
+	}
+	return drifts, missing
+}
+
+// PutTemplate put index template applying the mapping to indices matching patterns,
+// e.g. versioned indices of the same documents
+func (es *Elasticsearch) PutTemplate(ctx context.Context, name string, patterns []string, mapping *Mapping) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"index_patterns": patterns,
+		"mappings":       mapping,
+	})
+	if err != nil {
+		return err
+	}
+	res, err := es.Indices.PutTemplate(
+		name,
+		bytes.NewReader(body),
+		es.Indices.PutTemplate.WithContext(ctx),
+	)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("[%v] Error putting index template %s: %s", res.Status(), name, slim.ReplaceAllString(res.String(), " "))
+	}
+	return nil
+}
+
+// GetMapping return mapping of the index, of the first index behind it when it is an alias
+func (es *Elasticsearch) GetMapping(ctx context.Context, index string) (*Mapping, error) {
+	res, err := es.Indices.GetMapping(
+		es.Indices.GetMapping.WithIndex(index),
+		es.Indices.GetMapping.WithContext(ctx),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if res.IsError() {
+		return nil, fmt.Errorf("[%v] Error getting mapping of index %s", res.Status(), index)
+	}
+	var indices map[string]struct {
+		Mappings Mapping `json:"mappings"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&indices); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(indices))
+	for name := range indices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(names) == 0 {
+		return nil, nil
+	}
+	mapping := indices[names[0]].Mappings
+	return &mapping, nil
+}
+
+// createIndex create the index with the mapping, or the one of matching templates when nil, behind given aliases
+func (es *Elasticsearch) createIndex(ctx context.Context, index string, mapping *Mapping, aliases ...string) error {
+	create := map[string]interface{}{}
+	if mapping != nil {
+		create["mappings"] = mapping
+	}
+	if len(aliases) > 0 {
+		names := map[string]struct{}{}
+		for _, alias := range aliases {
+			names[alias] = struct{}{}
+		}
+		create["aliases"] = names
+	}
+	body, err := json.Marshal(create)
+	if err != nil {
+		return err
+	}
+	res, err := es.Indices.Create(
+		index,
+		es.Indices.Create.WithBody(bytes.NewReader(body)),
+		es.Indices.Create.WithContext(ctx),
+	)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("[%v] Error creating index %s: %s", res.Status(), index, slim.ReplaceAllString(res.String(), " "))
+	}
+	return nil
+}
+
+// putMapping add properties to the mapping of the index
+func (es *Elasticsearch) putMapping(ctx context.Context, index string, properties map[string]*MappingProperty) error {
+	body, err := json.Marshal(map[string]interface{}{"properties": properties})
+	if err != nil {
+		return err
+	}
+	res, err := es.Indices.PutMapping(
+		bytes.NewReader(body),
+		es.Indices.PutMapping.WithIndex(index),
+		es.Indices.PutMapping.WithContext(ctx),
+	)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("[%v] Error putting mapping of index %s: %s", res.Status(), index, slim.ReplaceAllString(res.String(), " "))
+	}
+	return nil
+}
+
+// EnsureIndex diff the mapping against the existing index, create the first version of the index with
+// the mapping behind the index alias when it doesn't exist and add missing fields. Fields of different
+// type are only reported since changing them requires Reindex. An index template applies the mapping
+// to indices created later under the same name, e.g. by the first document indexed after the index was deleted.
+func (es *Elasticsearch) EnsureIndex(ctx context.Context, index string, mapping *Mapping, opts ReconcileOptions) ([]Drift, error) {
+	if !opts.DryRun {
+		if err := es.PutTemplate(ctx, index, []string{index, index + "-v*"}, mapping); err != nil {
+			return nil, err
+		}
+	}
+	existing, err := es.GetMapping(ctx, index)
+	if err != nil {
+		return nil, err
+	}
+	if existing == nil {
+		drifts := []Drift{{Field: "index", Want: index}}
+		if opts.DryRun {
+			return drifts, nil
+		}
+		if err := es.createIndex(ctx, VersionedIndex(index, 1), mapping, index); err != nil {
+			return drifts, err
+		}
+		drifts[0].Applied = true
+		return drifts, nil
+	}
+	drifts, missing := mappingDrifts("", mapping.Properties, existing.Properties)
+	if len(missing) == 0 {
+		return drifts, nil
+	}
+	added := len(drifts)
+	for _, path := range missing {
+		drifts = append(drifts, Drift{Field: "mapping:" + path, Want: propertyAt(mapping.Properties, path).String()})
+	}
+	if opts.DryRun {
+		return drifts, nil
+	}
+	// only missing properties are sent, elasticsearch rejects the whole update when a type conflicts
+	if err := es.putMapping(ctx, index, propertiesAt(mapping.Properties, missing)); err != nil {
+		return drifts, err
+	}
+	for i := added; i < len(drifts); i++ {
+		drifts[i].Applied = true
+	}
+	return drifts, nil
+}
+
+// propertiesAt return the properties at dotted paths with the objects containing them
+func propertiesAt(properties map[string]*MappingProperty, paths []string) map[string]*MappingProperty {
+	out := map[string]*MappingProperty{}
+	for _, path := range paths {
+		parts := strings.SplitN(path, ".", 2)
+		p := properties[parts[0]]
+		if len(parts) == 1 {
+			out[parts[0]] = p
+			continue
+		}
+		object := out[parts[0]]
+		if object == nil {
+			object = &MappingProperty{Properties: map[string]*MappingProperty{}}
+			out[parts[0]] = object
+		}
+		for name, nested := range propertiesAt(p.Properties, []string{parts[1]}) {
+			object.Properties[name] = nested
+		}
+	}
+	return out
+}
+
+// propertyAt return property at dotted path
+func propertyAt(properties map[string]*MappingProperty, path string) *MappingProperty {
+	parts := strings.SplitN(path, ".", 2)
+	p := properties[parts[0]]
+	if len(parts) == 1 || p == nil {
+		return p
+	}
+	return propertyAt(p.Properties, parts[1])
+}
@@ -0,0 +1,232 @@
+package ddbstore
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	pbdescriptor "github.com/golang/protobuf/protoc-gen-go/descriptor"
+
+	pb "go-grpc-kubernetes/proto/orderservice"
+)
+
+func TestMappingFromDescriptor(t *testing.T) {
+	orders := MappingFromDescriptor(&pb.Order{}, MappingOptions{
+		Dates:        map[string]string{"timestamp": "epoch_second"},
+		ScaledFloats: map[string]float64{"amount": 100},
+		Exclude:      SensitiveAttributes(&pb.Order{}, pb.E_Sensitive),
+	})
+	fields := MappingFromDescriptor(&pbdescriptor.FieldDescriptorProto{}, MappingOptions{
+		Exclude: []string{"options.uninterpreted_option"},
+	})
+	for _, tc := range []struct {
+		mapping *Mapping
+		path    string
+		want    string
+	}{
+		{orders, "uuid", "keyword"},
+		{orders, "product_uuid", "keyword"},
+		{orders, "quantity", "integer"},
+		{orders, "amount", "scaled_float scaling_factor=100"},
+		{orders, "currency", "text"},
+		{orders, "status", "keyword"},
+		{orders, "timestamp", "date format=epoch_second"},
+		{orders, "customer_name", ""},
+		{orders, "customer_email", ""},
+		{orders, "shipping_address", ""},
+		{fields, "number", "integer"},
+		{fields, "label", "keyword"},
+		{fields, "options", "object"},
+		{fields, "options.packed", "boolean"},
+		{fields, "options.uninterpreted_option", ""},
+	} {
+		got := ""
+		if p := propertyAt(tc.mapping.Properties, tc.path); p != nil {
+			got = p.String()
+		}
+		if got != tc.want {
+			t.Errorf("%s mapped to %q, want %q", tc.path, got, tc.want)
+		}
+	}
+	if orders.Dynamic != "false" {
+		t.Errorf("dynamic %q, want unmapped attributes kept out of the index", orders.Dynamic)
+	}
+	if keyword := orders.Properties["currency"].Fields["keyword"]; keyword == nil || keyword.Type != "keyword" {
+		t.Errorf("currency has subfields %v, want a keyword subfield", orders.Properties["currency"].Fields)
+	}
+}
+
+func TestMappingDrifts(t *testing.T) {
+	want := map[string]*MappingProperty{
+		"uuid":     {Type: "keyword"},
+		"amount":   {Type: "scaled_float", ScalingFactor: 100},
+		"customer": {Properties: map[string]*MappingProperty{"name": {Type: "text"}, "email": {Type: "keyword"}}},
+	}
+	for _, tc := range []struct {
+		name    string
+		got     map[string]*MappingProperty
+		drifts  []string
+		missing []string
+	}{
+		{"same", want, nil, nil},
+		{"empty", map[string]*MappingProperty{}, nil, []string{"amount", "customer", "uuid"}},
+		{
+			"changed types",
+			map[string]*MappingProperty{
+				"uuid":     {Type: "text"},
+				"amount":   {Type: "scaled_float", ScalingFactor: 1000},
+				"customer": {Type: "keyword"},
+			},
+			[]string{
+				`drift mapping:amount: want="scaled_float scaling_factor=100" got="scaled_float scaling_factor=1000"`,
+				`drift mapping:customer: want="object" got="keyword"`,
+				`drift mapping:uuid: want="keyword" got="text"`,
+			},
+			nil,
+		},
+		{
+			"nested",
+			map[string]*MappingProperty{
+				"uuid":     {Type: "keyword"},
+				"amount":   {Type: "scaled_float", ScalingFactor: 100},
+				"customer": {Properties: map[string]*MappingProperty{"name": {Type: "keyword"}}},
+			},
+			[]string{`drift mapping:customer.name: want="text" got="keyword"`},
+			[]string{"customer.email"},
+		},
+	} {
+		drifts, missing := mappingDrifts("", want, tc.got)
+		var got []string
+		for _, drift := range drifts {
+			got = append(got, drift.String())
+		}
+		if strings.Join(got, "\n") != strings.Join(tc.drifts, "\n") || strings.Join(missing, ",") != strings.Join(tc.missing, ",") {
+			t.Errorf("%s: got drifts %q and missing %v, want %q and %v", tc.name, got, missing, tc.drifts, tc.missing)
+		}
+	}
+}
+
+// mappingStub is an elasticsearch serving the template, index and mapping requests of EnsureIndex
+// for a single alias, putting mappings fails while failPut is set
+type mappingStub struct {
+	mu       sync.Mutex
+	alias    string
+	index    string
+	mapping  *Mapping
+	template bool
+	failPut  bool
+}
+
+func (s *mappingStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case r.Method == http.MethodPut && parts[0] == "_template":
+		s.template = true
+		w.Write([]byte(`{"acknowledged":true}`))
+	case r.Method == http.MethodGet && len(parts) == 2 && parts[1] == "_mapping":
+		if s.mapping == nil {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":{"type":"index_not_found_exception"},"status":404}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{s.index: map[string]interface{}{"mappings": s.mapping}})
+	case r.Method == http.MethodPut && len(parts) == 2 && parts[1] == "_mapping":
+		var put Mapping
+		json.NewDecoder(r.Body).Decode(&put)
+		if s.failPut {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":{"type":"illegal_argument_exception"},"status":400}`))
+			return
+		}
+		for name, p := range put.Properties {
+			s.mapping.Properties[name] = p
+		}
+		w.Write([]byte(`{"acknowledged":true}`))
+	case r.Method == http.MethodPut && len(parts) == 1:
+		var create struct {
+			Mappings *Mapping            `json:"mappings"`
+			Aliases  map[string]struct{} `json:"aliases"`
+		}
+		json.NewDecoder(r.Body).Decode(&create)
+		if _, ok := create.Aliases[s.alias]; !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"index created without the alias"}`))
+			return
+		}
+		s.index, s.mapping = parts[0], create.Mappings
+		w.Write([]byte(`{"acknowledged":true}`))
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"unsupported by stub"}`))
+	}
+}
+
+func TestEnsureIndex(t *testing.T) {
+	stub := &mappingStub{alias: "orders"}
+	srv := httptest.NewServer(stub)
+	defer srv.Close()
+	es, err := NewElasticsearchWithOptions(ElasticsearchOptions{Addresses: []string{srv.URL}, Auth: ElasticsearchAuthNone})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	mapping := &Mapping{Dynamic: "false", Properties: map[string]*MappingProperty{
+		"uuid":     {Type: "keyword"},
+		"quantity": {Type: "integer"},
+	}}
+	drifts, err := es.EnsureIndex(ctx, "orders", mapping, ReconcileOptions{DryRun: true})
+	if err != nil || len(drifts) != 1 || drifts[0].String() != `drift index: want="orders" got=""` {
+		t.Fatalf("dry run got %v, %v, want the missing index reported", drifts, err)
+	}
+	if stub.template || stub.mapping != nil {
+		t.Fatal("dry run changed the cluster")
+	}
+
+	drifts, err = es.EnsureIndex(ctx, "orders", mapping, ReconcileOptions{})
+	if err != nil || len(drifts) != 1 || !drifts[0].Applied {
+		t.Fatalf("got %v, %v, want the index created", drifts, err)
+	}
+	if !stub.template || stub.index != "orders-v1" || len(stub.mapping.Properties) != 2 {
+		t.Fatalf("got index %q with mapping %v, want orders-v1 with the mapping and a template", stub.index, stub.mapping)
+	}
+
+	mapping.Properties["quantity"] = &MappingProperty{Type: "long"}
+	mapping.Properties["currency"] = &MappingProperty{Type: "keyword"}
+	stub.failPut = true
+	drifts, err = es.EnsureIndex(ctx, "orders", mapping, ReconcileOptions{})
+	if err == nil {
+		t.Fatal("EnsureIndex succeeded though the mapping wasn't put")
+	}
+	for _, drift := range drifts {
+		if drift.Applied {
+			t.Errorf("got %v after the mapping failed to put", drift)
+		}
+	}
+
+	stub.failPut = false
+	drifts, err = es.EnsureIndex(ctx, "orders", mapping, ReconcileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, drift := range drifts {
+		got = append(got, drift.String())
+	}
+	want := []string{
+		`drift mapping:quantity: want="long" got="integer"`,
+		`applied mapping:currency: want="keyword" got=""`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got drifts %q, want %q", got, want)
+	}
+	if p := stub.mapping.Properties["quantity"]; p.Type != "integer" {
+		t.Errorf("quantity changed to %v, want conflicting types only reported", p)
+	}
+}
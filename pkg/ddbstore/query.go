@@ -0,0 +1,275 @@
+package ddbstore
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/dynamodb/expression"
+	"github.com/golang/protobuf/proto"
+)
+
+var (
+	ErrKeyConditionRequired = errors.New("key condition required for query")
+)
+
+// QueryInput describe which items are read by Query and Scan iterators
+type QueryInput struct {
+	// IndexName of GSI or LSI to read from, empty reads the table itself
+	IndexName string
+	// KeyCondition is required by Query and ignored by Scan
+	KeyCondition *expression.KeyConditionBuilder
+	Filter       *expression.ConditionBuilder
+	Projection   *expression.ProjectionBuilder
+	// Limit is the page size of a single Query or Scan call
+	Limit          int64
+	ConsistentRead bool
+	// StartKey resume reading from LastEvaluatedKey of a previous iterator
+	StartKey map[string]*dynamodb.AttributeValue
+	// Segment and TotalSegments split a Scan into parallel segments
+	Segment, TotalSegments int64
+}
+
+// build return expression built from key condition, filter and projection if any of them is set
+func (q *QueryInput) build(withKeyCondition bool) (expression.Expression, error) {
+	builder := expression.NewBuilder()
+	empty := true
+	if withKeyCondition && q.KeyCondition != nil {
+		builder = builder.WithKeyCondition(*q.KeyCondition)
+		empty = false
+	}
+	if q.Filter != nil {
+		builder = builder.WithFilter(*q.Filter)
+		empty = false
+	}
+	if q.Projection != nil {
+		builder = builder.WithProjection(*q.Projection)
+		empty = false
+	}
+	if empty {
+		return expression.Expression{}, nil
+	}
+	return builder.Build()
+}
+
+// Iterator walks through items returned by Query or Scan and decode them to proto messages,
+// following LastEvaluatedKey until all pages are read
+type Iterator struct {
+	in        proto.Message
+	tableName string
+	fetch     func(startKey map[string]*dynamodb.AttributeValue) ([]map[string]*dynamodb.AttributeValue, map[string]*dynamodb.AttributeValue, error)
+
+	items    []map[string]*dynamodb.AttributeValue
+	pageKey  map[string]*dynamodb.AttributeValue
+	startKey map[string]*dynamodb.AttributeValue
+	started  bool
+	current  proto.Message
+	stored   map[string]*dynamodb.AttributeValue
+	err      error
+}
+
+// Next advance the iterator to the next message, it returns false when there are no more
+// messages or an error occurred
+func (it *Iterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	for len(it.items) == 0 {
+		if it.started && it.startKey == nil {
+			return false
+		}
+		it.started = true
+		it.pageKey = it.startKey
+		items, lastKey, err := it.fetch(it.startKey)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.items = items
+		it.startKey = lastKey
+	}
+	item := it.items[0]
+	it.items = it.items[1:]
+	// decoding replaces encrypted and offloaded attributes in place
+	it.stored = make(map[string]*dynamodb.AttributeValue, len(item))
+	for name, av := range item {
+		it.stored[name] = av
+	}
+	out, err := decodeItem(it.in, item, it.tableName)
+	if err != nil {
+		it.err = err
+		return false
+	}
+	it.current = out
+	return true
+}
+
+// Message return the current message
+func (it *Iterator) Message() proto.Message {
+	return it.current
+}
+
+// item return the current item as stored in the table
+func (it *Iterator) item() map[string]*dynamodb.AttributeValue {
+	return it.stored
+}
+
+// Err return the error which stopped the iterator if any
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// LastEvaluatedKey return the key to resume iteration with, it is nil once all pages were read.
+// When the current page is not fully consumed the key points at the start of that page,
+// so resumed iteration may return some messages again.
+func (it *Iterator) LastEvaluatedKey() map[string]*dynamodb.AttributeValue {
+	if len(it.items) == 0 {
+		return it.startKey
+	}
+	return it.pageKey
+}
+
+// QueryProtoFromDdb return iterator over items matching key condition, decoded to proto messages
+// of the same type as given proto
+func QueryProtoFromDdb(in proto.Message, q QueryInput, ddbClient dynamodbiface.DynamoDBAPI, tableName string) (*Iterator, error) {
+	if q.KeyCondition == nil {
+		return nil, ErrKeyConditionRequired
+	}
+	expr, err := q.build(true)
+	if err != nil {
+		return nil, err
+	}
+	input := &dynamodb.QueryInput{
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		KeyConditionExpression:    expr.KeyCondition(),
+		FilterExpression:          expr.Filter(),
+		ProjectionExpression:      expr.Projection(),
+		TableName:                 aws.String(tableName),
+		ConsistentRead:            aws.Bool(q.ConsistentRead),
+	}
+	if q.IndexName != "" {
+		input.IndexName = aws.String(q.IndexName)
+	}
+	if q.Limit > 0 {
+		input.Limit = aws.Int64(q.Limit)
+	}
+	return &Iterator{
+		in:        in,
+		tableName: tableName,
+		startKey:  q.StartKey,
+		fetch: func(startKey map[string]*dynamodb.AttributeValue) ([]map[string]*dynamodb.AttributeValue, map[string]*dynamodb.AttributeValue, error) {
+			input.ExclusiveStartKey = startKey
+			output, err := ddbClient.Query(input)
+			if err != nil {
+				return nil, nil, err
+			}
+			return output.Items, output.LastEvaluatedKey, nil
+		},
+	}, nil
+}
+
+// ScanProtoFromDdb return iterator over all items of the table or a single segment of it,
+// decoded to proto messages of the same type as given proto
+func ScanProtoFromDdb(in proto.Message, q QueryInput, ddbClient dynamodbiface.DynamoDBAPI, tableName string) (*Iterator, error) {
+	expr, err := q.build(false)
+	if err != nil {
+		return nil, err
+	}
+	input := &dynamodb.ScanInput{
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		FilterExpression:          expr.Filter(),
+		ProjectionExpression:      expr.Projection(),
+		TableName:                 aws.String(tableName),
+		ConsistentRead:            aws.Bool(q.ConsistentRead),
+	}
+	if q.IndexName != "" {
+		input.IndexName = aws.String(q.IndexName)
+	}
+	if q.Limit > 0 {
+		input.Limit = aws.Int64(q.Limit)
+	}
+	if q.TotalSegments > 1 {
+		input.Segment = aws.Int64(q.Segment)
+		input.TotalSegments = aws.Int64(q.TotalSegments)
+	}
+	return &Iterator{
+		in:        in,
+		tableName: tableName,
+		startKey:  q.StartKey,
+		fetch: func(startKey map[string]*dynamodb.AttributeValue) ([]map[string]*dynamodb.AttributeValue, map[string]*dynamodb.AttributeValue, error) {
+			input.ExclusiveStartKey = startKey
+			output, err := ddbClient.Scan(input)
+			if err != nil {
+				return nil, nil, err
+			}
+			return output.Items, output.LastEvaluatedKey, nil
+		},
+	}, nil
+}
+
+// ParallelScanProtoFromDdb scan the table in given number of segments at once and call fn
+// for every decoded message. fn is called concurrently from all workers; the first error
+// returned by fn or by dynamodb stops the scan and is returned. StartKey of the input is ignored
+// as every segment is paged on its own.
+func ParallelScanProtoFromDdb(in proto.Message, q QueryInput, workers int, ddbClient dynamodbiface.DynamoDBAPI, tableName string, fn func(segment int64, out proto.Message) error) error {
+	return parallelScan(in, q, workers, ddbClient, tableName, func(segment int64, it *Iterator) error {
+		return fn(segment, it.Message())
+	})
+}
+
+// parallelScan is ParallelScanProtoFromDdb calling fn with the iterator of the segment
+func parallelScan(in proto.Message, q QueryInput, workers int, ddbClient dynamodbiface.DynamoDBAPI, tableName string, fn func(segment int64, it *Iterator) error) error {
+	if workers < 1 {
+		workers = 1
+	}
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+		stop     = make(chan struct{})
+	)
+	fail := func(err error) {
+		once.Do(func() {
+			firstErr = err
+			close(stop)
+		})
+	}
+	iterators := make([]*Iterator, workers)
+	for segment := range iterators {
+		sq := q
+		sq.Segment = int64(segment)
+		sq.TotalSegments = int64(workers)
+		sq.StartKey = nil
+		it, err := ScanProtoFromDdb(in, sq, ddbClient, tableName)
+		if err != nil {
+			return err
+		}
+		iterators[segment] = it
+	}
+	for segment, it := range iterators {
+		wg.Add(1)
+		go func(segment int64, it *Iterator) {
+			defer wg.Done()
+			for it.Next() {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if err := fn(segment, it); err != nil {
+					fail(err)
+					return
+				}
+			}
+			if err := it.Err(); err != nil {
+				fail(err)
+			}
+		}(int64(segment), it)
+	}
+	wg.Wait()
+	return firstErr
+}
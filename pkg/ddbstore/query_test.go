@@ -0,0 +1,179 @@
+package ddbstore
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/dynamodb/expression"
+	"github.com/golang/protobuf/proto"
+
+	"go-grpc-kubernetes/pkg/ddbfake"
+	pb "go-grpc-kubernetes/proto/orderservice"
+)
+
+// queryCountingDB counts Query calls
+type queryCountingDB struct {
+	dynamodbiface.DynamoDBAPI
+	queries int
+}
+
+func (db *queryCountingDB) Query(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+	db.queries++
+	return db.DynamoDBAPI.Query(input)
+}
+
+// newStatusIndexedTable return table of started orders of quantity 1 to 7 and two completed ones,
+// indexed by status and quantity in status-quantity
+func newStatusIndexedTable(t *testing.T) (*ddbfake.DB, string) {
+	t.Helper()
+	db := ddbfake.New()
+	tableName := "orders-by-status"
+	_, err := EnsureTable(&TableSpec{
+		TableName: tableName,
+		HashKey:   "uuid",
+		AttributeTypes: map[string]string{
+			"uuid":     dynamodb.ScalarAttributeTypeS,
+			"status":   dynamodb.ScalarAttributeTypeS,
+			"quantity": dynamodb.ScalarAttributeTypeN,
+		},
+		GlobalIndexes: []IndexSpec{{Name: "status-quantity", HashKey: "status", RangeKey: "quantity"}},
+		BillingMode:   dynamodb.BillingModePayPerRequest,
+	}, db, ReconcileOptions{AllowCreate: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ConfigureTable(tableName, TableOptions{EmitDefaults: true})
+	for i := 1; i <= 9; i++ {
+		order := &pb.Order{Uuid: fmt.Sprintf("order-%d", i), Status: pb.Status_Started, Quantity: int32(i)}
+		if i > 7 {
+			order.Status = pb.Status_Completed
+		}
+		if _, err := PutProtoToDdb(order, order.Uuid, db, tableName); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db, tableName
+}
+
+// startedOfAtLeast return query of started orders of at least the quantity, two a page
+func startedOfAtLeast(quantity int32) QueryInput {
+	key := expression.Key("status").Equal(expression.Value(pb.Status_Started.String())).
+		And(expression.Key("quantity").GreaterThanEqual(expression.Value(quantity)))
+	return QueryInput{IndexName: "status-quantity", KeyCondition: &key, Limit: 2}
+}
+
+// uuids return uuids of the next n messages of the iterator, all of them when n is negative
+func uuids(t *testing.T, it *Iterator, n int) []string {
+	t.Helper()
+	var ids []string
+	for n != 0 && it.Next() {
+		ids = append(ids, it.Message().(*pb.Order).Uuid)
+		n--
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return ids
+}
+
+func TestQueryProtoFromDdbPages(t *testing.T) {
+	db, tableName := newStatusIndexedTable(t)
+	client := &queryCountingDB{DynamoDBAPI: db}
+	it, err := QueryProtoFromDdb(&pb.Order{}, startedOfAtLeast(2), client, tableName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"order-2", "order-3", "order-4", "order-5", "order-6", "order-7"}
+	if got := uuids(t, it, -1); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v in quantity order", got, want)
+	}
+	if client.queries < 3 {
+		t.Errorf("made %d queries, want a query per page of 2", client.queries)
+	}
+	if key := it.LastEvaluatedKey(); key != nil {
+		t.Errorf("got last evaluated key %v after the last page", key)
+	}
+	if _, err := QueryProtoFromDdb(&pb.Order{}, QueryInput{}, db, tableName); err != ErrKeyConditionRequired {
+		t.Errorf("got %v, want %v", err, ErrKeyConditionRequired)
+	}
+}
+
+func TestQueryProtoFromDdbResumes(t *testing.T) {
+	db, tableName := newStatusIndexedTable(t)
+	for _, tc := range []struct {
+		read    int
+		resumed []string
+	}{
+		// the first page was read, the next one is resumed
+		{2, []string{"order-3", "order-4", "order-5", "order-6", "order-7"}},
+		// the second page was read halfway, it is read again
+		{3, []string{"order-3", "order-4", "order-5", "order-6", "order-7"}},
+		{4, []string{"order-5", "order-6", "order-7"}},
+	} {
+		it, err := QueryProtoFromDdb(&pb.Order{}, startedOfAtLeast(1), db, tableName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		uuids(t, it, tc.read)
+		q := startedOfAtLeast(1)
+		q.StartKey = it.LastEvaluatedKey()
+		resumed, err := QueryProtoFromDdb(&pb.Order{}, q, db, tableName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := uuids(t, resumed, -1); !reflect.DeepEqual(got, tc.resumed) {
+			t.Errorf("after %d orders resumed with %v, want %v", tc.read, got, tc.resumed)
+		}
+	}
+}
+
+func TestParallelScanCoversEverySegment(t *testing.T) {
+	db, tableName := newOrdersTable(t, TableOptions{})
+	for i := 0; i < 50; i++ {
+		id := fmt.Sprintf("order-%02d", i)
+		if _, err := PutProtoToDdb(&pb.Order{Uuid: id}, id, db, tableName); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var mu sync.Mutex
+	seen := map[string]int{}
+	segments := map[int64]bool{}
+	err := ParallelScanProtoFromDdb(&pb.Order{}, QueryInput{Limit: 3}, 4, db, tableName, func(segment int64, out proto.Message) error {
+		mu.Lock()
+		defer mu.Unlock()
+		seen[out.(*pb.Order).Uuid]++
+		segments[segment] = true
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != 50 {
+		t.Errorf("scanned %d orders, want 50", len(seen))
+	}
+	for id, n := range seen {
+		if n != 1 {
+			t.Errorf("scanned %s %d times", id, n)
+		}
+	}
+	if len(segments) < 2 {
+		t.Errorf("got orders of segments %v, want them split between the workers", segments)
+	}
+
+	stopped := errors.New("stopped")
+	calls := 0
+	err = ParallelScanProtoFromDdb(&pb.Order{}, QueryInput{Limit: 3}, 4, db, tableName, func(segment int64, out proto.Message) error {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		return stopped
+	})
+	if err != stopped || calls > 4 {
+		t.Errorf("got %v after %d calls, want the error of fn stopping every worker", err, calls)
+	}
+}
@@ -0,0 +1,567 @@
+package ddbstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+var (
+	ErrUnsortableKey = errors.New("binary keys can't be compared in key order")
+)
+
+// kinds of drift between a table and its search index
+const (
+	DriftMissing   = "missing"
+	DriftExtra     = "extra"
+	DriftDivergent = "divergent"
+)
+
+// reconcilePageSize is the number of documents read from the index per search
+const reconcilePageSize = 1000
+
+// DocumentDrift is a document which differs between the table and its search index
+type DocumentDrift struct {
+	Kind       string
+	DocumentID string
+	// Repaired is true when the document was fixed through the indexer
+	Repaired bool
+}
+
+func (d DocumentDrift) String() string {
+	state := "drift"
+	if d.Repaired {
+		state = "repaired"
+	}
+	return fmt.Sprintf("%s %s document %s", state, d.Kind, d.DocumentID)
+}
+
+// ReconcileReport is the outcome of ReconcileIndex
+type ReconcileReport struct {
+	// Items and Documents are the numbers of table items and index documents compared
+	Items, Documents int
+	Drifts           []DocumentDrift
+}
+
+// ReconcileIndexOptions configure ReconcileIndex
+type ReconcileIndexOptions struct {
+	// Repair apply drifted documents through Indexer
+	Repair bool
+	// Indexer repairs drifted documents with Update and Remove like stream records do
+	Indexer DocumentIndexer
+	// Rate limits repaired documents per second, 0 is unlimited
+	Rate float64
+	// Workers is the number of parallel scan segments of the table
+	Workers int
+	// Index is compared with the table instead of the alias of the table, e.g. a new version being
+	// backfilled. Its drift is repaired in it directly, Indexer is not used.
+	Index string
+}
+
+// indexWriter repairs documents of a given index rather than of the alias of the table
+type indexWriter struct {
+	ctx   context.Context
+	bulk  *BulkIndexer
+	index string
+}
+
+// Update implements DocumentIndexer
+func (w *indexWriter) Update(d *Details, item map[string]events.DynamoDBAttributeValue) error {
+	op, err := IndexOperation(d, item)
+	if err != nil {
+		return err
+	}
+	op.Index = w.index
+	return w.bulk.Apply(w.ctx, []BulkOperation{op})
+}
+
+// Remove implements DocumentIndexer
+func (w *indexWriter) Remove(d *Details, item map[string]events.DynamoDBAttributeValue) error {
+	op := DeleteOperation(d, item)
+	op.Index = w.index
+	return w.bulk.Apply(w.ctx, []BulkOperation{op})
+}
+
+// keyType is the dynamodb type of a key attribute, S or N
+type keyType string
+
+// reconcileEntry is a table item or an index document reduced to its keys and content hash
+type reconcileEntry struct {
+	keys []interface{}
+	id   string
+	hash string
+	// item of table entries, source of index entries
+	item map[string]events.DynamoDBAttributeValue
+}
+
+// contentHash return hash of the document, keys of json objects are sorted so equal documents
+// hash the same however they were encoded
+func contentHash(doc []byte) (string, error) {
+	var v interface{}
+	if err := json.Unmarshal(doc, &v); err != nil {
+		return "", err
+	}
+	canonical, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(canonical)
+	return hex.EncodeToString(sum[:16]), nil
+}
+
+// keyValue return value of key attribute as elasticsearch sorts it
+func keyValue(av events.DynamoDBAttributeValue, t keyType) (interface{}, error) {
+	if t == dynamodb.ScalarAttributeTypeN {
+		return strconv.ParseFloat(av.Number(), 64)
+	}
+	return av.String(), nil
+}
+
+// reconcileKeys return the key attributes of the table with their types
+func reconcileKeys(d *Details, ddbClient dynamodbiface.DynamoDBAPI) ([]string, []keyType, error) {
+	table, err := DescribeTable(d.TableName, ddbClient)
+	if err != nil {
+		return nil, nil, err
+	}
+	names := []string{d.HashKey}
+	if d.RangeKey != "" {
+		names = append(names, d.RangeKey)
+	}
+	types := make([]keyType, len(names))
+	for i, name := range names {
+		for _, def := range table.AttributeDefinitions {
+			if aws.StringValue(def.AttributeName) == name {
+				types[i] = keyType(aws.StringValue(def.AttributeType))
+			}
+		}
+		if types[i] != dynamodb.ScalarAttributeTypeS && types[i] != dynamodb.ScalarAttributeTypeN {
+			return nil, nil, fmt.Errorf("%w: %s", ErrUnsortableKey, name)
+		}
+	}
+	return names, types, nil
+}
+
+// tableEntry return reconcile entry of the table item
+func tableEntry(d *Details, item map[string]*dynamodb.AttributeValue, names []string, types []keyType) (*reconcileEntry, error) {
+	e := &reconcileEntry{item: MapToEventStream(item)}
+	for i, name := range names {
+		v, err := keyValue(e.item[name], types[i])
+		if err != nil {
+			return nil, err
+		}
+		e.keys = append(e.keys, v)
+	}
+	doc, err := document(d, e.item)
+	if err != nil {
+		return nil, err
+	}
+	if e.hash, err = contentHash(doc); err != nil {
+		return nil, err
+	}
+	e.id = d.docID(e.item)
+	return e, nil
+}
+
+// searchHit is a document of search results sorted by keys
+type searchHit struct {
+	ID     string          `json:"_id"`
+	Source json.RawMessage `json:"_source"`
+	Sort   []interface{}   `json:"sort"`
+}
+
+// indexPage return the next page of documents of the index sorted by keys after given sort values
+func (es *Elasticsearch) indexPage(ctx context.Context, index string, names []string, after []interface{}) ([]searchHit, error) {
+	sortFields := make([]SortField, len(names))
+	for i, name := range names {
+		sortFields[i] = SortField{Field: name}
+	}
+	body, err := json.Marshal(&SearchRequest{
+		Query:       MatchAllQuery{},
+		Sort:        sortFields,
+		Size:        reconcilePageSize,
+		SearchAfter: after,
+	})
+	if err != nil {
+		return nil, err
+	}
+	res, err := es.Search(
+		es.Search.WithIndex(index),
+		es.Search.WithBody(bytes.NewReader(body)),
+		es.Search.WithContext(ctx),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if res.IsError() {
+		return nil, fmt.Errorf("[%v] Error reading index %s: %s", res.Status(), index, slim.ReplaceAllString(res.String(), " "))
+	}
+	var result struct {
+		Hits struct {
+			Hits []searchHit `json:"hits"`
+		} `json:"hits"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return result.Hits.Hits, nil
+}
+
+// indexEntry return reconcile entry of the search hit
+func indexEntry(hit searchHit, names []string, types []keyType) (*reconcileEntry, error) {
+	e := &reconcileEntry{id: hit.ID, keys: hit.Sort, item: map[string]events.DynamoDBAttributeValue{}}
+	if len(e.keys) != len(names) {
+		return nil, fmt.Errorf("document %s has no sort values for keys %v", hit.ID, names)
+	}
+	for i, name := range names {
+		switch v := e.keys[i].(type) {
+		case string:
+			e.item[name] = events.NewStringAttribute(v)
+		case float64:
+			e.item[name] = events.NewNumberAttribute(strconv.FormatFloat(v, 'f', -1, 64))
+		default:
+			return nil, fmt.Errorf("document %s has no %s", hit.ID, name)
+		}
+	}
+	hash, err := contentHash(hit.Source)
+	if err != nil {
+		return nil, err
+	}
+	e.hash = hash
+	return e, nil
+}
+
+// ReconcileIndex compare items of the table with documents of its search index and report documents
+// missing in the index, extra ones whose item is gone and divergent ones whose content differs.
+// The table is scanned a page at a time and the documents of each page are read by id, then the index
+// is read in key order a page at a time and the items of each page are read by key, so memory is bounded
+// by a few pages however large the table is. Drift found by the scans is confirmed by reading the item and the document again, so changes made
+// while the scans ran are not reported. With Repair drifted documents are indexed or removed through
+// opts.Indexer. Key fields must be sortable in the index, i.e. keyword or numeric.
+func ReconcileIndex(ctx context.Context, es *Elasticsearch, opts ReconcileIndexOptions, ddbClient dynamodbiface.DynamoDBAPI, tableName string) (*ReconcileReport, error) {
+	if opts.Workers == 0 {
+		opts.Workers = DefaultReindexOptions.Workers
+	}
+	if opts.Repair && opts.Indexer == nil {
+		opts.Indexer = es
+	}
+	d, err := (&DynamoDetails{DynamoDBAPI: ddbClient}).Get(tableName)
+	if err != nil {
+		return nil, err
+	}
+	index := opts.Index
+	if index == "" {
+		index = d.index()
+	} else if opts.Repair {
+		bulk, err := NewBulkIndexer(es, BulkOptions{})
+		if err != nil {
+			return nil, err
+		}
+		defer bulk.Close()
+		opts.Indexer = &indexWriter{ctx: ctx, bulk: bulk, index: index}
+	}
+	names, types, err := reconcileKeys(d, ddbClient)
+	if err != nil {
+		return nil, err
+	}
+	r := &reconciler{es: es, d: d, index: index, opts: opts, names: names, types: types, ddbClient: ddbClient, pace: newPacer(opts.Rate)}
+	report := &ReconcileReport{}
+	if err := r.compareItems(ctx, report); err != nil {
+		return report, err
+	}
+	return report, r.compareDocuments(ctx, report)
+}
+
+// compareItems scan the table in parallel segments and compare every page of items with its documents
+func (r *reconciler) compareItems(ctx context.Context, report *ReconcileReport) error {
+	pages := make(chan []*reconcileEntry)
+	// every segment sends a single result, so none blocks once we stopped reading
+	errs := make(chan error, r.opts.Workers)
+	stop := make(chan struct{})
+	defer close(stop)
+	for segment := 0; segment < r.opts.Workers; segment++ {
+		go func(segment int) {
+			input := &dynamodb.ScanInput{
+				TableName:     aws.String(r.d.TableName),
+				Segment:       aws.Int64(int64(segment)),
+				TotalSegments: aws.Int64(int64(r.opts.Workers)),
+			}
+			for {
+				output, err := r.ddbClient.Scan(input)
+				if err != nil {
+					errs <- err
+					return
+				}
+				page := make([]*reconcileEntry, 0, len(output.Items))
+				for _, item := range output.Items {
+					e, err := tableEntry(r.d, item, r.names, r.types)
+					if err != nil {
+						errs <- err
+						return
+					}
+					page = append(page, e)
+				}
+				select {
+				case pages <- page:
+				case <-stop:
+					errs <- nil
+					return
+				}
+				if len(output.LastEvaluatedKey) == 0 {
+					errs <- nil
+					return
+				}
+				input.ExclusiveStartKey = output.LastEvaluatedKey
+			}
+		}(segment)
+	}
+	for done := 0; done < r.opts.Workers; {
+		select {
+		case page := <-pages:
+			report.Items += len(page)
+			if err := r.compareEntries(ctx, report, page); err != nil {
+				return err
+			}
+		case err := <-errs:
+			done++
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// compareEntries read documents of the table entries by id and check entries whose document
+// is missing or differs
+func (r *reconciler) compareEntries(ctx context.Context, report *ReconcileReport, entries []*reconcileEntry) error {
+	for start := 0; start < len(entries); start += reconcilePageSize {
+		end := start + reconcilePageSize
+		if end > len(entries) {
+			end = len(entries)
+		}
+		ids := make([]string, 0, end-start)
+		for _, e := range entries[start:end] {
+			ids = append(ids, e.id)
+		}
+		sources, err := r.es.sources(ctx, r.index, ids)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries[start:end] {
+			if source, ok := sources[e.id]; ok {
+				hash, err := contentHash(source)
+				if err != nil {
+					return err
+				}
+				if hash == e.hash {
+					continue
+				}
+			}
+			if err := r.check(ctx, report, e); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// compareDocuments read the index in key order and check documents whose item is gone
+func (r *reconciler) compareDocuments(ctx context.Context, report *ReconcileReport) error {
+	var after []interface{}
+	for {
+		hits, err := r.es.indexPage(ctx, r.index, r.names, after)
+		if err != nil {
+			return err
+		}
+		report.Documents += len(hits)
+		for start := 0; start < len(hits); start += maxBatchGetItems {
+			end := start + maxBatchGetItems
+			if end > len(hits) {
+				end = len(hits)
+			}
+			docs := make([]*reconcileEntry, 0, end-start)
+			keys := make([]map[string]*dynamodb.AttributeValue, 0, end-start)
+			for _, hit := range hits[start:end] {
+				doc, err := indexEntry(hit, r.names, r.types)
+				if err != nil {
+					return err
+				}
+				key := map[string]*dynamodb.AttributeValue{}
+				for _, name := range r.names {
+					key[name] = ddbAttribute(doc.item[name])
+				}
+				docs = append(docs, doc)
+				keys = append(keys, key)
+			}
+			items, err := batchGetChunk(r.ddbClient, keys, r.d.TableName, DefaultBatchOptions)
+			if err != nil {
+				return err
+			}
+			found := make(map[string]bool, len(items))
+			for _, item := range items {
+				found[r.d.docID(MapToEventStream(item))] = true
+			}
+			for _, doc := range docs {
+				if found[doc.id] {
+					continue
+				}
+				if err := r.check(ctx, report, doc); err != nil {
+					return err
+				}
+			}
+		}
+		if len(hits) < reconcilePageSize {
+			return nil
+		}
+		after = hits[len(hits)-1].Sort
+	}
+}
+
+// reconciler confirms and repairs drift of a single table
+type reconciler struct {
+	es        *Elasticsearch
+	d         *Details
+	index     string
+	opts      ReconcileIndexOptions
+	names     []string
+	types     []keyType
+	ddbClient dynamodbiface.DynamoDBAPI
+	pace      *pacer
+}
+
+// check read the item and the document of the entry again and record drift if they still differ
+func (r *reconciler) check(ctx context.Context, report *ReconcileReport, e *reconcileEntry) error {
+	key := map[string]*dynamodb.AttributeValue{}
+	for _, name := range r.names {
+		key[name] = ddbAttribute(e.item[name])
+	}
+	output, err := r.ddbClient.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(r.d.TableName),
+		Key:            key,
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return err
+	}
+	source, err := r.es.source(ctx, r.index, e.id)
+	if err != nil {
+		return err
+	}
+	drift := DocumentDrift{DocumentID: e.id}
+	var item *reconcileEntry
+	switch {
+	case len(output.Item) == 0 && source == nil:
+		return nil
+	case len(output.Item) == 0:
+		drift.Kind = DriftExtra
+	case source == nil:
+		drift.Kind = DriftMissing
+	default:
+		if item, err = tableEntry(r.d, output.Item, r.names, r.types); err != nil {
+			return err
+		}
+		hash, err := contentHash(source)
+		if err != nil {
+			return err
+		}
+		if hash == item.hash {
+			return nil
+		}
+		drift.Kind = DriftDivergent
+	}
+	if r.opts.Repair {
+		r.pace.wait(1)
+		if drift.Kind == DriftExtra {
+			err = r.opts.Indexer.Remove(r.d, e.item)
+		} else {
+			err = r.opts.Indexer.Update(r.d, MapToEventStream(output.Item))
+		}
+		if err != nil {
+			return err
+		}
+		drift.Repaired = true
+	}
+	report.Drifts = append(report.Drifts, drift)
+	return nil
+}
+
+// sources return sources of the documents of the index by id, documents which don't exist are left out
+func (es *Elasticsearch) sources(ctx context.Context, index string, ids []string) (map[string]json.RawMessage, error) {
+	body, err := json.Marshal(map[string][]string{"ids": ids})
+	if err != nil {
+		return nil, err
+	}
+	res, err := es.Mget(
+		bytes.NewReader(body),
+		es.Mget.WithIndex(index),
+		es.Mget.WithContext(ctx),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return map[string]json.RawMessage{}, nil
+	}
+	if res.IsError() {
+		return nil, fmt.Errorf("[%v] Error getting documents of %s: %s", res.Status(), index, slim.ReplaceAllString(res.String(), " "))
+	}
+	var result struct {
+		Docs []struct {
+			ID     string          `json:"_id"`
+			Found  bool            `json:"found"`
+			Source json.RawMessage `json:"_source"`
+		} `json:"docs"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	sources := make(map[string]json.RawMessage, len(result.Docs))
+	for _, doc := range result.Docs {
+		if doc.Found {
+			sources[doc.ID] = doc.Source
+		}
+	}
+	return sources, nil
+}
+
+// source return source of the document, nil when it doesn't exist
+func (es *Elasticsearch) source(ctx context.Context, index, id string) (json.RawMessage, error) {
+	res, err := es.Get(index, id, es.Get.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if res.IsError() {
+		return nil, fmt.Errorf("[%v] Error getting document %s", res.Status(), id)
+	}
+	var doc struct {
+		Found  bool            `json:"found"`
+		Source json.RawMessage `json:"_source"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&doc); err != nil {
+		return nil, err
+	}
+	if !doc.Found {
+		return nil, nil
+	}
+	return doc.Source, nil
+}
@@ -0,0 +1,232 @@
+package ddbstore
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+
+	"go-grpc-kubernetes/pkg/ddbfake"
+)
+
+// esStub is an elasticsearch serving the _doc, _mget, _search, _bulk and _alias requests reconcile makes,
+// documents of tables keyed by uuid are sorted by id. Indices have no aliases.
+type esStub struct {
+	mu      sync.Mutex
+	indices map[string]map[string]json.RawMessage
+}
+
+func newESStub(t *testing.T) (*esStub, *Elasticsearch) {
+	t.Helper()
+	stub := &esStub{indices: map[string]map[string]json.RawMessage{}}
+	srv := httptest.NewServer(stub)
+	t.Cleanup(srv.Close)
+	es, err := NewElasticsearchWithOptions(ElasticsearchOptions{Addresses: []string{srv.URL}, Auth: ElasticsearchAuthNone})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stub, es
+}
+
+func (s *esStub) put(index, id string, doc []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.indices[index] == nil {
+		s.indices[index] = map[string]json.RawMessage{}
+	}
+	s.indices[index][id] = doc
+}
+
+// ids return sorted ids of documents of the index
+func (s *esStub) ids(index string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ids []string
+	for id := range s.indices[index] {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (s *esStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case parts[0] == "_alias":
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{}`))
+	case parts[0] == "_bulk":
+		var items []map[string]map[string]interface{}
+		lines := bufio.NewScanner(r.Body)
+		lines.Buffer(nil, 1<<20)
+		for lines.Scan() {
+			var meta map[string]map[string]string
+			json.Unmarshal(lines.Bytes(), &meta)
+			for action, target := range meta {
+				index, id := target["_index"], target["_id"]
+				status := http.StatusOK
+				if action == BulkDelete {
+					if _, ok := s.indices[index][id]; !ok {
+						status = http.StatusNotFound
+					}
+					delete(s.indices[index], id)
+				} else {
+					lines.Scan()
+					if s.indices[index] == nil {
+						s.indices[index] = map[string]json.RawMessage{}
+					}
+					s.indices[index][id] = append(json.RawMessage{}, lines.Bytes()...)
+				}
+				items = append(items, map[string]map[string]interface{}{action: {"_index": index, "_id": id, "status": status}})
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"errors": false, "items": items})
+	case len(parts) == 2 && parts[1] == "_search":
+		var req struct {
+			Size        int           `json:"size"`
+			SearchAfter []interface{} `json:"search_after"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		var ids []string
+		for id := range s.indices[parts[0]] {
+			if len(req.SearchAfter) == 0 || id > req.SearchAfter[0].(string) {
+				ids = append(ids, id)
+			}
+		}
+		sort.Strings(ids)
+		if len(ids) > req.Size {
+			ids = ids[:req.Size]
+		}
+		hits := []searchHit{}
+		for _, id := range ids {
+			hits = append(hits, searchHit{ID: id, Source: s.indices[parts[0]][id], Sort: []interface{}{id}})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"hits": map[string]interface{}{"hits": hits}})
+	case len(parts) == 2 && parts[1] == "_mget":
+		var req struct {
+			IDs []string `json:"ids"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		docs := []map[string]interface{}{}
+		for _, id := range req.IDs {
+			doc, ok := s.indices[parts[0]][id]
+			if !ok {
+				docs = append(docs, map[string]interface{}{"_id": id, "found": false})
+				continue
+			}
+			docs = append(docs, map[string]interface{}{"_id": id, "found": true, "_source": doc})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"docs": docs})
+	case len(parts) == 3 && parts[1] == "_doc":
+		doc, ok := s.indices[parts[0]][parts[2]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"found":false}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"found": true, "_source": doc})
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"unsupported by stub"}`))
+	}
+}
+
+// indexItems put documents of the table items into the index of the stub
+func indexItems(t *testing.T, stub *esStub, db *ddbfake.DB, tableName, index string, ids ...string) {
+	t.Helper()
+	d, err := (&DynamoDetails{DynamoDBAPI: db}).Get(tableName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range ids {
+		out, err := db.GetItem(&dynamodb.GetItemInput{TableName: aws.String(tableName), Key: keyFor(id)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		doc, err := document(d, MapToEventStream(out.Item))
+		if err != nil {
+			t.Fatal(err)
+		}
+		stub.put(index, id, doc)
+	}
+}
+
+func TestReconcileRepairsGivenIndex(t *testing.T) {
+	db, tableName := newOrdersTable(t, TableOptions{})
+	stub, es := newESStub(t)
+	putOrders(t, db, tableName, "order-1", "order-2", "order-3")
+	indexItems(t, stub, db, tableName, "orders-v2", "order-1", "order-2")
+	// order-2 was deleted while its document was backfilled, order-3 wasn't backfilled yet
+	if err := DeleteProtoFromDdb("order-2", db, tableName); err != nil {
+		t.Fatal(err)
+	}
+	report, err := ReconcileIndex(context.Background(), es, ReconcileIndexOptions{Repair: true, Index: "orders-v2"}, db, tableName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var drifts []string
+	for _, drift := range report.Drifts {
+		drifts = append(drifts, drift.String())
+	}
+	if strings.Join(drifts, ", ") != "repaired missing document order-3, repaired extra document order-2" {
+		t.Errorf("got drifts %v", drifts)
+	}
+	if ids := stub.ids("orders-v2"); strings.Join(ids, " ") != "order-1 order-3" {
+		t.Errorf("repaired index has %v, want order-1 order-3", ids)
+	}
+	if ids := stub.ids(SearchIndexName(tableName)); len(ids) > 0 {
+		t.Errorf("alias of the table was written: %v", ids)
+	}
+}
+
+func TestReconcilePagesThroughLargeTable(t *testing.T) {
+	db, tableName := newOrdersTable(t, TableOptions{})
+	stub, es := newESStub(t)
+	var ids, indexed []string
+	for i := 0; i < 2500; i++ {
+		ids = append(ids, fmt.Sprintf("order-%04d", i))
+	}
+	putOrders(t, db, tableName, ids...)
+	for i, id := range ids {
+		// every 700th order is missing from the index
+		if i%700 != 0 {
+			indexed = append(indexed, id)
+		}
+	}
+	indexItems(t, stub, db, tableName, SearchIndexName(tableName), indexed...)
+	for _, id := range []string{"order-0999", "order-2001"} {
+		// documents whose order was deleted
+		if err := DeleteProtoFromDdb(id, db, tableName); err != nil {
+			t.Fatal(err)
+		}
+	}
+	report, err := ReconcileIndex(context.Background(), es, ReconcileIndexOptions{Workers: 3}, db, tableName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Items != 2498 || report.Documents != 2496 {
+		t.Errorf("compared %d items and %d documents, want 2498 and 2496", report.Items, report.Documents)
+	}
+	var drifts []string
+	for _, drift := range report.Drifts {
+		drifts = append(drifts, drift.String())
+	}
+	sort.Strings(drifts)
+	want := "drift extra document order-0999, drift extra document order-2001, drift missing document order-0000, " +
+		"drift missing document order-0700, drift missing document order-1400, drift missing document order-2100"
+	if strings.Join(drifts, ", ") != want {
+		t.Errorf("got drifts %v", drifts)
+	}
+}
@@ -0,0 +1,315 @@
+package ddbstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// reindexAliasSuffix names the alias of the index being backfilled, writes to an alias are
+// applied to the index behind its reindex alias too
+const reindexAliasSuffix = "-reindex"
+
+// reindexTargetsTTL is how long the reindex alias of an index is cached by BulkIndexer,
+// ReindexOptions.DualWriteDelay must be longer so all indexers dual write before backfill starts
+const reindexTargetsTTL = 10 * time.Second
+
+// VersionedIndex return name of version of the index behind alias, e.g. orders-api-dev-v2
+func VersionedIndex(alias string, version int) string {
+	return fmt.Sprintf("%s-v%d", alias, version)
+}
+
+// ReindexAlias return alias of the index being backfilled for alias
+func ReindexAlias(alias string) string {
+	return alias + reindexAliasSuffix
+}
+
+// AliasIndices return indices behind the alias, none when the alias doesn't exist
+func (es *Elasticsearch) AliasIndices(ctx context.Context, alias string) ([]string, error) {
+	res, err := es.Indices.GetAlias(
+		es.Indices.GetAlias.WithName(alias),
+		es.Indices.GetAlias.WithContext(ctx),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if res.IsError() {
+		return nil, fmt.Errorf("[%v] Error getting alias %s", res.Status(), alias)
+	}
+	var indices map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&indices); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(indices))
+	for name := range indices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// indexExists report whether a concrete index or alias of the name exists
+func (es *Elasticsearch) indexExists(ctx context.Context, index string) (bool, error) {
+	res, err := es.Indices.Exists([]string{index}, es.Indices.Exists.WithContext(ctx))
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("[%v] Error checking index %s", res.Status(), index)
+}
+
+// indexVersions return versions of indices named after alias
+func (es *Elasticsearch) indexVersions(ctx context.Context, alias string) ([]int, error) {
+	res, err := es.Indices.Get(
+		[]string{alias + "-v*"},
+		es.Indices.Get.WithContext(ctx),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return nil, fmt.Errorf("[%v] Error listing indices of %s", res.Status(), alias)
+	}
+	var indices map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&indices); err != nil {
+		return nil, err
+	}
+	var versions []int
+	for name := range indices {
+		var version int
+		if _, err := fmt.Sscanf(strings.TrimPrefix(name, alias+"-v"), "%d", &version); err == nil && VersionedIndex(alias, version) == name {
+			versions = append(versions, version)
+		}
+	}
+	sort.Ints(versions)
+	return versions, nil
+}
+
+// updateAliases apply alias actions atomically
+func (es *Elasticsearch) updateAliases(ctx context.Context, actions []map[string]map[string]string) error {
+	body, err := json.Marshal(map[string]interface{}{"actions": actions})
+	if err != nil {
+		return err
+	}
+	res, err := es.Indices.UpdateAliases(
+		bytes.NewReader(body),
+		es.Indices.UpdateAliases.WithContext(ctx),
+	)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("[%v] Error updating aliases: %s", res.Status(), slim.ReplaceAllString(res.String(), " "))
+	}
+	return nil
+}
+
+// ReindexOptions configure Reindex
+type ReindexOptions struct {
+	// Mapping of the new index
+	Mapping *Mapping
+	// Workers is the number of parallel scan segments
+	Workers int
+	// Rate limits items per second read from the table, 0 is unlimited
+	Rate float64
+	// Bulk configure _bulk requests to the new index
+	Bulk BulkOptions
+	// DualWriteDelay is the time indexers get to start writing to the new index before backfill starts
+	DualWriteDelay time.Duration
+}
+
+// DefaultReindexOptions used for options left zero
+var DefaultReindexOptions = ReindexOptions{
+	Workers:        4,
+	DualWriteDelay: 3 * reindexTargetsTTL,
+}
+
+// Reindex backfill a new version of the search index of the table without downtime. The new index
+// gets the reindex alias so stream indexers write to it as well as to the current one, then the table
+// is parallel scanned into it, and the alias of the table is moved to it atomically. Backfilled
+// documents are only created, so they never overwrite newer documents written by the stream.
+// A document created after the stream deleted its item would outlive the item, so the new index is
+// reconciled with the table and repaired before the alias moves.
+// An interrupted reindex continues into the same index when run again. The previous index is kept.
+func Reindex(ctx context.Context, es *Elasticsearch, opts ReindexOptions, ddbClient dynamodbiface.DynamoDBAPI, tableName string) (string, error) {
+	defaults := DefaultReindexOptions
+	if opts.Workers == 0 {
+		opts.Workers = defaults.Workers
+	}
+	if opts.DualWriteDelay == 0 {
+		opts.DualWriteDelay = defaults.DualWriteDelay
+	}
+	d, err := (&DynamoDetails{DynamoDBAPI: ddbClient}).Get(tableName)
+	if err != nil {
+		return "", err
+	}
+	alias := d.index()
+	reindexAlias := ReindexAlias(alias)
+	pending, err := es.AliasIndices(ctx, reindexAlias)
+	if err != nil {
+		return "", err
+	}
+	var index string
+	if len(pending) > 0 {
+		index = pending[0]
+		fmt.Printf("ddbstore:Reindex: continuing backfill of %s\n", index)
+	} else {
+		versions, err := es.indexVersions(ctx, alias)
+		if err != nil {
+			return "", err
+		}
+		version := 1
+		if len(versions) > 0 {
+			version = versions[len(versions)-1] + 1
+		}
+		index = VersionedIndex(alias, version)
+		if err := es.createIndex(ctx, index, opts.Mapping); err != nil {
+			return "", err
+		}
+		if err := es.updateAliases(ctx, []map[string]map[string]string{
+			{"add": {"index": index, "alias": reindexAlias}},
+		}); err != nil {
+			return "", err
+		}
+		fmt.Printf("ddbstore:Reindex: created %s, waiting %v for indexers to write to it\n", index, opts.DualWriteDelay)
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(opts.DualWriteDelay):
+		}
+	}
+	count, err := backfill(ctx, es, d, index, opts, ddbClient)
+	if err != nil {
+		return "", err
+	}
+	fmt.Printf("ddbstore:Reindex: backfilled %d items of %s into %s\n", count, tableName, index)
+	res, err := es.Indices.Refresh(es.Indices.Refresh.WithIndex(index), es.Indices.Refresh.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	res.Body.Close()
+	report, err := ReconcileIndex(ctx, es, ReconcileIndexOptions{
+		Repair:  true,
+		Rate:    opts.Rate,
+		Workers: opts.Workers,
+		Index:   index,
+	}, ddbClient, tableName)
+	if err != nil {
+		return "", err
+	}
+	for _, drift := range report.Drifts {
+		fmt.Printf("ddbstore:Reindex: %v\n", drift)
+	}
+	return index, swapAlias(ctx, es, alias, index)
+}
+
+// swapAlias move alias to index and drop the reindex alias in a single atomic update. An index named
+// like the alias, written before indices were versioned, is deleted by the same update.
+func swapAlias(ctx context.Context, es *Elasticsearch, alias, index string) error {
+	current, err := es.AliasIndices(ctx, alias)
+	if err != nil {
+		return err
+	}
+	var actions []map[string]map[string]string
+	if len(current) == 0 {
+		legacy, err := es.indexExists(ctx, alias)
+		if err != nil {
+			return err
+		}
+		if legacy {
+			actions = append(actions, map[string]map[string]string{"remove_index": {"index": alias}})
+		}
+	}
+	for _, old := range current {
+		if old != index {
+			actions = append(actions, map[string]map[string]string{"remove": {"index": old, "alias": alias}})
+		}
+	}
+	actions = append(actions,
+		map[string]map[string]string{"add": {"index": index, "alias": alias}},
+		map[string]map[string]string{"remove": {"index": index, "alias": ReindexAlias(alias)}},
+	)
+	return es.updateAliases(ctx, actions)
+}
+
+// backfill parallel scan items of the table into index as create operations
+func backfill(ctx context.Context, es *Elasticsearch, d *Details, index string, opts ReindexOptions, ddbClient dynamodbiface.DynamoDBAPI) (int64, error) {
+	bulk, err := NewBulkIndexer(es, opts.Bulk)
+	if err != nil {
+		return 0, err
+	}
+	defer bulk.Close()
+	pace := newPacer(opts.Rate)
+	var count int64
+	var wg sync.WaitGroup
+	errs := make(chan error, opts.Workers)
+	for segment := 0; segment < opts.Workers; segment++ {
+		wg.Add(1)
+		go func(segment int) {
+			defer wg.Done()
+			input := &dynamodb.ScanInput{
+				TableName:      aws.String(d.TableName),
+				ConsistentRead: aws.Bool(true),
+				Segment:        aws.Int64(int64(segment)),
+				TotalSegments:  aws.Int64(int64(opts.Workers)),
+			}
+			for {
+				if err := ctx.Err(); err != nil {
+					errs <- err
+					return
+				}
+				output, err := ddbClient.Scan(input)
+				if err != nil {
+					errs <- err
+					return
+				}
+				pace.wait(len(output.Items))
+				ops := make([]BulkOperation, 0, len(output.Items))
+				for _, item := range output.Items {
+					op, err := IndexOperation(d, MapToEventStream(item))
+					if err != nil {
+						errs <- err
+						return
+					}
+					op.Action, op.Index = BulkCreate, index
+					ops = append(ops, op)
+				}
+				if err := bulk.Apply(ctx, ops); err != nil {
+					errs <- err
+					return
+				}
+				atomic.AddInt64(&count, int64(len(ops)))
+				if len(output.LastEvaluatedKey) == 0 {
+					return
+				}
+				input.ExclusiveStartKey = output.LastEvaluatedKey
+			}
+		}(segment)
+	}
+	wg.Wait()
+	close(errs)
+	return count, <-errs
+}
@@ -0,0 +1,464 @@
+package ddbstore
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+var (
+	ErrTableNotActive    = errors.New("table did not become active in time")
+	ErrTableCreateDenied = errors.New("table does not exist and creating it is not allowed")
+)
+
+// IndexSpec describe a global or local secondary index
+type IndexSpec struct {
+	Name     string
+	HashKey  string
+	RangeKey string
+	// ProjectionType is one of ALL, KEYS_ONLY or INCLUDE, ALL is used when empty
+	ProjectionType   string
+	NonKeyAttributes []string
+	// ReadCapacity and WriteCapacity are used by global indexes of provisioned tables
+	ReadCapacity, WriteCapacity int64
+}
+
+// TableSpec is the declarative definition of a dynamodb table
+type TableSpec struct {
+	TableName string
+	// AttributeTypes define S, N or B type of every key attribute of the table and its indexes
+	AttributeTypes map[string]string
+	HashKey        string
+	RangeKey       string
+	GlobalIndexes  []IndexSpec
+	LocalIndexes   []IndexSpec
+	// BillingMode is PROVISIONED or PAY_PER_REQUEST
+	BillingMode                 string
+	ReadCapacity, WriteCapacity int64
+	// StreamViewType enables the table stream when set
+	StreamViewType string
+	// TTLAttribute enables time to live on given attribute when set
+	TTLAttribute string
+	Tags         map[string]string
+}
+
+// Drift is a single difference between table spec and the existing table
+type Drift struct {
+	Field string
+	Want  string
+	Got   string
+	// Applied is true when the difference was safe to fix and it was fixed
+	Applied bool
+}
+
+func (d Drift) String() string {
+	state := "drift"
+	if d.Applied {
+		state = "applied"
+	}
+	return fmt.Sprintf("%s %s: want=%q got=%q", state, d.Field, d.Want, d.Got)
+}
+
+// ReconcileOptions configure EnsureTable
+type ReconcileOptions struct {
+	// DryRun only reports drift without creating or changing the table
+	DryRun bool
+	// AllowCreate permits creating the table when it doesn't exist
+	AllowCreate bool
+	// WaitTimeout bounds waiting for the table and its indexes to become ACTIVE
+	WaitTimeout time.Duration
+}
+
+// EnsureTable diff table spec against the existing table, create the table when it doesn't exist
+// and apply safe changes: adding global indexes, enabling the stream, TTL and missing tags.
+// Differences which can't be applied safely are only reported.
+func EnsureTable(spec *TableSpec, ddbClient dynamodbiface.DynamoDBAPI, opts ReconcileOptions) ([]Drift, error) {
+	if opts.WaitTimeout == 0 {
+		opts.WaitTimeout = 5 * time.Minute
+	}
+	desc, err := ddbClient.DescribeTable(&dynamodb.DescribeTableInput{
+		TableName: aws.String(spec.TableName),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeResourceNotFoundException {
+		drifts := []Drift{{Field: "table", Want: spec.TableName, Applied: !opts.DryRun}}
+		if opts.DryRun {
+			return drifts, nil
+		}
+		if !opts.AllowCreate {
+			return nil, ErrTableCreateDenied
+		}
+		if err := createTable(ddbClient, spec); err != nil {
+			return nil, err
+		}
+		if err := waitActive(ddbClient, spec.TableName, opts.WaitTimeout); err != nil {
+			return nil, err
+		}
+		if spec.TTLAttribute != "" {
+			if err := enableTTL(ddbClient, spec); err != nil {
+				return nil, err
+			}
+		}
+		return drifts, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !opts.DryRun {
+		if err := waitActive(ddbClient, spec.TableName, opts.WaitTimeout); err != nil {
+			return nil, err
+		}
+	}
+	return reconcileTable(ddbClient, spec, desc.Table, opts)
+}
+
+// DescribeTable return current description of the table
+func DescribeTable(tableName string, ddbClient dynamodbiface.DynamoDBAPI) (*dynamodb.TableDescription, error) {
+	desc, err := ddbClient.DescribeTable(&dynamodb.DescribeTableInput{
+		TableName: aws.String(tableName),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return desc.Table, nil
+}
+
+// keySchema return ddb key schema of hash and optional range key
+func keySchema(hashKey, rangeKey string) []*dynamodb.KeySchemaElement {
+	schema := []*dynamodb.KeySchemaElement{
+		{
+			AttributeName: aws.String(hashKey),
+			KeyType:       aws.String(dynamodb.KeyTypeHash),
+		},
+	}
+	if rangeKey != "" {
+		schema = append(schema, &dynamodb.KeySchemaElement{
+			AttributeName: aws.String(rangeKey),
+			KeyType:       aws.String(dynamodb.KeyTypeRange),
+		})
+	}
+	return schema
+}
+
+// attributeDefinitions return definitions of all key attributes used by the table and its indexes
+func (spec *TableSpec) attributeDefinitions() []*dynamodb.AttributeDefinition {
+	used := map[string]bool{spec.HashKey: true, spec.RangeKey: true}
+	for _, idx := range append(append([]IndexSpec{}, spec.GlobalIndexes...), spec.LocalIndexes...) {
+		used[idx.HashKey] = true
+		used[idx.RangeKey] = true
+	}
+	names := make([]string, 0, len(used))
+	for name := range used {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	defs := make([]*dynamodb.AttributeDefinition, 0, len(names))
+	for _, name := range names {
+		typ := spec.AttributeTypes[name]
+		if typ == "" {
+			typ = dynamodb.ScalarAttributeTypeS
+		}
+		defs = append(defs, &dynamodb.AttributeDefinition{
+			AttributeName: aws.String(name),
+			AttributeType: aws.String(typ),
+		})
+	}
+	return defs
+}
+
+func (spec *TableSpec) provisioned() bool {
+	return spec.BillingMode != dynamodb.BillingModePayPerRequest
+}
+
+func (spec *TableSpec) throughput(read, write int64) *dynamodb.ProvisionedThroughput {
+	if !spec.provisioned() {
+		return nil
+	}
+	return &dynamodb.ProvisionedThroughput{
+		ReadCapacityUnits:  aws.Int64(read),
+		WriteCapacityUnits: aws.Int64(write),
+	}
+}
+
+func projection(idx IndexSpec) *dynamodb.Projection {
+	p := &dynamodb.Projection{
+		ProjectionType: aws.String(dynamodb.ProjectionTypeAll),
+	}
+	if idx.ProjectionType != "" {
+		p.ProjectionType = aws.String(idx.ProjectionType)
+	}
+	if len(idx.NonKeyAttributes) > 0 {
+		p.NonKeyAttributes = aws.StringSlice(idx.NonKeyAttributes)
+	}
+	return p
+}
+
+func (spec *TableSpec) globalIndex(idx IndexSpec) *dynamodb.GlobalSecondaryIndex {
+	return &dynamodb.GlobalSecondaryIndex{
+		IndexName:             aws.String(idx.Name),
+		KeySchema:             keySchema(idx.HashKey, idx.RangeKey),
+		Projection:            projection(idx),
+		ProvisionedThroughput: spec.throughput(idx.ReadCapacity, idx.WriteCapacity),
+	}
+}
+
+func createTable(ddbClient dynamodbiface.DynamoDBAPI, spec *TableSpec) error {
+	input := &dynamodb.CreateTableInput{
+		AttributeDefinitions:  spec.attributeDefinitions(),
+		KeySchema:             keySchema(spec.HashKey, spec.RangeKey),
+		ProvisionedThroughput: spec.throughput(spec.ReadCapacity, spec.WriteCapacity),
+		TableName:             aws.String(spec.TableName),
+	}
+	if spec.BillingMode != "" {
+		input.BillingMode = aws.String(spec.BillingMode)
+	}
+	for _, idx := range spec.GlobalIndexes {
+		input.GlobalSecondaryIndexes = append(input.GlobalSecondaryIndexes, spec.globalIndex(idx))
+	}
+	for _, idx := range spec.LocalIndexes {
+		input.LocalSecondaryIndexes = append(input.LocalSecondaryIndexes, &dynamodb.LocalSecondaryIndex{
+			IndexName:  aws.String(idx.Name),
+			KeySchema:  keySchema(spec.HashKey, idx.RangeKey),
+			Projection: projection(idx),
+		})
+	}
+	if spec.StreamViewType != "" {
+		input.StreamSpecification = &dynamodb.StreamSpecification{
+			StreamEnabled:  aws.Bool(true),
+			StreamViewType: aws.String(spec.StreamViewType),
+		}
+	}
+	for _, k := range sortedKeys(spec.Tags) {
+		input.Tags = append(input.Tags, &dynamodb.Tag{
+			Key:   aws.String(k),
+			Value: aws.String(spec.Tags[k]),
+		})
+	}
+	_, err := ddbClient.CreateTable(input)
+	return err
+}
+
+func enableTTL(ddbClient dynamodbiface.DynamoDBAPI, spec *TableSpec) error {
+	_, err := ddbClient.UpdateTimeToLive(&dynamodb.UpdateTimeToLiveInput{
+		TableName: aws.String(spec.TableName),
+		TimeToLiveSpecification: &dynamodb.TimeToLiveSpecification{
+			AttributeName: aws.String(spec.TTLAttribute),
+			Enabled:       aws.Bool(true),
+		},
+	})
+	return err
+}
+
+// waitActive poll table description until the table and all of its global indexes are ACTIVE
+func waitActive(ddbClient dynamodbiface.DynamoDBAPI, tableName string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		desc, err := ddbClient.DescribeTable(&dynamodb.DescribeTableInput{
+			TableName: aws.String(tableName),
+		})
+		if err != nil {
+			return err
+		}
+		active := aws.StringValue(desc.Table.TableStatus) == dynamodb.TableStatusActive
+		for _, idx := range desc.Table.GlobalSecondaryIndexes {
+			if aws.StringValue(idx.IndexStatus) != dynamodb.IndexStatusActive {
+				active = false
+			}
+		}
+		if active {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return ErrTableNotActive
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// reconcileTable compare spec with table description and apply safe changes unless dry run
+func reconcileTable(ddbClient dynamodbiface.DynamoDBAPI, spec *TableSpec, table *dynamodb.TableDescription, opts ReconcileOptions) ([]Drift, error) {
+	var drifts []Drift
+	report := func(field, want, got string) {
+		drifts = append(drifts, Drift{Field: field, Want: want, Got: got})
+	}
+
+	// key schema and local indexes can only be defined on table creation
+	if got := findAttributeByKeyType(table.KeySchema, dynamodb.KeyTypeHash); got != spec.HashKey {
+		report("hash_key", spec.HashKey, got)
+	}
+	if got := findAttributeByKeyType(table.KeySchema, dynamodb.KeyTypeRange); got != spec.RangeKey {
+		report("range_key", spec.RangeKey, got)
+	}
+	localIndexes := map[string]bool{}
+	for _, idx := range table.LocalSecondaryIndexes {
+		localIndexes[aws.StringValue(idx.IndexName)] = true
+	}
+	for _, idx := range spec.LocalIndexes {
+		if !localIndexes[idx.Name] {
+			report("local_index", idx.Name, "")
+		}
+	}
+
+	billingMode := dynamodb.BillingModeProvisioned
+	if table.BillingModeSummary != nil && table.BillingModeSummary.BillingMode != nil {
+		billingMode = *table.BillingModeSummary.BillingMode
+	}
+	wantBillingMode := spec.BillingMode
+	if wantBillingMode == "" {
+		wantBillingMode = dynamodb.BillingModeProvisioned
+	}
+	if billingMode != wantBillingMode {
+		report("billing_mode", wantBillingMode, billingMode)
+	} else if spec.provisioned() && table.ProvisionedThroughput != nil {
+		if got := aws.Int64Value(table.ProvisionedThroughput.ReadCapacityUnits); got != spec.ReadCapacity {
+			report("read_capacity", fmt.Sprint(spec.ReadCapacity), fmt.Sprint(got))
+		}
+		if got := aws.Int64Value(table.ProvisionedThroughput.WriteCapacityUnits); got != spec.WriteCapacity {
+			report("write_capacity", fmt.Sprint(spec.WriteCapacity), fmt.Sprint(got))
+		}
+	}
+
+	// stream can be enabled in place, changing its view type requires disabling it first
+	streamViewType := ""
+	if table.StreamSpecification != nil && aws.BoolValue(table.StreamSpecification.StreamEnabled) {
+		streamViewType = aws.StringValue(table.StreamSpecification.StreamViewType)
+	}
+	if streamViewType != spec.StreamViewType {
+		drift := Drift{Field: "stream_view_type", Want: spec.StreamViewType, Got: streamViewType}
+		if streamViewType == "" && !opts.DryRun {
+			_, err := ddbClient.UpdateTable(&dynamodb.UpdateTableInput{
+				TableName: aws.String(spec.TableName),
+				StreamSpecification: &dynamodb.StreamSpecification{
+					StreamEnabled:  aws.Bool(true),
+					StreamViewType: aws.String(spec.StreamViewType),
+				},
+			})
+			if err != nil {
+				return drifts, err
+			}
+			if err := waitActive(ddbClient, spec.TableName, opts.WaitTimeout); err != nil {
+				return drifts, err
+			}
+			drift.Applied = true
+		}
+		drifts = append(drifts, drift)
+	}
+
+	// missing global indexes are added one by one as dynamodb allows a single index creation at a time
+	globalIndexes := map[string]bool{}
+	for _, idx := range table.GlobalSecondaryIndexes {
+		globalIndexes[aws.StringValue(idx.IndexName)] = true
+	}
+	for _, idx := range spec.GlobalIndexes {
+		if globalIndexes[idx.Name] {
+			delete(globalIndexes, idx.Name)
+			continue
+		}
+		drift := Drift{Field: "global_index", Want: idx.Name}
+		if !opts.DryRun {
+			_, err := ddbClient.UpdateTable(&dynamodb.UpdateTableInput{
+				TableName:            aws.String(spec.TableName),
+				AttributeDefinitions: spec.attributeDefinitions(),
+				GlobalSecondaryIndexUpdates: []*dynamodb.GlobalSecondaryIndexUpdate{
+					{
+						Create: &dynamodb.CreateGlobalSecondaryIndexAction{
+							IndexName:             aws.String(idx.Name),
+							KeySchema:             keySchema(idx.HashKey, idx.RangeKey),
+							Projection:            projection(idx),
+							ProvisionedThroughput: spec.throughput(idx.ReadCapacity, idx.WriteCapacity),
+						},
+					},
+				},
+			})
+			if err != nil {
+				return drifts, err
+			}
+			if err := waitActive(ddbClient, spec.TableName, opts.WaitTimeout); err != nil {
+				return drifts, err
+			}
+			drift.Applied = true
+		}
+		drifts = append(drifts, drift)
+	}
+	// indexes which are not in spec are never dropped automatically
+	for _, idx := range table.GlobalSecondaryIndexes {
+		if name := aws.StringValue(idx.IndexName); globalIndexes[name] {
+			report("global_index", "", name)
+		}
+	}
+
+	ttl, err := ddbClient.DescribeTimeToLive(&dynamodb.DescribeTimeToLiveInput{
+		TableName: aws.String(spec.TableName),
+	})
+	if err != nil {
+		return drifts, err
+	}
+	ttlAttribute := ""
+	if desc := ttl.TimeToLiveDescription; desc != nil && aws.StringValue(desc.TimeToLiveStatus) != dynamodb.TimeToLiveStatusDisabled {
+		ttlAttribute = aws.StringValue(desc.AttributeName)
+	}
+	if ttlAttribute != spec.TTLAttribute {
+		drift := Drift{Field: "ttl_attribute", Want: spec.TTLAttribute, Got: ttlAttribute}
+		if ttlAttribute == "" && !opts.DryRun {
+			if err := enableTTL(ddbClient, spec); err != nil {
+				return drifts, err
+			}
+			drift.Applied = true
+		}
+		drifts = append(drifts, drift)
+	}
+
+	if len(spec.Tags) > 0 {
+		tags, err := ddbClient.ListTagsOfResource(&dynamodb.ListTagsOfResourceInput{
+			ResourceArn: table.TableArn,
+		})
+		if err != nil {
+			return drifts, err
+		}
+		current := map[string]string{}
+		for _, tag := range tags.Tags {
+			current[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+		}
+		var missing []*dynamodb.Tag
+		tagDrifts := len(drifts)
+		for _, k := range sortedKeys(spec.Tags) {
+			if got, ok := current[k]; !ok || got != spec.Tags[k] {
+				drifts = append(drifts, Drift{Field: "tag:" + k, Want: spec.Tags[k], Got: got})
+				missing = append(missing, &dynamodb.Tag{
+					Key:   aws.String(k),
+					Value: aws.String(spec.Tags[k]),
+				})
+			}
+		}
+		if len(missing) > 0 && !opts.DryRun {
+			_, err := ddbClient.TagResource(&dynamodb.TagResourceInput{
+				ResourceArn: table.TableArn,
+				Tags:        missing,
+			})
+			if err != nil {
+				return drifts, err
+			}
+			for i := tagDrifts; i < len(drifts); i++ {
+				drifts[i].Applied = true
+			}
+		}
+	}
+	return drifts, nil
+}
+
+// sortedKeys return keys of string map in stable order
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,71 @@
+package ddbstore
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+
+	"go-grpc-kubernetes/pkg/ddbfake"
+)
+
+func taggedSpec(tableName string) *TableSpec {
+	return &TableSpec{
+		TableName:      tableName,
+		HashKey:        "uuid",
+		AttributeTypes: map[string]string{"uuid": dynamodb.ScalarAttributeTypeS},
+		BillingMode:    dynamodb.BillingModePayPerRequest,
+		Tags:           map[string]string{"team": "orders", "stage": "dev"},
+	}
+}
+
+func TestEnsureTableReportsTagDrift(t *testing.T) {
+	db := ddbfake.New()
+	spec := taggedSpec("orders")
+	spec.Tags = nil
+	if _, err := EnsureTable(spec, db, ReconcileOptions{AllowCreate: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	tagFailed := errors.New("access denied")
+	db.Fail = func(op string) error {
+		if op == "TagResource" {
+			return tagFailed
+		}
+		return nil
+	}
+	for _, tc := range []struct {
+		name    string
+		opts    ReconcileOptions
+		err     error
+		applied bool
+	}{
+		{"dry run", ReconcileOptions{DryRun: true}, nil, false},
+		{"failed tag", ReconcileOptions{}, tagFailed, false},
+	} {
+		drifts, err := EnsureTable(taggedSpec("orders"), db, tc.opts)
+		if err != tc.err {
+			t.Fatalf("%s: got %v, want %v", tc.name, err, tc.err)
+		}
+		if len(drifts) != 2 {
+			t.Fatalf("%s: got drifts %v, want both tags", tc.name, drifts)
+		}
+		for _, drift := range drifts {
+			if drift.Applied != tc.applied {
+				t.Errorf("%s: got %v, want applied %v", tc.name, drift, tc.applied)
+			}
+		}
+	}
+
+	db.Fail = nil
+	drifts, err := EnsureTable(taggedSpec("orders"), db, ReconcileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(drifts) != 2 || drifts[0].String() != `applied tag:stage: want="dev" got=""` || !drifts[1].Applied {
+		t.Errorf("got drifts %v, want both tags applied", drifts)
+	}
+	if drifts, err := EnsureTable(taggedSpec("orders"), db, ReconcileOptions{DryRun: true}); err != nil || len(drifts) != 0 {
+		t.Errorf("got %v, %v, want no drift once tagged", drifts, err)
+	}
+}
@@ -0,0 +1,299 @@
+package ddbstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+)
+
+var (
+	ErrInvalidCursor          = errors.New("invalid search cursor")
+	ErrSearchAfterWithoutSort = errors.New("search_after requires sort")
+	ErrIndexNotFound          = errors.New("index not found")
+)
+
+// sort orders
+const (
+	SortAsc  = "asc"
+	SortDesc = "desc"
+)
+
+// Query is a clause of the elasticsearch query DSL, Source return its json representation
+type Query interface {
+	Source() interface{}
+}
+
+// MatchAllQuery matches every document
+type MatchAllQuery struct{}
+
+// Source implements Query
+func (q MatchAllQuery) Source() interface{} {
+	return map[string]interface{}{"match_all": map[string]interface{}{}}
+}
+
+// TermQuery matches documents whose field is exactly the value, use it on keyword, numeric and date fields
+type TermQuery struct {
+	Field string
+	Value interface{}
+}
+
+// Source implements Query
+func (q TermQuery) Source() interface{} {
+	return map[string]interface{}{"term": map[string]interface{}{q.Field: map[string]interface{}{"value": q.Value}}}
+}
+
+// TermsQuery matches documents whose field is exactly one of the values
+type TermsQuery struct {
+	Field  string
+	Values []interface{}
+}
+
+// Source implements Query
+func (q TermsQuery) Source() interface{} {
+	values := q.Values
+	if values == nil {
+		values = []interface{}{}
+	}
+	return map[string]interface{}{"terms": map[string]interface{}{q.Field: values}}
+}
+
+// MatchQuery matches documents whose analyzed text field matches the text,
+// Operator "and" requires all terms of the text, the default "or" any of them
+type MatchQuery struct {
+	Field    string
+	Text     string
+	Operator string
+}
+
+// Source implements Query
+func (q MatchQuery) Source() interface{} {
+	match := map[string]interface{}{"query": q.Text}
+	if q.Operator != "" {
+		match["operator"] = q.Operator
+	}
+	return map[string]interface{}{"match": map[string]interface{}{q.Field: match}}
+}
+
+// RangeQuery matches documents whose field is within the bounds which are set,
+// Format is the date format of bounds of date fields e.g. epoch_second
+type RangeQuery struct {
+	Field            string
+	Gt, Gte, Lt, Lte interface{}
+	Format           string
+}
+
+// Source implements Query
+func (q RangeQuery) Source() interface{} {
+	bounds := map[string]interface{}{}
+	for name, v := range map[string]interface{}{"gt": q.Gt, "gte": q.Gte, "lt": q.Lt, "lte": q.Lte} {
+		if v != nil {
+			bounds[name] = v
+		}
+	}
+	if q.Format != "" {
+		bounds["format"] = q.Format
+	}
+	return map[string]interface{}{"range": map[string]interface{}{q.Field: bounds}}
+}
+
+// BoolQuery combines queries, Filter and MustNot don't score documents
+type BoolQuery struct {
+	Must, Filter, Should, MustNot []Query
+	// MinimumShouldMatch is the number of Should queries a document must match, 0 leaves the default
+	MinimumShouldMatch int
+}
+
+// Source implements Query
+func (q BoolQuery) Source() interface{} {
+	clauses := map[string]interface{}{}
+	for name, queries := range map[string][]Query{"must": q.Must, "filter": q.Filter, "should": q.Should, "must_not": q.MustNot} {
+		if len(queries) == 0 {
+			continue
+		}
+		sources := make([]interface{}, len(queries))
+		for i, query := range queries {
+			sources[i] = query.Source()
+		}
+		clauses[name] = sources
+	}
+	if q.MinimumShouldMatch > 0 {
+		clauses["minimum_should_match"] = q.MinimumShouldMatch
+	}
+	return map[string]interface{}{"bool": clauses}
+}
+
+// SortField sorts hits by the field, Order is SortAsc by default
+type SortField struct {
+	Field string
+	Order string
+}
+
+// Cursor is the sort values of the last hit of a page, given as SearchAfter it continues
+// with the next page
+type Cursor []interface{}
+
+// String return the cursor encoded for clients, an empty string when there is no next page
+func (c Cursor) String() string {
+	if len(c) == 0 {
+		return ""
+	}
+	b, err := json.Marshal([]interface{}(c))
+	if err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// ParseCursor return the cursor encoded by Cursor.String, nil for an empty string
+func ParseCursor(s string) (Cursor, error) {
+	if s == "" {
+		return nil, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+	}
+	return decodeCursor(b)
+}
+
+// decodeCursor decode sort values keeping numbers as they are, long values don't fit float64
+func decodeCursor(b []byte) (Cursor, error) {
+	var c Cursor
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	if err := decoder.Decode(&c); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+	}
+	return c, nil
+}
+
+// SearchRequest is the body of a _search request
+type SearchRequest struct {
+	Query Query
+	Sort  []SortField
+	// Size is the number of hits of a page, 0 leaves the default of 10
+	Size int
+	// SearchAfter continues after the hit of the cursor, Sort must end with a field unique to
+	// each document so no hit is skipped or repeated
+	SearchAfter Cursor
+	// TrackTotalHits counts all matching documents, otherwise totals above 10000 are a lower bound
+	TrackTotalHits bool
+}
+
+// MarshalJSON implements json.Marshaler
+func (r *SearchRequest) MarshalJSON() ([]byte, error) {
+	body := map[string]interface{}{}
+	if r.Query != nil {
+		body["query"] = r.Query.Source()
+	}
+	if len(r.Sort) > 0 {
+		sort := make([]interface{}, len(r.Sort))
+		for i, field := range r.Sort {
+			order := field.Order
+			if order == "" {
+				order = SortAsc
+			}
+			sort[i] = map[string]interface{}{field.Field: map[string]string{"order": order}}
+		}
+		body["sort"] = sort
+	}
+	if r.Size > 0 {
+		body["size"] = r.Size
+	}
+	if len(r.SearchAfter) > 0 {
+		body["search_after"] = []interface{}(r.SearchAfter)
+	}
+	if r.TrackTotalHits {
+		body["track_total_hits"] = true
+	}
+	return json.Marshal(body)
+}
+
+// SearchResult is a page of hits decoded into proto messages
+type SearchResult struct {
+	// Total is the number of matching documents, a lower bound when TotalRelation is "gte"
+	Total         int64
+	TotalRelation string
+	Hits          []proto.Message
+	// Next is the cursor of the next page, nil when this page is the last one
+	Next Cursor
+}
+
+// searchResponse is the part of a _search response decoded by Query
+type searchResponse struct {
+	Hits struct {
+		Total struct {
+			Value    int64  `json:"value"`
+			Relation string `json:"relation"`
+		} `json:"total"`
+		Hits []struct {
+			ID     string          `json:"_id"`
+			Source json.RawMessage `json:"_source"`
+			Sort   json.RawMessage `json:"sort"`
+		} `json:"hits"`
+	} `json:"hits"`
+}
+
+// Query search the index and decode hits into new messages of the same type as given proto. Documents
+// are decoded from their indexed fields, so redacted fields are left empty and unknown ones ignored.
+// Next is set when the page is full and the request is sorted, to be given as SearchAfter.
+// ErrIndexNotFound is returned when there is no index or alias of the name.
+func (es *Elasticsearch) Query(ctx context.Context, index string, req *SearchRequest, in proto.Message) (*SearchResult, error) {
+	if len(req.SearchAfter) > 0 && len(req.Sort) == 0 {
+		return nil, ErrSearchAfterWithoutSort
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	res, err := es.Search(
+		es.Search.WithIndex(index),
+		es.Search.WithBody(bytes.NewReader(body)),
+		es.Search.WithContext(ctx),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%w: %s", ErrIndexNotFound, index)
+	}
+	if res.IsError() {
+		return nil, fmt.Errorf("[%v] Error searching %s: %s", res.Status(), index, slim.ReplaceAllString(res.String(), " "))
+	}
+	var response searchResponse
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		return nil, err
+	}
+	result := &SearchResult{
+		Total:         response.Hits.Total.Value,
+		TotalRelation: response.Hits.Total.Relation,
+		Hits:          make([]proto.Message, 0, len(response.Hits.Hits)),
+	}
+	unmarshaler := &jsonpb.Unmarshaler{AllowUnknownFields: true}
+	for _, hit := range response.Hits.Hits {
+		out := proto.Clone(in)
+		out.Reset()
+		if err := unmarshaler.Unmarshal(bytes.NewReader(hit.Source), out); err != nil {
+			return nil, fmt.Errorf("document %s: %w", hit.ID, err)
+		}
+		result.Hits = append(result.Hits, out)
+	}
+	size := req.Size
+	if size == 0 {
+		size = 10
+	}
+	if n := len(response.Hits.Hits); n == size && len(req.Sort) > 0 {
+		if result.Next, err = decodeCursor(response.Hits.Hits[n-1].Sort); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
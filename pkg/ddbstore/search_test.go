@@ -0,0 +1,146 @@
+package ddbstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	pb "go-grpc-kubernetes/proto/orderservice"
+)
+
+// newSearchServer return client of an elasticsearch answering every request with the status and body,
+// the last request body is kept in the returned pointer
+func newSearchServer(t *testing.T, status int, body string) (*Elasticsearch, *[]byte) {
+	t.Helper()
+	var last []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		last, _ = ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+	es, err := NewElasticsearchWithOptions(ElasticsearchOptions{Addresses: []string{srv.URL}, Auth: ElasticsearchAuthNone})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return es, &last
+}
+
+func TestSearchRequestMarshalJSON(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		req  *SearchRequest
+		want string
+	}{
+		{"empty", &SearchRequest{}, `{}`},
+		{"match all", &SearchRequest{Query: MatchAllQuery{}, Size: 5}, `{"query":{"match_all":{}},"size":5}`},
+		{
+			"term and range",
+			&SearchRequest{Query: BoolQuery{
+				Filter:  []Query{TermQuery{Field: "status", Value: "Started"}, RangeQuery{Field: "timestamp", Gte: 10, Lt: 20, Format: "epoch_second"}},
+				MustNot: []Query{TermsQuery{Field: "currency"}},
+			}},
+			`{"query":{"bool":{"filter":[{"term":{"status":{"value":"Started"}}},{"range":{"timestamp":{"format":"epoch_second","gte":10,"lt":20}}}],"must_not":[{"terms":{"currency":[]}}]}}}`,
+		},
+		{
+			"match should",
+			&SearchRequest{Query: BoolQuery{Should: []Query{MatchQuery{Field: "customer_name", Text: "ada lovelace", Operator: "and"}}, MinimumShouldMatch: 1}},
+			`{"query":{"bool":{"minimum_should_match":1,"should":[{"match":{"customer_name":{"operator":"and","query":"ada lovelace"}}}]}}}`,
+		},
+		{
+			"sorted page",
+			&SearchRequest{Sort: []SortField{{Field: "timestamp", Order: SortDesc}, {Field: "uuid"}}, SearchAfter: Cursor{20, "order-2"}, TrackTotalHits: true},
+			`{"search_after":[20,"order-2"],"sort":[{"timestamp":{"order":"desc"}},{"uuid":{"order":"asc"}}],"track_total_hits":true}`,
+		},
+	} {
+		b, err := json.Marshal(tc.req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.name, b, tc.want)
+		}
+	}
+}
+
+func TestCursorRoundTrip(t *testing.T) {
+	if s := Cursor(nil).String(); s != "" {
+		t.Errorf("got %q for an empty cursor", s)
+	}
+	if c, err := ParseCursor(""); c != nil || err != nil {
+		t.Errorf("got %v, %v, want no cursor", c, err)
+	}
+	// 2^63-1 doesn't fit float64, the cursor must keep its digits
+	c, err := decodeCursor([]byte(`[9223372036854775807,"order-1"]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseCursor(c.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed, Cursor{json.Number("9223372036854775807"), "order-1"}) {
+		t.Errorf("got %#v after a round trip", parsed)
+	}
+	for _, s := range []string{"not base64!", "bm90IGpzb24"} {
+		if _, err := ParseCursor(s); !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("ParseCursor(%q) = %v, want %v", s, err, ErrInvalidCursor)
+		}
+	}
+}
+
+func TestQueryDecodesHits(t *testing.T) {
+	es, body := newSearchServer(t, http.StatusOK, `{"hits":{"total":{"value":12,"relation":"eq"},"hits":[
+		{"_id":"order-1","_source":{"uuid":"order-1","quantity":2,"status":"Started","indexed_only":true},"sort":[10,"order-1"]},
+		{"_id":"order-2","_source":{"uuid":"order-2","currency":"EUR"},"sort":[20,"order-2"]}]}}`)
+	req := &SearchRequest{Query: MatchAllQuery{}, Sort: []SortField{{Field: "timestamp"}, {Field: "uuid"}}, Size: 2}
+	result, err := es.Query(context.Background(), "orders", req, &pb.Order{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(*body) != `{"query":{"match_all":{}},"size":2,"sort":[{"timestamp":{"order":"asc"}},{"uuid":{"order":"asc"}}]}` {
+		t.Errorf("sent %s", *body)
+	}
+	if result.Total != 12 || result.TotalRelation != "eq" || len(result.Hits) != 2 {
+		t.Fatalf("got %+v, want 2 of 12 hits", result)
+	}
+	first, second := result.Hits[0].(*pb.Order), result.Hits[1].(*pb.Order)
+	if first.Uuid != "order-1" || first.Quantity != 2 || first.Status != pb.Status_Started || second.Currency != "EUR" {
+		t.Errorf("got hits %v and %v", first, second)
+	}
+	if !reflect.DeepEqual(result.Next, Cursor{json.Number("20"), "order-2"}) {
+		t.Errorf("got next cursor %#v, want the sort values of order-2", result.Next)
+	}
+
+	// a short page is the last one
+	req.Size = 3
+	if result, err := es.Query(context.Background(), "orders", req, &pb.Order{}); err != nil || result.Next != nil {
+		t.Errorf("got %v, %v, want no next cursor", result, err)
+	}
+	req.Sort = nil
+	req.SearchAfter = result.Next
+	if _, err := es.Query(context.Background(), "orders", req, &pb.Order{}); err != ErrSearchAfterWithoutSort {
+		t.Errorf("got %v, want %v", err, ErrSearchAfterWithoutSort)
+	}
+}
+
+func TestQueryErrors(t *testing.T) {
+	es, _ := newSearchServer(t, http.StatusNotFound, `{"error":{"type":"index_not_found_exception"},"status":404}`)
+	if _, err := es.Query(context.Background(), "orderz", &SearchRequest{}, &pb.Order{}); !errors.Is(err, ErrIndexNotFound) {
+		t.Errorf("got %v, want %v", err, ErrIndexNotFound)
+	}
+	es, _ = newSearchServer(t, http.StatusBadRequest, `{"error":{"type":"parsing_exception"},"status":400}`)
+	if _, err := es.Query(context.Background(), "orders", &SearchRequest{}, &pb.Order{}); err == nil {
+		t.Error("query failing with 400 succeeded")
+	}
+	es, _ = newSearchServer(t, http.StatusOK, `{"hits":{"hits":[{"_id":"order-1","_source":{"quantity":"many"}}]}}`)
+	if _, err := es.Query(context.Background(), "orders", &SearchRequest{}, &pb.Order{}); err == nil {
+		t.Error("hit which isn't an order was decoded")
+	}
+}
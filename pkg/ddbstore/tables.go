@@ -0,0 +1,46 @@
+package ddbstore
+
+import (
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// TableOptions configure optional per table behavior of ddbstore functions
+type TableOptions struct {
+	// Encryption of sensitive attributes, nil stores all attributes in plaintext
+	Encryption *Encryption
+	// Sensitive attributes are never indexed, dead lettered or exported, whether or not they are encrypted
+	Sensitive []string
+	// Offload of attributes too large for dynamodb to blob store, nil keeps everything in dynamodb
+	Offload *Offload
+	// Format of stored items, FormatJSON by default
+	Format Format
+	// Message is the type of items, items in FormatBinary are decoded to it to be indexed
+	Message proto.Message
+	// Projected lists attributes kept at top level next to the key in FormatBinary,
+	// typically keys of secondary indexes and attributes used in filters
+	Projected []string
+	// EmitDefaults stores zero valued fields e.g. enum 0 or empty string so filters can match them.
+	// Updates only store a zero value when the attribute is missing or the field is listed in UpdateOptions.Fields.
+	EmitDefaults bool
+}
+
+var (
+	tableOptionsMu sync.RWMutex
+	tableOptions   = map[string]TableOptions{}
+)
+
+// ConfigureTable set options used by all ddbstore functions working with given table
+func ConfigureTable(tableName string, opts TableOptions) {
+	tableOptionsMu.Lock()
+	defer tableOptionsMu.Unlock()
+	tableOptions[tableName] = opts
+}
+
+// optionsFor return options of given table, zero options when it was not configured
+func optionsFor(tableName string) TableOptions {
+	tableOptionsMu.RLock()
+	defer tableOptionsMu.RUnlock()
+	return tableOptions[tableName]
+}
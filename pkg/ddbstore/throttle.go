@@ -0,0 +1,501 @@
+package ddbstore
+
+import (
+	"expvar"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+const (
+	// minThrottleRate is the lowest rate in capacity units per second a throttled table is limited to
+	minThrottleRate = 1
+	// throttleRecovery is how long a halved rate takes to grow back to the table capacity
+	throttleRecovery = 10 * time.Second
+	// minRetryAfter is the hint given to clients when dynamodb throttled the request itself
+	minRetryAfter = 100 * time.Millisecond
+	// describeRetryInterval is how long a table which couldn't be described stays unlimited
+	// before it is described again
+	describeRetryInterval = time.Minute
+)
+
+// ThrottleMode decide what happens to requests exceeding the table capacity
+type ThrottleMode int
+
+const (
+	// ThrottleQueue delays requests until the table has capacity for them
+	ThrottleQueue ThrottleMode = iota
+	// ThrottleFailFast rejects requests exceeding the capacity with *ThrottledError
+	ThrottleFailFast
+)
+
+// ThrottledError is returned when a request was rejected for lack of table capacity,
+// either by the client side limiter or by dynamodb itself
+type ThrottledError struct {
+	TableName string
+	// RetryAfter is the estimated time until the table has capacity for the request
+	RetryAfter time.Duration
+}
+
+func (e *ThrottledError) Error() string {
+	return fmt.Sprintf("dynamodb table %s is over capacity, retry after %v", e.TableName, e.RetryAfter)
+}
+
+// ThrottleOptions configure NewThrottled
+type ThrottleOptions struct {
+	Mode ThrottleMode
+	// MaxWait bounds queueing, requests which would wait longer fail with *ThrottledError. 0 waits without limit.
+	MaxWait time.Duration
+	// Burst is the number of seconds of unused capacity a table may accumulate, 1 when 0
+	Burst float64
+	// OnDemandCapacity limits tables billed per request to given capacity units per second,
+	// 0 leaves them unlimited until dynamodb throttles them
+	OnDemandCapacity float64
+}
+
+// bucket is an adaptive token bucket of read or write capacity units of a table. Its rate starts
+// at the provisioned capacity, is halved whenever dynamodb throttles and grows back while requests succeed.
+type bucket struct {
+	mu  sync.Mutex
+	now func() time.Time
+	// rate is the current limit in capacity units per second, 0 is unlimited
+	rate float64
+	// max is the capacity the rate grows back to, 0 when unknown
+	max    float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	// observed is the consumption in capacity units per second measured over the last window
+	observed    float64
+	windowStart time.Time
+	windowUnits float64
+}
+
+func newBucket(capacity, burst float64, clock func() time.Time) *bucket {
+	now := clock()
+	return &bucket{now: clock, rate: capacity, max: capacity, burst: burst, tokens: capacity * burst, last: now, windowStart: now}
+}
+
+// refill add tokens accumulated since the last call and grow the rate back, b.mu must be held
+func (b *bucket) refill(now time.Time) {
+	elapsed := now.Sub(b.last).Seconds()
+	b.last = now
+	if b.rate == 0 || elapsed <= 0 {
+		return
+	}
+	if b.rate < b.max {
+		b.rate = math.Min(b.max, b.rate+b.max*elapsed/throttleRecovery.Seconds())
+	}
+	b.tokens = math.Min(b.rate*b.burst, b.tokens+b.rate*elapsed)
+}
+
+// reserve take n units returning how long the caller must wait before using them. In fail fast
+// mode, or when the wait would exceed maxWait, nothing is taken and ok is false.
+func (b *bucket) reserve(n float64, mode ThrottleMode, maxWait time.Duration) (wait time.Duration, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(b.now())
+	if b.rate == 0 {
+		return 0, true
+	}
+	// requests larger than the whole bucket pass once it is full and leave it in debt
+	need := math.Min(n, b.rate*b.burst)
+	if b.tokens < need {
+		wait = time.Duration((need - b.tokens) / b.rate * float64(time.Second))
+		if mode == ThrottleFailFast || (maxWait > 0 && wait > maxWait) {
+			return wait, false
+		}
+	}
+	b.tokens -= n
+	return wait, true
+}
+
+// settle correct reserved units by units actually consumed by the request
+func (b *bucket) settle(reserved, consumed float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens += reserved - consumed
+	b.windowUnits += consumed
+	if now := b.now(); now.Sub(b.windowStart) >= time.Second {
+		b.observed = b.windowUnits / now.Sub(b.windowStart).Seconds()
+		b.windowStart, b.windowUnits = now, 0
+	}
+}
+
+// throttled halve the rate after dynamodb rejected a request, an unlimited bucket starts
+// limiting at half of the observed consumption. It returns the wait before retrying.
+func (b *bucket) throttled() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(b.now())
+	if b.rate == 0 {
+		b.max = math.Max(b.observed, minThrottleRate)
+		b.rate = b.max
+	}
+	b.rate = math.Max(b.rate/2, minThrottleRate)
+	b.tokens = math.Min(b.tokens, 0)
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// limit return current rate, 0 is unlimited
+func (b *bucket) limit() float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.rate
+}
+
+type tableLimiter struct {
+	read, write *bucket
+	// expires is when a table which couldn't be described is described again, zero once described
+	expires time.Time
+}
+
+// Throttled is a dynamodb client limiting requests of every table to its capacity so bursts
+// are smoothed or rejected with *ThrottledError before dynamodb throttles them. It requests
+// ConsumedCapacity of every call to account for the actual cost of reads and writes.
+type Throttled struct {
+	dynamodbiface.DynamoDBAPI
+
+	opts   ThrottleOptions
+	mu     sync.Mutex
+	tables map[string]*tableLimiter
+
+	vars                        *expvar.Map
+	queued, rejected, throttled expvar.Int
+
+	// now and sleep are replaced by a fake clock in tests
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+// NewThrottled return client limiting requests made through given one
+func NewThrottled(client dynamodbiface.DynamoDBAPI, opts ThrottleOptions) *Throttled {
+	if opts.Burst <= 0 {
+		opts.Burst = 1
+	}
+	t := &Throttled{
+		DynamoDBAPI: client,
+		opts:        opts,
+		tables:      map[string]*tableLimiter{},
+		vars:        new(expvar.Map).Init(),
+		now:         time.Now,
+		sleep:       time.Sleep,
+	}
+	t.vars.Set("queued", &t.queued)
+	t.vars.Set("rejected", &t.rejected)
+	t.vars.Set("throttled", &t.throttled)
+	t.vars.Set("limits", expvar.Func(t.limits))
+	return t
+}
+
+// Vars return counters of queued and rejected requests and current limits for expvar
+func (t *Throttled) Vars() *expvar.Map {
+	return t.vars
+}
+
+func (t *Throttled) limits() interface{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	limits := map[string]map[string]float64{}
+	for name, l := range t.tables {
+		limits[name] = map[string]float64{"read": l.read.limit(), "write": l.write.limit()}
+	}
+	return limits
+}
+
+// limiter return limiter of the table sized by its provisioned capacity. A table which couldn't
+// be described is left unlimited until dynamodb throttles it and described again later.
+func (t *Throttled) limiter(tableName string) *tableLimiter {
+	t.mu.Lock()
+	l, ok := t.tables[tableName]
+	fresh := ok && (l.expires.IsZero() || t.now().Before(l.expires))
+	t.mu.Unlock()
+	if fresh {
+		return l
+	}
+	read, write := t.opts.OnDemandCapacity, t.opts.OnDemandCapacity
+	desc, err := DescribeTable(tableName, t.DynamoDBAPI)
+	if err != nil {
+		fmt.Printf("throttle: describe table %s: %v\n", tableName, err)
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		// the fallback keeps the rate it learned while dynamodb throttled it
+		if l, ok := t.tables[tableName]; ok {
+			l.expires = t.now().Add(describeRetryInterval)
+			return l
+		}
+		l = &tableLimiter{
+			read:    newBucket(0, t.opts.Burst, t.now),
+			write:   newBucket(0, t.opts.Burst, t.now),
+			expires: t.now().Add(describeRetryInterval),
+		}
+		t.tables[tableName] = l
+		return l
+	}
+	billing := desc.BillingModeSummary
+	if (billing == nil || aws.StringValue(billing.BillingMode) != dynamodb.BillingModePayPerRequest) && desc.ProvisionedThroughput != nil {
+		read = float64(aws.Int64Value(desc.ProvisionedThroughput.ReadCapacityUnits))
+		write = float64(aws.Int64Value(desc.ProvisionedThroughput.WriteCapacityUnits))
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if l, ok := t.tables[tableName]; ok && l.expires.IsZero() {
+		return l
+	}
+	l = &tableLimiter{read: newBucket(read, t.opts.Burst, t.now), write: newBucket(write, t.opts.Burst, t.now)}
+	t.tables[tableName] = l
+	return l
+}
+
+// cost is the estimated capacity units of a request per table
+type cost map[string]float64
+
+// consumedByTable sum consumed capacity units per table
+func consumedByTable(consumed ...*dynamodb.ConsumedCapacity) cost {
+	c := cost{}
+	for _, cc := range consumed {
+		if cc != nil {
+			c[aws.StringValue(cc.TableName)] += aws.Float64Value(cc.CapacityUnits)
+		}
+	}
+	return c
+}
+
+// do run request after reserving estimated capacity of its tables, then settle the reservation
+// with capacity the request consumed
+func (t *Throttled) do(write bool, estimate cost, call func() ([]*dynamodb.ConsumedCapacity, error)) error {
+	buckets := make(map[string]*bucket, len(estimate))
+	for tableName := range estimate {
+		l := t.limiter(tableName)
+		buckets[tableName] = l.read
+		if write {
+			buckets[tableName] = l.write
+		}
+	}
+	var (
+		maxWait  time.Duration
+		reserved []string
+	)
+	for tableName, b := range buckets {
+		wait, ok := b.reserve(estimate[tableName], t.opts.Mode, t.opts.MaxWait)
+		if !ok {
+			// give back units already reserved in other tables of the request
+			for _, name := range reserved {
+				buckets[name].settle(estimate[name], 0)
+			}
+			t.rejected.Add(1)
+			return &ThrottledError{TableName: tableName, RetryAfter: wait}
+		}
+		reserved = append(reserved, tableName)
+		if wait > maxWait {
+			maxWait = wait
+		}
+	}
+	if maxWait > 0 {
+		t.queued.Add(1)
+		t.sleep(maxWait)
+	}
+	consumed, err := call()
+	if err != nil && isThrottle(err) {
+		t.throttled.Add(1)
+		throttled := &ThrottledError{RetryAfter: minRetryAfter}
+		for tableName, b := range buckets {
+			if wait := b.throttled(); wait > throttled.RetryAfter || throttled.TableName == "" {
+				throttled.TableName, throttled.RetryAfter = tableName, wait
+			}
+		}
+		if throttled.RetryAfter < minRetryAfter {
+			throttled.RetryAfter = minRetryAfter
+		}
+		return throttled
+	}
+	actual := consumedByTable(consumed...)
+	for tableName, b := range buckets {
+		units, ok := actual[tableName]
+		if !ok {
+			units = estimate[tableName]
+		}
+		b.settle(estimate[tableName], units)
+	}
+	return err
+}
+
+// totalCapacity request consumed capacity unless the caller already asked for more detail
+func totalCapacity(current *string) *string {
+	if aws.StringValue(current) == dynamodb.ReturnConsumedCapacityIndexes {
+		return current
+	}
+	return aws.String(dynamodb.ReturnConsumedCapacityTotal)
+}
+
+// GetItem implements dynamodbiface.DynamoDBAPI
+func (t *Throttled) GetItem(input *dynamodb.GetItemInput) (output *dynamodb.GetItemOutput, err error) {
+	in := *input
+	in.ReturnConsumedCapacity = totalCapacity(in.ReturnConsumedCapacity)
+	err = t.do(false, cost{aws.StringValue(in.TableName): 1}, func() ([]*dynamodb.ConsumedCapacity, error) {
+		var err error
+		if output, err = t.DynamoDBAPI.GetItem(&in); err != nil {
+			return nil, err
+		}
+		return []*dynamodb.ConsumedCapacity{output.ConsumedCapacity}, nil
+	})
+	return output, err
+}
+
+// PutItem implements dynamodbiface.DynamoDBAPI
+func (t *Throttled) PutItem(input *dynamodb.PutItemInput) (output *dynamodb.PutItemOutput, err error) {
+	in := *input
+	in.ReturnConsumedCapacity = totalCapacity(in.ReturnConsumedCapacity)
+	err = t.do(true, cost{aws.StringValue(in.TableName): 1}, func() ([]*dynamodb.ConsumedCapacity, error) {
+		var err error
+		if output, err = t.DynamoDBAPI.PutItem(&in); err != nil {
+			return nil, err
+		}
+		return []*dynamodb.ConsumedCapacity{output.ConsumedCapacity}, nil
+	})
+	return output, err
+}
+
+// UpdateItem implements dynamodbiface.DynamoDBAPI
+func (t *Throttled) UpdateItem(input *dynamodb.UpdateItemInput) (output *dynamodb.UpdateItemOutput, err error) {
+	in := *input
+	in.ReturnConsumedCapacity = totalCapacity(in.ReturnConsumedCapacity)
+	err = t.do(true, cost{aws.StringValue(in.TableName): 1}, func() ([]*dynamodb.ConsumedCapacity, error) {
+		var err error
+		if output, err = t.DynamoDBAPI.UpdateItem(&in); err != nil {
+			return nil, err
+		}
+		return []*dynamodb.ConsumedCapacity{output.ConsumedCapacity}, nil
+	})
+	return output, err
+}
+
+// DeleteItem implements dynamodbiface.DynamoDBAPI
+func (t *Throttled) DeleteItem(input *dynamodb.DeleteItemInput) (output *dynamodb.DeleteItemOutput, err error) {
+	in := *input
+	in.ReturnConsumedCapacity = totalCapacity(in.ReturnConsumedCapacity)
+	err = t.do(true, cost{aws.StringValue(in.TableName): 1}, func() ([]*dynamodb.ConsumedCapacity, error) {
+		var err error
+		if output, err = t.DynamoDBAPI.DeleteItem(&in); err != nil {
+			return nil, err
+		}
+		return []*dynamodb.ConsumedCapacity{output.ConsumedCapacity}, nil
+	})
+	return output, err
+}
+
+// Query implements dynamodbiface.DynamoDBAPI, the cost of a page is known only after it was read
+func (t *Throttled) Query(input *dynamodb.QueryInput) (output *dynamodb.QueryOutput, err error) {
+	in := *input
+	in.ReturnConsumedCapacity = totalCapacity(in.ReturnConsumedCapacity)
+	err = t.do(false, cost{aws.StringValue(in.TableName): 1}, func() ([]*dynamodb.ConsumedCapacity, error) {
+		var err error
+		if output, err = t.DynamoDBAPI.Query(&in); err != nil {
+			return nil, err
+		}
+		return []*dynamodb.ConsumedCapacity{output.ConsumedCapacity}, nil
+	})
+	return output, err
+}
+
+// Scan implements dynamodbiface.DynamoDBAPI, the cost of a page is known only after it was read
+func (t *Throttled) Scan(input *dynamodb.ScanInput) (output *dynamodb.ScanOutput, err error) {
+	in := *input
+	in.ReturnConsumedCapacity = totalCapacity(in.ReturnConsumedCapacity)
+	err = t.do(false, cost{aws.StringValue(in.TableName): 1}, func() ([]*dynamodb.ConsumedCapacity, error) {
+		var err error
+		if output, err = t.DynamoDBAPI.Scan(&in); err != nil {
+			return nil, err
+		}
+		return []*dynamodb.ConsumedCapacity{output.ConsumedCapacity}, nil
+	})
+	return output, err
+}
+
+// BatchGetItem implements dynamodbiface.DynamoDBAPI
+func (t *Throttled) BatchGetItem(input *dynamodb.BatchGetItemInput) (output *dynamodb.BatchGetItemOutput, err error) {
+	in := *input
+	in.ReturnConsumedCapacity = totalCapacity(in.ReturnConsumedCapacity)
+	estimate := cost{}
+	for tableName, keys := range in.RequestItems {
+		estimate[tableName] = float64(len(keys.Keys))
+	}
+	err = t.do(false, estimate, func() ([]*dynamodb.ConsumedCapacity, error) {
+		var err error
+		if output, err = t.DynamoDBAPI.BatchGetItem(&in); err != nil {
+			return nil, err
+		}
+		return output.ConsumedCapacity, nil
+	})
+	return output, err
+}
+
+// BatchWriteItem implements dynamodbiface.DynamoDBAPI
+func (t *Throttled) BatchWriteItem(input *dynamodb.BatchWriteItemInput) (output *dynamodb.BatchWriteItemOutput, err error) {
+	in := *input
+	in.ReturnConsumedCapacity = totalCapacity(in.ReturnConsumedCapacity)
+	estimate := cost{}
+	for tableName, reqs := range in.RequestItems {
+		estimate[tableName] = float64(len(reqs))
+	}
+	err = t.do(true, estimate, func() ([]*dynamodb.ConsumedCapacity, error) {
+		var err error
+		if output, err = t.DynamoDBAPI.BatchWriteItem(&in); err != nil {
+			return nil, err
+		}
+		return output.ConsumedCapacity, nil
+	})
+	return output, err
+}
+
+// TransactWriteItems implements dynamodbiface.DynamoDBAPI, transactional writes cost twice as much
+func (t *Throttled) TransactWriteItems(input *dynamodb.TransactWriteItemsInput) (output *dynamodb.TransactWriteItemsOutput, err error) {
+	in := *input
+	in.ReturnConsumedCapacity = totalCapacity(in.ReturnConsumedCapacity)
+	estimate := cost{}
+	for _, item := range in.TransactItems {
+		switch {
+		case item.ConditionCheck != nil:
+			estimate[aws.StringValue(item.ConditionCheck.TableName)] += 2
+		case item.Put != nil:
+			estimate[aws.StringValue(item.Put.TableName)] += 2
+		case item.Update != nil:
+			estimate[aws.StringValue(item.Update.TableName)] += 2
+		case item.Delete != nil:
+			estimate[aws.StringValue(item.Delete.TableName)] += 2
+		}
+	}
+	err = t.do(true, estimate, func() ([]*dynamodb.ConsumedCapacity, error) {
+		var err error
+		if output, err = t.DynamoDBAPI.TransactWriteItems(&in); err != nil {
+			return nil, err
+		}
+		return output.ConsumedCapacity, nil
+	})
+	return output, err
+}
+
+// TransactGetItems implements dynamodbiface.DynamoDBAPI, transactional reads cost twice as much
+func (t *Throttled) TransactGetItems(input *dynamodb.TransactGetItemsInput) (output *dynamodb.TransactGetItemsOutput, err error) {
+	in := *input
+	in.ReturnConsumedCapacity = totalCapacity(in.ReturnConsumedCapacity)
+	estimate := cost{}
+	for _, item := range in.TransactItems {
+		if item.Get != nil {
+			estimate[aws.StringValue(item.Get.TableName)] += 2
+		}
+	}
+	err = t.do(false, estimate, func() ([]*dynamodb.ConsumedCapacity, error) {
+		var err error
+		if output, err = t.DynamoDBAPI.TransactGetItems(&in); err != nil {
+			return nil, err
+		}
+		return output.ConsumedCapacity, nil
+	})
+	return output, err
+}
@@ -0,0 +1,249 @@
+package ddbstore
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// fakeClock is a clock which only moves when the throttled client sleeps or the test advances it
+type fakeClock struct {
+	mu    sync.Mutex
+	t     time.Time
+	slept time.Duration
+}
+
+func (c *fakeClock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) sleep(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+	c.slept += d
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+}
+
+// capacityDB is a dynamodb table with provisioned capacity, reads consume given units
+// and writes are throttled on demand
+type capacityDB struct {
+	dynamodbiface.DynamoDBAPI
+	read, write int64
+	onDemand    bool
+	describeErr error
+	describes   int
+	consumed    float64
+	throttle    bool
+}
+
+func (db *capacityDB) DescribeTable(input *dynamodb.DescribeTableInput) (*dynamodb.DescribeTableOutput, error) {
+	db.describes++
+	if db.describeErr != nil {
+		return nil, db.describeErr
+	}
+	table := &dynamodb.TableDescription{
+		TableName:             input.TableName,
+		ProvisionedThroughput: &dynamodb.ProvisionedThroughputDescription{ReadCapacityUnits: aws.Int64(db.read), WriteCapacityUnits: aws.Int64(db.write)},
+	}
+	if db.onDemand {
+		table.BillingModeSummary = &dynamodb.BillingModeSummary{BillingMode: aws.String(dynamodb.BillingModePayPerRequest)}
+	}
+	return &dynamodb.DescribeTableOutput{Table: table}, nil
+}
+
+func (db *capacityDB) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	return &dynamodb.GetItemOutput{ConsumedCapacity: &dynamodb.ConsumedCapacity{TableName: input.TableName, CapacityUnits: aws.Float64(db.consumed)}}, nil
+}
+
+func (db *capacityDB) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	if db.throttle {
+		return nil, awserr.New(dynamodb.ErrCodeProvisionedThroughputExceededException, "throttled", nil)
+	}
+	return &dynamodb.PutItemOutput{ConsumedCapacity: &dynamodb.ConsumedCapacity{TableName: input.TableName, CapacityUnits: aws.Float64(1)}}, nil
+}
+
+func newTestThrottled(db *capacityDB, opts ThrottleOptions) (*Throttled, *fakeClock) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	t := NewThrottled(db, opts)
+	t.now, t.sleep = clock.now, clock.sleep
+	return t, clock
+}
+
+func put(t *Throttled) error {
+	_, err := t.PutItem(&dynamodb.PutItemInput{TableName: aws.String("orders")})
+	return err
+}
+
+func TestThrottleQueuesRequestsOverCapacity(t *testing.T) {
+	throttled, clock := newTestThrottled(&capacityDB{read: 10, write: 5}, ThrottleOptions{})
+	for i := 0; i < 5; i++ {
+		if err := put(throttled); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if clock.slept != 0 {
+		t.Errorf("slept %v within capacity", clock.slept)
+	}
+	if err := put(throttled); err != nil {
+		t.Fatal(err)
+	}
+	if clock.slept != 200*time.Millisecond {
+		t.Errorf("slept %v, want a unit of 5 per second", clock.slept)
+	}
+	if throttled.queued.Value() != 1 {
+		t.Errorf("queued %d requests, want 1", throttled.queued.Value())
+	}
+}
+
+func TestThrottleFailFast(t *testing.T) {
+	for name, opts := range map[string]ThrottleOptions{
+		"fail fast":     {Mode: ThrottleFailFast},
+		"over max wait": {MaxWait: 100 * time.Millisecond},
+	} {
+		throttled, clock := newTestThrottled(&capacityDB{read: 10, write: 5}, opts)
+		for i := 0; i < 5; i++ {
+			if err := put(throttled); err != nil {
+				t.Fatal(err)
+			}
+		}
+		err := put(throttled)
+		var throttledErr *ThrottledError
+		if !errors.As(err, &throttledErr) || throttledErr.TableName != "orders" || throttledErr.RetryAfter != 200*time.Millisecond {
+			t.Errorf("%s: got %v, want orders throttled for 200ms", name, err)
+		}
+		if clock.slept != 0 || throttled.rejected.Value() != 1 {
+			t.Errorf("%s: slept %v and rejected %d requests, want a request rejected at once", name, clock.slept, throttled.rejected.Value())
+		}
+		// the rejected request took no capacity
+		clock.advance(200 * time.Millisecond)
+		if err := put(throttled); err != nil {
+			t.Errorf("%s: %v once capacity was back", name, err)
+		}
+	}
+}
+
+func TestThrottleSettlesConsumedCapacity(t *testing.T) {
+	db := &capacityDB{read: 10, write: 5, consumed: 4}
+	throttled, clock := newTestThrottled(db, ThrottleOptions{})
+	// every read is estimated at a unit but consumes 4, leaving the bucket in debt
+	for i := 0; i < 3; i++ {
+		if _, err := throttled.GetItem(&dynamodb.GetItemInput{TableName: aws.String("orders")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := throttled.GetItem(&dynamodb.GetItemInput{TableName: aws.String("orders")}); err != nil {
+		t.Fatal(err)
+	}
+	if clock.slept != 300*time.Millisecond {
+		t.Errorf("slept %v, want the debt of 2 units and a unit at 10 per second", clock.slept)
+	}
+}
+
+func TestThrottleHalvesRateWhenDynamoDBThrottles(t *testing.T) {
+	db := &capacityDB{read: 10, write: 8}
+	throttled, clock := newTestThrottled(db, ThrottleOptions{})
+	db.throttle = true
+	err := put(throttled)
+	var throttledErr *ThrottledError
+	if !errors.As(err, &throttledErr) {
+		t.Fatalf("got %v, want *ThrottledError", err)
+	}
+	// the bucket is emptied, the retry waits for a unit at the halved rate
+	if throttledErr.RetryAfter != 250*time.Millisecond {
+		t.Errorf("retry after %v, want a unit at 4 per second", throttledErr.RetryAfter)
+	}
+	if throttled.throttled.Value() != 1 {
+		t.Errorf("counted %d throttled requests, want 1", throttled.throttled.Value())
+	}
+	limiter := throttled.limiter("orders")
+	if rate := limiter.write.limit(); rate != 4 {
+		t.Errorf("write rate %v, want half of 8", rate)
+	}
+	// the next request waits for the unit and is throttled again, halving the rate once more
+	err = put(throttled)
+	rate := limiter.write.limit()
+	if rate >= 4 || rate < 2 {
+		t.Errorf("write rate %v after a second throttle, want about 2", rate)
+	}
+	if !errors.As(err, &throttledErr) || throttledErr.RetryAfter != time.Duration(float64(time.Second)/rate) {
+		t.Errorf("got %v, want a retry after a unit at %v per second", err, rate)
+	}
+	db.throttle = false
+	clock.advance(throttleRecovery)
+	if err := put(throttled); err != nil {
+		t.Fatal(err)
+	}
+	if rate := limiter.write.limit(); rate != 8 {
+		t.Errorf("write rate %v after recovery, want the capacity of 8", rate)
+	}
+	if rate := limiter.read.limit(); rate != 10 {
+		t.Errorf("read rate %v, want reads left at their capacity", rate)
+	}
+}
+
+func TestThrottleLimitsOnDemandTableOnceThrottled(t *testing.T) {
+	db := &capacityDB{onDemand: true}
+	throttled, clock := newTestThrottled(db, ThrottleOptions{})
+	for i := 0; i < 40; i++ {
+		if err := put(throttled); err != nil {
+			t.Fatal(err)
+		}
+	}
+	clock.advance(time.Second)
+	if err := put(throttled); err != nil {
+		t.Fatal(err)
+	}
+	if clock.slept != 0 {
+		t.Errorf("slept %v, want on demand tables unlimited", clock.slept)
+	}
+	db.throttle = true
+	if err := put(throttled); err == nil {
+		t.Fatal("throttled put succeeded")
+	}
+	if rate := throttled.limiter("orders").write.limit(); rate != 20.5 {
+		t.Errorf("write rate %v, want half of the 41 units consumed in the last second", rate)
+	}
+}
+
+func TestThrottleDescribesFailedTableAgainLater(t *testing.T) {
+	db := &capacityDB{read: 10, write: 1, describeErr: errors.New("access denied")}
+	throttled, clock := newTestThrottled(db, ThrottleOptions{})
+	for i := 0; i < 3; i++ {
+		if err := put(throttled); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if db.describes != 1 {
+		t.Errorf("described the table %d times, want the failure cached", db.describes)
+	}
+	if clock.slept != 0 {
+		t.Errorf("slept %v, want the table unlimited while it can't be described", clock.slept)
+	}
+	db.describeErr = nil
+	clock.advance(describeRetryInterval)
+	for i := 0; i < 2; i++ {
+		if err := put(throttled); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if db.describes != 2 {
+		t.Errorf("described the table %d times, want once more after %v", db.describes, describeRetryInterval)
+	}
+	if clock.slept != time.Second {
+		t.Errorf("slept %v, want the second write waiting for the capacity of 1", clock.slept)
+	}
+}
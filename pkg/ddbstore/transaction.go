@@ -0,0 +1,387 @@
+package ddbstore
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/dynamodb/expression"
+	"github.com/golang/protobuf/proto"
+)
+
+// maxTransactItems is the dynamodb limit of items in a single transaction
+const maxTransactItems = 25
+
+var (
+	ErrTooManyTransactItems = errors.New("transaction has more than 25 items")
+	ErrEmptyTransaction     = errors.New("transaction has no items")
+	ErrEmptyUpdate          = errors.New("transaction update has no fields to write")
+	// ErrTransactionInProgress is returned when a transaction with the same idempotency token is still running
+	ErrTransactionInProgress = errors.New("transaction with the same token is in progress")
+	// ErrIdempotencyMismatch is returned when an idempotency token is reused for a different transaction
+	ErrIdempotencyMismatch = errors.New("transaction token was used with different items")
+)
+
+// CancellationReason of a single item of a canceled transaction
+type CancellationReason string
+
+const (
+	ReasonNone                   CancellationReason = "None"
+	ReasonConditionalCheckFailed CancellationReason = "ConditionalCheckFailed"
+	ReasonTransactionConflict    CancellationReason = "TransactionConflict"
+	ReasonThroughputExceeded     CancellationReason = "ProvisionedThroughputExceeded"
+	ReasonThrottlingError        CancellationReason = "ThrottlingError"
+	ReasonItemCollectionTooLarge CancellationReason = "ItemCollectionSizeLimitExceeded"
+	ReasonValidationError        CancellationReason = "ValidationError"
+)
+
+// TransactionCanceledError is returned when dynamodb canceled the transaction,
+// Reasons follow the order in which items were added to the transaction
+type TransactionCanceledError struct {
+	Reasons []CancellationReason
+	err     awserr.Error
+}
+
+func (e *TransactionCanceledError) Error() string {
+	return e.err.Error()
+}
+
+// Unwrap return the original aws error
+func (e *TransactionCanceledError) Unwrap() error {
+	return e.err
+}
+
+// ConditionFailed report whether some item condition failed, retrying the same transaction
+// fails again until the stored items change
+func (e *TransactionCanceledError) ConditionFailed() bool {
+	return len(e.Failed(ReasonConditionalCheckFailed)) > 0
+}
+
+// Conflict report whether the transaction was canceled by a concurrent transaction or throttling
+// only, so it may succeed when retried
+func (e *TransactionCanceledError) Conflict() bool {
+	conflict := false
+	for _, reason := range e.Reasons {
+		switch reason {
+		case ReasonNone:
+		case ReasonTransactionConflict, ReasonThroughputExceeded, ReasonThrottlingError:
+			conflict = true
+		default:
+			return false
+		}
+	}
+	return conflict
+}
+
+// Failed return indexes of items canceled for given reason
+func (e *TransactionCanceledError) Failed(reason CancellationReason) []int {
+	var indexes []int
+	for i, r := range e.Reasons {
+		if r == reason {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
+}
+
+// transactionError convert errors of transact calls to typed errors. This sdk version doesn't
+// expose cancellation reasons, dynamodb lists them in the message like
+// "Transaction cancelled, please refer cancellation reasons for specific reasons [None, ConditionalCheckFailed]".
+func transactionError(err error) error {
+	aerr, ok := err.(awserr.Error)
+	if !ok {
+		return err
+	}
+	switch aerr.Code() {
+	case dynamodb.ErrCodeTransactionInProgressException:
+		return ErrTransactionInProgress
+	case dynamodb.ErrCodeIdempotentParameterMismatchException:
+		return ErrIdempotencyMismatch
+	case dynamodb.ErrCodeTransactionCanceledException:
+	default:
+		return err
+	}
+	canceled := &TransactionCanceledError{err: aerr}
+	msg := aerr.Message()
+	start, end := strings.LastIndex(msg, "["), strings.LastIndex(msg, "]")
+	if start < 0 || end < start {
+		return canceled
+	}
+	for _, reason := range strings.Split(msg[start+1:end], ",") {
+		canceled.Reasons = append(canceled.Reasons, CancellationReason(strings.TrimSpace(reason)))
+	}
+	return canceled
+}
+
+// Transaction collects writes of proto messages and condition checks committed atomically
+// with a single TransactWriteItems call, e.g.
+//
+//	err := NewTransaction().
+//	    Put(order, order.Uuid, ordersTable, nil).
+//	    Check(order.ProductUuid, productsTable, expression.AttributeExists(expression.Name("uuid"))).
+//	    Commit(ddbClient)
+//
+// Errors of building the items are returned by Commit.
+type Transaction struct {
+	items  []*dynamodb.TransactWriteItem
+	token  string
+	blobs  []string
+	tables []string
+	// written items of puts and updates, their offloaded blobs are deleted when the transaction fails
+	written []writtenItem
+	err     error
+}
+
+// writtenItem is the attributes written to an item of the table
+type writtenItem struct {
+	tableName string
+	attrs     map[string]*dynamodb.AttributeValue
+}
+
+// NewTransaction return empty transaction
+func NewTransaction() *Transaction {
+	return &Transaction{}
+}
+
+// Idempotent make retries of the same transaction with the same token within 10 minutes succeed
+// without writing the items again
+func (t *Transaction) Idempotent(token string) *Transaction {
+	t.token = token
+	return t
+}
+
+// conditionExpression build condition with optional update, nil when both are missing
+func conditionExpression(cond *expression.ConditionBuilder, update *expression.UpdateBuilder) (*expression.Expression, error) {
+	if cond == nil && update == nil {
+		return nil, nil
+	}
+	builder := expression.NewBuilder()
+	if cond != nil {
+		builder = builder.WithCondition(*cond)
+	}
+	if update != nil {
+		builder = builder.WithUpdate(*update)
+	}
+	expr, err := builder.Build()
+	if err != nil {
+		return nil, err
+	}
+	return &expr, nil
+}
+
+// add append item unless the transaction already failed or is full
+func (t *Transaction) add(item *dynamodb.TransactWriteItem, err error) *Transaction {
+	if t.err != nil {
+		return t
+	}
+	if err != nil {
+		t.err = err
+		return t
+	}
+	if len(t.items) == maxTransactItems {
+		t.err = ErrTooManyTransactItems
+		return t
+	}
+	t.items = append(t.items, item)
+	return t
+}
+
+// Put replace the item with proto message if the optional condition holds for the stored item
+func (t *Transaction) Put(in proto.Message, instanceID string, tableName string, cond *expression.ConditionBuilder) *Transaction {
+	if !verifyProto(in, instanceID) {
+		return t.add(nil, ErrKeyMismatched)
+	}
+	attrs, err := encodeItem(in, instanceID, tableName)
+	if err != nil {
+		return t.add(nil, err)
+	}
+	t.written = append(t.written, writtenItem{tableName: tableName, attrs: attrs})
+	put := &dynamodb.Put{
+		Item:      attrs,
+		TableName: aws.String(tableName),
+	}
+	expr, err := conditionExpression(cond, nil)
+	if err != nil {
+		return t.add(nil, err)
+	}
+	if expr != nil {
+		put.ConditionExpression = expr.Condition()
+		put.ExpressionAttributeNames = expr.Names()
+		put.ExpressionAttributeValues = expr.Values()
+	}
+	return t.add(&dynamodb.TransactWriteItem{Put: put}, nil)
+}
+
+// Update write fields set in proto message like UpdateProtoInDdb if the optional condition holds.
+// Items in binary format are merged by reading them first so they can't be updated in a transaction,
+// in a table back in json format items still stored in binary cancel it with ConditionalCheckFailed.
+func (t *Transaction) Update(in proto.Message, instanceID string, opts UpdateOptions, tableName string, cond *expression.ConditionBuilder) *Transaction {
+	if !verifyProto(in, instanceID) {
+		return t.add(nil, ErrKeyMismatched)
+	}
+	if optionsFor(tableName).Format == FormatBinary {
+		return t.add(nil, ErrUnsupportedInBinaryFormat)
+	}
+	attrs, err := encodeItem(in, instanceID, tableName)
+	if err != nil {
+		return t.add(nil, err)
+	}
+	t.written = append(t.written, writtenItem{tableName: tableName, attrs: attrs})
+	defaults, err := defaultAttrs(in, attrs, tableName)
+	if err != nil {
+		return t.add(nil, err)
+	}
+	update, err := updateBuilder(attrs, defaults, opts)
+	if err != nil {
+		return t.add(nil, err)
+	}
+	// dynamodb requires an update expression in transactions and the key itself can't be set
+	if update == nil {
+		return t.add(nil, ErrEmptyUpdate)
+	}
+	// reads prefer the binary attribute so updating only the json layout would be lost
+	binary := expression.AttributeNotExists(expression.Name(protoAttribute))
+	if cond != nil {
+		binary = binary.And(*cond)
+	}
+	expr, err := conditionExpression(&binary, update)
+	if err != nil {
+		return t.add(nil, err)
+	}
+	return t.add(&dynamodb.TransactWriteItem{Update: &dynamodb.Update{
+		Key:                       keyFor(instanceID),
+		TableName:                 aws.String(tableName),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	}}, nil)
+}
+
+// Delete remove the item if the optional condition holds, offloaded blobs are removed after commit
+func (t *Transaction) Delete(instanceID string, tableName string, cond *expression.ConditionBuilder) *Transaction {
+	if !verifyInstanceID(instanceID) {
+		return t.add(nil, ErrKeyMismatched)
+	}
+	del := &dynamodb.Delete{
+		Key:       keyFor(instanceID),
+		TableName: aws.String(tableName),
+	}
+	expr, err := conditionExpression(cond, nil)
+	if err != nil {
+		return t.add(nil, err)
+	}
+	if expr != nil {
+		del.ConditionExpression = expr.Condition()
+		del.ExpressionAttributeNames = expr.Names()
+		del.ExpressionAttributeValues = expr.Values()
+	}
+	t.blobs = append(t.blobs, instanceID)
+	t.tables = append(t.tables, tableName)
+	return t.add(&dynamodb.TransactWriteItem{Delete: del}, nil)
+}
+
+// Check require the condition to hold for the item without changing it
+func (t *Transaction) Check(instanceID string, tableName string, cond expression.ConditionBuilder) *Transaction {
+	if !verifyInstanceID(instanceID) {
+		return t.add(nil, ErrKeyMismatched)
+	}
+	expr, err := conditionExpression(&cond, nil)
+	if err != nil {
+		return t.add(nil, err)
+	}
+	return t.add(&dynamodb.TransactWriteItem{ConditionCheck: &dynamodb.ConditionCheck{
+		Key:                       keyFor(instanceID),
+		TableName:                 aws.String(tableName),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	}}, nil)
+}
+
+// Commit write all items atomically. A canceled transaction returns *TransactionCanceledError
+// with a reason per item in the order they were added.
+func (t *Transaction) Commit(ddbClient dynamodbiface.DynamoDBAPI) error {
+	if t.err != nil {
+		t.discard()
+		return t.err
+	}
+	if len(t.items) == 0 {
+		return ErrEmptyTransaction
+	}
+	input := &dynamodb.TransactWriteItemsInput{TransactItems: t.items}
+	if t.token != "" {
+		input.ClientRequestToken = aws.String(t.token)
+	}
+	if _, err := ddbClient.TransactWriteItems(input); err != nil {
+		err = transactionError(err)
+		if rejected(err) {
+			t.discard()
+		}
+		return err
+	}
+	for i, instanceID := range t.blobs {
+		if err := deleteBlobs(instanceID, t.tables[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// discard delete blobs offloaded for puts and updates of a transaction which didn't commit
+func (t *Transaction) discard() {
+	for _, written := range t.written {
+		discardBlobs(written.tableName, written.attrs)
+	}
+}
+
+// TransactGet identify a message read by TransactGetProtoFromDdb
+type TransactGet struct {
+	// In is the message type the item is decoded to
+	In         proto.Message
+	InstanceID string
+	TableName  string
+}
+
+// TransactGetProtoFromDdb read items of possibly different tables as a consistent snapshot
+// and parse them to proto messages. Returned slice follows the order of gets,
+// items which do not exist are left nil.
+func TransactGetProtoFromDdb(gets []TransactGet, ddbClient dynamodbiface.DynamoDBAPI) ([]proto.Message, error) {
+	if len(gets) == 0 {
+		return nil, ErrEmptyTransaction
+	}
+	if len(gets) > maxTransactItems {
+		return nil, ErrTooManyTransactItems
+	}
+	items := make([]*dynamodb.TransactGetItem, 0, len(gets))
+	for _, get := range gets {
+		if !verifyProto(get.In, get.InstanceID) {
+			return nil, ErrKeyMismatched
+		}
+		items = append(items, &dynamodb.TransactGetItem{Get: &dynamodb.Get{
+			Key:       keyFor(get.InstanceID),
+			TableName: aws.String(get.TableName),
+		}})
+	}
+	output, err := ddbClient.TransactGetItems(&dynamodb.TransactGetItemsInput{TransactItems: items})
+	if err != nil {
+		return nil, transactionError(err)
+	}
+	if len(output.Responses) != len(gets) {
+		return nil, fmt.Errorf("transact get returned %d items for %d keys", len(output.Responses), len(gets))
+	}
+	outs := make([]proto.Message, len(gets))
+	for i, response := range output.Responses {
+		if len(response.Item) == 0 {
+			continue
+		}
+		if outs[i], err = decodeItem(gets[i].In, response.Item, gets[i].TableName); err != nil {
+			return nil, err
+		}
+	}
+	return outs, nil
+}
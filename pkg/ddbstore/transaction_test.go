@@ -0,0 +1,91 @@
+package ddbstore
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb/expression"
+
+	pb "go-grpc-kubernetes/proto/orderservice"
+)
+
+func TestTransactionCommit(t *testing.T) {
+	db, tableName := newOrdersTable(t, TableOptions{})
+	if _, err := PutProtoToDdb(&pb.Order{Uuid: "order-1", Quantity: 1}, "order-1", db, tableName); err != nil {
+		t.Fatal(err)
+	}
+	exists := expression.AttributeExists(expression.Name("uuid"))
+	err := NewTransaction().
+		Put(&pb.Order{Uuid: "order-2", Quantity: 2}, "order-2", tableName, nil).
+		Update(&pb.Order{Uuid: "order-1", Quantity: 3}, "order-1", UpdateOptions{Add: []string{"quantity"}}, tableName, &exists).
+		Commit(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := TransactGetProtoFromDdb([]TransactGet{
+		{In: &pb.Order{}, InstanceID: "order-1", TableName: tableName},
+		{In: &pb.Order{}, InstanceID: "order-2", TableName: tableName},
+		{In: &pb.Order{}, InstanceID: "missing", TableName: tableName},
+	}, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got[0].(*pb.Order).Quantity != 4 || got[1].(*pb.Order).Quantity != 2 || got[2] != nil {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestTransactionCanceled(t *testing.T) {
+	db, tableName := newOrdersTable(t, TableOptions{})
+	if _, err := PutProtoToDdb(&pb.Order{Uuid: "order-1", Quantity: 1}, "order-1", db, tableName); err != nil {
+		t.Fatal(err)
+	}
+	err := NewTransaction().
+		Delete("order-1", tableName, nil).
+		Check("missing", tableName, expression.AttributeExists(expression.Name("uuid"))).
+		Commit(db)
+	canceled, ok := err.(*TransactionCanceledError)
+	if !ok {
+		t.Fatalf("got %v, want *TransactionCanceledError", err)
+	}
+	if !canceled.ConditionFailed() || canceled.Conflict() {
+		t.Errorf("condition failed %v, conflict %v", canceled.ConditionFailed(), canceled.Conflict())
+	}
+	if failed := canceled.Failed(ReasonConditionalCheckFailed); len(failed) != 1 || failed[0] != 1 {
+		t.Errorf("failed items %v, want [1]", failed)
+	}
+	if _, _, err := GetProtoFromDdb(&pb.Order{}, "order-1", db, tableName); err != nil {
+		t.Errorf("canceled transaction deleted the item: %v", err)
+	}
+	if err := NewTransaction().Commit(db); err != ErrEmptyTransaction {
+		t.Errorf("empty transaction: got %v", err)
+	}
+	tx := NewTransaction()
+	for i := 0; i <= maxTransactItems; i++ {
+		tx.Delete("order-1", tableName, nil)
+	}
+	if err := tx.Commit(db); err != ErrTooManyTransactItems {
+		t.Errorf("%d items: got %v", maxTransactItems+1, err)
+	}
+}
+
+func TestIdempotentTransaction(t *testing.T) {
+	db, tableName := newOrdersTable(t, TableOptions{})
+	commit := func() error {
+		return NewTransaction().
+			Update(&pb.Order{Uuid: "order-1", Quantity: 1}, "order-1", UpdateOptions{Add: []string{"quantity"}}, tableName, nil).
+			Idempotent("token-1").
+			Commit(db)
+	}
+	for i := 0; i < 2; i++ {
+		if err := commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, _, err := GetProtoFromDdb(&pb.Order{}, "order-1", db, tableName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if quantity := got.(*pb.Order).Quantity; quantity != 1 {
+		t.Errorf("retried transaction added quantity twice: %d", quantity)
+	}
+}
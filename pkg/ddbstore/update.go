@@ -0,0 +1,175 @@
+package ddbstore
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/dynamodb/expression"
+	"github.com/golang/protobuf/proto"
+)
+
+var (
+	ErrNotNumeric = errors.New("attribute to add is not a number")
+)
+
+// UpdateOptions describe how fields of the message are written by UpdateProtoInDdb.
+// Every attribute set in the message which is neither the key nor listed in Add is written with SET.
+type UpdateOptions struct {
+	// Add lists numeric attributes which values are atomically added to the stored ones
+	Add []string
+	// Remove lists attributes removed from the stored item
+	Remove []string
+	// Fields lists fields explicitly set by the caller which are written even when zero valued,
+	// fields missing from the message are removed unless the table emits defaults
+	Fields []string
+}
+
+// rawAttr pass an already marshalled attribute value through the expression builder
+type rawAttr struct {
+	av *dynamodb.AttributeValue
+}
+
+// MarshalDynamoDBAttributeValue implements dynamodbattribute.Marshaler
+func (r rawAttr) MarshalDynamoDBAttributeValue(av *dynamodb.AttributeValue) error {
+	*av = *r.av
+	return nil
+}
+
+// updateBuilder return SET/ADD/REMOVE clauses generated from attributes, zero valued attributes
+// listed in defaults only fill in missing attributes unless listed in Fields
+func updateBuilder(attrs map[string]*dynamodb.AttributeValue, defaults map[string]bool, opts UpdateOptions) (*expression.UpdateBuilder, error) {
+	add := make(map[string]bool, len(opts.Add))
+	for _, name := range opts.Add {
+		add[name] = true
+	}
+	explicit := make(map[string]bool, len(opts.Fields))
+	for _, name := range opts.Fields {
+		explicit[name] = true
+	}
+	// sorted names keep the generated expression stable between calls
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var update expression.UpdateBuilder
+	empty := true
+	for _, name := range names {
+		if name == "uuid" {
+			continue
+		}
+		if add[name] {
+			if attrs[name].N == nil {
+				return nil, ErrNotNumeric
+			}
+			update = update.Add(expression.Name(name), expression.Value(rawAttr{attrs[name]}))
+		} else if defaults[name] && !explicit[name] {
+			update = update.Set(expression.Name(name), expression.IfNotExists(expression.Name(name), expression.Value(rawAttr{attrs[name]})))
+		} else {
+			update = update.Set(expression.Name(name), expression.Value(rawAttr{attrs[name]}))
+		}
+		empty = false
+	}
+	remove := append([]string{}, opts.Remove...)
+	for _, name := range opts.Fields {
+		if _, ok := attrs[name]; !ok && name != "uuid" {
+			remove = append(remove, name)
+		}
+	}
+	for _, name := range remove {
+		update = update.Remove(expression.Name(name))
+		empty = false
+	}
+	if empty {
+		return nil, nil
+	}
+	return &update, nil
+}
+
+// defaultAttrs return names of zero valued attributes of item encoded by a table emitting defaults
+func defaultAttrs(in proto.Message, attrs map[string]*dynamodb.AttributeValue, tableName string) (map[string]bool, error) {
+	if !optionsFor(tableName).EmitDefaults {
+		return nil, nil
+	}
+	set, err := protoToAttrs(in, false)
+	if err != nil {
+		return nil, err
+	}
+	defaults := map[string]bool{}
+	for name := range attrs {
+		if _, ok := set[name]; !ok {
+			defaults[name] = true
+		}
+	}
+	return defaults, nil
+}
+
+// UpdateProtoInDdb write fields set in proto message to dynamodb with a single UpdateItem call
+// and return the whole stored item parsed to proto message. The item is created when it doesn't exist.
+func UpdateProtoInDdb(in proto.Message, instanceID string, opts UpdateOptions, ddbClient dynamodbiface.DynamoDBAPI, tableName string) (proto.Message, error) {
+	if !verifyProto(in, instanceID) {
+		return nil, ErrKeyMismatched
+	}
+	// binary attribute can't be merged by dynamodb so the item is merged here
+	if optionsFor(tableName).Format == FormatBinary {
+		return updateBinary(in, instanceID, opts, ddbClient, tableName)
+	}
+	// offloading needs the stored item to check the size of the merged item
+	// and to release blobs replaced by the update
+	var stored map[string]*dynamodb.AttributeValue
+	if optionsFor(tableName).Offload != nil {
+		output, err := ddbClient.GetItem(&dynamodb.GetItemInput{
+			Key:            keyFor(instanceID),
+			TableName:      aws.String(tableName),
+			ConsistentRead: aws.Bool(true),
+		})
+		if err != nil {
+			return nil, err
+		}
+		stored = output.Item
+	}
+	attrs, err := encodeUpdate(in, instanceID, stored, tableName)
+	if err != nil {
+		return nil, err
+	}
+	defaults, err := defaultAttrs(in, attrs, tableName)
+	if err != nil {
+		return nil, err
+	}
+	update, err := updateBuilder(attrs, defaults, opts)
+	if err != nil {
+		return nil, err
+	}
+	// reads prefer the binary attribute, so items converted to binary format before the table went
+	// back to json format are merged here and written back in json layout
+	binary := expression.AttributeNotExists(expression.Name(protoAttribute))
+	expr, err := conditionExpression(&binary, update)
+	if err != nil {
+		return nil, err
+	}
+	input := &dynamodb.UpdateItemInput{
+		Key:                       keyFor(instanceID),
+		TableName:                 aws.String(tableName),
+		ReturnValues:              aws.String(dynamodb.ReturnValueAllNew),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		UpdateExpression:          expr.Update(),
+	}
+	output, err := ddbClient.UpdateItem(input)
+	if err != nil {
+		if rejected(err) {
+			discardBlobs(tableName, attrs)
+		}
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			return updateBinary(in, instanceID, opts, ddbClient, tableName)
+		}
+		return nil, err
+	}
+	releaseBlobs(tableName, blobKeys(stored), blobKeys(output.Attributes))
+	return decodeItem(in, output.Attributes, tableName)
+}
@@ -0,0 +1,44 @@
+package ddbstore
+
+import (
+	"testing"
+
+	pb "go-grpc-kubernetes/proto/orderservice"
+)
+
+func TestUpdateProtoInDdb(t *testing.T) {
+	db, tableName := newOrdersTable(t, TableOptions{})
+	if _, err := PutProtoToDdb(&pb.Order{Uuid: "order-1", Quantity: 2, Currency: "EUR", ProductUuid: "product-1"}, "order-1", db, tableName); err != nil {
+		t.Fatal(err)
+	}
+	out, err := UpdateProtoInDdb(&pb.Order{Uuid: "order-1", Quantity: 3, Status: pb.Status_InProgress}, "order-1", UpdateOptions{
+		Add:    []string{"quantity"},
+		Remove: []string{"product_uuid"},
+	}, db, tableName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	order := out.(*pb.Order)
+	if order.Quantity != 5 || order.Status != pb.Status_InProgress || order.Currency != "EUR" || order.ProductUuid != "" {
+		t.Errorf("got %v", order)
+	}
+	// fields listed explicitly are written even when zero valued, missing ones are removed
+	out, err = UpdateProtoInDdb(&pb.Order{Uuid: "order-1"}, "order-1", UpdateOptions{Fields: []string{"quantity", "currency"}}, db, tableName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, fields, err := GetProtoFromDdb(&pb.Order{}, "order-1", db, tableName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := map[string]bool{}
+	for _, name := range fields {
+		stored[name] = true
+	}
+	if order := out.(*pb.Order); order.Quantity != 0 || order.Currency != "" || stored["currency"] {
+		t.Errorf("got %v with stored fields %v", order, fields)
+	}
+	if _, err := UpdateProtoInDdb(&pb.Order{Uuid: "order-1", Currency: "USD"}, "order-1", UpdateOptions{Add: []string{"currency"}}, db, tableName); err != ErrNotNumeric {
+		t.Errorf("adding a string: got %v, want ErrNotNumeric", err)
+	}
+}
@@ -0,0 +1,161 @@
+package ddbstore
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams/dynamodbstreamsiface"
+)
+
+var (
+	ErrStreamNotEnabled = errors.New("table stream not enabled")
+)
+
+const (
+	// watchShardsInterval is how often new shards are discovered after splits
+	watchShardsInterval = 30 * time.Second
+	// watchIdleInterval is the pause between GetRecords calls returning no records
+	watchIdleInterval = time.Second
+)
+
+// WatchStream follow every shard of the table stream from its latest record and call fn
+// for each new record until stop is closed. fn is called concurrently from all shards.
+// Nothing is checkpointed so records written while nobody watches are not seen.
+// A shard whose reading failed, e.g. on an expired iterator, is read again from TRIM_HORIZON
+// on the next discovery of shards.
+func WatchStream(ddbSession *session.Session, tableName string, stop <-chan struct{}, fn func(record *dynamodbstreams.Record)) error {
+	return watchStream(dynamodb.New(ddbSession), dynamodbstreams.New(ddbSession), tableName, watchShardsInterval, stop, fn)
+}
+
+// watchStream is WatchStream discovering shards every interval
+func watchStream(ddbClient dynamodbiface.DynamoDBAPI, streamsClient dynamodbstreamsiface.DynamoDBStreamsAPI, tableName string, interval time.Duration, stop <-chan struct{}, fn func(record *dynamodbstreams.Record)) error {
+	table, err := DescribeTable(tableName, ddbClient)
+	if err != nil {
+		return err
+	}
+	if table.LatestStreamArn == nil {
+		return ErrStreamNotEnabled
+	}
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+		// watched shards, a shard is removed when reading it fails so it is started again
+		watched = map[string]bool{}
+	)
+	defer wg.Wait()
+	// shards open on start are read from LATEST, shards created later from TRIM_HORIZON
+	// so records written right after a split are not missed
+	iteratorType := dynamodbstreams.ShardIteratorTypeLatest
+	for {
+		shards, err := describeShards(streamsClient, table.LatestStreamArn)
+		if err != nil {
+			fmt.Printf("ddbstore:WatchStream: %v\n", err)
+		}
+		for _, shard := range shards {
+			shardID := aws.StringValue(shard.ShardId)
+			mu.Lock()
+			seen := watched[shardID]
+			watched[shardID] = true
+			mu.Unlock()
+			if seen {
+				continue
+			}
+			// closed shards have nothing new to read
+			if shard.SequenceNumberRange != nil && shard.SequenceNumberRange.EndingSequenceNumber != nil {
+				continue
+			}
+			wg.Add(1)
+			go func(shardID, iteratorType string) {
+				defer wg.Done()
+				if err := watchShard(streamsClient, table.LatestStreamArn, shardID, iteratorType, stop, fn); err != nil {
+					fmt.Printf("ddbstore:WatchStream: shard %s: %v\n", shardID, err)
+					mu.Lock()
+					delete(watched, shardID)
+					mu.Unlock()
+				}
+			}(shardID, iteratorType)
+		}
+		iteratorType = dynamodbstreams.ShardIteratorTypeTrimHorizon
+		select {
+		case <-stop:
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
+
+// describeShards return all shards of the stream following pagination
+func describeShards(streamsClient dynamodbstreamsiface.DynamoDBStreamsAPI, streamArn *string) ([]*dynamodbstreams.Shard, error) {
+	var shards []*dynamodbstreams.Shard
+	input := &dynamodbstreams.DescribeStreamInput{
+		StreamArn: streamArn,
+	}
+	for {
+		output, err := streamsClient.DescribeStream(input)
+		if err != nil {
+			return nil, err
+		}
+		shards = append(shards, output.StreamDescription.Shards...)
+		if output.StreamDescription.LastEvaluatedShardId == nil {
+			return shards, nil
+		}
+		input.ExclusiveStartShardId = output.StreamDescription.LastEvaluatedShardId
+	}
+}
+
+// watchShard read records of a single shard until it is closed or stop is closed
+func watchShard(streamsClient dynamodbstreamsiface.DynamoDBStreamsAPI, streamArn *string, shardID, iteratorType string, stop <-chan struct{}, fn func(record *dynamodbstreams.Record)) error {
+	iterator, err := streamsClient.GetShardIterator(&dynamodbstreams.GetShardIteratorInput{
+		StreamArn:         streamArn,
+		ShardId:           aws.String(shardID),
+		ShardIteratorType: aws.String(iteratorType),
+	})
+	if err != nil {
+		return err
+	}
+	next := iterator.ShardIterator
+	for next != nil {
+		output, err := streamsClient.GetRecords(&dynamodbstreams.GetRecordsInput{
+			ShardIterator: next,
+		})
+		if err != nil {
+			return err
+		}
+		for _, record := range output.Records {
+			fn(record)
+		}
+		next = output.NextShardIterator
+		wait := time.Duration(0)
+		if len(output.Records) == 0 {
+			wait = watchIdleInterval
+		}
+		select {
+		case <-stop:
+			return nil
+		case <-time.After(wait):
+		}
+	}
+	return nil
+}
+
+// RecordKey return string value of the key attribute of stream record
+func RecordKey(record *dynamodbstreams.Record, key string) string {
+	if record.Dynamodb == nil {
+		return ""
+	}
+	v := record.Dynamodb.Keys[key]
+	if v == nil {
+		return ""
+	}
+	if v.N != nil {
+		return *v.N
+	}
+	return aws.StringValue(v.S)
+}
@@ -0,0 +1,53 @@
+package ddbstore
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams"
+
+	pb "go-grpc-kubernetes/proto/orderservice"
+)
+
+func TestWatchStreamRestartsFailedShard(t *testing.T) {
+	db, tableName := newOrdersTable(t, TableOptions{})
+	failed := make(chan struct{})
+	var once sync.Once
+	db.Fail = func(op string) error {
+		err := error(nil)
+		if op == "GetRecords" {
+			once.Do(func() {
+				close(failed)
+				err = awserr.New(dynamodbstreams.ErrCodeExpiredIteratorException, "expired", nil)
+			})
+		}
+		return err
+	}
+	seen := make(chan string, 10)
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- watchStream(db, db.Streams(), tableName, 10*time.Millisecond, stop, func(record *dynamodbstreams.Record) {
+			seen <- RecordKey(record, "uuid")
+		})
+	}()
+	<-failed
+	// written while the shard has no reader, the restart from TRIM_HORIZON must still see it
+	if _, err := PutProtoToDdb(&pb.Order{Uuid: "order-1", Quantity: 1}, "order-1", db, tableName); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case id := <-seen:
+		if id != "order-1" {
+			t.Errorf("got record of %q, want order-1", id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("shard wasn't watched again after its reader failed")
+	}
+	close(stop)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,27 @@
+// Package env reads configuration from environment variables, it is shared by config and
+// ddbstore so neither depends on the other for it.
+package env
+
+import (
+	"os"
+	"strings"
+)
+
+// Get return env variable if key existed or returning the fallback
+func Get(key, fallback string) string {
+	if val := os.Getenv(key); val != "" {
+		return val
+	}
+	return fallback
+}
+
+// List return non empty values of comma separated env variable, nil when it isn't set
+func List(key string) []string {
+	var values []string
+	for _, v := range strings.Split(os.Getenv(key), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
@@ -0,0 +1,115 @@
+package order
+
+import (
+	"context"
+	"fmt"
+
+	"go-grpc-kubernetes/pkg/config"
+	"go-grpc-kubernetes/pkg/ddbstore"
+	"go-grpc-kubernetes/pkg/env"
+	pb "go-grpc-kubernetes/proto/orderservice"
+)
+
+const (
+	// ordersLeaseTable keeps shard leases of consumers of the orders table stream
+	ordersLeaseTable = "orders-stream-leases"
+	// ordersDeadLetterTable keeps orders stream records which couldn't be indexed
+	ordersDeadLetterTable = "orders-index-dead-letters"
+)
+
+// LeaseTableName return name of the lease table of the configured stage
+func (s *Server) LeaseTableName() string {
+	return s.Config.TableName(ordersLeaseTable)
+}
+
+// StreamIndexer return indexer of orders table stream records into Elasticsearch with _bulk requests.
+// Storage is configured like the server's so sensitive attributes are never indexed.
+func (s *Server) StreamIndexer() (*ddbstore.StreamIndexer, error) {
+	if err := s.ConfigureStorage(); err != nil {
+		return nil, err
+	}
+	es, err := s.Elasticsearch()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.EnsureSearchIndex(context.Background(), es); err != nil {
+		return nil, err
+	}
+	bulk, err := ddbstore.NewBulkIndexer(es, ddbstore.BulkOptions{Refresh: s.Config.IndexRefresh})
+	if err != nil {
+		return nil, err
+	}
+	indexer := ddbstore.NewStreamIndexer(s.Ddb, bulk)
+	sink, err := s.DeadLetterSink()
+	if err != nil {
+		return nil, err
+	}
+	if sink != nil {
+		indexer.DeadLetter(sink, s.Config.IndexMaxAttempts)
+	}
+	return indexer, nil
+}
+
+// Elasticsearch return client of the cluster configured by ELASTICSEARCH_ variables,
+// requests are signed with credentials of the server's session unless another auth is set
+func (s *Server) Elasticsearch() (*ddbstore.Elasticsearch, error) {
+	return ddbstore.NewElasticsearchWithOptions(ddbstore.ElasticsearchOptions{
+		Addresses:  s.Config.ElasticsearchURLs,
+		Auth:       s.Config.ElasticsearchAuth,
+		Username:   s.Config.ElasticsearchUsername,
+		Password:   s.Config.ElasticsearchPassword,
+		APIKey:     s.Config.ElasticsearchAPIKey,
+		CACert:     s.Config.ElasticsearchCACert,
+		ClientCert: s.Config.ElasticsearchClientCert,
+		ClientKey:  s.Config.ElasticsearchClientKey,
+		Session:    s.DdbSession,
+	})
+}
+
+// SearchIndex return elasticsearch index of orders
+func (s *Server) SearchIndex() string {
+	return ddbstore.SearchIndexName(s.TableName())
+}
+
+// SearchMapping return mapping of order documents generated from the proto, sensitive fields are
+// never indexed, timestamp holds unix seconds and amount is money with two decimal places
+func SearchMapping() *ddbstore.Mapping {
+	return ddbstore.MappingFromDescriptor(&pb.Order{}, ddbstore.MappingOptions{
+		Dates:        map[string]string{"timestamp": "epoch_second"},
+		ScaledFloats: map[string]float64{"amount": 100},
+		Exclude:      ddbstore.SensitiveAttributes(&pb.Order{}, pb.E_Sensitive),
+	})
+}
+
+// EnsureSearchIndex apply the orders mapping to the search index before anything is indexed,
+// with SCHEMA_DRY_RUN=true drift is only reported
+func (s *Server) EnsureSearchIndex(ctx context.Context, es *ddbstore.Elasticsearch) ([]ddbstore.Drift, error) {
+	dryRun := env.Get("SCHEMA_DRY_RUN", "false") == "true"
+	drifts, err := es.EnsureIndex(ctx, s.SearchIndex(), SearchMapping(), ddbstore.ReconcileOptions{DryRun: dryRun})
+	if err != nil {
+		return nil, err
+	}
+	for _, drift := range drifts {
+		fmt.Printf("elasticsearch index %s: %v\n", s.SearchIndex(), drift)
+	}
+	return drifts, nil
+}
+
+// DeadLetterSink return the configured sink of stream records which couldn't be indexed,
+// nil when dead letters are off. The dead letter table is created in dev.
+func (s *Server) DeadLetterSink() (ddbstore.DeadLetterSink, error) {
+	switch s.Config.DeadLetter {
+	case config.DeadLetterFile:
+		return &ddbstore.FileDeadLetterSink{Path: s.Config.DeadLetterFile}, nil
+	case config.DeadLetterTable:
+		tableName := s.Config.TableName(ordersDeadLetterTable)
+		_, err := ddbstore.EnsureTable(ddbstore.DeadLetterTableSpec(tableName), s.Ddb, ddbstore.ReconcileOptions{
+			AllowCreate: s.Config.CanCreateTables(),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &ddbstore.DynamoDeadLetterSink{DdbClient: s.Ddb, TableName: tableName}, nil
+	}
+	return nil, nil
+}
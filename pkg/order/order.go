@@ -2,118 +2,327 @@ package order
 
 import (
 	"context"
+	"errors"
+	"expvar"
 	"fmt"
 
+	"go-grpc-kubernetes/pkg/config"
 	"go-grpc-kubernetes/pkg/ddbstore"
+	"go-grpc-kubernetes/pkg/env"
 	pb "go-grpc-kubernetes/proto/orderservice"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 const (
-	tableName = "orders-api-dev"
+	ordersTable = "orders-api"
+)
+
+// projectedAttributes stay at top level of orders stored in binary format so they can be filtered on
+var projectedAttributes = []string{"product_uuid", "status", "timestamp"}
+
+var (
+	ErrEncryptionRequired = errors.New("KMS_KEY_ID or ENCRYPTION_KEY_FILE required to store sensitive order fields")
 )
 
 // Server type definition
 type Server struct {
 	DdbSession *session.Session
+	// Ddb is the dynamodb client of DdbSession, replaceable by an in-memory fake in tests
+	Ddb    dynamodbiface.DynamoDBAPI
+	Config *config.Config
+	// cache of GetOrder, nil when disabled
+	cache *ddbstore.Cache
+}
+
+// TableName return orders table name of the configured stage
+func (s *Server) TableName() string {
+	return s.Config.TableName(ordersTable)
 }
 
-// EnsureDDB ensure ddb exist in dev sandbox
+// ordersTableSpec is the declarative definition of the orders table
+func (s *Server) ordersTableSpec() *ddbstore.TableSpec {
+	return &ddbstore.TableSpec{
+		TableName: s.TableName(),
+		// uuid as hash key
+		HashKey:        "uuid",
+		AttributeTypes: map[string]string{"uuid": dynamodb.ScalarAttributeTypeS},
+		BillingMode:    dynamodb.BillingModeProvisioned,
+		ReadCapacity:   10,
+		WriteCapacity:  10,
+		StreamViewType: dynamodb.StreamViewTypeNewAndOldImages,
+	}
+}
+
+// EnsureDDB ensure ddb table matches its spec, with SCHEMA_DRY_RUN=true drift and errors
+// checking the table are only reported
 func (s *Server) EnsureDDB() error {
-	ddbClient := dynamodb.New(s.DdbSession)
-	ddbDesc, err := ddbClient.DescribeTable(&dynamodb.DescribeTableInput{
-		TableName: aws.String(tableName),
+	dryRun := env.Get("SCHEMA_DRY_RUN", "false") == "true"
+	drifts, err := ddbstore.EnsureTable(s.ordersTableSpec(), s.Ddb, ddbstore.ReconcileOptions{
+		DryRun:      dryRun,
+		AllowCreate: s.Config.CanCreateTables(),
 	})
+	if err != nil && dryRun {
+		fmt.Printf("dynamodb table %s: can't check table: %v\n", s.TableName(), err)
+		return nil
+	}
 	if err != nil {
-		input := &dynamodb.CreateTableInput{
-			AttributeDefinitions: []*dynamodb.AttributeDefinition{
-				{
-					AttributeName: aws.String("uuid"),
-					AttributeType: aws.String("S"),
-				},
-			},
-			// KeySchema with instance_id as hash key
-			KeySchema: []*dynamodb.KeySchemaElement{
-				{
-					AttributeName: aws.String("uuid"),
-					KeyType:       aws.String("HASH"),
-				},
-			},
-			ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
-				ReadCapacityUnits:  aws.Int64(10),
-				WriteCapacityUnits: aws.Int64(10),
-			},
-			TableName: aws.String(tableName),
-			StreamSpecification: &dynamodb.StreamSpecification{
-				StreamEnabled:  aws.Bool(true),
-				StreamViewType: aws.String("NEW_AND_OLD_IMAGES"),
-			},
-		}
-		_, err := ddbClient.CreateTable(input)
-		if err != nil {
-			panic(err)
-		}
+		return err
+	}
+	for _, drift := range drifts {
+		fmt.Printf("dynamodb table %s: %v\n", s.TableName(), drift)
+	}
+	if dryRun {
+		return nil
+	}
+	ddbDesc, err := ddbstore.DescribeTable(s.TableName(), s.Ddb)
+	if err != nil {
+		return err
 	}
 	fmt.Printf("dynamodb table description: %v\n", ddbDesc.String())
 	return nil
 }
 
-// MakeServer returns a new server satisfying todo grpc service
-func MakeServer() *Server {
-	// This configuration is for local only
-	// server := &Server{
-	// 	DdbSession: session.Must(session.NewSession(&aws.Config{
-	// 		Endpoint:    aws.String("http://dynamodb:8000"),
-	// 		Region:      aws.String("eu-west-1"),
-	// 		Credentials: credentials.NewStaticCredentials("blah", "blah", ""), // AKID, SECRET_KEY, TOKEN
-	// 	})),
-	// }
+// NewSession return aws session of the configured dynamodb endpoint
+func NewSession(cfg *config.Config) *session.Session {
+	awsConfig := &aws.Config{}
+	if cfg.DdbEndpoint != "" {
+		// local dynamodb e.g. DYNAMODB_ENDPOINT=http://dynamodb:8000
+		awsConfig.Endpoint = aws.String(cfg.DdbEndpoint)
+	}
+	return session.Must(session.NewSession(awsConfig))
+}
+
+// newDdbClient return dynamodb client limiting requests to table capacity unless throttling is off
+func newDdbClient(sess *session.Session, cfg *config.Config) dynamodbiface.DynamoDBAPI {
+	client := dynamodb.New(sess)
+	if cfg.ThrottleMode == config.ThrottleOff {
+		return client
+	}
+	opts := ddbstore.ThrottleOptions{Mode: ddbstore.ThrottleQueue, MaxWait: cfg.ThrottleMaxWait}
+	if cfg.ThrottleMode == config.ThrottleFail {
+		opts.Mode = ddbstore.ThrottleFailFast
+	}
+	throttled := ddbstore.NewThrottled(client, opts)
+	expvar.Publish("ddb_throttle", throttled.Vars())
+	return throttled
+}
 
+// MakeServer returns a new server satisfying todo grpc service
+func MakeServer(cfg *config.Config) (*Server, error) {
+	sess := NewSession(cfg)
 	server := &Server{
-		DdbSession: session.Must(session.NewSession()),
+		DdbSession: sess,
+		Ddb:        newDdbClient(sess, cfg),
+		Config:     cfg,
 	}
 
 	if err := server.EnsureDDB(); err != nil {
-		panic(err)
+		return nil, err
+	}
+	if err := server.ConfigureStorage(); err != nil {
+		return nil, err
+	}
+	if cfg.CacheSize > 0 {
+		server.cache = ddbstore.NewCache(cfg.CacheSize, cfg.CacheTTL)
+		expvar.Publish("order_cache", server.cache.Vars())
+		go server.invalidateCache(nil)
+	}
+	return server, nil
+}
+
+// ConfigureStorage set up storage format, encryption of sensitive order fields and offload of large ones
+func (s *Server) ConfigureStorage() error {
+	// zero valued fields like status Started are stored so scans can filter on them,
+	// sensitive fields are kept out of search, dead letters and exports even without a key
+	opts := ddbstore.TableOptions{
+		EmitDefaults: true,
+		Sensitive:    ddbstore.SensitiveAttributes(&pb.Order{}, pb.E_Sensitive),
+	}
+	encryption, err := s.encryption()
+	if err != nil {
+		return err
+	}
+	opts.Encryption = encryption
+	switch {
+	case s.Config.BlobBucket != "":
+		opts.Offload = &ddbstore.Offload{
+			Store: ddbstore.NewS3BlobStore(s.Config.BlobBucket, "", s.DdbSession),
+		}
+	case s.Config.BlobDir != "":
+		opts.Offload = &ddbstore.Offload{
+			Store: &ddbstore.FileBlobStore{Dir: s.Config.BlobDir},
+		}
+	}
+	if s.Config.StorageFormat == config.StorageBinary {
+		opts.Format = ddbstore.FormatBinary
+		opts.Projected = projectedAttributes
+	}
+	// orders stored in binary format are decoded to be indexed
+	opts.Message = &pb.Order{}
+	ddbstore.ConfigureTable(s.TableName(), opts)
+	return nil
+}
+
+// encryption of order fields marked sensitive in the proto with configured key provider
+func (s *Server) encryption() (*ddbstore.Encryption, error) {
+	var provider ddbstore.KeyProvider
+	switch {
+	case s.Config.KMSKeyID != "":
+		provider = ddbstore.NewKMSKeyProvider(s.Config.KMSKeyID, s.DdbSession)
+	case s.Config.EncryptionKeyFile != "":
+		fileProvider, err := ddbstore.NewFileKeyProvider(s.Config.EncryptionKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		provider = fileProvider
+	case s.Config.RequiresEncryption():
+		return nil, ErrEncryptionRequired
+	default:
+		fmt.Printf("sensitive order fields are stored in plaintext\n")
+		return nil, nil
+	}
+	return &ddbstore.Encryption{
+		Provider:   provider,
+		Attributes: ddbstore.SensitiveAttributes(&pb.Order{}, pb.E_Sensitive),
+	}, nil
+}
+
+// invalidateCache drop orders changed by any replica from cache following the table stream,
+// it runs until stop is closed
+func (s *Server) invalidateCache(stop <-chan struct{}) {
+	err := ddbstore.WatchStream(s.DdbSession, s.TableName(), stop, func(record *dynamodbstreams.Record) {
+		s.cache.Invalidate(ddbstore.RecordKey(record, "uuid"))
+	})
+	// without invalidations orders changed by other replicas would be served stale until they expire
+	if err != nil {
+		fmt.Printf("order cache invalidation stopped, cache disabled: %v\n", err)
+		s.cache.Disable()
 	}
-	return server
+}
+
+// invalidate drop the order from cache if it is enabled
+func (s *Server) invalidate(uuid string) {
+	if s.cache != nil {
+		s.cache.Invalidate(uuid)
+	}
+}
+
+// statusError map storage errors to grpc status codes: requests over table capacity to
+// ResourceExhausted with a retry delay, failed transaction conditions to FailedPrecondition,
+// conflicting writes, which may succeed when retried, to Aborted and invalid uuids to InvalidArgument
+func statusError(err error) error {
+	var (
+		canceled  *ddbstore.TransactionCanceledError
+		throttled *ddbstore.ThrottledError
+	)
+	switch {
+	case errors.As(err, &throttled):
+		st, detailErr := status.New(codes.ResourceExhausted, err.Error()).WithDetails(&errdetails.RetryInfo{
+			RetryDelay: ptypes.DurationProto(throttled.RetryAfter),
+		})
+		if detailErr != nil {
+			return status.Error(codes.ResourceExhausted, err.Error())
+		}
+		return st.Err()
+	case errors.As(err, &canceled):
+		if canceled.ConditionFailed() {
+			return status.Error(codes.FailedPrecondition, err.Error())
+		}
+		if len(canceled.Failed(ddbstore.ReasonValidationError)) > 0 {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+		return status.Error(codes.Aborted, err.Error())
+	case errors.Is(err, ddbstore.ErrIdempotencyMismatch):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, ddbstore.ErrTransactionInProgress), errors.Is(err, ddbstore.ErrConcurrentUpdate):
+		return status.Error(codes.Aborted, err.Error())
+	case errors.Is(err, ddbstore.ErrKeyMismatched):
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	return err
 }
 
 // CreateOrder service
 func (s *Server) CreateOrder(ctx context.Context, in *pb.Order) (*pb.Order, error) {
-	out, err := ddbstore.PutProtoToDdb(in, in.GetUuid(), s.DdbSession, tableName)
+	out, err := ddbstore.PutProtoToDdb(in, in.GetUuid(), s.Ddb, s.TableName())
 	if err != nil {
-		return nil, err
+		return nil, statusError(err)
 	}
+	s.invalidate(in.GetUuid())
 	return out.(*pb.Order), nil
 }
 
 // UpdateOrder service
 func (s *Server) UpdateOrder(ctx context.Context, in *pb.Order) (*pb.Order, error) {
-	out, err := ddbstore.PutProtoToDdb(in, in.GetUuid(), s.DdbSession, "orders-api-dev")
+	out, err := ddbstore.PutProtoToDdb(in, in.GetUuid(), s.Ddb, s.TableName())
 	if err != nil {
-		return nil, err
+		return nil, statusError(err)
 	}
+	s.invalidate(in.GetUuid())
 	return out.(*pb.Order), nil
 }
 
 // GetOrder service
 func (s *Server) GetOrder(ctx context.Context, in *pb.RequestBy) (*pb.Order, error) {
-	out, err := ddbstore.GetProtoFromDdb(in, in.GetUuid(), s.DdbSession, "orders-api-dev")
+	get := func() (proto.Message, error) {
+		out, _, err := ddbstore.GetProtoFromDdb(&pb.Order{}, in.GetUuid(), s.Ddb, s.TableName())
+		return out, err
+	}
+	var (
+		out proto.Message
+		err error
+	)
+	if s.cache != nil {
+		out, err = s.cache.Load(in.GetUuid(), get)
+	} else {
+		out, err = get()
+	}
 	if err != nil {
-		return nil, err
+		return nil, statusError(err)
 	}
 	return out.(*pb.Order), nil
 }
 
 // DeleteOrder service
 func (s *Server) DeleteOrder(ctx context.Context, in *pb.RequestBy) (*pb.Order, error) {
-	err := ddbstore.DeleteProtoFromDdb(in.GetUuid(), s.DdbSession, "orders-api-dev")
+	err := ddbstore.DeleteProtoFromDdb(in.GetUuid(), s.Ddb, s.TableName())
 	if err != nil {
-		return nil, err
+		return nil, statusError(err)
 	}
+	s.invalidate(in.GetUuid())
 	return &pb.Order{Uuid: in.GetUuid()}, nil
 }
+
+// BatchGetOrders service
+func (s *Server) BatchGetOrders(ctx context.Context, in *pb.BatchGetOrdersRequest) (*pb.BatchGetOrdersResponse, error) {
+	outs, err := ddbstore.BatchGetProtoFromDdb(&pb.Order{}, in.GetUuids(), s.Ddb, s.TableName())
+	if err != nil {
+		return nil, statusError(err)
+	}
+	resp := &pb.BatchGetOrdersResponse{}
+	// uuids requested more than once are answered once
+	seen := map[string]bool{}
+	for i, out := range outs {
+		uuid := in.GetUuids()[i]
+		if seen[uuid] {
+			continue
+		}
+		seen[uuid] = true
+		if out == nil {
+			resp.MissingUuids = append(resp.MissingUuids, uuid)
+			continue
+		}
+		resp.Orders = append(resp.Orders, out.(*pb.Order))
+	}
+	return resp, nil
+}
@@ -0,0 +1,98 @@
+package order
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/golang/protobuf/ptypes"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"go-grpc-kubernetes/pkg/config"
+	"go-grpc-kubernetes/pkg/ddbfake"
+	"go-grpc-kubernetes/pkg/ddbstore"
+	pb "go-grpc-kubernetes/proto/orderservice"
+)
+
+// newTestServer return a dev server storing orders in an in-memory dynamodb
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	server := &Server{Ddb: ddbfake.New(), Config: &config.Config{Stage: config.StageDev}}
+	if err := server.EnsureDDB(); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.ConfigureStorage(); err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+func TestEnsureDDBDryRunReportsErrors(t *testing.T) {
+	db := ddbfake.New()
+	db.Fail = func(op string) error {
+		return awserr.New("AccessDeniedException", "not authorized to perform "+op, nil)
+	}
+	server := &Server{Ddb: db, Config: &config.Config{Stage: config.StageProd}}
+
+	os.Setenv("SCHEMA_DRY_RUN", "true")
+	defer os.Unsetenv("SCHEMA_DRY_RUN")
+	if err := server.EnsureDDB(); err != nil {
+		t.Fatalf("EnsureDDB in dry run = %v, want nil", err)
+	}
+
+	os.Unsetenv("SCHEMA_DRY_RUN")
+	if err := server.EnsureDDB(); err == nil {
+		t.Fatal("EnsureDDB = nil, want the DescribeTable error")
+	}
+}
+
+func TestBatchGetOrders(t *testing.T) {
+	server := newTestServer(t)
+	ctx := context.Background()
+	for _, uuid := range []string{"order-1", "order-2"} {
+		if _, err := server.CreateOrder(ctx, &pb.Order{Uuid: uuid, Quantity: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	resp, err := server.BatchGetOrders(ctx, &pb.BatchGetOrdersRequest{
+		Uuids: []string{"order-2", "missing", "order-1", "missing", "order-2"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var uuids []string
+	for _, order := range resp.Orders {
+		uuids = append(uuids, order.Uuid)
+	}
+	if len(uuids) != 2 || uuids[0] != "order-2" || uuids[1] != "order-1" {
+		t.Errorf("got orders %v, want each found order once in request order", uuids)
+	}
+	if len(resp.MissingUuids) != 1 || resp.MissingUuids[0] != "missing" {
+		t.Errorf("got missing uuids %v, want [missing]", resp.MissingUuids)
+	}
+	_, err = server.BatchGetOrders(ctx, &pb.BatchGetOrdersRequest{Uuids: []string{"order-1", ""}})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("got %v for an empty uuid, want InvalidArgument", err)
+	}
+}
+
+func TestThrottledErrorCarriesRetryInfo(t *testing.T) {
+	err := statusError(&ddbstore.ThrottledError{TableName: "orders", RetryAfter: 1500 * time.Millisecond})
+	st := status.Convert(err)
+	if st.Code() != codes.ResourceExhausted {
+		t.Fatalf("got %v, want ResourceExhausted", st.Code())
+	}
+	for _, detail := range st.Details() {
+		if info, ok := detail.(*errdetails.RetryInfo); ok {
+			if delay, err := ptypes.Duration(info.RetryDelay); err != nil || delay != 1500*time.Millisecond {
+				t.Errorf("got retry delay %v, %v, want 1.5s", delay, err)
+			}
+			return
+		}
+	}
+	t.Errorf("got details %v, want RetryInfo", st.Details())
+}
@@ -7,6 +7,7 @@ import (
 	context "context"
 	fmt "fmt"
 	proto "github.com/golang/protobuf/proto"
+	descriptor "github.com/golang/protobuf/protoc-gen-go/descriptor"
 	grpc "google.golang.org/grpc"
 	codes "google.golang.org/grpc/codes"
 	status "google.golang.org/grpc/status"
@@ -63,6 +64,9 @@ type Order struct {
 	Currency             string   `protobuf:"bytes,5,opt,name=currency,proto3" json:"currency,omitempty"`
 	Status               Status   `protobuf:"varint,6,opt,name=status,proto3,enum=order.api.v1.Status" json:"status,omitempty"`
 	Timestamp            int64    `protobuf:"varint,7,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	CustomerName         string   `protobuf:"bytes,8,opt,name=customer_name,json=customerName,proto3" json:"customer_name,omitempty"`
+	CustomerEmail        string   `protobuf:"bytes,9,opt,name=customer_email,json=customerEmail,proto3" json:"customer_email,omitempty"`
+	ShippingAddress      string   `protobuf:"bytes,10,opt,name=shipping_address,json=shippingAddress,proto3" json:"shipping_address,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -142,6 +146,27 @@ func (m *Order) GetTimestamp() int64 {
 	return 0
 }
 
+func (m *Order) GetCustomerName() string {
+	if m != nil {
+		return m.CustomerName
+	}
+	return ""
+}
+
+func (m *Order) GetCustomerEmail() string {
+	if m != nil {
+		return m.CustomerEmail
+	}
+	return ""
+}
+
+func (m *Order) GetShippingAddress() string {
+	if m != nil {
+		return m.ShippingAddress
+	}
+	return ""
+}
+
 type RequestBy struct {
 	Uuid                 string   `protobuf:"bytes,1,opt,name=uuid,proto3" json:"uuid,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
@@ -181,37 +206,150 @@ func (m *RequestBy) GetUuid() string {
 	return ""
 }
 
+type BatchGetOrdersRequest struct {
+	Uuids                []string `protobuf:"bytes,1,rep,name=uuids,proto3" json:"uuids,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *BatchGetOrdersRequest) Reset()         { *m = BatchGetOrdersRequest{} }
+func (m *BatchGetOrdersRequest) String() string { return proto.CompactTextString(m) }
+func (*BatchGetOrdersRequest) ProtoMessage()    {}
+func (*BatchGetOrdersRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_f3dcd817f520e5b1, []int{2}
+}
+
+func (m *BatchGetOrdersRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_BatchGetOrdersRequest.Unmarshal(m, b)
+}
+func (m *BatchGetOrdersRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_BatchGetOrdersRequest.Marshal(b, m, deterministic)
+}
+func (m *BatchGetOrdersRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_BatchGetOrdersRequest.Merge(m, src)
+}
+func (m *BatchGetOrdersRequest) XXX_Size() int {
+	return xxx_messageInfo_BatchGetOrdersRequest.Size(m)
+}
+func (m *BatchGetOrdersRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_BatchGetOrdersRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_BatchGetOrdersRequest proto.InternalMessageInfo
+
+func (m *BatchGetOrdersRequest) GetUuids() []string {
+	if m != nil {
+		return m.Uuids
+	}
+	return nil
+}
+
+type BatchGetOrdersResponse struct {
+	// orders found in the same order as requested uuids
+	Orders               []*Order `protobuf:"bytes,1,rep,name=orders,proto3" json:"orders,omitempty"`
+	MissingUuids         []string `protobuf:"bytes,2,rep,name=missing_uuids,json=missingUuids,proto3" json:"missing_uuids,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *BatchGetOrdersResponse) Reset()         { *m = BatchGetOrdersResponse{} }
+func (m *BatchGetOrdersResponse) String() string { return proto.CompactTextString(m) }
+func (*BatchGetOrdersResponse) ProtoMessage()    {}
+func (*BatchGetOrdersResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_f3dcd817f520e5b1, []int{3}
+}
+
+func (m *BatchGetOrdersResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_BatchGetOrdersResponse.Unmarshal(m, b)
+}
+func (m *BatchGetOrdersResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_BatchGetOrdersResponse.Marshal(b, m, deterministic)
+}
+func (m *BatchGetOrdersResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_BatchGetOrdersResponse.Merge(m, src)
+}
+func (m *BatchGetOrdersResponse) XXX_Size() int {
+	return xxx_messageInfo_BatchGetOrdersResponse.Size(m)
+}
+func (m *BatchGetOrdersResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_BatchGetOrdersResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_BatchGetOrdersResponse proto.InternalMessageInfo
+
+func (m *BatchGetOrdersResponse) GetOrders() []*Order {
+	if m != nil {
+		return m.Orders
+	}
+	return nil
+}
+
+func (m *BatchGetOrdersResponse) GetMissingUuids() []string {
+	if m != nil {
+		return m.MissingUuids
+	}
+	return nil
+}
+
+var E_Sensitive = &proto.ExtensionDesc{
+	ExtendedType:  (*descriptor.FieldOptions)(nil),
+	ExtensionType: (*bool)(nil),
+	Field:         50000,
+	Name:          "order.api.v1.sensitive",
+	Tag:           "varint,50000,opt,name=sensitive",
+	Filename:      "orderservice/orderservice.proto",
+}
+
 func init() {
 	proto.RegisterEnum("order.api.v1.Status", Status_name, Status_value)
 	proto.RegisterType((*Order)(nil), "order.api.v1.Order")
 	proto.RegisterType((*RequestBy)(nil), "order.api.v1.RequestBy")
+	proto.RegisterType((*BatchGetOrdersRequest)(nil), "order.api.v1.BatchGetOrdersRequest")
+	proto.RegisterType((*BatchGetOrdersResponse)(nil), "order.api.v1.BatchGetOrdersResponse")
+	proto.RegisterExtension(E_Sensitive)
 }
 
 func init() { proto.RegisterFile("orderservice/orderservice.proto", fileDescriptor_f3dcd817f520e5b1) }
 
 var fileDescriptor_f3dcd817f520e5b1 = []byte{
-	// 330 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x9c, 0x92, 0xcf, 0x4a, 0xf3, 0x40,
-	0x14, 0xc5, 0x3b, 0xfd, 0x93, 0x36, 0xb7, 0xf9, 0x4a, 0x99, 0x4f, 0x34, 0x14, 0xa1, 0xb1, 0xab,
-	0x20, 0x12, 0xb1, 0xae, 0x74, 0xd9, 0x2e, 0xc4, 0x95, 0x92, 0xd2, 0xb5, 0xc4, 0xcc, 0x55, 0x02,
-	0x26, 0x93, 0xce, 0xdc, 0x29, 0xf4, 0xed, 0x7c, 0x0e, 0x9f, 0x46, 0x32, 0x29, 0xb5, 0x85, 0xba,
-	0x71, 0x97, 0xf3, 0x3b, 0xf7, 0x5c, 0x72, 0x0f, 0x03, 0x63, 0xa9, 0x04, 0x2a, 0x8d, 0x6a, 0x9d,
-	0xa5, 0x78, 0xbd, 0x2f, 0xa2, 0x52, 0x49, 0x92, 0xdc, 0xb3, 0x2c, 0x4a, 0xca, 0x2c, 0x5a, 0xdf,
-	0x4c, 0xbe, 0x18, 0x74, 0x9e, 0x2a, 0xc0, 0x39, 0xb4, 0x8d, 0xc9, 0x84, 0xcf, 0x02, 0x16, 0xba,
-	0xb1, 0xfd, 0xe6, 0x17, 0xe0, 0x95, 0x4a, 0x0a, 0x93, 0xd2, 0x8b, 0xf5, 0x9a, 0xd6, 0xeb, 0x6f,
-	0xd9, 0xb2, 0x1a, 0x19, 0x41, 0x6f, 0x65, 0x92, 0x82, 0x32, 0xda, 0xf8, 0xad, 0x80, 0x85, 0x9d,
-	0x78, 0xa7, 0xf9, 0x29, 0x38, 0x49, 0x2e, 0x4d, 0x41, 0x7e, 0x3b, 0x60, 0x61, 0x33, 0xde, 0xaa,
-	0x2a, 0x93, 0x1a, 0xa5, 0xb0, 0x48, 0x37, 0x7e, 0xc7, 0xae, 0xdc, 0x69, 0x7e, 0x05, 0x8e, 0xa6,
-	0x84, 0x8c, 0xf6, 0x9d, 0x80, 0x85, 0x83, 0xe9, 0x49, 0xb4, 0xff, 0xbf, 0xd1, 0xc2, 0x7a, 0xf1,
-	0x76, 0x86, 0x9f, 0x83, 0x4b, 0x59, 0x8e, 0x9a, 0x92, 0xbc, 0xf4, 0xbb, 0x01, 0x0b, 0x5b, 0xf1,
-	0x0f, 0x98, 0x8c, 0xc1, 0x8d, 0x71, 0x65, 0x50, 0xd3, 0x6c, 0x73, 0xec, 0xbe, 0xcb, 0x19, 0x38,
-	0xf5, 0x42, 0xde, 0x87, 0xee, 0x82, 0x12, 0x45, 0x28, 0x86, 0x0d, 0x3e, 0x00, 0x78, 0x2c, 0x9e,
-	0x95, 0x7c, 0x57, 0xa8, 0xf5, 0x90, 0xf1, 0x7f, 0xe0, 0xce, 0x65, 0x5e, 0x7e, 0x60, 0x65, 0x37,
-	0xb9, 0x07, 0xbd, 0x18, 0xdf, 0x4c, 0x21, 0x50, 0x0c, 0x5b, 0xd3, 0x4f, 0x06, 0x9e, 0x6d, 0x70,
-	0x51, 0xd7, 0xcc, 0xef, 0xa0, 0x3f, 0x57, 0x98, 0x10, 0xd6, 0xbd, 0xfe, 0x3f, 0x3c, 0xc0, 0xc2,
-	0xd1, 0x31, 0x38, 0x69, 0x54, 0xd1, 0x65, 0x29, 0xfe, 0x14, 0xbd, 0x87, 0xde, 0x03, 0x52, 0x9d,
-	0x3b, 0x3b, 0x1c, 0xd9, 0x75, 0xf0, 0x4b, 0xf6, 0xd5, 0xb1, 0x2f, 0xe3, 0xf6, 0x3b, 0x00, 0x00,
-	0xff, 0xff, 0xbe, 0xe4, 0x9d, 0xe9, 0x3c, 0x02, 0x00, 0x00,
+	// 550 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x9c, 0x93, 0xcf, 0x6e, 0xd3, 0x4e,
+	0x10, 0xc7, 0x6b, 0xa7, 0x71, 0xe3, 0x89, 0x9b, 0x5f, 0xb4, 0xbf, 0x52, 0x56, 0x11, 0xa8, 0xc6,
+	0xe5, 0x60, 0xfe, 0x39, 0xa2, 0x9c, 0xa8, 0xc4, 0x81, 0x54, 0x80, 0xb8, 0x50, 0xe4, 0xaa, 0x47,
+	0x54, 0x6d, 0xed, 0x69, 0xba, 0x28, 0xf6, 0xba, 0xbb, 0xeb, 0x4a, 0xbd, 0x71, 0xe2, 0x35, 0x78,
+	0x0a, 0xde, 0x83, 0x77, 0xe0, 0x45, 0xd0, 0xae, 0x9d, 0x34, 0x41, 0x81, 0x03, 0x37, 0xcf, 0x7c,
+	0x3f, 0xdf, 0x1d, 0xcf, 0xcc, 0x2e, 0xec, 0x09, 0x99, 0xa3, 0x54, 0x28, 0xaf, 0x79, 0x86, 0xe3,
+	0xe5, 0x20, 0xa9, 0xa4, 0xd0, 0x82, 0x04, 0x36, 0x97, 0xb0, 0x8a, 0x27, 0xd7, 0xcf, 0x47, 0xe1,
+	0x54, 0x88, 0xe9, 0x0c, 0xc7, 0x56, 0x3b, 0xaf, 0x2f, 0xc6, 0x39, 0xaa, 0x4c, 0xf2, 0x4a, 0x0b,
+	0xd9, 0xf0, 0xd1, 0x4f, 0x17, 0xba, 0xc7, 0xc6, 0x42, 0x08, 0x6c, 0xd6, 0x35, 0xcf, 0xa9, 0x13,
+	0x3a, 0xb1, 0x9f, 0xda, 0x6f, 0xf2, 0x00, 0x82, 0x4a, 0x8a, 0xbc, 0xce, 0xf4, 0x99, 0xd5, 0x5c,
+	0xab, 0xf5, 0xdb, 0xdc, 0xa9, 0x41, 0x46, 0xd0, 0xbb, 0xaa, 0x59, 0xa9, 0xb9, 0xbe, 0xa1, 0x9d,
+	0xd0, 0x89, 0xbb, 0xe9, 0x22, 0x26, 0xbb, 0xe0, 0xb1, 0x42, 0xd4, 0xa5, 0xa6, 0x9b, 0xa1, 0x13,
+	0xbb, 0x69, 0x1b, 0x19, 0x4f, 0x56, 0x4b, 0x89, 0x65, 0x76, 0x43, 0xbb, 0xf6, 0xc8, 0x45, 0x4c,
+	0x9e, 0x82, 0xa7, 0x34, 0xd3, 0xb5, 0xa2, 0x5e, 0xe8, 0xc4, 0x83, 0x83, 0x9d, 0x64, 0xb9, 0xa3,
+	0xe4, 0xc4, 0x6a, 0x69, 0xcb, 0x90, 0x7b, 0xe0, 0x6b, 0x5e, 0xa0, 0xd2, 0xac, 0xa8, 0xe8, 0x56,
+	0xe8, 0xc4, 0x9d, 0xf4, 0x36, 0x41, 0x1e, 0xc1, 0x76, 0x56, 0x2b, 0x2d, 0x0a, 0x94, 0x67, 0x25,
+	0x2b, 0x90, 0xf6, 0x4c, 0xb1, 0xc9, 0xe6, 0x97, 0xef, 0xd4, 0x49, 0x83, 0xb9, 0xf4, 0x81, 0x15,
+	0x48, 0x9e, 0xc0, 0x60, 0x81, 0x62, 0xc1, 0xf8, 0x8c, 0xfa, 0x4b, 0xec, 0xe2, 0x98, 0x37, 0x46,
+	0x22, 0x63, 0x18, 0xaa, 0x4b, 0x5e, 0x55, 0xbc, 0x9c, 0x9e, 0xb1, 0x3c, 0x97, 0xa8, 0x14, 0x85,
+	0x25, 0xfc, 0xbf, 0xb9, 0xfa, 0xba, 0x11, 0xa3, 0x3d, 0xf0, 0x53, 0xbc, 0xaa, 0x51, 0xe9, 0xc9,
+	0xcd, 0xba, 0x41, 0x47, 0xcf, 0xe0, 0xce, 0x84, 0xe9, 0xec, 0xf2, 0x1d, 0x6a, 0xbb, 0x0d, 0xd5,
+	0xe2, 0x64, 0x07, 0xba, 0x06, 0x50, 0xd4, 0x09, 0x3b, 0xb1, 0x9f, 0x36, 0x41, 0xf4, 0x19, 0x76,
+	0x7f, 0xc7, 0x55, 0x25, 0x4a, 0x65, 0xfa, 0xf0, 0x9a, 0x5b, 0x61, 0x0d, 0xfd, 0x83, 0xff, 0x57,
+	0xc7, 0x67, 0xe9, 0xb4, 0x45, 0xc8, 0x3e, 0x6c, 0x17, 0x5c, 0x29, 0xd3, 0x46, 0x53, 0xc4, 0xb5,
+	0x45, 0x82, 0x36, 0x69, 0xf6, 0xab, 0x1e, 0x4f, 0xc0, 0x6b, 0x86, 0x4e, 0xfa, 0xb0, 0x75, 0xa2,
+	0x99, 0xd4, 0x98, 0x0f, 0x37, 0xc8, 0x00, 0xe0, 0x7d, 0xf9, 0x51, 0x8a, 0xa9, 0x69, 0x70, 0xe8,
+	0x90, 0x6d, 0xf0, 0x8f, 0x44, 0x51, 0xcd, 0xd0, 0xc8, 0x2e, 0x09, 0xa0, 0x97, 0xe2, 0x45, 0x5d,
+	0xe6, 0x98, 0x0f, 0x3b, 0x07, 0xdf, 0x5c, 0x08, 0x6c, 0xe9, 0x93, 0xe6, 0xb2, 0x92, 0x97, 0xd0,
+	0x3f, 0x92, 0xc8, 0x34, 0xda, 0x2c, 0x59, 0xf7, 0x97, 0xa3, 0x75, 0xc9, 0x68, 0xc3, 0x58, 0x4f,
+	0xab, 0xfc, 0x9f, 0xac, 0x87, 0xd0, 0x9b, 0x4f, 0x8c, 0xdc, 0x5d, 0x45, 0x16, 0xeb, 0xf9, 0x93,
+	0xf7, 0x13, 0x0c, 0x56, 0x47, 0x4e, 0xf6, 0x57, 0xc1, 0xb5, 0xfb, 0x1b, 0x3d, 0xfc, 0x3b, 0xd4,
+	0x6c, 0x2d, 0xda, 0x38, 0x7c, 0x05, 0xbe, 0xc2, 0x52, 0x71, 0xcd, 0xaf, 0x91, 0xdc, 0x4f, 0x9a,
+	0x77, 0x9b, 0xcc, 0xdf, 0x6d, 0xf2, 0x96, 0xe3, 0x2c, 0x3f, 0xae, 0x34, 0x17, 0xa5, 0xa2, 0x3f,
+	0xbe, 0x9a, 0x87, 0xd6, 0x4b, 0x6f, 0x1d, 0xe7, 0x9e, 0x25, 0x5f, 0xfc, 0x1a, 0x00, 0x89, 0x8f,
+	0x12, 0x3b, 0x20, 0x04, 0x00, 0x00,
 }
 
 // Reference imports to suppress errors if they are not otherwise used.
@@ -229,6 +367,7 @@ type OrderServiceClient interface {
 	CreateOrder(ctx context.Context, in *Order, opts ...grpc.CallOption) (*Order, error)
 	UpdateOrder(ctx context.Context, in *Order, opts ...grpc.CallOption) (*Order, error)
 	GetOrder(ctx context.Context, in *RequestBy, opts ...grpc.CallOption) (*Order, error)
+	BatchGetOrders(ctx context.Context, in *BatchGetOrdersRequest, opts ...grpc.CallOption) (*BatchGetOrdersResponse, error)
 }
 
 type orderServiceClient struct {
@@ -266,11 +405,21 @@ func (c *orderServiceClient) GetOrder(ctx context.Context, in *RequestBy, opts .
 	return out, nil
 }
 
+func (c *orderServiceClient) BatchGetOrders(ctx context.Context, in *BatchGetOrdersRequest, opts ...grpc.CallOption) (*BatchGetOrdersResponse, error) {
+	out := new(BatchGetOrdersResponse)
+	err := c.cc.Invoke(ctx, "/order.api.v1.OrderService/BatchGetOrders", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // OrderServiceServer is the server API for OrderService service.
 type OrderServiceServer interface {
 	CreateOrder(context.Context, *Order) (*Order, error)
 	UpdateOrder(context.Context, *Order) (*Order, error)
 	GetOrder(context.Context, *RequestBy) (*Order, error)
+	BatchGetOrders(context.Context, *BatchGetOrdersRequest) (*BatchGetOrdersResponse, error)
 }
 
 // UnimplementedOrderServiceServer can be embedded to have forward compatible implementations.
@@ -286,6 +435,9 @@ func (*UnimplementedOrderServiceServer) UpdateOrder(ctx context.Context, req *Or
 func (*UnimplementedOrderServiceServer) GetOrder(ctx context.Context, req *RequestBy) (*Order, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method GetOrder not implemented")
 }
+func (*UnimplementedOrderServiceServer) BatchGetOrders(ctx context.Context, req *BatchGetOrdersRequest) (*BatchGetOrdersResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method BatchGetOrders not implemented")
+}
 
 func RegisterOrderServiceServer(s *grpc.Server, srv OrderServiceServer) {
 	s.RegisterService(&_OrderService_serviceDesc, srv)
@@ -345,6 +497,24 @@ func _OrderService_GetOrder_Handler(srv interface{}, ctx context.Context, dec fu
 	return interceptor(ctx, in, info, handler)
 }
 
+func _OrderService_BatchGetOrders_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BatchGetOrdersRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(OrderServiceServer).BatchGetOrders(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/order.api.v1.OrderService/BatchGetOrders",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(OrderServiceServer).BatchGetOrders(ctx, req.(*BatchGetOrdersRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 var _OrderService_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "order.api.v1.OrderService",
 	HandlerType: (*OrderServiceServer)(nil),
@@ -361,6 +531,10 @@ var _OrderService_serviceDesc = grpc.ServiceDesc{
 			MethodName: "GetOrder",
 			Handler:    _OrderService_GetOrder_Handler,
 		},
+		{
+			MethodName: "BatchGetOrders",
+			Handler:    _OrderService_BatchGetOrders_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "orderservice/orderservice.proto",